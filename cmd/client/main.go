@@ -0,0 +1,9 @@
+// Command client reads a gamepad (or the keyboard) and streams its state to
+// the server.
+package main
+
+import "lunabotics/pkg/client"
+
+func main() {
+	client.Main()
+}
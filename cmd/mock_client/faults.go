@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+
+	"lunabotics/pkg/protocol"
+)
+
+// faultInjector damages the mock's traffic on purpose so the server's CRC
+// rejection, oversize drain and failsafe paths can be exercised
+type faultInjector struct {
+	corruptRate  float64 // fraction of packets with a bit flipped after the CRC
+	dropRate     float64 // fraction of packets never sent
+	oversizeRate float64 // fraction of packets replaced by one over the maximum size
+
+	sent, corrupted, dropped, oversized int
+}
+
+func checkRate(name string, rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("-%s must be between 0 and 1, got %g", name, rate)
+	}
+	return nil
+}
+
+// drop reports whether this packet should be skipped entirely
+func (f *faultInjector) drop() bool {
+	if rand.Float64() < f.dropRate {
+		f.dropped++
+		return true
+	}
+	f.sent++
+	return false
+}
+
+// frame returns the payload+CRC to send for payload. The CRC always covers
+// the clean payload, so a flipped bit anywhere in the packet must be caught
+// by the server's check.
+func (f *faultInjector) frame(framing protocol.Framing, payload []byte) []byte {
+	if rand.Float64() < f.oversizeRate {
+		f.oversized++
+		junk := make([]byte, framing.MaxPacketSize+64)
+		rand.Read(junk)
+		return framing.AppendCRC(junk)
+	}
+	pkt := framing.AppendCRC(payload)
+	if rand.Float64() < f.corruptRate {
+		f.corrupted++
+		bit := rand.Intn(len(pkt) * 8)
+		pkt[bit/8] ^= 1 << (bit % 8)
+	}
+	return pkt
+}
+
+// active reports whether any fault is enabled
+func (f *faultInjector) active() bool {
+	return f.corruptRate > 0 || f.dropRate > 0 || f.oversizeRate > 0
+}
+
+func (f *faultInjector) String() string {
+	return fmt.Sprintf("sent %d (corrupted %d, oversized %d), dropped %d",
+		f.sent, f.corrupted, f.oversized, f.dropped)
+}
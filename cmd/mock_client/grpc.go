@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// runGRPC is run for the server's gRPC front end (-grpc on the server):
+// one ControlStream call over cleartext HTTP/2, states up and telemetry
+// back, over net/http like the server end.
+func (m *mockSession) runGRPC(stats *stressStats) error {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	body, requests := io.Pipe()
+	req, err := http.NewRequest("POST", "http://"+m.server+protocol.GRPC_CONTROL_STREAM, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gRPC call failed: %s", resp.Status)
+	}
+	if status := resp.Header.Get("Grpc-Status"); status != "" {
+		return fmt.Errorf("gRPC status %s: %s", status, resp.Header.Get("Grpc-Message"))
+	}
+	if stats == nil {
+		fmt.Println("ControlStream open on", m.server)
+	} else {
+		stats.connected.Add(1)
+		defer stats.connected.Add(-1)
+	}
+
+	// Telemetry until the server ends the call
+	ended := make(chan error, 1)
+	go func() {
+		ended <- readTelemetry(resp, stats == nil)
+	}()
+
+	period := time.Duration(float64(time.Second) / m.hz)
+	if stats != nil {
+		time.Sleep(time.Duration(rand.Int63n(int64(period))))
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	start := time.Now()
+	warned := false
+
+	for {
+		select {
+		case err := <-ended:
+			return err
+		case <-ticker.C:
+		}
+		elapsed := time.Since(start).Seconds()
+
+		var state protocol.ControllerState
+		var estops []string
+		done := false
+		if m.scenario != nil {
+			state, estops, done = m.scenario.at(elapsed)
+		} else {
+			state = waveState(elapsed, m.random)
+		}
+		state.Timestamp = time.Now().UnixMilli()
+
+		if _, err := requests.Write(protocol.GRPCMessage(protocol.ProtobufState(&state))); err != nil {
+			return fmt.Errorf("write state error: %w", err)
+		}
+		if stats != nil {
+			stats.packets.Add(1)
+		}
+
+		if len(estops) > 0 && !warned && stats == nil {
+			fmt.Printf("%.2fs: ControlStream only carries states, skipping e-stops\n", elapsed)
+			warned = true
+		}
+		if done {
+			if stats == nil {
+				fmt.Printf("%.2fs: scenario finished\n", elapsed)
+			}
+			requests.Close()
+			return <-ended
+		}
+	}
+}
+
+// readTelemetry prints the Telemetry messages of a ControlStream response
+// and returns the call's status as an error unless it is OK
+func readTelemetry(resp *http.Response, verbose bool) error {
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(resp.Body, hdr); err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("read telemetry error: %w", err)
+			}
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			return fmt.Errorf("read telemetry error: %w", err)
+		}
+		t, err := protocol.ParseProtobufTelemetry(msg)
+		if err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Printf("telemetry: %.2fV motors %v limits %08b\n", t.BatteryVolts, t.MotorCurrents, t.LimitSwitches)
+		}
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		return fmt.Errorf("gRPC status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	return nil
+}
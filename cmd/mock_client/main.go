@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// simple wave 0..255 centered on 127 for pretty output
+func wave(t float64, phase float64) uint8 {
+	s := 0.5 + 0.5*math.Sin(2*math.Pi*(t+phase))
+	return uint8(s * 255.0)
+}
+
+func main() {
+	server := flag.String("server", "127.0.0.1:8080", "server address host:port")
+	hz := flag.Float64("hz", 33, "send frequency")
+	random := flag.Bool("random", false, "send random values instead of smooth wave")
+	scenarioFile := flag.String("scenario", "", "play a timeline (.json or .csv) of states and e-stops instead of the wave, then exit")
+	legacy := flag.Bool("legacy-framing", false, "send bare newline-delimited JSON like pre-framing clients, to test how the server handles them")
+	connections := flag.Int("connections", 1, "open this many simultaneous sessions, each at -hz, to load-test the server")
+	encoding := flag.String("encoding", protocol.ENCODING_JSON, "payload encoding: json, or protobuf (see protocol.proto)")
+	grpc := flag.Bool("grpc", false, "drive the server's gRPC ControlStream at -server (its -grpc address) instead of the TCP port")
+	maxPacketSize := flag.Int("max-packet-size", protocol.DEFAULT_MAX_PACKET_SIZE, "largest packet payload, as the server's -max-packet-size")
+	crcAlgo := flag.String("crc", protocol.CRC_32, "packet CRC, as the server's -crc: crc32, crc32c or crc16-ccitt")
+	faults := &faultInjector{}
+	flag.Float64Var(&faults.corruptRate, "corrupt-rate", 0, "fraction of packets (0-1) with one bit flipped after the CRC is computed")
+	flag.Float64Var(&faults.dropRate, "drop-rate", 0, "fraction of packets (0-1) not sent at all")
+	flag.Float64Var(&faults.oversizeRate, "oversize-rate", 0, "fraction of packets (0-1) replaced by one larger than the server accepts")
+	flag.Parse()
+
+	for _, err := range []error{
+		checkRate("corrupt-rate", faults.corruptRate),
+		checkRate("drop-rate", faults.dropRate),
+		checkRate("oversize-rate", faults.oversizeRate),
+	} {
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if *encoding != protocol.ENCODING_JSON && *encoding != protocol.ENCODING_PROTOBUF {
+		fmt.Printf("-encoding must be %s or %s\n", protocol.ENCODING_JSON, protocol.ENCODING_PROTOBUF)
+		return
+	}
+	if *encoding == protocol.ENCODING_PROTOBUF && *legacy {
+		fmt.Println("-legacy-framing sends JSON; it can't be combined with -encoding protobuf")
+		return
+	}
+
+	if *grpc && (*legacy || faults.active()) {
+		fmt.Println("-grpc can't be combined with -legacy-framing or fault injection")
+		return
+	}
+
+	framing := protocol.Framing{MaxPacketSize: *maxPacketSize, CRC: *crcAlgo}
+	if err := framing.Check(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *connections < 1 {
+		fmt.Println("-connections must be at least 1")
+		return
+	}
+
+	var sc *scenario
+	if *scenarioFile != "" {
+		var err error
+		if sc, err = loadScenario(*scenarioFile); err != nil {
+			fmt.Println("scenario:", err)
+			return
+		}
+	}
+
+	session := &mockSession{
+		server:   *server,
+		hz:       *hz,
+		random:   *random,
+		scenario: sc,
+		faults:   faults,
+		framing:  framing,
+		legacy:   *legacy,
+		protobuf: *encoding == protocol.ENCODING_PROTOBUF,
+		grpc:     *grpc,
+	}
+	if *connections > 1 {
+		runStress(*connections, session)
+		return
+	}
+	if err := session.run(nil); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// mockSession is one simulated client connection
+type mockSession struct {
+	server   string
+	hz       float64
+	random   bool
+	scenario *scenario // nil for the wave
+	faults   *faultInjector
+	framing  protocol.Framing
+	legacy   bool // newline-delimited JSON, as clients sent before framing
+	protobuf bool // states and e-stops as protobuf Packets
+	grpc     bool // a gRPC ControlStream call instead of a TCP connection
+}
+
+// run connects and sends states until the scenario ends or a write fails.
+// With stats set it is one of many stress sessions: it stays quiet and
+// counts into stats instead.
+func (m *mockSession) run(stats *stressStats) error {
+	if m.grpc {
+		return m.runGRPC(stats)
+	}
+	network, address := protocol.SplitNetwork(m.server)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if stats == nil {
+		fmt.Println("Connected to", m.server)
+	} else {
+		stats.connected.Add(1)
+		defer stats.connected.Add(-1)
+	}
+
+	if m.protobuf {
+		// The server reads protobuf whether or not it was asked; asking
+		// makes its replies protobuf too, as a real client's would be
+		b, _ := json.Marshal(&protocol.EncodingFrame{Type: protocol.MsgEncoding, Encoding: protocol.ENCODING_PROTOBUF})
+		if err := m.framing.WritePacket(conn, b); err != nil {
+			return fmt.Errorf("write encoding request error: %w", err)
+		}
+	}
+
+	period := time.Duration(float64(time.Second) / m.hz)
+	if stats != nil {
+		// Spread sessions across the period instead of sending in lockstep
+		time.Sleep(time.Duration(rand.Int63n(int64(period))))
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	start := time.Now()
+	lastReport := start
+	faults := m.faults
+
+	// Frames are [4-byte big-endian length][payload][CRC], as in pkg/protocol
+	for range ticker.C {
+		elapsed := time.Since(start).Seconds()
+
+		var state protocol.ControllerState
+		var estops []string
+		done := false
+		if m.scenario != nil {
+			state, estops, done = m.scenario.at(elapsed)
+		} else {
+			state = waveState(elapsed, m.random)
+		}
+		state.Timestamp = time.Now().UnixMilli()
+
+		b, err := m.marshal(&state)
+		if err != nil {
+			return fmt.Errorf("marshal error: %w", err)
+		}
+
+		if len(b) > m.framing.MaxPacketSize {
+			fmt.Println("packet too large, skipping")
+			continue
+		}
+
+		if stats == nil && faults.active() && time.Since(lastReport) > 5*time.Second {
+			fmt.Println("faults:", faults)
+			lastReport = time.Now()
+		}
+		if !faults.drop() {
+			if m.legacy {
+				err = sendLegacy(conn, b)
+			} else {
+				err = protocol.WriteFrame(conn, faults.frame(m.framing, b))
+			}
+			if err != nil {
+				return fmt.Errorf("write packet error: %w", err)
+			}
+			if stats != nil {
+				stats.packets.Add(1)
+			}
+		}
+
+		for _, reason := range estops {
+			if stats == nil {
+				fmt.Printf("%.2fs: e-stop (%s)\n", elapsed, reason)
+			}
+			b, _ := m.marshal(&protocol.EStopFrame{Type: protocol.MsgEStop, Reason: reason})
+			if err := m.framing.WritePacket(conn, b); err != nil {
+				return fmt.Errorf("write e-stop error: %w", err)
+			}
+		}
+		if done {
+			if stats == nil {
+				fmt.Printf("%.2fs: scenario finished\n", elapsed)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// marshal encodes a message in the session's encoding. Without a trailing
+// newline, so legacy framing can add its own.
+func (m *mockSession) marshal(v any) ([]byte, error) {
+	if m.protobuf {
+		if b, ok := protocol.MarshalProtobuf(v); ok {
+			return b, nil
+		}
+	}
+	return json.Marshal(v)
+}
+
+// sendLegacy writes a state the way clients did before framing: the JSON
+// object and a newline, no length or CRC
+func sendLegacy(conn net.Conn, payload []byte) error {
+	_, err := conn.Write(append(payload, '\n'))
+	return err
+}
+
+// waveState is the default input: smooth waves, or noise with random set
+func waveState(elapsed float64, random bool) protocol.ControllerState {
+	var lx, ly, ry, rt uint8
+	if random {
+		lx = uint8(rand.Intn(256))
+		ly = uint8(rand.Intn(256))
+		ry = uint8(rand.Intn(256))
+		rt = uint8(rand.Intn(256))
+	} else {
+		lx = wave(elapsed, 0.00)  // LjoyX
+		ly = wave(elapsed, 0.25)  // LjoyY
+		ry = wave(elapsed, 0.50)  // RjoyY
+		rt = wave(elapsed, 0.125) // RT
+	}
+
+	state := protocol.ControllerState{
+		// flip some buttons occasionally so you see bit changes
+		North:       uint8((int(elapsed) / 2) % 2),
+		East:        uint8((int(elapsed) / 3) % 2),
+		South:       uint8((int(elapsed) / 5) % 2),
+		West:        uint8((int(elapsed) / 7) % 2),
+		LeftBumper:  uint8((int(elapsed) / 4) % 2),
+		RightBumper: uint8((int(elapsed) / 6) % 2),
+
+		LeftX:        lx,
+		LeftY:        ly,
+		RightY:       ry,
+		RightTrigger: rt,
+	}
+	return state
+}
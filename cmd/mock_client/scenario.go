@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lunabotics/pkg/protocol"
+)
+
+// scenarioStep is one point on a timeline: from At seconds on, the mock
+// sends State until the next step. State only lists the fields that change;
+// the rest carry over from the previous step, starting from neutral. A step
+// with EStop set also asks the server to latch its e-stop.
+//
+// JSON scenarios are a list of steps:
+//
+//	[{"t": 0, "state": {"LjoyY": 0}},
+//	 {"t": 2, "state": {"LjoyY": 127, "LjoyX": 0}},
+//	 {"t": 3, "estop": "end of scenario"}]
+//
+// CSV scenarios have a header row naming "t", any ControllerState JSON
+// fields and optionally "estop"; an empty cell keeps the previous value.
+type scenarioStep struct {
+	At    float64         `json:"t"`
+	State json.RawMessage `json:"state,omitempty"`
+	EStop string          `json:"estop,omitempty"`
+
+	state protocol.ControllerState // resolved by loadScenario
+}
+
+// scenario plays steps back against the time since the mock started
+type scenario struct {
+	steps []scenarioStep
+	next  int
+}
+
+// neutralState is what the server treats as "no input"
+func neutralState() protocol.ControllerState {
+	return protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER,
+		RightX: protocol.AXIS_CENTER, RightY: protocol.AXIS_CENTER}
+}
+
+// loadScenario reads a .json or .csv timeline
+func loadScenario(filename string) (*scenario, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var steps []scenarioStep
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		steps, err = parseScenarioCSV(string(data))
+	} else {
+		err = json.Unmarshal(data, &steps)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", filename)
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].At < steps[j].At })
+
+	state := neutralState()
+	for i := range steps {
+		if len(steps[i].State) > 0 {
+			if err := json.Unmarshal(steps[i].State, &state); err != nil {
+				return nil, fmt.Errorf("%s: step at %gs: %w", filename, steps[i].At, err)
+			}
+		}
+		steps[i].state = state
+	}
+	return &scenario{steps: steps}, nil
+}
+
+// parseScenarioCSV turns each row into a step whose state holds its
+// non-empty cells
+func parseScenarioCSV(data string) ([]scenarioStep, error) {
+	rows, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("need a header row and at least one step")
+	}
+	header := rows[0]
+	var steps []scenarioStep
+	for n, row := range rows[1:] {
+		var step scenarioStep
+		fields := make(map[string]int)
+		for i, cell := range row {
+			cell = strings.TrimSpace(cell)
+			if cell == "" || i >= len(header) {
+				continue
+			}
+			name := strings.TrimSpace(header[i])
+			switch name {
+			case "t":
+				if step.At, err = strconv.ParseFloat(cell, 64); err != nil {
+					return nil, fmt.Errorf("row %d: t: %w", n+2, err)
+				}
+			case "estop":
+				step.EStop = cell
+			default:
+				if fields[name], err = strconv.Atoi(cell); err != nil {
+					return nil, fmt.Errorf("row %d: %s: %w", n+2, name, err)
+				}
+			}
+		}
+		if len(fields) > 0 {
+			step.State, _ = json.Marshal(fields)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// clone returns a copy that plays from the start; the steps are shared
+func (s *scenario) clone() *scenario {
+	return &scenario{steps: s.steps}
+}
+
+// at returns the state to send elapsed seconds in, any e-stops whose time
+// has come, and whether the timeline is over
+func (s *scenario) at(elapsed float64) (state protocol.ControllerState, estops []string, done bool) {
+	for s.next < len(s.steps) && s.steps[s.next].At <= elapsed {
+		if s.steps[s.next].EStop != "" {
+			estops = append(estops, s.steps[s.next].EStop)
+		}
+		s.next++
+	}
+	if s.next == 0 {
+		return neutralState(), nil, false
+	}
+	return s.steps[s.next-1].state, estops, s.next == len(s.steps)
+}
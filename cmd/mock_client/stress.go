@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// STRESS_REPORT_INTERVAL is how often stress mode prints its totals
+const STRESS_REPORT_INTERVAL = 5 * time.Second
+
+// stressStats are shared by every stress session
+type stressStats struct {
+	connected atomic.Int64
+	packets   atomic.Uint64
+	failed    atomic.Uint64 // sessions that ended with an error
+}
+
+// runStress runs n copies of template at once, each with its own scenario
+// position and fault counters, and reports totals until they have all
+// finished
+func runStress(n int, template *mockSession) {
+	stats := &stressStats{}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		session := *template
+		faults := *template.faults
+		session.faults = &faults
+		if template.scenario != nil {
+			session.scenario = template.scenario.clone()
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := session.run(stats); err != nil {
+				stats.failed.Add(1)
+				fmt.Printf("session %d: %v\n", id, err)
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(STRESS_REPORT_INTERVAL)
+	defer ticker.Stop()
+	start := time.Now()
+	var lastPackets uint64
+	for {
+		select {
+		case <-done:
+			fmt.Printf("stress: all %d sessions ended after %v, %d packets sent, %d failed\n",
+				n, time.Since(start).Round(time.Second), stats.packets.Load(), stats.failed.Load())
+			return
+		case <-ticker.C:
+		}
+		packets := stats.packets.Load()
+		rate := float64(packets-lastPackets) / STRESS_REPORT_INTERVAL.Seconds()
+		lastPackets = packets
+		fmt.Printf("stress: %d/%d connected, %.0f packets/s, %d failed\n",
+			stats.connected.Load(), n, rate, stats.failed.Load())
+	}
+}
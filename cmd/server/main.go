@@ -0,0 +1,9 @@
+// Command server receives controller states from a client and drives the
+// robot's Arduinos. See the README for its flags and config file.
+package main
+
+import "lunabotics/pkg/server"
+
+func main() {
+	server.Main()
+}
@@ -1,13 +1,18 @@
 module lunabotics
 
-go 1.23
+go 1.24.0
 
 require (
 	github.com/0xcafed00d/joystick v1.0.1
+	github.com/BurntSushi/toml v1.6.0
 	go.bug.st/serial v1.6.2
+	golang.org/x/net v0.50.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/term v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
-	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/crypto v0.48.0 // indirect
 )
@@ -0,0 +1,5 @@
+// Package integration runs the server end to end: it builds cmd/server,
+// starts it with the virtual Arduino (-serial mock:), connects as a client
+// over TCP and checks the exact frames the Arduino receives. It has no code
+// of its own; run it with go test ./integration.
+package integration
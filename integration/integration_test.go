@@ -0,0 +1,307 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// FRAME_TIMEOUT is how long a test waits for the Arduino to see a frame
+const FRAME_TIMEOUT = 5 * time.Second
+
+// Frames for byte_config.json, as the virtual Arduino logs them
+const (
+	FAILSAFE_FRAME = "A8 7F 7F 7F 00 15"
+	BUTTONS_FRAME  = "AF 00 FF 40 C8 F5"
+	STICKS_FRAME   = "AA 0A C8 7F FF 35"
+)
+
+var (
+	buttonsState = map[string]int{"N": 1, "E": 1, "S": 1, "W": 1, "LB": 1, "RB": 1, "LjoyX": 0, "LjoyY": 255, "RjoyY": 64, "RT": 200}
+	sticksState  = map[string]int{"E": 1, "LB": 1, "LjoyX": 10, "LjoyY": 200, "RjoyY": 127, "RT": 255}
+	neutralState = map[string]int{"LjoyX": 127, "LjoyY": 127, "RjoyY": 127} // gives FAILSAFE_FRAME
+)
+
+// serverBin is the server built once for every test
+var serverBin string
+
+// framing is the server's, which the tests start with the defaults
+var framing = protocol.DefaultFraming()
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "lunabotics-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	serverBin = filepath.Join(dir, "server")
+	if err := buildServer(serverBin); err != nil {
+		fmt.Fprintln(os.Stderr, "building server:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// buildServer compiles cmd/server, as the README's build line does
+func buildServer(out string) error {
+	cmd := exec.Command("go", "build", "-o", out, "../cmd/server")
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// testServer is a running server whose Arduino is the virtual one
+type testServer struct {
+	addr   string
+	frames chan string // each frame the virtual Arduino received, in hex
+
+	mu  sync.Mutex
+	log []string // every log line, shown when a test fails
+}
+
+// startServer runs the server with byte_config.json and the virtual
+// Arduino until the test ends
+func startServer(t *testing.T, args ...string) *testServer {
+	t.Helper()
+	port := freePort(t)
+	args = append([]string{
+		"-port", strconv.Itoa(port),
+		"-serial", "mock:",
+		"-config", "../byte_config.json",
+		"-log-level", "debug",
+		"-log-format", "json",
+	}, args...)
+	cmd := exec.Command(serverBin, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		addr:   net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		frames: make(chan string, 4096),
+	}
+	listening := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.readLog(stderr, listening)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		<-done
+		cmd.Wait()
+		if t.Failed() {
+			s.mu.Lock()
+			t.Log("server log:\n" + strings.Join(s.log, "\n"))
+			s.mu.Unlock()
+		}
+	})
+
+	select {
+	case <-listening:
+	case <-done:
+		t.Fatal("server exited before listening")
+	case <-time.After(FRAME_TIMEOUT):
+		t.Fatal("server never started listening")
+	}
+	return s
+}
+
+// readLog follows the server's JSON log, closing listening once it accepts
+// connections and passing on the virtual Arduino's frames
+func (s *testServer) readLog(r io.Reader, listening chan struct{}) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		s.mu.Lock()
+		s.log = append(s.log, line)
+		s.mu.Unlock()
+
+		var entry struct {
+			Msg   string `json:"msg"`
+			Frame string `json:"frame"`
+		}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		switch entry.Msg {
+		case "Server listening":
+			close(listening)
+		case "Virtual Arduino received":
+			select {
+			case s.frames <- entry.Frame:
+			default:
+			}
+		}
+	}
+}
+
+// expectFrame waits for the Arduino to receive want, failing if it gets any
+// of the frames in never first
+func (s *testServer) expectFrame(t *testing.T, want string, never ...string) {
+	t.Helper()
+	timeout := time.After(FRAME_TIMEOUT)
+	for {
+		select {
+		case frame := <-s.frames:
+			if frame == want {
+				return
+			}
+			for _, bad := range never {
+				if frame == bad {
+					t.Fatalf("Arduino received %s while waiting for %s", frame, want)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Arduino never received %s", want)
+		}
+	}
+}
+
+// freePort returns a TCP port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dial connects to the server as a client
+func dial(t *testing.T, s *testServer) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// marshalState encodes a controller state stamped with the current time
+func marshalState(t *testing.T, state map[string]int) []byte {
+	t.Helper()
+	fields := map[string]int64{"ts": time.Now().UnixMilli()}
+	for k, v := range state {
+		fields[k] = int64(v)
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writePacket frames payload as the server expects, damaged when corrupt is
+// set. Payloads over the size limit are framed anyway.
+func writePacket(t *testing.T, conn net.Conn, payload []byte, corrupt bool) {
+	t.Helper()
+	pkt := framing.AppendCRC(payload)
+	if corrupt {
+		pkt[len(pkt)-1] ^= 0x01
+	}
+	if err := protocol.WriteFrame(conn, pkt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendState sends state until the Arduino has received want, since the
+// first states may arrive before the port is open
+func sendState(t *testing.T, s *testServer, conn net.Conn, state map[string]int, want string) {
+	t.Helper()
+	deadline := time.Now().Add(FRAME_TIMEOUT)
+	for {
+		writePacket(t, conn, marshalState(t, state), false)
+		select {
+		case frame := <-s.frames:
+			if frame == want {
+				return
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Arduino never received %s", want)
+		}
+	}
+}
+
+func TestStatesBecomeFrames(t *testing.T) {
+	s := startServer(t)
+	conn := dial(t, s)
+
+	sendState(t, s, conn, buttonsState, BUTTONS_FRAME)
+	writePacket(t, conn, marshalState(t, sticksState), false)
+	s.expectFrame(t, STICKS_FRAME)
+	writePacket(t, conn, marshalState(t, buttonsState), false)
+	s.expectFrame(t, BUTTONS_FRAME)
+}
+
+func TestCRCFailureIsDropped(t *testing.T) {
+	s := startServer(t)
+	conn := dial(t, s)
+
+	sendState(t, s, conn, buttonsState, BUTTONS_FRAME)
+	writePacket(t, conn, marshalState(t, sticksState), true)
+	// The damaged state must never reach the Arduino, and the connection
+	// must survive it
+	writePacket(t, conn, marshalState(t, neutralState), false)
+	s.expectFrame(t, FAILSAFE_FRAME, STICKS_FRAME)
+	writePacket(t, conn, marshalState(t, buttonsState), false)
+	s.expectFrame(t, BUTTONS_FRAME, STICKS_FRAME)
+}
+
+func TestOversizedPacketIsSkipped(t *testing.T) {
+	s := startServer(t)
+	conn := dial(t, s)
+
+	sendState(t, s, conn, buttonsState, BUTTONS_FRAME)
+	// A real state padded past the limit: were it parsed, the Arduino would
+	// see the sticks frame
+	big := marshalState(t, sticksState)
+	big = append(big, bytes.Repeat([]byte(" "), framing.MaxPacketSize+1-len(big))...)
+	writePacket(t, conn, big, false)
+	writePacket(t, conn, marshalState(t, neutralState), false)
+	s.expectFrame(t, FAILSAFE_FRAME, STICKS_FRAME)
+	writePacket(t, conn, marshalState(t, buttonsState), false)
+	s.expectFrame(t, BUTTONS_FRAME, STICKS_FRAME)
+}
+
+func TestDisconnectSendsFailsafe(t *testing.T) {
+	s := startServer(t)
+	conn := dial(t, s)
+
+	sendState(t, s, conn, sticksState, STICKS_FRAME)
+	conn.Close()
+	s.expectFrame(t, FAILSAFE_FRAME)
+}
+
+func TestDriverLeavingSendsFailsafe(t *testing.T) {
+	s := startServer(t)
+	driver := dial(t, s)
+	dial(t, s) // a spectator keeps the port open
+
+	sendState(t, s, driver, sticksState, STICKS_FRAME)
+	driver.Close()
+	s.expectFrame(t, FAILSAFE_FRAME)
+}
@@ -0,0 +1,288 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/0xcafed00d/joystick"
+)
+
+const (
+	CALIBRATE_POLL       = 10 * time.Millisecond
+	CALIBRATE_THRESHOLD  = 16000 // raw axis travel that counts as deliberate
+	CALIBRATE_SETTLE     = 500 * time.Millisecond
+	CALIBRATE_REST_NOISE = 4000
+)
+
+// calibrator walks the user through every control on a pad, recording which
+// axis or button each one is and the range the axes cover
+type calibrator struct {
+	js   joystick.Joystick
+	rest joystick.State
+	skip chan struct{} // Enter on stdin skips the current prompt
+}
+
+// runCalibration interactively builds a PadMapping for the controller
+// findController picks and saves it into filename, replacing any earlier
+// mapping for the same pad
+func runCalibration(filename string) error {
+	js, _, err := findController()
+	if err != nil {
+		return err
+	}
+	defer js.Close()
+
+	c := &calibrator{js: js, skip: make(chan struct{})}
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			c.skip <- struct{}{}
+		}
+	}()
+
+	fmt.Println("Calibrating", js.Name())
+	fmt.Println("Leave every control at rest...")
+	time.Sleep(time.Second)
+	if c.rest, err = js.Read(); err != nil {
+		return err
+	}
+	fmt.Println("Follow each prompt; press Enter to skip a control the pad doesn't have.")
+
+	mapping := &PadMapping{
+		Match:   js.Name(),
+		Axes:    make(map[string]AxisMapping),
+		Buttons: make(map[string]int),
+	}
+
+	buttonPrompts := []struct{ field, prompt string }{
+		{"N", "Press North (top face button)"},
+		{"E", "Press East (right face button)"},
+		{"S", "Press South (bottom face button)"},
+		{"W", "Press West (left face button)"},
+		{"LB", "Press the left bumper"},
+		{"RB", "Press the right bumper"},
+		{"LS", "Click the left stick"},
+		{"RS", "Click the right stick"},
+		{"SELECT", "Press Select/Back/Share"},
+		{"START", "Press Start/Options"},
+	}
+	for _, p := range buttonPrompts {
+		bit, ok, err := c.waitButton(p.prompt)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mapping.Buttons[p.field] = bit
+		}
+	}
+
+	stickPrompts := []struct{ field, low, high string }{
+		{"LjoyX", "Move the left stick fully left and hold", "Move the left stick fully right and hold"},
+		{"LjoyY", "Move the left stick fully up and hold", "Move the left stick fully down and hold"},
+		{"RjoyX", "Move the right stick fully left and hold", "Move the right stick fully right and hold"},
+		{"RjoyY", "Move the right stick fully up and hold", "Move the right stick fully down and hold"},
+	}
+	for _, p := range stickPrompts {
+		index, low, ok, err := c.waitAxis(p.low, -1)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		_, high, ok, err := c.waitAxis(p.high, index)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mapping.Axes[p.field] = AxisMapping{Index: index, Min: low, Max: high, Center: c.rest.AxisData[index]}
+		}
+	}
+
+	triggerPrompts := []struct{ field, prompt string }{
+		{"LT", "Squeeze the left trigger fully and hold"},
+		{"RT", "Squeeze the right trigger fully and hold"},
+	}
+	for _, p := range triggerPrompts {
+		index, pressed, ok, err := c.waitAxis(p.prompt, -1)
+		if err != nil {
+			return err
+		}
+		if ok {
+			rest := c.rest.AxisData[index]
+			mapping.Axes[p.field] = AxisMapping{Index: index, Min: rest, Max: pressed, Center: rest}
+		}
+	}
+
+	// Hats show up as a pair of axes on some pads and as four buttons on
+	// others
+	hatPrompts := []struct{ axis, low, high, lowPrompt, highPrompt string }{
+		{"dX", "dLeft", "dRight", "Press D-pad left and hold", "Press D-pad right and hold"},
+		{"dY", "dUp", "dDown", "Press D-pad up and hold", "Press D-pad down and hold"},
+	}
+	for _, p := range hatPrompts {
+		low, ok, err := c.waitInput(p.lowPrompt, true, true, -1)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if low.axis {
+			_, high, ok, err := c.waitAxis(p.highPrompt, low.index)
+			if err != nil {
+				return err
+			}
+			if ok {
+				mapping.Axes[p.axis] = AxisMapping{Index: low.index, Min: low.value, Max: high, Center: c.rest.AxisData[low.index]}
+			}
+			continue
+		}
+		mapping.Buttons[p.low] = low.index
+		high, ok, err := c.waitButton(p.highPrompt)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mapping.Buttons[p.high] = high
+		}
+	}
+
+	if err := saveCalibration(filename, mapping); err != nil {
+		return err
+	}
+	fmt.Printf("Saved mapping for %q to %s\n", mapping.Match, filename)
+	return nil
+}
+
+// calibrationInput is the control the user operated for a prompt
+type calibrationInput struct {
+	axis  bool // axis rather than button
+	index int
+	value int // most extreme axis reading
+}
+
+// waitButton prompts for a button and returns its index once it has been
+// pressed and released
+func (c *calibrator) waitButton(prompt string) (int, bool, error) {
+	in, ok, err := c.waitInput(prompt, true, false, -1)
+	return in.index, ok, err
+}
+
+// waitAxis prompts for an axis movement and returns the axis and its most
+// extreme reading once it has been held. only restricts the search to one
+// axis, or -1 for any.
+func (c *calibrator) waitAxis(prompt string, only int) (index, value int, ok bool, err error) {
+	in, ok, err := c.waitInput(prompt, false, true, only)
+	return in.index, in.value, ok, err
+}
+
+// waitInput prompts for a button press and/or axis movement, whichever
+// comes first, and waits for the control to return to rest
+func (c *calibrator) waitInput(prompt string, buttons, axes bool, only int) (calibrationInput, bool, error) {
+	fmt.Println(prompt)
+	in := calibrationInput{index: -1}
+	var since time.Time
+	for {
+		select {
+		case <-c.skip:
+			return in, false, c.waitRest()
+		case <-time.After(CALIBRATE_POLL):
+		}
+		state, err := c.js.Read()
+		if err != nil {
+			return in, false, err
+		}
+
+		if pressed := state.Buttons &^ c.rest.Buttons; buttons && !in.axis && pressed != 0 {
+			bit := 0
+			for pressed&1 == 0 {
+				pressed >>= 1
+				bit++
+			}
+			fmt.Printf("  button %d\n", bit)
+			return calibrationInput{index: bit}, true, c.waitRest()
+		}
+		if !axes {
+			continue
+		}
+
+		if !in.axis {
+			best := CALIBRATE_THRESHOLD
+			for i, v := range state.AxisData {
+				if (only >= 0 && i != only) || i >= len(c.rest.AxisData) {
+					continue
+				}
+				if d := abs(v - c.rest.AxisData[i]); d > best {
+					in.index, best = i, d
+				}
+			}
+			if in.index < 0 {
+				continue
+			}
+			in.axis, in.value, since = true, state.AxisData[in.index], time.Now()
+		}
+
+		v := state.AxisData[in.index]
+		if abs(v-c.rest.AxisData[in.index]) > abs(in.value-c.rest.AxisData[in.index]) {
+			in.value = v
+		}
+		if time.Since(since) >= CALIBRATE_SETTLE {
+			fmt.Printf("  axis %d: %d\n", in.index, in.value)
+			return in, true, c.waitRest()
+		}
+	}
+}
+
+// waitRest waits until every control is back near its resting state
+func (c *calibrator) waitRest() error {
+	for {
+		state, err := c.js.Read()
+		if err != nil {
+			return err
+		}
+		resting := state.Buttons == c.rest.Buttons
+		for i, v := range state.AxisData {
+			if i < len(c.rest.AxisData) && abs(v-c.rest.AxisData[i]) > CALIBRATE_REST_NOISE {
+				resting = false
+			}
+		}
+		if resting {
+			return nil
+		}
+		time.Sleep(CALIBRATE_POLL)
+	}
+}
+
+// saveCalibration writes mapping into the mapping file, ahead of any other
+// entries so it takes priority, replacing an earlier entry for the same pad
+func saveCalibration(filename string, mapping *PadMapping) error {
+	mappings, err := LoadPadMappings(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	out := []*PadMapping{mapping}
+	for _, m := range mappings {
+		if m.Match != mapping.Match {
+			out = append(out, m)
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
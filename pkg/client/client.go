@@ -0,0 +1,548 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0xcafed00d/joystick"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	DEFAULT_PORT = 8080
+	SEND_RATE_HZ = 33 // ~30ms between sends
+	KEEPALIVE_HZ = 2  // unchanged states are still resent this often
+)
+
+// console receives status and telemetry output
+var console io.Writer = os.Stdout
+
+// enableVT turns on escape sequences on stdout where the terminal has to be
+// asked (the Windows console, set by console_windows.go); nil elsewhere
+var enableVT func() error
+
+// readController continuously reads joystick and sends state over connection,
+// using mapping to translate the pad's axes and buttons. Unless the deadman
+// control (if any) is held, neutral input is sent instead.
+func readController(js joystick.Joystick, conn net.Conn, mapping *PadMapping, deadman string, rate *rateControl) error {
+	period := rate.period()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	// We'll manually marshal JSON and send framed packets: [4-byte big-endian length][payload][4-byte CRC]
+	state := &protocol.ControllerState{}
+	var estop estopCombo
+	sender := &stateSender{conn: conn}
+
+	for range ticker.C {
+		jsState, err := js.Read()
+		if err != nil {
+			return fmt.Errorf("reading joystick: %w", err)
+		}
+
+		mapping.Apply(jsState, state)
+		if estop.pressed(state) {
+			if err := sendEStop(conn, "START+SELECT on "+js.Name()); err != nil {
+				return err
+			}
+		}
+		applyDeadman(state, deadman)
+
+		sent, err := sender.send(state)
+		if err != nil {
+			return err
+		}
+		if sent && tui != nil {
+			tui.sent(state)
+		} else if sent {
+			fmt.Println(state)
+		}
+
+		if p := rate.period(); p != period {
+			period = p
+			ticker.Reset(period)
+		}
+	}
+
+	return nil
+}
+
+// stateSender skips states identical to the last one sent, apart from a
+// keepalive every 1/KEEPALIVE_HZ so the server knows the link is up
+type stateSender struct {
+	conn     net.Conn
+	last     protocol.ControllerState
+	lastSent time.Time
+}
+
+// send transmits state if it changed or the keepalive is due, and reports
+// whether it did
+func (s *stateSender) send(state *protocol.ControllerState) (bool, error) {
+	cmp := *state
+	cmp.Timestamp = 0
+	if cmp == s.last && time.Since(s.lastSent) < time.Second/KEEPALIVE_HZ {
+		return false, nil
+	}
+	if err := sendState(s.conn, state); err != nil {
+		return false, err
+	}
+	s.last = cmp
+	s.lastSent = time.Now()
+	return true, nil
+}
+
+// sendState timestamps and numbers state and sends it as one packet, with
+// a copy on the -link2 link
+func sendState(conn net.Conn, state *protocol.ControllerState) error {
+	state.Timestamp = time.Now().UnixMilli()
+	state.Seq = stateSeq.Add(1)
+	link2.send(state)
+
+	b, err := encodePayload(state)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if len(b) > framing.MaxPacketSize {
+		// Skip sending if exceeding configured max
+		log.Printf("state too large (%d bytes), skipping send", len(b))
+		return nil
+	}
+
+	if err := framing.WritePacket(conn, b); err != nil {
+		return fmt.Errorf("write packet: %w", err)
+	}
+	return nil
+}
+
+// readStatus displays the status and telemetry frames the server pushes back
+// until the connection closes, feeding status to rate and pongs to lat
+func readStatus(conn net.Conn, rate *rateControl, lat *latencyMeter) {
+	for {
+		payload, err := framing.ReadPacket(conn)
+		if err == protocol.ErrBadCRC || err == protocol.ErrPacketTooLarge {
+			log.Printf("Dropping status frame: %v", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if protocol.IsProtobuf(payload) {
+			if payload, err = protocol.ProtobufToJSON(payload); err != nil {
+				log.Printf("Dropping undecodable frame: %v", err)
+				continue
+			}
+		}
+
+		switch protocol.PeekType(payload) {
+		case protocol.MsgHello:
+			var answer protocol.HelloFrame
+			if err := json.Unmarshal(payload, &answer); err != nil {
+				log.Printf("Hello unmarshal error: %v", err)
+				continue
+			}
+			helloAnswer(&answer)
+		case protocol.MsgStatus:
+			var status protocol.StatusFrame
+			if err := json.Unmarshal(payload, &status); err != nil {
+				log.Printf("Status unmarshal error: %v", err)
+				continue
+			}
+			rate.update(&status)
+			if tui != nil {
+				tui.showStatus(&status)
+				continue
+			}
+			fmt.Fprintf(console, "%s%s\n", &status, lat)
+		case protocol.MsgPong:
+			var pong protocol.PongFrame
+			if err := json.Unmarshal(payload, &pong); err != nil {
+				log.Printf("Pong unmarshal error: %v", err)
+				continue
+			}
+			lat.pong(&pong)
+		case protocol.MsgTelemetry:
+			var telem protocol.TelemetryState
+			if err := json.Unmarshal(payload, &telem); err != nil {
+				log.Printf("Telemetry unmarshal error: %v", err)
+				continue
+			}
+			if tui != nil {
+				tui.showTelemetry(&telem)
+				continue
+			}
+			fmt.Fprintln(console, &telem)
+		case protocol.MsgShutdown:
+			var bye protocol.ShutdownFrame
+			json.Unmarshal(payload, &bye)
+			log.Printf("Server closed the connection: %s", bye.Reason)
+		case protocol.MsgRumble:
+			var rumble protocol.RumbleFrame
+			if err := json.Unmarshal(payload, &rumble); err != nil {
+				log.Printf("Rumble unmarshal error: %v", err)
+				continue
+			}
+			log.Printf("Server reports %s", rumble.Event)
+			padRumble.play(&rumble)
+		case protocol.MsgReplay:
+			var replay protocol.ReplayFrame
+			if err := json.Unmarshal(payload, &replay); err != nil {
+				log.Printf("Replay unmarshal error: %v", err)
+				continue
+			}
+			if tui != nil {
+				tui.showReplay(&replay)
+				continue
+			}
+			fmt.Fprintln(console, &replay)
+		}
+	}
+}
+
+// findController opens the pad picked with -controller or
+// -controller-name, or else the first with any buttons, returning its
+// index too. Devices without buttons, like a laptop's accelerometer, are
+// only opened when picked by index.
+func findController() (joystick.Joystick, int, error) {
+	for i := 0; i < PAD_SLOTS; i++ {
+		if padChoice.index >= 0 && i != padChoice.index {
+			continue
+		}
+		js, err := openPad(i)
+		if err != nil {
+			continue
+		}
+		if !padChoice.matches(js, i) {
+			js.Close()
+			continue
+		}
+		log.Printf("Controller found: %s", js.Name())
+		return js, i, nil
+	}
+	return nil, 0, fmt.Errorf("no controller found")
+}
+
+// claimDriver asks the server for the driver seat using token
+func claimDriver(conn net.Conn, token string) error {
+	b, err := json.Marshal(&protocol.ClaimFrame{Type: protocol.MsgClaim, Token: token})
+	if err != nil {
+		return err
+	}
+	return framing.WritePacket(conn, b)
+}
+
+// clientOptions are the input settings runClient passes to the readers
+type clientOptions struct {
+	token    string
+	mappings []*PadMapping
+	tuning   AxisTuning
+	invertY  bool
+	keyboard bool
+	deadman  string
+	rate     float64 // requested send rate in Hz
+	encoding string  // payload encoding to ask the server for
+	rumble   bool    // play the server's rumbles on the pad
+
+	recorder *inputRecorder  // -record, nil when not recording
+	replay   *replayJoystick // -replay, used instead of a real pad
+	split    *SplitConfig    // -split, read two pads instead of one
+}
+
+func runClient(serverAddr string, opts *clientOptions) error {
+	conn, err := dialServer(serverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Println("Connected to server")
+	if err := link2.open(); err != nil {
+		log.Printf("-link2: %v", err)
+	}
+
+	if err := sayHello(conn, opts.encoding); err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+
+	if opts.token != "" {
+		if err := claimDriver(conn, opts.token); err != nil {
+			return fmt.Errorf("claim driver: %w", err)
+		}
+	}
+
+	rate := newRateControl(opts.rate)
+	lat := &latencyMeter{}
+	if tui != nil {
+		tui.attach(rate, lat)
+		defer tui.attach(nil, nil)
+	}
+	go readStatus(conn, rate, lat)
+	go lat.run(conn)
+
+	if opts.keyboard {
+		return readKeyboard(conn, opts.deadman, rate)
+	}
+
+	for {
+		var js joystick.Joystick = opts.replay
+		var mapping *PadMapping
+		if opts.split != nil {
+			var index int
+			js, mapping, index, err = opts.split.open(opts.mappings, opts.tuning, opts.invertY)
+			if err != nil {
+				log.Printf("Waiting for controllers (%v)...", err)
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			defer js.Close()
+			if opts.rumble {
+				padRumble.open(index)
+				defer padRumble.close()
+			}
+		} else if opts.replay == nil {
+			var index int
+			js, index, err = findController()
+			if err != nil {
+				log.Println("Waiting for controller...")
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			defer js.Close()
+			if opts.rumble {
+				padRumble.open(index)
+				defer padRumble.close()
+			}
+		}
+		if opts.recorder != nil {
+			js = opts.recorder.wrap(js)
+		}
+
+		if mapping == nil {
+			mapping = padMapping(opts.mappings, js.Name())
+			if mapping.Match != "" {
+				log.Printf("Using %q pad mapping", mapping.Match)
+			}
+			mapping = mapping.WithTuning(opts.tuning, opts.invertY)
+		}
+		if err := reportGamepad(conn, js, mapping); err != nil {
+			log.Printf("Gamepad report failed: %v", err)
+		}
+
+		if err := readController(js, conn, mapping, opts.deadman, rate); err != nil {
+			js.Close()
+			if opts.replay != nil && errors.Is(err, io.EOF) {
+				log.Println("Replay finished")
+				return errors.Join(errQuit, sendState(conn, formatter.NeutralState()))
+			}
+			if strings.Contains(err.Error(), "broken pipe") {
+				return fmt.Errorf("server disconnected")
+			}
+			log.Printf("Controller error: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// Main parses the command line and runs the client until it is
+// interrupted. cmd/client is just a call to it.
+func Main() {
+	serverAddr := flag.String("server", fmt.Sprintf("localhost:%d", DEFAULT_PORT), "Server address")
+	token := flag.String("token", "", "Driver token expected by the server")
+	mappingFile := flag.String("mapping", "", "Gamepad mapping file (JSON list, matched by controller name)")
+	deadzone := flag.Float64("deadzone", 0, "Stick deadzone as a fraction of travel (0-1), unless the mapping sets one")
+	sensitivity := flag.Float64("sensitivity", 1, "Stick sensitivity multiplier, unless the mapping sets one")
+	invertY := flag.Bool("invert-y", false, "Invert both stick Y axes")
+	keyboard := flag.Bool("keyboard", false, "Drive from the terminal keyboard instead of a gamepad")
+	deadman := flag.String("deadman", "", "Button or trigger (e.g. LB, RT) that must be held for any non-neutral input")
+	sendRate := flag.Float64("rate", SEND_RATE_HZ, "Controller send rate in Hz (capped by the server, reduced when it is congested)")
+	reset := flag.Bool("reset-estop", false, "Release the server's e-stop and exit")
+	mode := flag.String("mode", "", "Switch the server to teleop, autonomy, paused or estop and exit")
+	recordFile := flag.String("record", "", "Save raw joystick samples to this file for -replay")
+	replayFile := flag.String("replay", "", "Send a -record file's samples instead of reading a controller, then exit")
+	discover := flag.Bool("discover", false, "Find the server on the local network over mDNS instead of using -server")
+	calibrate := flag.Bool("calibrate", false, "Interactively map the connected controller into the -mapping file and exit")
+	tuiMode := flag.Bool("tui", false, "Show a live terminal dashboard instead of printing every state")
+	rumble := flag.Bool("rumble", true, "Rumble the gamepad when the server reports an e-stop, failsafe, CRC storm or motor stall (Linux, Windows XInput)")
+	flag.BoolVar(&xinputOpts.enabled, "xinput", openXInputPad != nil, "Read Xbox-style pads through XInput in a fixed layout (Windows); false reads any pad through winmm and -mapping")
+	flag.BoolVar(&sdlOpts.enabled, "sdl", false, "Read gamepads through SDL2's controller database instead of -mapping; needs an SDL build, see README")
+	flag.StringVar(&sdlOpts.dbFile, "sdl-db", "", "Extra SDL controller mappings to load with -sdl (e.g. gamecontrollerdb.txt)")
+	list := flag.Bool("list", false, "List the attached controllers with their index, name and axis and button counts, and exit")
+	flag.IntVar(&padChoice.index, "controller", -1, "Use the controller at this index (see -list) instead of the first one found")
+	flag.StringVar(&padChoice.name, "controller-name", "", "Use the first controller whose name contains this (case-insensitive)")
+	splitFile := flag.String("split", "", "Merge a driver's and an operator's gamepad, each owning the fields listed in this file")
+	encoding := flag.String("encoding", protocol.ENCODING_JSON, "Payload encoding to ask the server for: json, or protobuf (see protocol.proto)")
+	flag.BoolVar(&quicOpts.enabled, "quic", false, "Connect over QUIC to the server's -quic address; needs a QUIC build, see README")
+	flag.StringVar(&link2.addr, "link2", "", "Also send every state over UDP to the server's -udp-link address (e.g. its tethered IP:8091)")
+	flag.IntVar(&framing.MaxPacketSize, "max-packet-size", protocol.DEFAULT_MAX_PACKET_SIZE, "Largest packet payload in bytes, as the server's -max-packet-size")
+	flag.StringVar(&framing.CRC, "crc", protocol.CRC_32, "Packet CRC, as the server's -crc: crc32, crc32c or crc16-ccitt")
+	flag.StringVar(&quicOpts.caFile, "quic-ca", "", "PEM certificates to trust for -quic instead of the system roots (e.g. the server's self-signed cert)")
+	flag.Parse()
+
+	if sdlOpts.enabled && openSDLPad == nil {
+		log.Fatal("this client was built without SDL support")
+	}
+	if xinputOpts.enabled && openXInputPad == nil {
+		log.Fatal("-xinput is only available on Windows")
+	}
+	if *list {
+		var mappings []*PadMapping
+		if *mappingFile != "" {
+			var err error
+			if mappings, err = LoadPadMappings(*mappingFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		listPads(os.Stdout, mappings)
+		return
+	}
+	if *calibrate {
+		if sdlOpts.enabled {
+			log.Fatal("-sdl pads use SDL's mappings and need no -calibrate")
+		}
+		if *mappingFile == "" {
+			*mappingFile = "gamepads.json"
+		}
+		if err := runCalibration(*mappingFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *deadzone < 0 || *deadzone >= 1 {
+		log.Fatalf("-deadzone must be in [0, 1), got %g", *deadzone)
+	}
+	if *sendRate < protocol.MIN_SEND_RATE_HZ {
+		log.Fatalf("-rate must be at least %g Hz to beat the server's %v driver timeout, got %g", protocol.MIN_SEND_RATE_HZ, protocol.DRIVER_TIMEOUT, *sendRate)
+	}
+	if err := checkDeadmanField(*deadman); err != nil {
+		log.Fatal(err)
+	}
+	if err := framing.Check(); err != nil {
+		log.Fatal(err)
+	}
+	if link2.addr != "" {
+		clientCaps = append(clientCaps, protocol.CAP_DUAL_LINK)
+	}
+	if *rumble && openRumble != nil {
+		clientCaps = append(clientCaps, protocol.CAP_RUMBLE)
+	}
+	if *encoding != protocol.ENCODING_JSON && *encoding != protocol.ENCODING_PROTOBUF {
+		log.Fatalf("-encoding must be %s or %s, got %q", protocol.ENCODING_JSON, protocol.ENCODING_PROTOBUF, *encoding)
+	}
+	opts := &clientOptions{
+		token:    *token,
+		tuning:   AxisTuning{Deadzone: *deadzone, Sensitivity: *sensitivity},
+		invertY:  *invertY,
+		keyboard: *keyboard,
+		deadman:  *deadman,
+		rate:     *sendRate,
+		encoding: *encoding,
+		rumble:   *rumble,
+	}
+
+	if *mappingFile != "" {
+		var err error
+		if opts.mappings, err = LoadPadMappings(*mappingFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if padChoice.index >= PAD_SLOTS {
+		log.Fatalf("-controller must be below %d, got %d", PAD_SLOTS, padChoice.index)
+	}
+	if *splitFile != "" {
+		if padChoice.index >= 0 || padChoice.name != "" {
+			log.Fatal("-split picks its controllers by index; drop -controller and -controller-name")
+		}
+		if *keyboard || *replayFile != "" || *recordFile != "" {
+			log.Fatal("-split can't be combined with -keyboard, -replay or -record")
+		}
+		var err error
+		if opts.split, err = LoadSplitConfig(*splitFile, *deadman); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayFile != "" && *keyboard {
+		log.Fatal("-replay and -keyboard are mutually exclusive")
+	}
+	if *tuiMode && *keyboard {
+		log.Fatal("-tui and -keyboard are mutually exclusive")
+	}
+	if *replayFile != "" {
+		var err error
+		if opts.replay, err = loadInputRecording(*replayFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Replaying %s (%s)", *replayFile, opts.replay.Name())
+	}
+	if *recordFile != "" {
+		recorder, err := newInputRecorder(*recordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+		opts.recorder = recorder
+	}
+
+	if flag.NArg() > 0 {
+		*serverAddr = flag.Arg(0)
+	}
+
+	if !strings.Contains(*serverAddr, ":") {
+		*serverAddr = fmt.Sprintf("%s:%d", *serverAddr, DEFAULT_PORT)
+	}
+
+	if *discover {
+		addr, err := discoverServer(DISCOVER_TIMEOUT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*serverAddr = addr
+	}
+
+	if *reset {
+		if err := resetEStop(*serverAddr, *token); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("E-stop reset")
+		return
+	}
+	if *mode != "" {
+		if err := sendMode(*serverAddr, *token, *mode); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Mode switch to %s sent", *mode)
+		return
+	}
+
+	if *tuiMode {
+		var err error
+		if tui, err = startTUI(*serverAddr); err != nil {
+			log.Fatal(err)
+		}
+		defer tui.close()
+	}
+	log.Printf("Connecting to %s (Ctrl+C to stop)", *serverAddr)
+
+	for {
+		err := runClient(*serverAddr, opts)
+		if errors.Is(err, errQuit) {
+			return
+		}
+		if err != nil {
+			log.Printf("Connection error: %v", err)
+		}
+		if !pathChanged.Swap(false) {
+			time.Sleep(3 * time.Second)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package client
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func init() {
+	enableVT = enableConsoleVT
+}
+
+// enableConsoleVT turns on escape sequence processing, which Windows
+// Terminal has on but the older console host leaves off
+func enableConsoleVT() error {
+	h := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return err
+	}
+	return windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// checkDeadmanField rejects deadman fields the client can't read
+func checkDeadmanField(field string) error {
+	if field == "" {
+		return nil
+	}
+	return protocol.CheckDeadman(field)
+}
+
+// applyDeadman neutralizes state unless the deadman control is held, so
+// the robot stops even if the server isn't enforcing it. It reports
+// whether the deadman is held; an empty field always counts as held.
+func applyDeadman(state *protocol.ControllerState, field string) bool {
+	if field == "" {
+		return true
+	}
+	held := state.DeadmanHeld(field)
+	if !held {
+		*state = *formatter.NeutralState()
+	}
+	return held
+}
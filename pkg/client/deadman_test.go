@@ -0,0 +1,59 @@
+package client
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestApplyDeadman(t *testing.T) {
+	driving := protocol.ControllerState{LeftX: 10, LeftY: 200, RightY: 127, South: 1, RightTrigger: 255}
+	tests := []struct {
+		name  string
+		field string
+		edit  func(*protocol.ControllerState)
+		held  bool
+	}{
+		{"no deadman", "", func(*protocol.ControllerState) {}, true},
+		{"button held", "S", func(*protocol.ControllerState) {}, true},
+		{"button released", "S", func(s *protocol.ControllerState) { s.South = 0 }, false},
+		{"other button", "LB", func(*protocol.ControllerState) {}, false},
+		{"trigger pulled", "RT", func(s *protocol.ControllerState) { s.RightTrigger = protocol.DEADMAN_TRIGGER_MIN }, true},
+		{"trigger barely pulled", "RT", func(s *protocol.ControllerState) { s.RightTrigger = protocol.DEADMAN_TRIGGER_MIN - 1 }, false},
+		{"trigger released", "LT", func(*protocol.ControllerState) {}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := driving
+			tt.edit(&state)
+			sent := state
+			if held := applyDeadman(&state, tt.field); held != tt.held {
+				t.Fatalf("held = %v, want %v", held, tt.held)
+			}
+			want := sent
+			if !tt.held {
+				want = *formatter.NeutralState()
+			}
+			if state != want {
+				t.Fatalf("sent %v, want %v", &state, &want)
+			}
+		})
+	}
+}
+
+func TestCheckDeadmanField(t *testing.T) {
+	for field, ok := range map[string]bool{"": true, "S": true, "SELECT": true, "LT": true, "RT": true, "LjoyX": false, "dX": false, "X": false} {
+		if err := checkDeadmanField(field); (err == nil) != ok {
+			t.Errorf("checkDeadmanField(%q) = %v", field, err)
+		}
+	}
+}
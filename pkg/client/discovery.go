@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/mdns"
+)
+
+// DISCOVER_TIMEOUT is how long -discover listens for servers
+const DISCOVER_TIMEOUT = 2 * time.Second
+
+// discoveredServer is one answer to a -discover query
+type discoveredServer struct {
+	instance string
+	host     string
+	port     uint16
+	ip       net.IP // the one that answered, so reachable from here
+}
+
+// name is the instance label, e.g. "lunapi" for
+// lunapi._lunabotics-ctl._tcp.local.
+func (s *discoveredServer) name() string {
+	return strings.TrimSuffix(s.instance, "."+mdns.MDNS_SERVICE)
+}
+
+func (s *discoveredServer) addr() string {
+	return net.JoinHostPort(s.ip.String(), strconv.Itoa(int(s.port)))
+}
+
+// discoverServer finds the server over mDNS and returns its address. It
+// fails rather than guess when more than one answers, since two robots on
+// the same field network is a real possibility.
+func discoverServer(timeout time.Duration) (string, error) {
+	servers, err := browse(timeout)
+	if err != nil {
+		return "", err
+	}
+	switch len(servers) {
+	case 0:
+		return "", fmt.Errorf("no server answered on %s within %v", mdns.MDNS_SERVICE, timeout)
+	case 1:
+		log.Printf("Discovered %s at %s", servers[0].name(), servers[0].addr())
+		return servers[0].addr(), nil
+	}
+	var found []string
+	for _, s := range servers {
+		found = append(found, fmt.Sprintf("%s (%s)", s.name(), s.addr()))
+	}
+	return "", fmt.Errorf("found several servers, give one as the server address: %s", strings.Join(found, ", "))
+}
+
+// browse asks for the control service and collects every server that
+// answers within timeout
+func browse(timeout time.Duration) ([]*discoveredServer, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdns.MDNS_GROUP)
+	if err != nil {
+		return nil, err
+	}
+	// An ephemeral port makes this a one-shot query: responders reply to us
+	// directly instead of to the group
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query, err := (&mdns.Message{
+		ID:        uint16(rand.Intn(1 << 16)),
+		Questions: []mdns.Question{{Name: mdns.MDNS_SERVICE, Type: mdns.DNS_TYPE_PTR}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make(map[string]*discoveredServer) // by instance
+	deadline := time.Now().Add(timeout)
+	resend := time.Now()
+	buf := make([]byte, 9000)
+	for time.Now().Before(deadline) {
+		if !time.Now().Before(resend) {
+			if _, err := conn.WriteToUDP(query, group); err != nil {
+				return nil, fmt.Errorf("mDNS query: %w", err)
+			}
+			resend = time.Now().Add(timeout / 2)
+		}
+		conn.SetReadDeadline(minTime(deadline, resend))
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		reply, err := mdns.Parse(buf[:n])
+		if err != nil || !reply.Response {
+			continue
+		}
+		for _, r := range reply.Answers {
+			switch r.Type {
+			case mdns.DNS_TYPE_PTR:
+				if mdns.SameName(r.Name, mdns.MDNS_SERVICE) && r.TTL > 0 && servers[r.Target] == nil {
+					servers[r.Target] = &discoveredServer{instance: r.Target, ip: src.IP}
+				}
+			case mdns.DNS_TYPE_SRV:
+				if s := servers[r.Name]; s != nil {
+					s.host, s.port = r.Target, r.Port
+				}
+			}
+		}
+	}
+
+	var found []*discoveredServer
+	for _, s := range servers {
+		if s.port == 0 {
+			continue // never said where
+		}
+		found = append(found, s)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].instance < found[j].instance })
+	return found, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
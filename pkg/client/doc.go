@@ -0,0 +1,4 @@
+// Package client is the driver-station program: it reads a gamepad or the
+// keyboard and streams ControllerStates to the server. Main is the whole
+// program; cmd/client calls it.
+package client
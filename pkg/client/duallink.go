@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"lunabotics/pkg/protocol"
+)
+
+// stateSeq numbers every state sent, so a server given each one twice
+// knows which copies it has already handled
+var stateSeq atomic.Uint64
+
+// dualLink is the second path (-link2) every state also takes: UDP to the
+// server's -udp-link address, typically over a tether while the connection
+// runs over Wi-Fi. The server drops whichever copy arrives second.
+type dualLink struct {
+	addr string // -link2, "" without
+
+	mu    sync.Mutex
+	conn  net.Conn
+	token string // from the server's hello; nothing is sent until it arrives
+}
+
+var link2 dualLink
+
+// open starts the link for a new connection. The token comes later, with
+// the server's hello.
+func (l *dualLink) open() error {
+	if l.addr == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.conn, l.token = conn, ""
+	return nil
+}
+
+// accept takes the token from the server's hello; "" means the server
+// has no UDP link and states only go on the connection
+func (l *dualLink) accept(token string) {
+	if l.addr == "" {
+		return
+	}
+	l.mu.Lock()
+	l.token = token
+	l.mu.Unlock()
+	if token == "" {
+		log.Printf("Server has no UDP link; -link2 %s unused", l.addr)
+	} else {
+		log.Printf("Duplicating states over UDP to %s", l.addr)
+	}
+}
+
+// send copies a state onto the link. Errors are ignored: the link exists
+// for when one path is failing.
+func (l *dualLink) send(state *protocol.ControllerState) {
+	l.mu.Lock()
+	conn, token := l.conn, l.token
+	l.mu.Unlock()
+	if conn == nil || token == "" {
+		return
+	}
+	b, err := json.Marshal(&protocol.LinkFrame{Type: protocol.MsgLink, Link: token, State: state})
+	if err != nil {
+		return
+	}
+	var datagram bytes.Buffer
+	if framing.WritePacket(&datagram, b) == nil {
+		conn.Write(datagram.Bytes())
+	}
+}
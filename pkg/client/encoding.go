@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"lunabotics/pkg/protocol"
+)
+
+// clientCaps are the capabilities the client advertises in its hello
+var clientCaps = []string{protocol.CAP_PING, protocol.CAP_TELEMETRY, protocol.CAP_ESTOP, protocol.CAP_AXES16, protocol.CAP_GAMEPAD, protocol.CAP_RESUME}
+
+// framing is how packets are framed, -max-packet-size and -crc; it must
+// match the server's
+var framing = protocol.DefaultFraming()
+
+// protobufLink is set once the server has agreed to protobuf payloads on
+// the current connection. Until then, and with servers that predate it,
+// everything goes as JSON.
+var protobufLink atomic.Bool
+
+// resumeToken is the token from the last server hello, presented in the
+// next one so a reconnect after a network blip gets the driver seat back
+var resumeToken atomic.Pointer[string]
+
+// sayHello opens a connection with the client's HelloFrame, offering
+// encoding first and JSON as the fallback. The switch happens when
+// readStatus sees the answer; a server too old to answer leaves the
+// connection on JSON, which every server reads.
+func sayHello(conn net.Conn, encoding string) error {
+	protobufLink.Store(false)
+	encodings := []string{encoding}
+	if encoding != protocol.ENCODING_JSON {
+		encodings = append(encodings, protocol.ENCODING_JSON)
+	}
+	b, err := json.Marshal(&protocol.HelloFrame{
+		Type:         protocol.MsgHello,
+		Version:      protocol.PROTOCOL_VERSION,
+		MinVersion:   protocol.PROTOCOL_MIN_VERSION,
+		Encodings:    encodings,
+		Framing:      framing.Name(),
+		Capabilities: clientCaps,
+		Resume:       resumeTokenValue(),
+	})
+	if err != nil {
+		return err
+	}
+	return framing.WritePacket(conn, b)
+}
+
+// helloAnswer applies the server's HelloFrame
+func helloAnswer(h *protocol.HelloFrame) {
+	if h.Error != "" {
+		log.Printf("Server refused the connection: %s", h.Error)
+		return
+	}
+	log.Printf("Server protocol %d, %s payloads, capabilities %v", h.Version, h.Encoding, h.Capabilities)
+	protobufLink.Store(h.Encoding == protocol.ENCODING_PROTOBUF)
+	link2.accept(h.Link)
+	resumeToken.Store(&h.Resume)
+	if h.Resumed {
+		log.Println("Resumed as driver")
+	}
+}
+
+// resumeTokenValue is the token to present in a hello, "" on the first
+// connection
+func resumeTokenValue() string {
+	if t := resumeToken.Load(); t != nil {
+		return *t
+	}
+	return ""
+}
+
+// encodePayload marshals a message for the server: as protobuf once the
+// link has switched and the schema has the message, as JSON otherwise
+func encodePayload(v any) ([]byte, error) {
+	if protobufLink.Load() {
+		if b, ok := protocol.MarshalProtobuf(v); ok {
+			return b, nil
+		}
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// estopFields are the buttons of the e-stop combo
+var estopFields = []string{"START", "SELECT"}
+
+// estopCombo watches for START+SELECT being pressed together and reports
+// the moment it happens, so holding them sends one e-stop rather than one
+// per frame
+type estopCombo struct {
+	held bool
+}
+
+// pressed reports whether the combo went down in this state
+func (e *estopCombo) pressed(state *protocol.ControllerState) bool {
+	held := state.Start != 0 && state.Select != 0
+	edge := held && !e.held
+	e.held = held
+	return edge
+}
+
+// sendEStop tells the server to latch its e-stop
+func sendEStop(conn net.Conn, reason string) error {
+	b, err := encodePayload(&protocol.EStopFrame{Type: protocol.MsgEStop, Reason: reason})
+	if err != nil {
+		return err
+	}
+	if err := framing.WritePacket(conn, b); err != nil {
+		return fmt.Errorf("send e-stop: %w", err)
+	}
+	log.Printf("E-STOP sent (%s)", reason)
+	return nil
+}
+
+// RESET_ANSWER_TIMEOUT is how long resetEStop waits for the server to
+// confirm or refuse the reset
+const RESET_ANSWER_TIMEOUT = 2 * time.Second
+
+// resetEStop connects to the server, takes the driver seat, presenting
+// token if one is given, and releases a latched e-stop. The server only
+// takes a reset from its driver, so this fails while someone else drives,
+// or while the seat is held for a driver that dropped; the error says which.
+func resetEStop(serverAddr, token string) error {
+	conn, err := dialServer(serverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if token != "" {
+		if err := claimDriver(conn, token); err != nil {
+			return err
+		}
+	}
+	// A neutral state seats us if the seat is free; nothing drives while
+	// the e-stop is latched
+	if err := sendState(conn, formatter.NeutralState()); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&protocol.EStopFrame{Type: protocol.MsgReset})
+	if err != nil {
+		return err
+	}
+	if err := framing.WritePacket(conn, b); err != nil {
+		return err
+	}
+	return awaitReset(conn)
+}
+
+// awaitReset reads the server's answer to a reset: a status without the
+// e-stop means it was released, a reset frame back that it was refused
+func awaitReset(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(RESET_ANSWER_TIMEOUT))
+	for {
+		payload, err := framing.ReadPacket(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errors.New("the server didn't confirm the e-stop reset")
+		}
+		if err == protocol.ErrBadCRC || err == protocol.ErrPacketTooLarge {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("awaiting e-stop reset: %w", err)
+		}
+		switch protocol.PeekType(payload) {
+		case protocol.MsgReset:
+			var refusal protocol.EStopFrame
+			json.Unmarshal(payload, &refusal)
+			return fmt.Errorf("e-stop reset refused: %s", refusal.Reason)
+		case protocol.MsgStatus:
+			var status protocol.StatusFrame
+			if json.Unmarshal(payload, &status) == nil && !status.EStop {
+				return nil
+			}
+		}
+	}
+}
+
+// sendMode connects to the server, claims the driver seat with token and
+// asks it to switch mode (MODE_*). The claim is sent even without a token,
+// as a server without one lets any claimant switch.
+func sendMode(serverAddr, token, mode string) error {
+	conn, err := dialServer(serverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := claimDriver(conn, token); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&protocol.ModeFrame{Type: protocol.MsgMode, Mode: mode})
+	if err != nil {
+		return err
+	}
+	return framing.WritePacket(conn, b)
+}
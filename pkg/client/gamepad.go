@@ -0,0 +1,59 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/0xcafed00d/joystick"
+
+	"lunabotics/pkg/protocol"
+)
+
+// reportGamepad tells the server which pad is driving and which fields its
+// mapping can fill. Servers that predate gamepad reports ignore it.
+func reportGamepad(conn net.Conn, js joystick.Joystick, mapping *PadMapping) error {
+	b, err := json.Marshal(&protocol.GamepadFrame{
+		Type:    protocol.MsgGamepad,
+		Name:    js.Name(),
+		GUID:    padGUID(js.Name()),
+		Axes:    js.AxisCount(),
+		Buttons: js.ButtonCount(),
+		Fields:  mapping.Fields(js.AxisCount(), js.ButtonCount()),
+	})
+	if err != nil {
+		return err
+	}
+	return framing.WritePacket(conn, b)
+}
+
+// padGUID builds the SDL-style GUID of the joystick device named name from
+// its input IDs in sysfs: bus, vendor, product and version as little-endian
+// 16-bit words, each followed by a zero word. It returns "" where sysfs
+// doesn't describe the pad, as on other OSes or when replaying.
+func padGUID(name string) string {
+	devices, _ := filepath.Glob("/sys/class/input/js*/device")
+	for _, dev := range devices {
+		if b, err := os.ReadFile(filepath.Join(dev, "name")); err != nil || strings.TrimSpace(string(b)) != name {
+			continue
+		}
+		var guid strings.Builder
+		for _, id := range []string{"bustype", "vendor", "product", "version"} {
+			b, err := os.ReadFile(filepath.Join(dev, "id", id))
+			if err != nil {
+				return ""
+			}
+			v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 16, 16)
+			if err != nil {
+				return ""
+			}
+			fmt.Fprintf(&guid, "%02x%02x0000", v&0xFF, v>>8)
+		}
+		return guid.String()
+	}
+	return ""
+}
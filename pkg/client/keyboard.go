@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+
+	"lunabotics/pkg/formatter"
+)
+
+// KEY_HOLD is how long a key counts as held after its last press or
+// auto-repeat. Terminals report no key releases, so this has to cover the
+// delay before auto-repeat starts.
+const KEY_HOLD = 600 * time.Millisecond
+
+// keyBindings maps keyboard input to ControllerState fields. Sticks deflect
+// fully while their key is held; everything else is a button.
+//
+//	W A S D     left stick        arrows    right stick
+//	I J K L     N W S E buttons   Q / E     LB / RB
+//	Z / C       LT / RT           Tab/Enter SELECT / START
+//	Space       release everything
+//	X           e-stop
+var keyBindings = map[string]struct {
+	field string
+	value uint8
+}{
+	"w": {"LjoyY", 0}, "s": {"LjoyY", 255}, "a": {"LjoyX", 0}, "d": {"LjoyX", 255},
+	"up": {"RjoyY", 0}, "down": {"RjoyY", 255}, "left": {"RjoyX", 0}, "right": {"RjoyX", 255},
+	"i": {"N", 1}, "j": {"W", 1}, "k": {"S", 1}, "l": {"E", 1},
+	"q": {"LB", 1}, "e": {"RB", 1}, "z": {"LT", 255}, "c": {"RT", 255},
+	"tab": {"SELECT", 1}, "enter": {"START", 1},
+}
+
+// parseKeys splits raw terminal input into key names, decoding arrow key
+// escape sequences
+func parseKeys(data []byte) []string {
+	var keys []string
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b == 0x1b && i+2 < len(data) && data[i+1] == '[':
+			switch data[i+2] {
+			case 'A':
+				keys = append(keys, "up")
+			case 'B':
+				keys = append(keys, "down")
+			case 'C':
+				keys = append(keys, "right")
+			case 'D':
+				keys = append(keys, "left")
+			}
+			i += 2
+		case b == '\t':
+			keys = append(keys, "tab")
+		case b == '\r' || b == '\n':
+			keys = append(keys, "enter")
+		case b == ' ':
+			keys = append(keys, "space")
+		case b >= 'A' && b <= 'Z':
+			keys = append(keys, string(b+'a'-'A'))
+		default:
+			keys = append(keys, string(b))
+		}
+	}
+	return keys
+}
+
+// errQuit reports that the user asked to quit keyboard mode
+var errQuit = errors.New("quit")
+
+// readKeyboard drives from the terminal instead of a gamepad, for when the
+// controller dies mid-test. It returns when the connection fails, or
+// errQuit when the user presses Esc or Ctrl+C.
+func readKeyboard(conn net.Conn, deadman string, rate *rateControl) error {
+	// Raw mode also turns off "\n" -> "\r\n" translation, so route the
+	// status and log output through crlfWriter while it's on. Ctrl+C arrives
+	// as a byte rather than a signal, so the terminal is always restored.
+	fd := int(os.Stdin.Fd())
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("keyboard mode: %w", err)
+	}
+	defer term.Restore(fd, old)
+	if enableVT != nil {
+		enableVT() // without it the status line just isn't cleared
+	}
+	console = crlfWriter{os.Stdout}
+	log.SetOutput(crlfWriter{os.Stderr})
+	defer func() {
+		console = os.Stdout
+		log.SetOutput(os.Stderr)
+	}()
+
+	keys := make(chan []string)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- parseKeys(buf[:n])
+		}
+	}()
+
+	fmt.Fprint(console, "Keyboard mode: WASD/arrows move, IJKL QE ZC Tab Enter buttons, Space stops, X e-stops, Esc quits\r\n")
+	held := make(map[string]time.Time)
+	sender := &stateSender{conn: conn}
+	period := rate.period()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case pressed, ok := <-keys:
+			if !ok {
+				return io.EOF
+			}
+			for _, k := range pressed {
+				switch k {
+				case "\x1b", "\x03":
+					fmt.Fprint(console, "\r\n")
+					return errQuit
+				case "space":
+					clear(held)
+				case "x":
+					clear(held)
+					if err := sendEStop(conn, "keyboard"); err != nil {
+						return err
+					}
+				default:
+					if _, bound := keyBindings[k]; bound {
+						held[k] = time.Now()
+					}
+				}
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		state := formatter.NeutralState()
+		for k, at := range held {
+			if time.Since(at) > KEY_HOLD {
+				delete(held, k)
+				continue
+			}
+			b := keyBindings[k]
+			if p := state.Button(b.field); p != nil {
+				*p = b.value
+			} else {
+				*state.Axis8(b.field) = b.value
+			}
+		}
+		applyDeadman(state, deadman)
+		if _, err := sender.send(state); err != nil {
+			return err
+		}
+		fmt.Fprintf(console, "\r%v\x1b[K", state)
+
+		if p := rate.period(); p != period {
+			period = p
+			ticker.Reset(period)
+		}
+	}
+}
+
+// crlfWriter translates "\n" to "\r\n" for a terminal in raw mode
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	PING_INTERVAL  = time.Second
+	PING_BURST     = 5 // pings sent on connect to learn the clock offset quickly
+	PING_BURST_GAP = 20 * time.Millisecond
+	OFFSET_SAMPLES = 8                      // offset comes from the fastest of this many round trips
+	LATENCY_WARN   = 100 * time.Millisecond // drivers notice control lag past this
+)
+
+// offsetSample is one NTP-style measurement
+type offsetSample struct {
+	rtt    time.Duration
+	offset time.Duration // server clock minus client clock
+}
+
+// latencyMeter pings the server, keeps the latest round trip, warning when
+// it crosses LATENCY_WARN, and estimates how far the server's clock is from
+// ours. The estimate travels back in each ping so the server can judge
+// state timestamps by its own clock.
+type latencyMeter struct {
+	mu      sync.Mutex
+	seq     uint32
+	sentAt  [OFFSET_SAMPLES]time.Time // by seq % OFFSET_SAMPLES
+	rtt     time.Duration
+	samples []offsetSample // newest last
+	valid   bool
+	slow    bool
+}
+
+// run sends a quick burst of pings, then one every PING_INTERVAL until a
+// write fails
+func (l *latencyMeter) run(conn net.Conn) {
+	for i := 0; i < PING_BURST; i++ {
+		if err := l.ping(conn); err != nil {
+			return
+		}
+		time.Sleep(PING_BURST_GAP)
+	}
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := l.ping(conn); err != nil {
+			return
+		}
+	}
+}
+
+func (l *latencyMeter) ping(conn net.Conn) error {
+	l.mu.Lock()
+	l.seq++
+	now := time.Now()
+	l.sentAt[l.seq%OFFSET_SAMPLES] = now
+	ping := &protocol.PingFrame{Type: protocol.MsgPing, Seq: l.seq, Sent: now.UnixMilli()}
+	if l.valid {
+		ping.RTTMs = float64(l.rtt) / float64(time.Millisecond)
+		offset := l.offset()
+		ping.OffsetMs = &offset
+	}
+	l.mu.Unlock()
+
+	b, err := encodePayload(ping)
+	if err != nil {
+		return err
+	}
+	return framing.WritePacket(conn, b)
+}
+
+// pong takes the server's answer. The server stamps Recv as it replies, so
+// with our send and receive times this is one NTP exchange.
+func (l *latencyMeter) pong(p *protocol.PongFrame) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p.Seq > l.seq || l.seq-p.Seq >= OFFSET_SAMPLES {
+		return // too old to match up
+	}
+	sentAt := l.sentAt[p.Seq%OFFSET_SAMPLES]
+	rtt := now.Sub(sentAt)
+	midpoint := sentAt.Add(rtt / 2)
+	l.samples = append(l.samples, offsetSample{
+		rtt:    rtt,
+		offset: time.UnixMilli(p.Recv).Add(time.Millisecond / 2).Sub(midpoint), // Recv is truncated to the ms
+	})
+	if len(l.samples) > OFFSET_SAMPLES {
+		l.samples = l.samples[1:]
+	}
+	if p.Seq != l.seq {
+		return // only the latest ping counts for the displayed round trip
+	}
+	wasValid := l.valid
+	l.rtt = rtt
+	l.valid = true
+	if !wasValid {
+		log.Printf("Server clock offset %+dms", l.offset())
+	}
+
+	slow := l.rtt > LATENCY_WARN
+	if slow && !l.slow {
+		log.Printf("HIGH LATENCY: round trip %v (over %v)", l.rtt.Round(time.Millisecond), LATENCY_WARN)
+	} else if !slow && l.slow {
+		log.Printf("Latency back to normal: round trip %v", l.rtt.Round(time.Millisecond))
+	}
+	l.slow = slow
+}
+
+// offset returns the estimate from the fastest recent exchange, whose
+// midpoint is the least uncertain, in milliseconds. Callers hold l.mu.
+func (l *latencyMeter) offset() int64 {
+	best := l.samples[0]
+	for _, s := range l.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	return best.offset.Round(time.Millisecond).Milliseconds()
+}
+
+// roundTrip returns the latest round trip and clock offset in
+// milliseconds, whether there has been a pong yet, and whether the round
+// trip is over LATENCY_WARN
+func (l *latencyMeter) roundTrip() (rtt time.Duration, offset int64, ok, slow bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.valid {
+		return 0, 0, false, false
+	}
+	return l.rtt, l.offset(), true, l.slow
+}
+
+// String is appended to the status line: empty until the first pong
+func (l *latencyMeter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.valid {
+		return ""
+	}
+	str := fmt.Sprintf(" RTT[%.1fms clock%+dms]", float64(l.rtt)/float64(time.Millisecond), l.offset())
+	if l.slow {
+		str += " LAGGING"
+	}
+	return str
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestLatencyMeter(t *testing.T) {
+	const serverAhead = 1500 * time.Millisecond
+	tests := []struct {
+		name    string
+		seq     uint32        // the ping answered
+		latest  uint32        // the last ping sent
+		rtt     time.Duration // how long ago it went out
+		counted bool          // taken as a sample
+		valid   bool          // the displayed round trip is set
+	}{
+		{"latest ping", 3, 3, 20 * time.Millisecond, true, true},
+		{"earlier ping", 2, 3, 20 * time.Millisecond, true, false},
+		{"too old", 1, OFFSET_SAMPLES + 1, 20 * time.Millisecond, false, false},
+		{"not sent yet", 4, 3, 20 * time.Millisecond, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &latencyMeter{seq: tt.latest}
+			sent := time.Now().Add(-tt.rtt)
+			l.sentAt[tt.seq%OFFSET_SAMPLES] = sent
+			l.pong(&protocol.PongFrame{Seq: tt.seq, Recv: sent.Add(tt.rtt / 2).Add(serverAhead).UnixMilli()})
+
+			if counted := len(l.samples) == 1; counted != tt.counted {
+				t.Fatalf("sampled = %v, want %v", counted, tt.counted)
+			}
+			rtt, offset, ok, slow := l.roundTrip()
+			if ok != tt.valid {
+				t.Fatalf("round trip known = %v, want %v", ok, tt.valid)
+			}
+			if !ok {
+				return
+			}
+			if rtt < tt.rtt || slow {
+				t.Fatalf("round trip %v (slow %v), sent %v ago", rtt, slow, tt.rtt)
+			}
+			if d := time.Duration(offset)*time.Millisecond - serverAhead; d < -5*time.Millisecond || d > 5*time.Millisecond {
+				t.Fatalf("offset %dms, want about %v", offset, serverAhead)
+			}
+		})
+	}
+
+	// The fastest exchange's offset wins
+	l := &latencyMeter{samples: []offsetSample{
+		{rtt: 80 * time.Millisecond, offset: 40 * time.Millisecond},
+		{rtt: 4 * time.Millisecond, offset: 2 * time.Millisecond},
+		{rtt: 30 * time.Millisecond, offset: -10 * time.Millisecond},
+	}}
+	if got := l.offset(); got != 2 {
+		t.Fatalf("offset %dms, want the fastest sample's 2ms", got)
+	}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/0xcafed00d/joystick"
+
+	"lunabotics/pkg/protocol"
+)
+
+// PadMapping says which joystick axes and buttons feed each ControllerState
+// field for one model of gamepad. Keys are the JSON field names used on the
+// wire ("LjoyX", "LT", "N", "SELECT", ...); values are indices into the
+// joystick library's AxisData and Buttons.
+type PadMapping struct {
+	// Match is a case-insensitive substring of js.Name(). An empty Match
+	// accepts any pad and is used as the fallback.
+	Match   string                 `json:"match"`
+	Axes    map[string]AxisMapping `json:"axes"`
+	Buttons map[string]int         `json:"buttons"`
+}
+
+// AxisMapping locates one axis. Min and Max are the raw readings that map
+// to 0 and 65535 (Min > Max flips the axis) and Center the reading at rest;
+// left at zero, the raw -32768..32767 range is used as is.
+type AxisMapping struct {
+	Index  int `json:"index"`
+	Min    int `json:"min,omitempty"`
+	Max    int `json:"max,omitempty"`
+	Center int `json:"center,omitempty"`
+	AxisTuning
+}
+
+// AxisTuning adjusts the feel of an axis after calibration. Deadzone is the
+// fraction of travel (0-1) around rest that reads as rest, with the
+// remaining travel stretched to keep full range; Sensitivity scales the
+// deflection (0 means 1) and Invert flips it.
+type AxisTuning struct {
+	Deadzone    float64 `json:"deadzone,omitempty"`
+	Sensitivity float64 `json:"sensitivity,omitempty"`
+	Invert      bool    `json:"invert,omitempty"`
+}
+
+// tune applies deadzone, sensitivity and inversion to a normalized value.
+// Sticks are treated as -1..1 around 0x8000 and triggers as 0..1.
+func (t AxisTuning) tune(v uint16, trigger bool) uint16 {
+	if t.Deadzone == 0 && t.Sensitivity == 0 && !t.Invert {
+		return v
+	}
+
+	x := (float64(v) - 0x8000) / 0x8000
+	if trigger {
+		x = float64(v) / 0xFFFF
+	}
+	sign := 1.0
+	if x < 0 {
+		sign, x = -1, -x
+	}
+	if x <= t.Deadzone {
+		x = 0
+	} else if t.Deadzone > 0 && t.Deadzone < 1 {
+		x = (x - t.Deadzone) / (1 - t.Deadzone)
+	}
+	if t.Sensitivity != 0 {
+		x *= t.Sensitivity
+	}
+	x = math.Min(1, x) * sign
+
+	if trigger {
+		if t.Invert {
+			x = 1 - x
+		}
+		return uint16(math.Round(math.Max(0, x) * 0xFFFF))
+	}
+	if t.Invert {
+		x = -x
+	}
+	return uint16(math.Max(0, math.Min(0xFFFF, math.Round(0x8000+x*0x8000))))
+}
+
+// normalize maps a raw reading to 0-65535 using the calibrated range. When
+// Center lies inside the range each half is scaled separately so the stick
+// rests exactly at 0x8000.
+func (a AxisMapping) normalize(raw int) uint16 {
+	if a.Min == a.Max {
+		return uint16(int32(raw) + 32768)
+	}
+
+	var out float64
+	lo, hi := min(a.Min, a.Max), max(a.Min, a.Max)
+	if a.Center > lo && a.Center < hi {
+		if (raw < a.Center) == (a.Min < a.Max) {
+			out = float64(raw-a.Min) / float64(a.Center-a.Min) * 0x8000
+		} else {
+			out = 0x8000 + float64(raw-a.Center)/float64(a.Max-a.Center)*0x7FFF
+		}
+	} else {
+		out = float64(raw-a.Min) / float64(a.Max-a.Min) * 0xFFFF
+	}
+	return uint16(math.Max(0, math.Min(0xFFFF, math.Round(out))))
+}
+
+// axisFields are the ControllerState axes a PadMapping can fill
+var axisFields = []string{"LjoyX", "LjoyY", "RjoyX", "RjoyY", "LT", "RT"}
+
+// buttonFields are the ControllerState buttons a PadMapping can fill
+var buttonFields = []string{"N", "E", "S", "W", "LB", "RB", "LS", "RS", "SELECT", "START"}
+
+// The D-pad fills dX and dY with -1, 0 or 1 (left/up is -1, like the
+// sticks). Pads report it either as two hat axes, mapped as "dX" and "dY"
+// under axes, or as four buttons.
+var (
+	hatAxes    = []string{"dX", "dY"}
+	hatButtons = []string{"dUp", "dDown", "dLeft", "dRight"}
+)
+
+// DefaultPadMapping is the layout readController has always assumed
+func DefaultPadMapping() *PadMapping {
+	return &PadMapping{
+		Axes: map[string]AxisMapping{
+			"LjoyX": {Index: 0}, "LjoyY": {Index: 1},
+			"RjoyX": {Index: 2}, "RjoyY": {Index: 3},
+			"LT": {Index: 4}, "RT": {Index: 5},
+			"dX": {Index: 6}, "dY": {Index: 7},
+		},
+		Buttons: map[string]int{
+			"S": 0, "E": 1, "W": 2, "N": 3, "LB": 4, "RB": 5,
+			"SELECT": 6, "START": 7, "LS": 8, "RS": 9,
+		},
+	}
+}
+
+// LoadPadMappings reads a JSON list of PadMappings, checking every field
+// name so a typo doesn't silently leave a control unmapped
+func LoadPadMappings(filename string) ([]*PadMapping, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []*PadMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for i, m := range mappings {
+		for field := range m.Axes {
+			if !contains(axisFields, field) && !contains(hatAxes, field) {
+				return nil, fmt.Errorf("%s: mapping %d (%q): unknown axis %q (valid: %s, %s)",
+					filename, i, m.Match, field, strings.Join(axisFields, ", "), strings.Join(hatAxes, ", "))
+			}
+		}
+		for field := range m.Buttons {
+			if !contains(buttonFields, field) && !contains(hatButtons, field) {
+				return nil, fmt.Errorf("%s: mapping %d (%q): unknown button %q (valid: %s, %s)",
+					filename, i, m.Match, field, strings.Join(buttonFields, ", "), strings.Join(hatButtons, ", "))
+			}
+		}
+	}
+	return mappings, nil
+}
+
+// SelectPadMapping returns the first mapping whose Match is in name,
+// falling back to DefaultPadMapping
+func SelectPadMapping(mappings []*PadMapping, name string) *PadMapping {
+	name = strings.ToLower(name)
+	for _, m := range mappings {
+		if strings.Contains(name, strings.ToLower(m.Match)) {
+			return m
+		}
+	}
+	return DefaultPadMapping()
+}
+
+// WithTuning returns a copy of m with t filling in the deadzone and
+// sensitivity of every stick axis that doesn't set its own. invertY flips
+// both Y axes.
+func (m *PadMapping) WithTuning(t AxisTuning, invertY bool) *PadMapping {
+	tuned := *m
+	tuned.Axes = make(map[string]AxisMapping, len(m.Axes))
+	for field, a := range m.Axes {
+		if field != "LT" && field != "RT" {
+			if a.Deadzone == 0 {
+				a.Deadzone = t.Deadzone
+			}
+			if a.Sensitivity == 0 {
+				a.Sensitivity = t.Sensitivity
+			}
+		}
+		if invertY && (field == "LjoyY" || field == "RjoyY") {
+			a.Invert = !a.Invert
+		}
+		tuned.Axes[field] = a
+	}
+	return &tuned
+}
+
+// Apply copies a joystick reading into state. Axes the pad doesn't have
+// rest at center (triggers at zero) and missing buttons read as released.
+func (m *PadMapping) Apply(js joystick.State, state *protocol.ControllerState) {
+	for _, field := range axisFields {
+		v := uint16(0x8000)
+		if field == "LT" || field == "RT" {
+			v = 0
+		}
+		if a, ok := m.Axes[field]; ok && a.Index >= 0 && a.Index < len(js.AxisData) {
+			v = a.tune(a.normalize(js.AxisData[a.Index]), field == "LT" || field == "RT")
+		}
+		*state.Axis16(field) = v
+	}
+	state.LeftX = uint8(state.LeftX16 >> 8)
+	state.LeftY = uint8(state.LeftY16 >> 8)
+	state.RightX = uint8(state.RightX16 >> 8)
+	state.RightY = uint8(state.RightY16 >> 8)
+	state.LeftTrigger = uint8(state.LeftTrigger16 >> 8)
+	state.RightTrigger = uint8(state.RightTrigger16 >> 8)
+
+	for _, field := range buttonFields {
+		*state.Button(field) = uint8(m.pressed(js, field))
+	}
+
+	state.DPadX = m.hat(js, "dX", "dLeft", "dRight")
+	state.DPadY = m.hat(js, "dY", "dUp", "dDown")
+}
+
+// Fields lists the ControllerState fields the mapping fills from a pad with
+// the given number of axes and buttons; the rest always read as neutral
+func (m *PadMapping) Fields(axes, buttons int) []string {
+	hasAxis := func(field string) bool {
+		a, ok := m.Axes[field]
+		return ok && a.Index >= 0 && a.Index < axes
+	}
+	hasButton := func(field string) bool {
+		bit, ok := m.Buttons[field]
+		return ok && bit >= 0 && bit < min(buttons, 32)
+	}
+	var fields []string
+	for _, field := range axisFields {
+		if hasAxis(field) {
+			fields = append(fields, field)
+		}
+	}
+	for _, field := range buttonFields {
+		if hasButton(field) {
+			fields = append(fields, field)
+		}
+	}
+	if hasAxis("dX") || hasButton("dLeft") || hasButton("dRight") {
+		fields = append(fields, "dX")
+	}
+	if hasAxis("dY") || hasButton("dUp") || hasButton("dDown") {
+		fields = append(fields, "dY")
+	}
+	return fields
+}
+
+// pressed reads a mapped button as 0 or 1
+func (m *PadMapping) pressed(js joystick.State, field string) int8 {
+	if bit, ok := m.Buttons[field]; ok && bit >= 0 && bit < 32 {
+		return int8((js.Buttons >> bit) & 1)
+	}
+	return 0
+}
+
+// hat reads one D-pad direction as -1, 0 or 1, from its hat axis if mapped
+// and otherwise from its pair of buttons
+func (m *PadMapping) hat(js joystick.State, axis, low, high string) int8 {
+	if a, ok := m.Axes[axis]; ok && a.Index >= 0 && a.Index < len(js.AxisData) {
+		switch v := a.normalize(js.AxisData[a.Index]); {
+		case v < 0x4000:
+			return -1
+		case v > 0xC000:
+			return 1
+		}
+		return 0
+	}
+	return m.pressed(js, high) - m.pressed(js, low)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
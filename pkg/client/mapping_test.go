@@ -0,0 +1,67 @@
+package client
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	raw := AxisMapping{}
+	calibrated := AxisMapping{Min: 100, Max: 900, Center: 500}
+	flipped := AxisMapping{Min: 900, Max: 100, Center: 500}
+	offCenter := AxisMapping{Min: 100, Max: 900, Center: 300}
+	trigger := AxisMapping{Min: 0, Max: 1000}
+	tests := []struct {
+		name    string
+		mapping AxisMapping
+		raw     int
+		want    uint16
+	}{
+		{"raw low", raw, -32768, 0},
+		{"raw rest", raw, 0, 0x8000},
+		{"raw high", raw, 32767, 0xFFFF},
+		{"calibrated low", calibrated, 100, 0},
+		{"calibrated rest", calibrated, 500, 0x8000},
+		{"calibrated high", calibrated, 900, 0xFFFF},
+		{"past the calibration", calibrated, 1000, 0xFFFF},
+		{"flipped low", flipped, 900, 0},
+		{"flipped high", flipped, 100, 0xFFFF},
+		{"rest off center", offCenter, 300, 0x8000},
+		{"halfway down, off center", offCenter, 200, 0x4000},
+		{"no center", trigger, 500, 0x8000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mapping.normalize(tt.raw); got != tt.want {
+				t.Fatalf("normalize(%d) = %#04x, want %#04x", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAxisTuning(t *testing.T) {
+	tests := []struct {
+		name    string
+		tuning  AxisTuning
+		trigger bool
+		v, want uint16
+	}{
+		{"untuned", AxisTuning{}, false, 0x1234, 0x1234},
+		{"inside the deadzone", AxisTuning{Deadzone: 0.1}, false, 0x8800, 0x8000},
+		{"below, inside the deadzone", AxisTuning{Deadzone: 0.1}, false, 0x7800, 0x8000},
+		{"deadzone keeps full travel", AxisTuning{Deadzone: 0.1}, false, 0, 0},
+		{"past the deadzone", AxisTuning{Deadzone: 0.5}, false, 0xC000, 0x8000},
+		{"three quarters, past the deadzone", AxisTuning{Deadzone: 0.5}, false, 0xE000, 0xC000},
+		{"half sensitivity", AxisTuning{Sensitivity: 0.5}, false, 0, 0x4000},
+		{"sensitivity clamps", AxisTuning{Sensitivity: 2}, false, 0xC000, 0xFFFF},
+		{"inverted stick", AxisTuning{Invert: true}, false, 0, 0xFFFF},
+		{"inverted rest", AxisTuning{Invert: true}, false, 0x8000, 0x8000},
+		{"trigger deadzone", AxisTuning{Deadzone: 0.1}, true, 0x1000, 0},
+		{"trigger full", AxisTuning{Deadzone: 0.1}, true, 0xFFFF, 0xFFFF},
+		{"inverted trigger", AxisTuning{Invert: true}, true, 0, 0xFFFF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tuning.tune(tt.v, tt.trigger); got != tt.want {
+				t.Fatalf("tune(%#04x) = %#04x, want %#04x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/0xcafed00d/joystick"
+)
+
+// Pads are opened through one of three backends: SDL2 with -sdl, XInput
+// with -xinput (the default on Windows), and otherwise the joystick
+// library, which reads /dev/input/jsN on Linux, winmm on Windows and IOKit
+// on macOS. SDL and XInput pads arrive already in a fixed layout; the
+// joystick library's axis and button numbering depends on the pad and OS,
+// hence -mapping and -calibrate.
+
+// PAD_SLOTS is how many joystick indices findController and -list try
+const PAD_SLOTS = 16
+
+// padSelection picks which pad findController opens: the one at index, or
+// with name in its name (case-insensitive); -1 and "" accept any
+type padSelection struct {
+	index int
+	name  string
+}
+
+// padChoice is -controller and -controller-name
+var padChoice = padSelection{index: -1}
+
+// matches reports whether pad index is the one asked for. Without an
+// index, pads with no buttons are passed over.
+func (c *padSelection) matches(js joystick.Joystick, index int) bool {
+	if c.index >= 0 {
+		return index == c.index && c.matchesName(js)
+	}
+	return js.ButtonCount() > 0 && c.matchesName(js)
+}
+
+func (c *padSelection) matchesName(js joystick.Joystick) bool {
+	return strings.Contains(strings.ToLower(js.Name()), strings.ToLower(c.name))
+}
+
+// openPad opens joystick index with the selected backend
+func openPad(index int) (joystick.Joystick, error) {
+	switch {
+	case sdlOpts.enabled:
+		return openSDLPad(index, sdlOpts.dbFile)
+	case xinputOpts.enabled:
+		return openXInputPad(index)
+	}
+	return openJoystick(index)
+}
+
+// padMapping picks the mapping for a pad opened with openPad: the fixed
+// SDL layout with -sdl, otherwise the pad's entry in mappings, falling back
+// to the XInput layout for XInput pads (so their recordings replay
+// anywhere) and the original Xbox layout for the rest
+func padMapping(mappings []*PadMapping, name string) *PadMapping {
+	if sdlOpts.enabled {
+		return SDLPadMapping()
+	}
+	m := SelectPadMapping(mappings, name)
+	if m.Match == "" && strings.HasPrefix(name, XINPUT_NAME) {
+		return XInputPadMapping()
+	}
+	return m
+}
+
+// listPads writes a line per attached pad: its index, name, axis and button
+// counts and the mapping padMapping would give it
+func listPads(w io.Writer, mappings []*PadMapping) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	found := false
+	for i := 0; i < PAD_SLOTS; i++ {
+		js, err := openPad(i)
+		if err != nil {
+			continue
+		}
+		if !found {
+			fmt.Fprintln(tw, "INDEX\tNAME\tAXES\tBUTTONS\tMAPPING")
+			found = true
+		}
+		mapping := padMapping(mappings, js.Name()).Match
+		if mapping == "" {
+			mapping = "default"
+		}
+		note := ""
+		if js.ButtonCount() == 0 {
+			note = " (no buttons, only used with -controller)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s%s\n", i, js.Name(), js.AxisCount(), js.ButtonCount(), mapping, note)
+		js.Close()
+	}
+	tw.Flush()
+	if !found {
+		fmt.Fprintln(w, "No controllers found")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !darwin || cgo
+
+package client
+
+import (
+	"github.com/0xcafed00d/joystick"
+)
+
+// openJoystick opens a pad through the joystick library
+func openJoystick(index int) (joystick.Joystick, error) {
+	return joystick.Open(index)
+}
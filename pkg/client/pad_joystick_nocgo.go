@@ -0,0 +1,16 @@
+//go:build darwin && !cgo
+
+package client
+
+import (
+	"errors"
+
+	"github.com/0xcafed00d/joystick"
+)
+
+// openJoystick stands in for the joystick library, whose macOS backend
+// calls IOKit through cgo. A client cross-compiled without cgo can still
+// use -keyboard, -replay and the command-line tools.
+func openJoystick(index int) (joystick.Joystick, error) {
+	return nil, errors.New("this client was built without cgo, which macOS gamepads need; build it on the Mac or use an SDL build with -sdl")
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"lunabotics/pkg/protocol"
+)
+
+// dialQUIC connects to a server's -quic address, trusting caFile's
+// certificates (the system roots when empty). It is set by quic_client.go,
+// which needs golang.org/x/net and so is only built in on request (see the
+// README); nil means this client has no QUIC.
+var dialQUIC func(addr, caFile string) (net.Conn, error)
+
+// pathChanged is set when a QUIC connection was closed because the route
+// to the server moved to another local address, so the client redials at
+// once instead of after its usual pause
+var pathChanged atomic.Bool
+
+// quicOpts are the -quic flags
+var quicOpts struct {
+	enabled bool
+	caFile  string
+}
+
+// dialServer connects to the server over TCP or a Unix socket, or QUIC
+// with -quic
+func dialServer(addr string) (net.Conn, error) {
+	if !quicOpts.enabled {
+		network, address := protocol.SplitNetwork(addr)
+		return net.Dial(network, address)
+	}
+	if dialQUIC == nil {
+		return nil, errors.New("this client was built without QUIC support")
+	}
+	return dialQUIC(addr, quicOpts.caFile)
+}
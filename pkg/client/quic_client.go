@@ -0,0 +1,113 @@
+//go:build quic
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/quic"
+
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	QUIC_DIAL_TIMEOUT = 5 * time.Second        // bounds the handshake
+	QUIC_PATH_POLL    = 500 * time.Millisecond // how often the route to the server is checked
+)
+
+func init() {
+	dialQUIC = dialQUICServer
+}
+
+// dialQUICServer connects to addr and opens the stream the session runs
+// on. The server sees the stream with the first frame written to it.
+func dialQUICServer(addr, caFile string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+	}
+
+	endpoint, err := quic.Listen("udp", ":0", nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), QUIC_DIAL_TIMEOUT)
+	defer cancel()
+	conn, err := endpoint.Dial(ctx, "udp", addr, protocol.QUICConfig(tlsConfig))
+	if err != nil {
+		endpoint.Close(ctx)
+		return nil, err
+	}
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		conn.Abort(nil)
+		endpoint.Close(ctx)
+		return nil, err
+	}
+	qc := protocol.NewQUICConn(conn, stream, endpoint)
+	if raddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		go watchPath(qc, raddr)
+	}
+	return qc, nil
+}
+
+// watchPath closes conn as soon as the local address the server is
+// reached from changes, as it does when the laptop roams onto another
+// network. The QUIC library drops packets from an address a connection
+// didn't start on, so the old connection would only idle out; closing it
+// makes the client dial again at once from the new address and resume its
+// seat with the hello's resume token.
+func watchPath(conn *protocol.QUICConn, server *net.UDPAddr) {
+	ctx := conn.Context()
+	from, _ := localAddrFor(server)
+	ticker := time.NewTicker(QUIC_PATH_POLL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now, err := localAddrFor(server)
+		if err != nil {
+			continue // no route for now; the old address may come back
+		}
+		if from == nil {
+			from = now
+		} else if !now.Equal(from) {
+			log.Printf("Local address changed from %v to %v, reconnecting", from, now)
+			pathChanged.Store(true)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// localAddrFor returns the local address packets to server leave from.
+// Connecting a UDP socket picks the route without sending anything.
+func localAddrFor(server *net.UDPAddr) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	MIN_RATE_HZ      = 5 // adaptive backoff never goes below this
+	RATE_RECOVER_HZ  = 1 // added per uncongested status frame
+	RATE_BACKOFF_DIV = 2 // rate is divided by this on congestion
+)
+
+// rateControl picks the client's send rate: the -rate flag, capped by the
+// server's advertised maximum, halved whenever the server reports that its
+// serial writes are falling behind and crept back up once they recover
+type rateControl struct {
+	mu      sync.Mutex
+	want    float64 // requested with -rate
+	max     float64 // advertised by the server, 0 if none
+	current float64
+}
+
+func newRateControl(want float64) *rateControl {
+	return &rateControl{want: want, current: want}
+}
+
+// period returns the current interval between sends
+func (r *rateControl) period() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Duration(float64(time.Second) / r.current)
+}
+
+// update adjusts the rate from a server status frame
+func (r *rateControl) update(status *protocol.StatusFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.max = float64(status.MaxRate)
+	limit := r.want
+	if r.max > 0 && r.max < limit {
+		// Never so slow the server times the driver out
+		limit = max(r.max, protocol.MIN_SEND_RATE_HZ)
+	}
+
+	old := r.current
+	if status.Congested {
+		r.current = max(r.current/RATE_BACKOFF_DIV, min(MIN_RATE_HZ, limit))
+	} else {
+		r.current = min(r.current+RATE_RECOVER_HZ, limit)
+	}
+	r.current = min(r.current, limit)
+	if r.current != old && (status.Congested || r.current == limit) {
+		log.Printf("Send rate %.0f Hz", r.current)
+	}
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"testing"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestRateControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   float64 // -rate
+		status []protocol.StatusFrame
+		hz     float64 // after the last status
+	}{
+		{"no status", 50, nil, 50},
+		{"server cap", 50, []protocol.StatusFrame{{MaxRate: 30}}, 30},
+		{"cap above -rate", 50, []protocol.StatusFrame{{MaxRate: 100}}, 50},
+		{"cap below the driver timeout", 50, []protocol.StatusFrame{{MaxRate: 1}}, protocol.MIN_SEND_RATE_HZ},
+		{"backoff", 50, []protocol.StatusFrame{{Congested: true}}, 25},
+		{"backoff under a cap", 50, []protocol.StatusFrame{{MaxRate: 30}, {MaxRate: 30, Congested: true}}, 15},
+		{"floor", 50, []protocol.StatusFrame{{Congested: true}, {Congested: true}, {Congested: true}, {Congested: true}}, MIN_RATE_HZ},
+		{"floor above -rate", 3, []protocol.StatusFrame{{Congested: true}}, 3},
+		{"recovery", 50, []protocol.StatusFrame{{Congested: true}, {}, {}}, 25 + 2*RATE_RECOVER_HZ},
+		{"recovered", 20, []protocol.StatusFrame{{Congested: true}, {}, {}, {}, {}, {}, {}, {}, {}, {}, {}, {}, {}}, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRateControl(tt.want)
+			for _, status := range tt.status {
+				r.update(&status)
+			}
+			if r.current != tt.hz {
+				t.Fatalf("%g Hz, want %g", r.current, tt.hz)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/0xcafed00d/joystick"
+)
+
+// Input recordings are JSON lines: a header naming the pad, then one raw
+// joystick sample per change, stamped with milliseconds since recording
+// began. Samples are taken before any mapping, so replaying them tests the
+// current mapping and tuning against real driver input.
+type inputHeader struct {
+	Pad     string `json:"pad"`
+	Axes    int    `json:"axis_count"`
+	Buttons int    `json:"button_count"`
+}
+
+type inputSample struct {
+	Time    int64  `json:"t"`
+	Axes    []int  `json:"axes"`
+	Buttons uint32 `json:"buttons"`
+}
+
+// inputRecorder appends samples to a recording. It outlives reconnects, so
+// one file covers the whole run.
+type inputRecorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	start  time.Time
+	header bool
+	last   joystick.State
+}
+
+func newInputRecorder(filename string) (*inputRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &inputRecorder{file: file, enc: json.NewEncoder(file), start: time.Now()}, nil
+}
+
+// wrap returns js with every Read recorded
+func (r *inputRecorder) wrap(js joystick.Joystick) joystick.Joystick {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.header {
+		r.header = true
+		r.write(&inputHeader{Pad: js.Name(), Axes: js.AxisCount(), Buttons: js.ButtonCount()})
+	}
+	return &recordingJoystick{Joystick: js, rec: r}
+}
+
+// sample records s if it differs from the last sample
+func (r *inputRecorder) sample(s joystick.State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.Buttons == r.last.Buttons && slices.Equal(s.AxisData, r.last.AxisData) {
+		return
+	}
+	r.last = joystick.State{AxisData: slices.Clone(s.AxisData), Buttons: s.Buttons}
+	r.write(&inputSample{Time: time.Since(r.start).Milliseconds(), Axes: s.AxisData, Buttons: s.Buttons})
+}
+
+// write encodes one line. Callers hold r.mu.
+func (r *inputRecorder) write(v any) {
+	if err := r.enc.Encode(v); err != nil {
+		log.Printf("Recording write error: %v", err)
+	}
+}
+
+func (r *inputRecorder) Close() error {
+	return r.file.Close()
+}
+
+// recordingJoystick passes reads through to a real pad, recording them
+type recordingJoystick struct {
+	joystick.Joystick
+	rec *inputRecorder
+}
+
+func (j *recordingJoystick) Read() (joystick.State, error) {
+	s, err := j.Joystick.Read()
+	if err == nil {
+		j.rec.sample(s)
+	}
+	return s, err
+}
+
+// replayJoystick stands in for a pad, returning recorded samples at their
+// original times from the first Read on. Once the last sample has played,
+// Read returns io.EOF.
+type replayJoystick struct {
+	header  inputHeader
+	samples []inputSample
+	start   time.Time
+	next    int
+}
+
+// loadInputRecording reads a recording made with -record
+func loadInputRecording(filename string) (*replayJoystick, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	js := &replayJoystick{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var err error
+		if line == 1 {
+			err = json.Unmarshal(scanner.Bytes(), &js.header)
+		} else {
+			var s inputSample
+			err = json.Unmarshal(scanner.Bytes(), &s)
+			js.samples = append(js.samples, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(js.samples) == 0 {
+		return nil, fmt.Errorf("%s: no samples", filename)
+	}
+	return js, nil
+}
+
+func (j *replayJoystick) AxisCount() int   { return j.header.Axes }
+func (j *replayJoystick) ButtonCount() int { return j.header.Buttons }
+func (j *replayJoystick) Name() string     { return j.header.Pad }
+func (j *replayJoystick) Close()           {}
+
+func (j *replayJoystick) Read() (joystick.State, error) {
+	if j.start.IsZero() {
+		j.start = time.Now()
+	}
+	elapsed := time.Since(j.start).Milliseconds()
+	if j.next >= len(j.samples) {
+		return joystick.State{}, io.EOF
+	}
+	for j.next < len(j.samples)-1 && j.samples[j.next+1].Time <= elapsed {
+		j.next++
+	}
+	s := j.samples[j.next]
+	if j.next == len(j.samples)-1 && s.Time <= elapsed {
+		j.next++ // played the last sample
+	}
+	return joystick.State{AxisData: s.Axes, Buttons: s.Buttons}, nil
+}
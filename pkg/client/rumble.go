@@ -0,0 +1,78 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// rumbler plays force feedback on a gamepad
+type rumbler interface {
+	// rumble runs the strong and weak motors, 0 to 1, for d
+	rumble(strong, weak float64, d time.Duration) error
+	Close() error
+}
+
+// openRumble opens force feedback on joystick index, the N of
+// /dev/input/jsN on Linux or the XInput slot on Windows. It is set in
+// init() by rumble_linux.go and xinput_windows.go, and nil on other OSes,
+// where the client doesn't ask the server for rumbles.
+var openRumble func(index int) (rumbler, error)
+
+// padRumble is the force feedback of the pad being read, if it has any.
+// The server's RumbleFrames play on it (see RumbleFrame).
+var padRumble rumbleTarget
+
+type rumbleTarget struct {
+	mu sync.Mutex
+	r  rumbler // nil without a pad that rumbles
+}
+
+// open starts using pad index's force feedback, logging why not when it
+// has none
+func (t *rumbleTarget) open(index int) {
+	if openRumble == nil {
+		return
+	}
+	r, err := openRumble(index)
+	if err != nil {
+		log.Printf("Controller can't rumble: %v", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.r != nil {
+		t.r.Close()
+	}
+	t.r = r
+}
+
+// close stops using the pad's force feedback
+func (t *rumbleTarget) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.r != nil {
+		t.r.Close()
+		t.r = nil
+	}
+}
+
+// magnitude scales 0-1 to a motor's 0-0xFFFF
+func magnitude(v float64) uint16 {
+	return uint16(max(0, min(v, 1)) * 0xFFFF)
+}
+
+// play rumbles the pad as the server asked
+func (t *rumbleTarget) play(f *protocol.RumbleFrame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.r == nil {
+		return
+	}
+	d := time.Duration(f.DurationMs) * time.Millisecond
+	if err := t.r.rumble(f.Strong, f.Weak, d); err != nil {
+		log.Printf("Rumble failed: %v", err)
+	}
+}
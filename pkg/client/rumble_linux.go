@@ -0,0 +1,95 @@
+//go:build linux
+
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Linux force feedback goes through the pad's evdev node, the eventN next
+// to its jsN in sysfs, which the joystick library doesn't open. One
+// FF_RUMBLE effect is uploaded with EVIOCSFF, updated in place for each
+// rumble, and played by writing an EV_FF event.
+const (
+	EV_FF     = 0x15
+	FF_RUMBLE = 0x50
+)
+
+var (
+	// struct ff_effect: a 16-byte header, then a union as large as
+	// ff_periodic_effect, which holds a pointer
+	ffEffectSize = 16 + 24 + int(unsafe.Sizeof(uintptr(0)))
+	eviocsff     = uintptr(1<<30 | ffEffectSize<<16 | 'E'<<8 | 0x80) // _IOW('E', 0x80, struct ff_effect)
+	eviocrmff    = uintptr(1<<30 | 4<<16 | 'E'<<8 | 0x81)            // _IOW('E', 0x81, int)
+)
+
+func init() {
+	openRumble = openEvdevRumble
+}
+
+// evdevRumble is a pad's evdev node and its uploaded effect
+type evdevRumble struct {
+	file *os.File
+	id   int16 // effect id, -1 until uploaded
+}
+
+// openEvdevRumble opens the evdev node of /dev/input/js<index>
+func openEvdevRumble(index int) (rumbler, error) {
+	nodes, _ := filepath.Glob(fmt.Sprintf("/sys/class/input/js%d/device/event*", index))
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no event device for js%d", index)
+	}
+	file, err := os.OpenFile(filepath.Join("/dev/input", filepath.Base(nodes[0])), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &evdevRumble{file: file, id: -1}
+	if err := r.upload(0, 0, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("no force feedback: %w", err)
+	}
+	return r, nil
+}
+
+// upload sets the effect's magnitudes and length, creating it the first
+// time
+func (r *evdevRumble) upload(strong, weak float64, d time.Duration) error {
+	effect := make([]byte, ffEffectSize)
+	binary.NativeEndian.PutUint16(effect[0:], FF_RUMBLE)
+	binary.NativeEndian.PutUint16(effect[2:], uint16(r.id))
+	binary.NativeEndian.PutUint16(effect[10:], uint16(min(d.Milliseconds(), 0xFFFF))) // replay.length
+	binary.NativeEndian.PutUint16(effect[16:], magnitude(strong))
+	binary.NativeEndian.PutUint16(effect[18:], magnitude(weak))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, r.file.Fd(), eviocsff, uintptr(unsafe.Pointer(&effect[0])))
+	if errno != 0 {
+		return errno
+	}
+	r.id = int16(binary.NativeEndian.Uint16(effect[2:]))
+	return nil
+}
+
+func (r *evdevRumble) rumble(strong, weak float64, d time.Duration) error {
+	if err := r.upload(strong, weak, d); err != nil {
+		return err
+	}
+	// struct input_event: a timeval, then type, code and value
+	event := make([]byte, unsafe.Sizeof(unix.Timeval{})+8)
+	tv := len(event) - 8
+	binary.NativeEndian.PutUint16(event[tv:], EV_FF)
+	binary.NativeEndian.PutUint16(event[tv+2:], uint16(r.id))
+	binary.NativeEndian.PutUint32(event[tv+4:], 1) // play once
+	_, err := r.file.Write(event)
+	return err
+}
+
+func (r *evdevRumble) Close() error {
+	unix.Syscall(unix.SYS_IOCTL, r.file.Fd(), eviocrmff, uintptr(r.id))
+	return r.file.Close()
+}
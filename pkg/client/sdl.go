@@ -0,0 +1,45 @@
+package client
+
+import (
+	"github.com/0xcafed00d/joystick"
+)
+
+// openSDLPad opens game controller index through SDL2, loading the extra
+// mappings in dbFile (e.g. the community gamecontrollerdb.txt) first if
+// set. It is set by sdl_pad.go, which needs cgo, libSDL2 and
+// github.com/veandco/go-sdl2 and so is only built in with the sdl tag (see
+// the README); nil means this client has no SDL backend.
+var openSDLPad func(index int, dbFile string) (joystick.Joystick, error)
+
+// sdlOpts are the -sdl flags
+var sdlOpts struct {
+	enabled bool
+	dbFile  string
+}
+
+// An SDL pad has already been mapped by SDL's controller database, so it
+// always reports these axes and buttons in this order, named as in
+// gamecontrollerdb.txt and numbered like SDL's own enums
+var (
+	sdlAxes    = []string{"leftx", "lefty", "rightx", "righty", "lefttrigger", "righttrigger"}
+	sdlButtons = []string{"a", "b", "x", "y", "back", "guide", "start", "leftstick", "rightstick",
+		"leftshoulder", "rightshoulder", "dpup", "dpdown", "dpleft", "dpright"}
+)
+
+// SDLPadMapping maps the fixed SDL layout, with the face buttons by
+// position (a is south) as on an Xbox pad. SDL triggers read 0-32767.
+func SDLPadMapping() *PadMapping {
+	return &PadMapping{
+		Match: "SDL",
+		Axes: map[string]AxisMapping{
+			"LjoyX": {Index: 0}, "LjoyY": {Index: 1},
+			"RjoyX": {Index: 2}, "RjoyY": {Index: 3},
+			"LT": {Index: 4, Max: 32767}, "RT": {Index: 5, Max: 32767},
+		},
+		Buttons: map[string]int{
+			"S": 0, "E": 1, "W": 2, "N": 3, "SELECT": 4, "START": 6,
+			"LS": 7, "RS": 8, "LB": 9, "RB": 10,
+			"dUp": 11, "dDown": 12, "dLeft": 13, "dRight": 14,
+		},
+	}
+}
@@ -0,0 +1,87 @@
+//go:build sdl
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/0xcafed00d/joystick"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+func init() {
+	openSDLPad = openSDLController
+}
+
+// sdlInit starts SDL's game controller subsystem once, loading the -sdl-db
+// mappings on top of SDL's built-in ones
+var sdlInit struct {
+	once sync.Once
+	err  error
+}
+
+func startSDL(dbFile string) error {
+	sdlInit.once.Do(func() {
+		// No window: read pads whether or not anything has focus
+		sdl.SetHint(sdl.HINT_JOYSTICK_ALLOW_BACKGROUND_EVENTS, "1")
+		if err := sdl.Init(sdl.INIT_GAMECONTROLLER); err != nil {
+			sdlInit.err = fmt.Errorf("SDL init: %w", err)
+			return
+		}
+		if dbFile != "" {
+			if _, err := sdl.GameControllerAddMappingsFromFile(dbFile); err != nil {
+				sdlInit.err = fmt.Errorf("%s: %w", dbFile, err)
+			}
+		}
+	})
+	return sdlInit.err
+}
+
+// openSDLController opens SDL device index as a game controller
+func openSDLController(index int, dbFile string) (joystick.Joystick, error) {
+	if err := startSDL(dbFile); err != nil {
+		return nil, err
+	}
+	sdl.GameControllerUpdate()
+	if index >= sdl.NumJoysticks() {
+		return nil, fmt.Errorf("no SDL joystick %d", index)
+	}
+	if !sdl.IsGameController(index) {
+		return nil, fmt.Errorf("SDL joystick %d (%s, GUID %s) isn't in the controller database",
+			index, sdl.JoystickNameForIndex(index), sdl.JoystickGetGUIDString(sdl.JoystickGetDeviceGUID(index)))
+	}
+	c := sdl.GameControllerOpen(index)
+	if c == nil {
+		return nil, fmt.Errorf("SDL joystick %d: %w", index, sdl.GetError())
+	}
+	return &sdlPad{c: c}, nil
+}
+
+// sdlPad reads a game controller in the order of sdlAxes and sdlButtons
+type sdlPad struct {
+	c *sdl.GameController
+}
+
+func (p *sdlPad) AxisCount() int   { return len(sdlAxes) }
+func (p *sdlPad) ButtonCount() int { return len(sdlButtons) }
+func (p *sdlPad) Name() string     { return p.c.Name() }
+func (p *sdlPad) Close()           { p.c.Close() }
+
+func (p *sdlPad) Read() (joystick.State, error) {
+	sdl.GameControllerUpdate()
+	if !p.c.Attached() {
+		return joystick.State{}, errors.New("controller disconnected")
+	}
+	state := joystick.State{AxisData: make([]int, len(sdlAxes))}
+	for i := range sdlAxes {
+		state.AxisData[i] = int(p.c.Axis(sdl.GameControllerAxis(i)))
+	}
+	for i := range sdlButtons {
+		if p.c.Button(sdl.GameControllerButton(i)) != 0 {
+			state.Buttons |= 1 << i
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/0xcafed00d/joystick"
+)
+
+// A split config lets two people share the robot: the driver's pad and the
+// operator's pad are read together and merged into one ControllerState per
+// tick, each field taken from the pad that owns it. The merge happens below
+// the mapping layer: the two pads read as one joystick whose axes and
+// buttons are the driver's followed by the operator's, and each pad's own
+// PadMapping is shifted to match, so deadman, e-stop and the send loop work
+// as they do with one pad.
+type SplitConfig struct {
+	Driver   SplitSeat `json:"driver"`
+	Operator SplitSeat `json:"operator"`
+}
+
+// SplitSeat is one person's pad, by joystick index, and the ControllerState
+// fields it owns. Fields neither seat owns read as neutral.
+type SplitSeat struct {
+	Index  int      `json:"index"`
+	Fields []string `json:"fields"`
+}
+
+// splitFields are the fields a seat can own. Owning dX or dY takes the
+// D-pad axis whether the pad reports it as a hat or as buttons.
+var splitFields = slices.Concat(axisFields, buttonFields, hatAxes)
+
+// LoadSplitConfig reads a split config, checking that every field is known
+// and owned by at most one seat, that one seat owns the whole e-stop combo
+// so one person can press it, and that the driver owns the deadman control
+// ("" for none)
+func LoadSplitConfig(filename, deadman string) (*SplitConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var split SplitConfig
+	if err := json.Unmarshal(data, &split); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if split.Driver.Index == split.Operator.Index {
+		return nil, fmt.Errorf("%s: driver and operator both use joystick %d", filename, split.Driver.Index)
+	}
+	owner := make(map[string]string)
+	for _, seat := range []struct {
+		name string
+		SplitSeat
+	}{{"driver", split.Driver}, {"operator", split.Operator}} {
+		if seat.Index < 0 {
+			return nil, fmt.Errorf("%s: %s index must not be negative, got %d", filename, seat.name, seat.Index)
+		}
+		for _, field := range seat.Fields {
+			if !contains(splitFields, field) {
+				return nil, fmt.Errorf("%s: %s: unknown field %q (valid: %s)",
+					filename, seat.name, field, strings.Join(splitFields, ", "))
+			}
+			if prev, ok := owner[field]; ok {
+				return nil, fmt.Errorf("%s: %s is owned by both %s and %s", filename, field, prev, seat.name)
+			}
+			owner[field] = seat.name
+		}
+	}
+
+	if estop := owner[estopFields[0]]; estop == "" || owner[estopFields[1]] != estop {
+		return nil, fmt.Errorf("%s: one seat must own both %s and %s, the e-stop combo", filename, estopFields[0], estopFields[1])
+	}
+	if deadman != "" && owner[deadman] != "driver" {
+		return nil, fmt.Errorf("%s: the driver must own the deadman control %s", filename, deadman)
+	}
+
+	var unowned []string
+	for _, field := range splitFields {
+		if _, ok := owner[field]; !ok {
+			unowned = append(unowned, field)
+		}
+	}
+	if len(unowned) > 0 {
+		log.Printf("%s: %s owned by neither pad, always neutral", filename, strings.Join(unowned, ", "))
+	}
+	return &split, nil
+}
+
+// open opens both pads and builds the merged mapping from each pad's entry
+// in mappings, tuned as usual. It also returns the driver's index, whose
+// pad plays the server's rumbles.
+func (s *SplitConfig) open(mappings []*PadMapping, tuning AxisTuning, invertY bool) (joystick.Joystick, *PadMapping, int, error) {
+	driver, err := openPad(s.Driver.Index)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("driver pad %d: %w", s.Driver.Index, err)
+	}
+	operator, err := openPad(s.Operator.Index)
+	if err != nil {
+		driver.Close()
+		return nil, nil, 0, fmt.Errorf("operator pad %d: %w", s.Operator.Index, err)
+	}
+	log.Printf("Driver pad: %s", driver.Name())
+	log.Printf("Operator pad: %s", operator.Name())
+
+	js, mapping, err := s.merge(driver, operator, mappings, tuning, invertY)
+	if err != nil {
+		driver.Close()
+		operator.Close()
+		return nil, nil, 0, err
+	}
+	return js, mapping, s.Driver.Index, nil
+}
+
+// merge builds the merged joystick and mapping for two open pads
+func (s *SplitConfig) merge(driver, operator joystick.Joystick, mappings []*PadMapping, tuning AxisTuning, invertY bool) (joystick.Joystick, *PadMapping, error) {
+	merged := &mergedJoystick{driver: driver, operator: operator, shift: driver.ButtonCount()}
+	mapping := &PadMapping{Axes: make(map[string]AxisMapping), Buttons: make(map[string]int)}
+	seats := []struct {
+		js     joystick.Joystick
+		fields []string
+		axes   int // offset of the pad's axes in the merged reading
+		bits   int // and of its buttons
+	}{
+		{driver, s.Driver.Fields, 0, 0},
+		{operator, s.Operator.Fields, driver.AxisCount(), merged.shift},
+	}
+	for _, seat := range seats {
+		m := padMapping(mappings, seat.js.Name())
+		if m.Match != "" {
+			log.Printf("Using %q pad mapping for %s", m.Match, seat.js.Name())
+		}
+		m = m.WithTuning(tuning, invertY)
+		for _, field := range seat.fields {
+			// Indices past the pad's own count would read the other pad
+			if a, ok := m.Axes[field]; ok && a.Index >= 0 && a.Index < seat.js.AxisCount() {
+				a.Index += seat.axes
+				mapping.Axes[field] = a
+			}
+			buttons := []string{field}
+			switch field {
+			case "dX":
+				buttons = []string{"dLeft", "dRight"}
+			case "dY":
+				buttons = []string{"dUp", "dDown"}
+			}
+			for _, button := range buttons {
+				if bit, ok := m.Buttons[button]; ok && bit >= 0 && bit < seat.js.ButtonCount() {
+					if bit+seat.bits >= 32 {
+						return nil, nil, fmt.Errorf("%s button %d is past the 32 the merged pads can carry", button, bit)
+					}
+					mapping.Buttons[button] = bit + seat.bits
+				}
+			}
+		}
+	}
+	return merged, mapping, nil
+}
+
+// mergedJoystick reads the driver's and operator's pads as one, the
+// operator's axes following the driver's and its buttons shifted past them
+type mergedJoystick struct {
+	driver, operator joystick.Joystick
+	shift            int
+}
+
+func (j *mergedJoystick) AxisCount() int {
+	return j.driver.AxisCount() + j.operator.AxisCount()
+}
+
+func (j *mergedJoystick) ButtonCount() int {
+	return min(32, j.shift+j.operator.ButtonCount())
+}
+
+func (j *mergedJoystick) Name() string {
+	return j.driver.Name() + " + " + j.operator.Name()
+}
+
+func (j *mergedJoystick) Read() (joystick.State, error) {
+	d, err := j.driver.Read()
+	if err != nil {
+		return d, fmt.Errorf("driver pad: %w", err)
+	}
+	o, err := j.operator.Read()
+	if err != nil {
+		return o, fmt.Errorf("operator pad: %w", err)
+	}
+	axes := make([]int, j.driver.AxisCount(), j.driver.AxisCount()+len(o.AxisData))
+	copy(axes, d.AxisData)
+	return joystick.State{
+		AxisData: append(axes, o.AxisData...),
+		Buttons:  d.Buttons | o.Buttons<<j.shift,
+	}, nil
+}
+
+func (j *mergedJoystick) Close() {
+	j.driver.Close()
+	j.operator.Close()
+}
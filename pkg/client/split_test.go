@@ -0,0 +1,53 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSplitConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		deadman string
+		problem string // substring of the error, "" for none
+	}{
+		{"example", `{"driver": {"index": 0, "fields": ["LjoyY", "LB", "START", "SELECT"]},
+			"operator": {"index": 1, "fields": ["RT", "N"]}}`, "LB", ""},
+		{"operator holds the e-stop", `{"driver": {"index": 0, "fields": ["LjoyY", "LB"]},
+			"operator": {"index": 1, "fields": ["START", "SELECT"]}}`, "LB", ""},
+		{"e-stop unowned", `{"driver": {"index": 0, "fields": ["LjoyY"]},
+			"operator": {"index": 1, "fields": ["RT"]}}`, "", "e-stop"},
+		{"e-stop half owned", `{"driver": {"index": 0, "fields": ["START"]},
+			"operator": {"index": 1, "fields": ["RT"]}}`, "", "e-stop"},
+		{"e-stop split across seats", `{"driver": {"index": 0, "fields": ["START"]},
+			"operator": {"index": 1, "fields": ["SELECT"]}}`, "", "e-stop"},
+		{"deadman on the operator's pad", `{"driver": {"index": 0, "fields": ["START", "SELECT"]},
+			"operator": {"index": 1, "fields": ["RT"]}}`, "RT", "deadman"},
+		{"deadman unowned", `{"driver": {"index": 0, "fields": ["START", "SELECT"]},
+			"operator": {"index": 1, "fields": ["N"]}}`, "LB", "deadman"},
+		{"field owned twice", `{"driver": {"index": 0, "fields": ["N", "START", "SELECT"]},
+			"operator": {"index": 1, "fields": ["N"]}}`, "", "owned by both"},
+		{"same pad", `{"driver": {"index": 1}, "operator": {"index": 1}}`, "", "both use joystick"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "split.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadSplitConfig(path, tt.deadman)
+			if tt.problem == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Fatalf("err = %v, want one mentioning %q", err, tt.problem)
+			}
+		})
+	}
+}
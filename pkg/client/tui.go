@@ -0,0 +1,400 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	TUI_REFRESH_HZ = 10
+	TUI_LOG_LINES  = 6               // recent log messages kept on screen
+	TUI_STICK_W    = 13              // crosshair width inside the box, odd so centre is a column
+	TUI_STICK_H    = 5               // and height
+	TUI_BAR_W      = 12              // trigger bar width
+	TUI_STALE      = 2 * time.Second // status or telemetry older than this is shown as stale
+)
+
+// tuiDisplay is the -tui screen, which replaces the line per state and per
+// status frame with one live view: the sticks as crosshairs, buttons,
+// triggers, the actual send rate, round trip, what the server says about
+// the robot and each Arduino's telemetry, and the last few log messages.
+// It is redrawn TUI_REFRESH_HZ times a second on the terminal's alternate
+// screen; the log goes to it rather than to stderr while it is up.
+type tuiDisplay struct {
+	out    io.Writer
+	server string
+
+	mu        sync.Mutex
+	rate      *rateControl  // of the current connection, nil between them
+	lat       *latencyMeter // likewise
+	state     protocol.ControllerState
+	sends     int // since rateFrom
+	rateFrom  time.Time
+	sendHz    float64
+	status    *protocol.StatusFrame
+	statusAt  time.Time
+	telemetry map[string]*protocol.TelemetryState // by device
+	telemAt   map[string]time.Time
+	replay    *protocol.ReplayFrame
+	replayAt  time.Time
+	logLines  []string
+	partial   []byte // log output not yet ended by a newline
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// tui is the screen, nil without -tui
+var tui *tuiDisplay
+
+// startTUI takes over the terminal for the -tui screen until close
+func startTUI(server string) (*tuiDisplay, error) {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, fmt.Errorf("-tui needs a terminal on stdout")
+	}
+	if enableVT != nil {
+		if err := enableVT(); err != nil {
+			return nil, fmt.Errorf("-tui: %w", err)
+		}
+	}
+	t := &tuiDisplay{
+		out:       os.Stdout,
+		server:    server,
+		rateFrom:  time.Now(),
+		telemetry: make(map[string]*protocol.TelemetryState),
+		telemAt:   make(map[string]time.Time),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	// Alternate screen, hidden cursor, no line wrap: rows too long for the
+	// terminal are cut off rather than pushing the rest down
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l\x1b[?7l")
+	log.SetOutput(t)
+	log.SetFlags(log.Ltime)
+
+	// Ctrl+C would otherwise leave the terminal on the alternate screen
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		t.close()
+		os.Exit(130)
+	}()
+
+	go t.run()
+	return t, nil
+}
+
+// close restores the terminal and the log
+func (t *tuiDisplay) close() {
+	t.mu.Lock()
+	select {
+	case <-t.stop:
+		t.mu.Unlock()
+		return
+	default:
+		close(t.stop)
+	}
+	t.mu.Unlock()
+	<-t.done
+	fmt.Fprint(t.out, "\x1b[?7h\x1b[?25h\x1b[?1049l")
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
+
+func (t *tuiDisplay) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second / TUI_REFRESH_HZ)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attach shows a new connection's send rate and latency; nil, nil between
+// connections
+func (t *tuiDisplay) attach(rate *rateControl, lat *latencyMeter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate, t.lat = rate, lat
+	if rate == nil {
+		t.status = nil
+	}
+}
+
+// sent records a state that went to the server
+func (t *tuiDisplay) sent(state *protocol.ControllerState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state = *state
+	t.sends++
+}
+
+func (t *tuiDisplay) showStatus(status *protocol.StatusFrame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+	t.statusAt = time.Now()
+}
+
+func (t *tuiDisplay) showTelemetry(telem *protocol.TelemetryState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.telemetry[telem.Device] = telem
+	t.telemAt[telem.Device] = time.Now()
+}
+
+func (t *tuiDisplay) showReplay(replay *protocol.ReplayFrame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.replay = replay
+	t.replayAt = time.Now()
+}
+
+// Write takes the log's output, keeping the last TUI_LOG_LINES lines
+func (t *tuiDisplay) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.logLines = append(t.logLines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.logLines) > TUI_LOG_LINES {
+		t.logLines = slices.Clone(t.logLines[len(t.logLines)-TUI_LOG_LINES:])
+	}
+	return len(p), nil
+}
+
+// tuiLink is the connection's send rate and round trip, read before the
+// screen is laid out: the rate control and latency meter log while holding
+// their own locks, and the log takes t.mu
+type tuiLink struct {
+	connected bool
+	rateHz    float64
+	rttKnown  bool
+	rtt       time.Duration
+	offset    int64
+	slow      bool
+}
+
+// draw writes the whole screen in one go, each row clearing the rest of
+// its line, so nothing flickers
+func (t *tuiDisplay) draw() {
+	t.mu.Lock()
+	rate, lat := t.rate, t.lat
+	t.mu.Unlock()
+	var link tuiLink
+	if rate != nil {
+		link.connected = true
+		link.rateHz = float64(time.Second) / float64(rate.period())
+		link.rtt, link.offset, link.rttKnown, link.slow = lat.roundTrip()
+	}
+
+	t.mu.Lock()
+	lines := t.render(time.Now(), &link)
+	t.mu.Unlock()
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	t.out.Write(b.Bytes())
+}
+
+// render lays out the screen. Callers hold t.mu.
+func (t *tuiDisplay) render(now time.Time, link *tuiLink) []string {
+	if elapsed := now.Sub(t.rateFrom); elapsed >= time.Second {
+		t.sendHz = float64(t.sends) / elapsed.Seconds()
+		t.sends = 0
+		t.rateFrom = now
+	}
+	s := &t.state
+
+	header := "Lunabotics client  " + t.server
+	if !link.connected {
+		header += "  (connecting)"
+	} else if st := t.status; st != nil {
+		header += "  " + st.Role
+		if st.Mode != "" {
+			header += "  mode " + st.Mode
+		}
+		if st.EStop {
+			header += "  " + reverse("E-STOP")
+		}
+	}
+	lines := []string{header, ""}
+
+	// Sticks side by side, triggers and d-pad to their right
+	left := stickBox("Left stick", s.LeftX, s.LeftY)
+	right := stickBox("Right stick", s.RightX, s.RightY)
+	side := []string{
+		"",
+		"",
+		fmt.Sprintf("LT [%s] %3d", bar(s.LeftTrigger), s.LeftTrigger),
+		fmt.Sprintf("RT [%s] %3d", bar(s.RightTrigger), s.RightTrigger),
+		"",
+		fmt.Sprintf("D-pad X %+d Y %+d", s.DPadX, s.DPadY),
+	}
+	for i := range left {
+		row := "  " + left[i] + "   " + right[i]
+		if i < len(side) {
+			row += "   " + side[i]
+		}
+		lines = append(lines, row)
+	}
+
+	buttons := "  "
+	for _, b := range []struct {
+		name string
+		on   uint8
+	}{
+		{"N", s.North}, {"E", s.East}, {"S", s.South}, {"W", s.West},
+		{"LB", s.LeftBumper}, {"RB", s.RightBumper}, {"LS", s.LeftStick}, {"RS", s.RightStick},
+		{"SELECT", s.Select}, {"START", s.Start},
+	} {
+		if b.on != 0 {
+			buttons += reverse(" "+b.name+" ") + " "
+		} else {
+			buttons += " " + b.name + "  "
+		}
+	}
+	lines = append(lines, buttons, "")
+
+	linkLine := fmt.Sprintf("Link   sending %.1f Hz", t.sendHz)
+	if link.connected {
+		linkLine += fmt.Sprintf(" (rate %.0f Hz)", link.rateHz)
+	}
+	if link.rttKnown {
+		linkLine += fmt.Sprintf("   RTT %.1f ms   clock %+d ms", float64(link.rtt)/float64(time.Millisecond), link.offset)
+		if link.slow {
+			linkLine += "   " + reverse("LAGGING")
+		}
+	}
+	lines = append(lines, linkLine)
+	lines = append(lines, t.robotLine(now))
+
+	lines = append(lines, "", "Telemetry")
+	devices := make([]string, 0, len(t.telemetry))
+	for name := range t.telemetry {
+		devices = append(devices, name)
+	}
+	slices.Sort(devices)
+	if len(devices) == 0 {
+		lines = append(lines, "  none yet")
+	}
+	for _, name := range devices {
+		line := "  " + t.telemetry[name].String()
+		if age := now.Sub(t.telemAt[name]); age > TUI_STALE {
+			line += fmt.Sprintf("  (%.0fs old)", age.Seconds())
+		}
+		lines = append(lines, line)
+	}
+	if t.replay != nil && now.Sub(t.replayAt) <= TUI_STALE {
+		lines = append(lines, "  "+t.replay.String())
+	}
+
+	lines = append(lines, "", "Recent messages")
+	for _, l := range t.logLines {
+		lines = append(lines, "  "+l)
+	}
+	return lines
+}
+
+// robotLine is what the last status frame says about the server and the
+// Arduinos. Callers hold t.mu.
+func (t *tuiDisplay) robotLine(now time.Time) string {
+	st := t.status
+	if st == nil {
+		return "Robot  no status yet"
+	}
+	line := "Robot"
+	devices := st.Devices
+	if len(devices) == 0 {
+		devices = []protocol.DeviceStatus{{Name: "arduino", Connected: st.ArduinoConnected}}
+	}
+	for _, d := range devices {
+		if d.Connected {
+			line += "  " + d.Name + " ok"
+		} else {
+			line += "  " + reverse(d.Name+" DISCONNECTED")
+		}
+	}
+	line += fmt.Sprintf("  crc errors %d", st.CRCErrors)
+	if st.Battery != "" {
+		line += "  " + reverse("battery "+st.Battery)
+	}
+	if st.Congested {
+		line += "  congested"
+	}
+	if st.Profile != "" {
+		line += "  profile " + st.Profile
+	}
+	if st.Speed != "" {
+		line += "  speed " + st.Speed
+	}
+	if st.Cruise {
+		line += "  cruise"
+	}
+	if age := now.Sub(t.statusAt); age > TUI_STALE {
+		line += fmt.Sprintf("  (no status for %.0fs)", age.Seconds())
+	}
+	return line
+}
+
+// stickBox draws a stick's position as a crosshair in a box, with its
+// title above and its values below. Y grows downwards, as on the pad.
+func stickBox(title string, x, y uint8) []string {
+	col := int(x) * (TUI_STICK_W - 1) / 255
+	row := int(y) * (TUI_STICK_H - 1) / 255
+	width := TUI_STICK_W + 2
+	rows := []string{fmt.Sprintf("%-*s", width, title), "+" + strings.Repeat("-", TUI_STICK_W) + "+"}
+	for r := 0; r < TUI_STICK_H; r++ {
+		cells := []byte(strings.Repeat(" ", TUI_STICK_W))
+		if r == TUI_STICK_H/2 {
+			cells[TUI_STICK_W/2] = '.'
+		}
+		if r == row {
+			cells[col] = '+'
+		}
+		rows = append(rows, "|"+string(cells)+"|")
+	}
+	rows = append(rows, "+"+strings.Repeat("-", TUI_STICK_W)+"+")
+	rows = append(rows, fmt.Sprintf("%-*s", width, fmt.Sprintf("X %3d  Y %3d", x, y)))
+	return rows
+}
+
+// bar draws a trigger's travel
+func bar(v uint8) string {
+	n := int(v) * TUI_BAR_W / 255
+	return strings.Repeat("#", n) + strings.Repeat(".", TUI_BAR_W-n)
+}
+
+// reverse shows s in reverse video
+func reverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/0xcafed00d/joystick"
+)
+
+// XINPUT_NAME starts the name of every XInput pad, followed by its slot
+// (1-4), as XInput gives pads no names of their own
+const XINPUT_NAME = "XInput Controller"
+
+// openXInputPad opens XInput slot index (0-3). It is set in init() by
+// xinput_windows.go and nil elsewhere.
+var openXInputPad func(index int) (joystick.Joystick, error)
+
+// xinputOpts are the -xinput flags
+var xinputOpts struct {
+	enabled bool
+}
+
+// XInputPadMapping maps an XInput pad's fixed layout: the four stick axes
+// (up positive, so flipped here to the sticks' up-is-low), the two 0-255
+// triggers, then XINPUT_GAMEPAD's wButtons bits as buttons
+func XInputPadMapping() *PadMapping {
+	return &PadMapping{
+		Match: "XInput",
+		Axes: map[string]AxisMapping{
+			"LjoyX": {Index: 0}, "LjoyY": {Index: 1, Min: 32767, Max: -32768},
+			"RjoyX": {Index: 2}, "RjoyY": {Index: 3, Min: 32767, Max: -32768},
+			"LT": {Index: 4, Max: 255}, "RT": {Index: 5, Max: 255},
+		},
+		Buttons: map[string]int{
+			"dUp": 0, "dDown": 1, "dLeft": 2, "dRight": 3,
+			"START": 4, "SELECT": 5, "LS": 6, "RS": 7, "LB": 8, "RB": 9,
+			"S": 12, "E": 13, "W": 14, "N": 15,
+		},
+	}
+}
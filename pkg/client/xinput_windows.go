@@ -0,0 +1,169 @@
+//go:build windows
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/0xcafed00d/joystick"
+	"golang.org/x/sys/windows"
+)
+
+// XInput reads Xbox-style pads in a fixed layout, unlike winmm, which
+// merges their triggers into one axis. xinput1_4.dll ships with Windows 8
+// and later, and xinput9_1_0.dll with Windows 7.
+const ERROR_DEVICE_NOT_CONNECTED = 1167
+
+var (
+	xinputGetState = xinputProc("XInputGetState")
+	xinputSetState = xinputProc("XInputSetState")
+)
+
+func init() {
+	openXInputPad = openXInput
+	openRumble = openXInputRumble
+}
+
+// xinputProc finds proc in the newest XInput DLL that has it
+func xinputProc(name string) *windows.LazyProc {
+	for _, dll := range []string{"xinput1_4.dll", "xinput9_1_0.dll"} {
+		if proc := windows.NewLazySystemDLL(dll).NewProc(name); proc.Find() == nil {
+			return proc
+		}
+	}
+	return nil
+}
+
+// xinputState is XINPUT_STATE
+type xinputState struct {
+	Packet       uint32
+	Buttons      uint16
+	LeftTrigger  uint8
+	RightTrigger uint8
+	ThumbLX      int16
+	ThumbLY      int16
+	ThumbRX      int16
+	ThumbRY      int16
+}
+
+// xinputVibration is XINPUT_VIBRATION: the left motor is the strong,
+// low-frequency one
+type xinputVibration struct {
+	LeftMotor  uint16
+	RightMotor uint16
+}
+
+// getState reads slot index
+func getState(index int) (xinputState, error) {
+	var s xinputState
+	if xinputGetState == nil {
+		return s, errors.New("XInput isn't installed")
+	}
+	ret, _, _ := xinputGetState.Call(uintptr(index), uintptr(unsafe.Pointer(&s)))
+	switch ret {
+	case 0:
+		return s, nil
+	case ERROR_DEVICE_NOT_CONNECTED:
+		return s, fmt.Errorf("no XInput controller in slot %d", index+1)
+	}
+	return s, fmt.Errorf("XInputGetState: %w", syscall.Errno(ret))
+}
+
+// openXInput opens slot index if a pad is plugged into it
+func openXInput(index int) (joystick.Joystick, error) {
+	if index < 0 || index > 3 {
+		return nil, fmt.Errorf("XInput slot %d out of range", index)
+	}
+	if _, err := getState(index); err != nil {
+		return nil, err
+	}
+	return &xinputPad{index: index}, nil
+}
+
+// xinputPad reads one slot in the order XInputPadMapping expects
+type xinputPad struct {
+	index int
+}
+
+func (p *xinputPad) AxisCount() int   { return 6 }
+func (p *xinputPad) ButtonCount() int { return 16 }
+func (p *xinputPad) Name() string     { return fmt.Sprintf("%s %d", XINPUT_NAME, p.index+1) }
+func (p *xinputPad) Close()           {}
+
+func (p *xinputPad) Read() (joystick.State, error) {
+	s, err := getState(p.index)
+	if err != nil {
+		return joystick.State{}, err
+	}
+	return joystick.State{
+		AxisData: []int{
+			int(s.ThumbLX), int(s.ThumbLY), int(s.ThumbRX), int(s.ThumbRY),
+			int(s.LeftTrigger), int(s.RightTrigger),
+		},
+		Buttons: uint32(s.Buttons),
+	}, nil
+}
+
+// xinputRumble drives a slot's motors. XInput has no effect length, so a
+// timer stops the motors unless a newer rumble has replaced them.
+type xinputRumble struct {
+	index int
+	mu    sync.Mutex
+	stop  *time.Timer
+}
+
+// openXInputRumble opens the motors of slot index. Pads read through winmm
+// (-xinput=false) are numbered differently, so they don't rumble.
+func openXInputRumble(index int) (rumbler, error) {
+	if !xinputOpts.enabled {
+		return nil, errors.New("rumble needs -xinput")
+	}
+	if xinputSetState == nil {
+		return nil, errors.New("XInput isn't installed")
+	}
+	return &xinputRumble{index: index}, nil
+}
+
+// set runs the motors at the given speeds
+func (r *xinputRumble) set(strong, weak float64) error {
+	v := xinputVibration{LeftMotor: magnitude(strong), RightMotor: magnitude(weak)}
+	if ret, _, _ := xinputSetState.Call(uintptr(r.index), uintptr(unsafe.Pointer(&v))); ret != 0 {
+		return fmt.Errorf("XInputSetState: %w", syscall.Errno(ret))
+	}
+	return nil
+}
+
+func (r *xinputRumble) rumble(strong, weak float64, d time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		r.stop.Stop()
+	}
+	if err := r.set(strong, weak); err != nil {
+		return err
+	}
+	var stop *time.Timer
+	stop = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.stop == stop {
+			r.set(0, 0)
+		}
+	})
+	r.stop = stop
+	return nil
+}
+
+func (r *xinputRumble) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		r.stop.Stop()
+	}
+	return r.set(0, 0)
+}
@@ -0,0 +1,57 @@
+package formatter
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Byte mapping config file formats
+const (
+	CONFIG_JSON = "json"
+	CONFIG_YAML = "yaml"
+	CONFIG_TOML = "toml"
+)
+
+// ConfigFormat picks the format of filename: format if given, otherwise by
+// extension, defaulting to JSON
+func ConfigFormat(filename, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch format {
+	case "", CONFIG_JSON:
+		return CONFIG_JSON, nil
+	case CONFIG_YAML, "yml":
+		return CONFIG_YAML, nil
+	case CONFIG_TOML:
+		return CONFIG_TOML, nil
+	}
+	return "", fmt.Errorf("unknown config format %q (valid: json, yaml, toml)", format)
+}
+
+// ConfigToJSON converts a YAML or TOML config to JSON so every format goes
+// through the same strict decoding and validation. Keys keep their JSON
+// names, e.g. output_size.
+func ConfigToJSON(data []byte, format string) ([]byte, error) {
+	var doc any
+	switch format {
+	case CONFIG_YAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case CONFIG_TOML:
+		var table map[string]any
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, err
+		}
+		doc = table
+	default:
+		return data, nil
+	}
+	return json.Marshal(doc)
+}
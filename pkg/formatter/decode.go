@@ -0,0 +1,250 @@
+package formatter
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// Decode reconstructs the approximate ControllerState that produced frame
+// under the named profile. Fields the frame doesn't carry are left neutral,
+// and lossy mappings (deadzones, curves, clamped scales, exprs) can't be
+// inverted exactly. Constant and checksum bytes are checked, so a frame
+// that doesn't match the layout is reported as an error.
+func (c *ByteConfig) Decode(frame []byte, profile string) (*protocol.ControllerState, error) {
+	if len(frame) != c.OutputSize {
+		return nil, fmt.Errorf("frame is %d bytes, config expects %d", len(frame), c.OutputSize)
+	}
+
+	state := NeutralState()
+	mix := make(map[string]uint8)
+	i := 0
+	for _, m := range c.profileBytes(profile) {
+		width := byteWidths[m.Type]
+		if i+width > len(frame) {
+			break
+		}
+		v := frame[i]
+
+		// A conditional byte holding its default may not have been active
+		if m.When != "" && v == m.Default {
+			i += width
+			continue
+		}
+
+		switch m.Type {
+		case "const":
+			if v != m.Value {
+				return nil, fmt.Errorf("byte %d is 0x%02X, expected const 0x%02X", i, v, m.Value)
+			}
+		case "field":
+			setDecodedField(state, mix, m.Field, v)
+		case "scale":
+			setDecodedField(state, mix, m.Field, m.unscale(v))
+		case "bits":
+			if v&m.Value != m.Value {
+				return nil, fmt.Errorf("byte %d is 0x%02X, missing fixed bits 0x%02X", i, v, m.Value)
+			}
+			for _, bit := range m.Bits {
+				setDecodedField(state, mix, bit.Field, v>>bit.Pos&1)
+			}
+		case "checksum":
+			if want := checksum(m.Algo, frame[:i]); v != want {
+				return nil, fmt.Errorf("byte %d checksum is 0x%02X, expected 0x%02X", i, v, want)
+			}
+		case "field16":
+			var w uint16
+			if m.Endian == "little" {
+				w = binary.LittleEndian.Uint16(frame[i:])
+			} else {
+				w = binary.BigEndian.Uint16(frame[i:])
+			}
+			if m.Signed {
+				w ^= 0x8000
+			}
+			setDecodedField(state, mix, m.Field, uint8(w>>8))
+			setDecodedField16(state, m.Field, w)
+		}
+		i += width
+	}
+
+	left, okL := mix["mixL"]
+	right, okR := mix["mixR"]
+	if okL && okR {
+		c.unmix(state, left, right)
+	}
+	return state, nil
+}
+
+// unscale inverts a scale mapping, ignoring any clamping
+func (m *ByteMapping) unscale(v uint8) uint8 {
+	inMin, inMax := m.InMin, m.InMax
+	if inMin == 0 && inMax == 0 {
+		inMax = 255
+	}
+	outMin, outMax := m.OutMin, m.OutMax
+	if outMin == 0 && outMax == 0 {
+		outMax = 255
+	}
+	if outMin == outMax {
+		return uint8(inMin)
+	}
+
+	t := float64(int(v)-outMin) / float64(outMax-outMin)
+	if m.Invert {
+		t = 1 - t
+	}
+	in := math.Round(float64(inMin) + t*float64(inMax-inMin))
+	return uint8(math.Max(0, math.Min(255, in)))
+}
+
+// unmix inverts arcadeMix back to throttle and steer axes. Frames where
+// the mix was normalized to keep the turn ratio decode with reduced input.
+func (c *ByteConfig) unmix(state *protocol.ControllerState, left, right uint8) {
+	throttleField, steerField := c.MixThrottle, c.MixSteer
+	if throttleField == "" {
+		throttleField = "LjoyY"
+	}
+	if steerField == "" {
+		steerField = "RjoyX"
+	}
+	maxSpeed, turnGain := c.MaxSpeed, c.TurnGain
+	if maxSpeed == 0 {
+		maxSpeed = 1
+	}
+	if turnGain == 0 {
+		turnGain = 1
+	}
+
+	l := float64(int(left)-protocol.AXIS_CENTER) / (maxSpeed * protocol.AXIS_CENTER)
+	r := float64(int(right)-protocol.AXIS_CENTER) / (maxSpeed * protocol.AXIS_CENTER)
+	throttle := (l + r) / 2
+	steer := (l - r) / (2 * turnGain)
+
+	toByte := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round(v))))
+	}
+	setDecodedField(state, nil, throttleField, toByte(protocol.AXIS_CENTER-throttle*protocol.AXIS_CENTER))
+	setDecodedField(state, nil, steerField, toByte(protocol.AXIS_CENTER+steer*protocol.AXIS_CENTER))
+}
+
+// setDecodedField stores v in the named field. The virtual mix fields are
+// collected in mix for unmix.
+func setDecodedField(state *protocol.ControllerState, mix map[string]uint8, field string, v uint8) {
+	switch field {
+	case "N":
+		state.North = v
+	case "E":
+		state.East = v
+	case "S":
+		state.South = v
+	case "W":
+		state.West = v
+	case "LB":
+		state.LeftBumper = v
+	case "RB":
+		state.RightBumper = v
+	case "LS":
+		state.LeftStick = v
+	case "RS":
+		state.RightStick = v
+	case "SELECT":
+		state.Select = v
+	case "START":
+		state.Start = v
+	case "LjoyX":
+		state.LeftX = v
+	case "LjoyY":
+		state.LeftY = v
+	case "RjoyX":
+		state.RightX = v
+	case "RjoyY":
+		state.RightY = v
+	case "LT":
+		state.LeftTrigger = v
+	case "RT":
+		state.RightTrigger = v
+	case "dX":
+		state.DPadX = int8(v)
+	case "dY":
+		state.DPadY = int8(v)
+	case "mixL", "mixR":
+		if mix != nil {
+			mix[field] = v
+		}
+	}
+}
+
+// setDecodedField16 stores a full-resolution axis value
+func setDecodedField16(state *protocol.ControllerState, field string, v uint16) {
+	switch field {
+	case "LjoyX":
+		state.LeftX16 = v
+	case "LjoyY":
+		state.LeftY16 = v
+	case "RjoyX":
+		state.RightX16 = v
+	case "RjoyY":
+		state.RightY16 = v
+	case "LT":
+		state.LeftTrigger16 = v
+	case "RT":
+		state.RightTrigger16 = v
+	}
+}
+
+// ParseHexFrame parses bytes written as hex, e.g. "A9 7F 14", "a97f14" or
+// "0xA9,0x7F,0x14"
+func ParseHexFrame(s string) ([]byte, error) {
+	s = strings.NewReplacer("0x", "", "0X", "", ",", "", " ", "", ":", "", "\n", "", "\t", "").Replace(s)
+	return hex.DecodeString(s)
+}
+
+// RunDecode decodes a hex frame captured from the named device's serial
+// line and prints the reconstructed state as JSON
+func RunDecode(w io.Writer, config *ByteConfig, hexFrame, device, profile string) error {
+	wire, err := ParseHexFrame(hexFrame)
+	if err != nil {
+		return fmt.Errorf("bad hex frame: %w", err)
+	}
+
+	devices := config.OutputDevices()
+	dev := devices[0]
+	if device != "" {
+		dev = nil
+		for _, d := range devices {
+			if d.Name == device {
+				dev = d
+			}
+		}
+		if dev == nil {
+			return fmt.Errorf("no device named %q", device)
+		}
+	}
+
+	frame, err := serialout.DecodeFrame(dev.Framing, wire)
+	if err != nil {
+		return err
+	}
+	if dev.Serial != nil && dev.Serial.Ack && len(frame) == dev.OutputSize+1 {
+		frame = frame[1:] // rolling frame ID
+	}
+	state, err := dev.Decode(frame, profile)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", out)
+	return nil
+}
@@ -0,0 +1,6 @@
+// Package formatter turns a ControllerState into the bytes an Arduino
+// expects, as described by the byte config (byte_config.json): fields,
+// expressions, profiles and macros. It also validates a config, and
+// decodes, previews and writes C headers for it, for the server's
+// -decode, -preview and -gen-header commands.
+package formatter
@@ -0,0 +1,316 @@
+package formatter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// StateFields lists the field names ByteMappings can read from a
+// ControllerState, plus the virtual drive-mix outputs
+var StateFields = []string{
+	"N", "E", "S", "W", "LB", "RB", "LS", "RS", "SELECT", "START",
+	"LjoyX", "LjoyY", "RjoyX", "RjoyY", "LT", "RT", "dX", "dY",
+	"mixL", "mixR",
+}
+
+// IsStateField reports whether name is a ControllerState field
+func IsStateField(name string) bool {
+	for _, f := range StateFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expr is a compiled "expr" mapping. It evaluates over field values looked
+// up by name.
+type Expr interface {
+	Eval(field func(string) float64) float64
+}
+
+type exprNum float64
+
+type exprField string
+
+type exprUnary struct {
+	op string
+	x  Expr
+}
+
+type exprBinary struct {
+	op   string
+	l, r Expr
+}
+
+type exprCall struct {
+	fn   string
+	args []Expr
+}
+
+func (e exprNum) Eval(field func(string) float64) float64   { return float64(e) }
+func (e exprField) Eval(field func(string) float64) float64 { return field(string(e)) }
+
+func (e *exprUnary) Eval(field func(string) float64) float64 {
+	return -e.x.Eval(field)
+}
+
+func (e *exprBinary) Eval(field func(string) float64) float64 {
+	l, r := e.l.Eval(field), e.r.Eval(field)
+	switch e.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	case "%":
+		if r == 0 {
+			return 0
+		}
+		return math.Mod(l, r)
+	case "==":
+		return boolNum(l == r)
+	case "!=":
+		return boolNum(l != r)
+	case "<":
+		return boolNum(l < r)
+	case "<=":
+		return boolNum(l <= r)
+	case ">":
+		return boolNum(l > r)
+	case ">=":
+		return boolNum(l >= r)
+	case "&&":
+		return boolNum(l != 0 && r != 0)
+	case "||":
+		return boolNum(l != 0 || r != 0)
+	}
+	return 0
+}
+
+// boolNum converts a comparison result to 1 or 0
+func boolNum(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *exprCall) Eval(field func(string) float64) float64 {
+	a := make([]float64, len(e.args))
+	for i, arg := range e.args {
+		a[i] = arg.Eval(field)
+	}
+	switch e.fn {
+	case "abs":
+		return math.Abs(a[0])
+	case "min":
+		return math.Min(a[0], a[1])
+	case "max":
+		return math.Max(a[0], a[1])
+	case "clamp":
+		return math.Max(a[1], math.Min(a[2], a[0]))
+	case "bit":
+		return boolNum(a[1] >= 0 && a[1] < 64 && uint64(a[0])>>uint(a[1])&1 == 1)
+	}
+	return 0
+}
+
+// exprFuncs maps supported functions to their argument count
+var exprFuncs = map[string]int{"abs": 1, "min": 2, "max": 2, "clamp": 3, "bit": 2}
+
+// CompileExpr parses an arithmetic expression over ControllerState fields:
+// numbers, field names, + - * / %, unary minus, parentheses and the
+// functions abs, min, max, clamp and bit (bit(x, n) is 1 if bit n of x is
+// set). Comparisons (== != < <= > >=) and && || yield 1 or 0. Division by
+// zero yields 0.
+func CompileExpr(src string) (Expr, error) {
+	return CompileExprNames(src, IsStateField)
+}
+
+// CompileExprNames is compileExpr over the names known accepts
+func CompileExprNames(src string, known func(string) bool) (Expr, error) {
+	p := &exprParser{src: src, known: known}
+	p.next()
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.tok, p.tokPos)
+	}
+	return e, nil
+}
+
+// exprParser is a recursive-descent parser over a one-token lookahead
+type exprParser struct {
+	known  func(string) bool // names that may appear
+	src    string
+	pos    int
+	tok    string
+	tokPos int
+}
+
+// next advances to the next token; tok is "" at end of input
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.tokPos = p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	c := rune(p.src[p.pos])
+	start := p.pos
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+	case unicode.IsLetter(c) || c == '_':
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '_') {
+			p.pos++
+		}
+	default:
+		p.pos++
+		if p.pos < len(p.src) {
+			switch p.src[start : p.pos+1] {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				p.pos++
+			}
+		}
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func (p *exprParser) parseOr() (Expr, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (Expr, error) {
+	return p.parseBinary([]string{"&&"}, p.parseCompare)
+}
+
+func (p *exprParser) parseCompare() (Expr, error) {
+	return p.parseBinary([]string{"==", "!=", "<", "<=", ">", ">="}, p.parseSum)
+}
+
+// parseBinary parses a left-associative chain of ops over operands
+func (p *exprParser) parseBinary(ops []string, operand func() (Expr, error)) (Expr, error) {
+	l, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOneOf(ops) {
+		op := p.tok
+		p.next()
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) isOneOf(ops []string) bool {
+	for _, op := range ops {
+		if p.tok == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseSum() (Expr, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (Expr, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	if p.tok == "-" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	tok, pos := p.tok, p.tokPos
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+
+	case tok == "(":
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing ) at offset %d", p.tokPos)
+		}
+		p.next()
+		return e, nil
+
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at offset %d", tok, pos)
+		}
+		p.next()
+		return exprNum(v), nil
+
+	case unicode.IsLetter(rune(tok[0])) || tok[0] == '_':
+		p.next()
+		if argc, ok := exprFuncs[strings.ToLower(tok)]; ok && p.tok == "(" {
+			return p.parseCall(strings.ToLower(tok), argc, pos)
+		}
+		if !p.known(tok) {
+			return nil, fmt.Errorf("unknown field %q at offset %d", tok, pos)
+		}
+		return exprField(tok), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok, pos)
+}
+
+func (p *exprParser) parseCall(fn string, argc, pos int) (Expr, error) {
+	p.next() // (
+	call := &exprCall{fn: fn}
+	for p.tok != ")" {
+		if len(call.args) > 0 {
+			if p.tok != "," {
+				return nil, fmt.Errorf("expected , or ) at offset %d", p.tokPos)
+			}
+			p.next()
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next() // )
+	if len(call.args) != argc {
+		return nil, fmt.Errorf("%s at offset %d takes %d arguments, got %d", fn, pos, argc, len(call.args))
+	}
+	return call, nil
+}
@@ -0,0 +1,736 @@
+package formatter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// ByteFormatter handles conversion from controller state to Arduino bytes
+type ByteFormatter struct {
+	Config *ByteConfig
+
+	live    atomic.Pointer[ByteConfig] // replaces Config once SetConfig is called
+	profile atomic.Pointer[string]     // active profile name
+
+	frames atomic.Uint32 // frames formatted so far, for "counter" bytes
+	exprs  sync.Map      // expr source -> compiled expr, for "expr" bytes
+
+	slewMu sync.Mutex
+	last   []byte // previous frame, for max_delta_per_frame
+}
+
+// ByteConfig defines the byte mapping configuration
+type ByteConfig struct {
+	OutputSize int                     `json:"output_size"`
+	Bytes      []ByteMapping           `json:"bytes"`
+	Serial     *serialout.SerialConfig `json:"serial,omitempty"`
+
+	// Framing wraps each frame for the wire: "" sends it raw, "cobs" uses
+	// COBS with a 0x00 delimiter, "slip" uses SLIP (RFC 1055)
+	Framing string `json:"framing,omitempty"`
+
+	// Mix enables drive mixing. "arcade" turns MixThrottle (default LjoyY,
+	// stick up = forward) and MixSteer (default RjoyX) into the virtual
+	// fields "mixL" and "mixR" for the left and right motors, centered on
+	// 127. MaxSpeed (0-1) caps both sides and TurnGain scales steering;
+	// zero means 1 for both.
+	Mix         string  `json:"mix,omitempty"`
+	MixThrottle string  `json:"mix_throttle,omitempty"`
+	MixSteer    string  `json:"mix_steer,omitempty"`
+	MaxSpeed    float64 `json:"max_speed,omitempty"`
+	TurnGain    float64 `json:"turn_gain,omitempty"`
+
+	// Profiles are alternative byte mappings for the same frame layout,
+	// e.g. "drive" and "dig". Bytes above is used while no profile (or one
+	// this device doesn't define) is active.
+	Profiles []*ProfileConfig `json:"profiles,omitempty"`
+
+	// Devices replaces the single mapping above when the robot has more
+	// than one Arduino. Each gets its own frame from the same state.
+	Devices []*DeviceConfig `json:"devices,omitempty"`
+
+	// Macros are timed input sequences the driver starts with a combo,
+	// played to every device. Only the top level's are used.
+	Macros []*MacroConfig `json:"macros,omitempty"`
+}
+
+// ProfileConfig is a named set of byte mappings. Holding every field in
+// Combo at once switches to it.
+type ProfileConfig struct {
+	Name  string        `json:"name"`
+	Combo []string      `json:"combo,omitempty"`
+	Bytes []ByteMapping `json:"bytes"`
+}
+
+// profileBytes returns the mappings for the named profile, falling back to
+// the top-level Bytes. A profile without bytes of its own only exists to be
+// tested by "when" conditions.
+func (c *ByteConfig) profileBytes(name string) []ByteMapping {
+	for _, p := range c.Profiles {
+		if p.Name == name && len(p.Bytes) > 0 {
+			return p.Bytes
+		}
+	}
+	return c.Bytes
+}
+
+// DeviceConfig is one named Arduino with its own port and byte mapping
+type DeviceConfig struct {
+	Name string `json:"name"`
+	ByteConfig
+}
+
+// OutputDevices returns the configured devices, treating a config without a
+// devices list as a single device named "arduino"
+func (c *ByteConfig) OutputDevices() []*DeviceConfig {
+	if len(c.Devices) > 0 {
+		return c.Devices
+	}
+	return []*DeviceConfig{{Name: "arduino", ByteConfig: *c}}
+}
+
+// ByteMapping defines how each byte is constructed
+type ByteMapping struct {
+	Type  string       `json:"type"`            // "const", "field", "bits", "checksum", "counter", "scale", "field16", "expr"
+	Value uint8        `json:"value,omitempty"` // For const, and fixed bits under "bits"
+	Field string       `json:"field,omitempty"` // For field mapping
+	Bits  []BitMapping `json:"bits,omitempty"`  // For bitmask
+	Algo  string       `json:"algo,omitempty"`  // For checksum: "xor" (default), "sum", "crc8"
+
+	// For scale: maps Field from [InMin, InMax] to [OutMin, OutMax], clamped.
+	// A range left at 0-0 means the full 0-255.
+	InMin  int  `json:"in_min,omitempty"`
+	InMax  int  `json:"in_max,omitempty"`
+	OutMin int  `json:"out_min,omitempty"`
+	OutMax int  `json:"out_max,omitempty"`
+	Invert bool `json:"invert,omitempty"`
+
+	// For field and scale: values within Deadzone of center snap to center
+	Deadzone uint8 `json:"deadzone,omitempty"`
+
+	// For field and scale: response curve applied after the deadzone
+	Curve *CurveConfig `json:"curve,omitempty"`
+
+	// For field16: byte order ("big" or "little") and whether to emit a
+	// signed int16 centered on zero instead of a uint16
+	Endian string `json:"endian,omitempty"`
+	Signed bool   `json:"signed,omitempty"`
+
+	// For expr: arithmetic over field names, e.g. "(LjoyY + RjoyX) / 2".
+	// The result is rounded and clamped to 0-255.
+	Expr string `json:"expr,omitempty"`
+
+	// For field, scale and expr: the most the byte may change between
+	// consecutive frames, so motors ramp instead of reversing instantly.
+	// 0 disables the limit.
+	MaxDeltaPerFrame uint8 `json:"max_delta_per_frame,omitempty"`
+
+	// When makes the mapping conditional: either the name of a profile
+	// that must be active, or an expr such as "START == 1" that must be
+	// non-zero. Otherwise the byte (both bytes for field16) is Default.
+	When    string `json:"when,omitempty"`
+	Default uint8  `json:"default,omitempty"`
+}
+
+// CurveConfig reshapes an axis' response. Expo (0-1) blends a linear
+// response with a cubic one around center, so small stick movements give
+// finer control while full deflection still reaches full speed. Table
+// instead lists output values at evenly spaced inputs from 0 to 255,
+// interpolated linearly.
+type CurveConfig struct {
+	Expo  float64 `json:"expo,omitempty"`
+	Table []int   `json:"table,omitempty"`
+}
+
+// BitMapping maps a bit position to a field
+type BitMapping struct {
+	Pos   uint8  `json:"pos"`   // 0-7
+	Field string `json:"field"` // Field name from ControllerState
+}
+
+// Start and end markers of the Python-compatible 6-byte frame
+const (
+	PYTHON_START_BYTE = 0b10101000
+	PYTHON_END_BYTE   = 0b00010101
+)
+
+// DefaultConfig returns the Python-compatible 6-byte format
+func DefaultConfig() *ByteConfig {
+	return &ByteConfig{
+		OutputSize: 6,
+		Bytes: []ByteMapping{
+			{
+				Type:  "bits",
+				Value: PYTHON_START_BYTE,
+				Bits: []BitMapping{
+					{Pos: 0, Field: "W"},
+					{Pos: 1, Field: "E"},
+					{Pos: 2, Field: "S"},
+				},
+			},
+			{Type: "field", Field: "LjoyX"},
+			{Type: "field", Field: "LjoyY"},
+			{Type: "field", Field: "RjoyY"},
+			{Type: "field", Field: "RT"},
+			{
+				Type:  "bits",
+				Value: PYTHON_END_BYTE,
+				Bits: []BitMapping{
+					{Pos: 5, Field: "LB"},
+					{Pos: 6, Field: "RB"},
+					{Pos: 7, Field: "N"},
+				},
+			},
+		},
+	}
+}
+
+// NeutralState is the failsafe input: sticks centered, triggers and buttons
+// released
+func NeutralState() *protocol.ControllerState {
+	return &protocol.ControllerState{
+		LeftX:  protocol.AXIS_CENTER,
+		LeftY:  protocol.AXIS_CENTER,
+		RightX: protocol.AXIS_CENTER,
+		RightY: protocol.AXIS_CENTER,
+	}
+}
+
+// Current returns the config in effect, defaulting to the Python format
+func (f *ByteFormatter) Current() *ByteConfig {
+	if c := f.live.Load(); c != nil {
+		return c
+	}
+	if f.Config == nil {
+		return DefaultConfig()
+	}
+	return f.Config
+}
+
+// SetConfig atomically swaps the mapping used by subsequent frames
+func (f *ByteFormatter) SetConfig(config *ByteConfig) {
+	f.live.Store(config)
+}
+
+// SetProfile selects the named profile for subsequent frames
+func (f *ByteFormatter) SetProfile(name string) {
+	f.profile.Store(&name)
+}
+
+// Profile returns the active profile name, "" for the default mapping
+func (f *ByteFormatter) Profile() string {
+	if p := f.profile.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// Format converts controller state to Arduino bytes
+func (f *ByteFormatter) Format(state *protocol.ControllerState) []byte {
+	return f.format(state, true)
+}
+
+// FormatStop is Format without max_delta_per_frame, for a frame that must
+// cut the output at once however the last one got there, such as the
+// e-stop's failsafe frame. Frames after it slew from it.
+func (f *ByteFormatter) FormatStop(state *protocol.ControllerState) []byte {
+	return f.format(state, false)
+}
+
+// format is Format, slew limited or not
+func (f *ByteFormatter) format(state *protocol.ControllerState, slewed bool) []byte {
+	config := f.Current()
+	frame := f.frames.Add(1) - 1
+
+	output := make([]byte, config.OutputSize)
+
+	f.slewMu.Lock()
+	defer f.slewMu.Unlock()
+	last := f.last
+	if !slewed || len(last) != len(output) {
+		last = nil
+	}
+
+	// Build each byte according to config. Entries fill one byte each,
+	// except field16 which fills two.
+	i := 0
+	for _, byteMap := range config.profileBytes(f.Profile()) {
+		if i >= len(output) {
+			break
+		}
+
+		mapType := byteMap.Type
+		if byteMap.When != "" && !f.conditionHolds(config, state, byteMap.When) {
+			mapType = "default"
+		}
+
+		switch mapType {
+		case "default":
+			output[i] = byteMap.Default
+			if byteMap.Type == "field16" && i+1 < len(output) {
+				i++
+				output[i] = byteMap.Default
+			}
+
+		case "const":
+			output[i] = byteMap.Value
+
+		case "field":
+			output[i] = byteMap.curve(byteMap.deadzone(f.FieldValue(state, byteMap.Field)))
+
+		case "bits":
+			// Value supplies fixed bits, e.g. a start/end marker sharing
+			// the byte with buttons
+			b := byteMap.Value
+			for _, bit := range byteMap.Bits {
+				if f.FieldValue(state, bit.Field) != 0 {
+					b |= (1 << bit.Pos)
+				}
+			}
+			output[i] = b
+
+		case "checksum":
+			output[i] = checksum(byteMap.Algo, output[:i])
+
+		case "counter":
+			// Rolls over every 256 frames; firmware treats a counter that
+			// stops changing as a dead link
+			output[i] = uint8(frame)
+
+		case "scale":
+			output[i] = byteMap.scale(byteMap.curve(byteMap.deadzone(f.FieldValue(state, byteMap.Field))))
+
+		case "field16":
+			if i+1 >= len(output) {
+				break
+			}
+			v := f.Field16Value(state, byteMap.Field)
+			if byteMap.Signed {
+				v ^= 0x8000 // offset binary to two's complement int16
+			}
+			if byteMap.Endian == "little" {
+				binary.LittleEndian.PutUint16(output[i:], v)
+			} else {
+				binary.BigEndian.PutUint16(output[i:], v)
+			}
+			i++
+
+		case "expr":
+			output[i] = f.evalExpr(state, byteMap.Expr)
+		}
+		if byteMap.MaxDeltaPerFrame > 0 && last != nil && byteMap.Type != "field16" {
+			output[i] = slew(last[i], output[i], byteMap.MaxDeltaPerFrame)
+		}
+		i++
+	}
+
+	f.last = output
+	return output
+}
+
+// ResetSlew forgets the previous frame so the next one is output without
+// slew limiting, e.g. the failsafe frame after the Arduino resets
+func (f *ByteFormatter) ResetSlew() {
+	f.slewMu.Lock()
+	f.last = nil
+	f.slewMu.Unlock()
+}
+
+// slew moves from prev toward target by at most delta
+func slew(prev, target, delta uint8) uint8 {
+	switch {
+	case int(target) > int(prev)+int(delta):
+		return prev + delta
+	case int(target) < int(prev)-int(delta):
+		return prev - delta
+	}
+	return target
+}
+
+// conditionHolds evaluates a mapping's "when": a profile name defined in
+// config is true while that profile is active, anything else is an expr
+func (f *ByteFormatter) conditionHolds(config *ByteConfig, state *protocol.ControllerState, when string) bool {
+	if DefinesProfile(config.Profiles, when) {
+		return f.Profile() == when
+	}
+	v, ok := f.exprValue(state, when)
+	return ok && v != 0
+}
+
+// evalExpr evaluates an "expr" mapping, rounded and clamped to a byte
+func (f *ByteFormatter) evalExpr(state *protocol.ControllerState, src string) uint8 {
+	v, ok := f.exprValue(state, src)
+	if !ok || math.IsNaN(v) {
+		return 0
+	}
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// exprValue evaluates an expression, compiling it on first use. An
+// expression that doesn't compile is logged once and reports !ok.
+func (f *ByteFormatter) exprValue(state *protocol.ControllerState, src string) (float64, bool) {
+	cached, ok := f.exprs.Load(src)
+	if !ok {
+		e, err := CompileExpr(src)
+		if err != nil {
+			slog.Warn("Bad expr", "expr", src, "err", err)
+			cached = nil
+		} else {
+			cached = e
+		}
+		f.exprs.Store(src, cached)
+	}
+	e, _ := cached.(Expr)
+	if e == nil {
+		return 0, false
+	}
+
+	return e.Eval(func(field string) float64 {
+		switch field {
+		case "dX":
+			return float64(state.DPadX)
+		case "dY":
+			return float64(state.DPadY)
+		}
+		return float64(f.FieldValue(state, field))
+	}), true
+}
+
+// deadzone snaps axis values near center to exactly center so resting
+// sticks don't creep the motors
+func (m *ByteMapping) deadzone(v uint8) uint8 {
+	return Deadzone(v, m.Deadzone)
+}
+
+// Deadzone snaps an axis value within deadzone of center to center
+func Deadzone(v, deadzone uint8) uint8 {
+	if deadzone == 0 {
+		return v
+	}
+	diff := int(v) - protocol.AXIS_CENTER
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= int(deadzone) {
+		return protocol.AXIS_CENTER
+	}
+	return v
+}
+
+// curve applies the mapping's response curve to an axis value
+func (m *ByteMapping) curve(v uint8) uint8 {
+	return m.Curve.Apply(v)
+}
+
+// Apply reshapes an axis value with the curve. A nil curve is linear.
+func (c *CurveConfig) Apply(v uint8) uint8 {
+	if c == nil {
+		return v
+	}
+
+	if len(c.Table) >= 2 {
+		pos := float64(v) / 255 * float64(len(c.Table)-1)
+		lo := int(pos)
+		if lo >= len(c.Table)-1 {
+			return uint8(c.Table[len(c.Table)-1])
+		}
+		frac := pos - float64(lo)
+		out := math.Round(float64(c.Table[lo]) + frac*float64(c.Table[lo+1]-c.Table[lo]))
+		return uint8(math.Max(0, math.Min(255, out)))
+	}
+
+	if c.Expo == 0 {
+		return v
+	}
+	x := float64(int(v)-protocol.AXIS_CENTER) / protocol.AXIS_CENTER
+	if v > protocol.AXIS_CENTER {
+		x = float64(int(v)-protocol.AXIS_CENTER) / (255 - protocol.AXIS_CENTER)
+	}
+	y := (1-c.Expo)*x + c.Expo*x*x*x
+	out := protocol.AXIS_CENTER + y*protocol.AXIS_CENTER
+	if y > 0 {
+		out = protocol.AXIS_CENTER + y*(255-protocol.AXIS_CENTER)
+	}
+	return uint8(math.Max(0, math.Min(255, math.Round(out))))
+}
+
+// scale maps v through the mapping's input and output ranges
+func (m *ByteMapping) scale(v uint8) uint8 {
+	inMin, inMax := m.InMin, m.InMax
+	if inMin == 0 && inMax == 0 {
+		inMax = 255
+	}
+	outMin, outMax := m.OutMin, m.OutMax
+	if outMin == 0 && outMax == 0 {
+		outMax = 255
+	}
+	if inMin == inMax {
+		return uint8(outMin)
+	}
+
+	t := float64(int(v)-inMin) / float64(inMax-inMin)
+	t = math.Max(0, math.Min(1, t))
+	if m.Invert {
+		t = 1 - t
+	}
+	out := math.Round(float64(outMin) + t*float64(outMax-outMin))
+	return uint8(math.Max(0, math.Min(255, out)))
+}
+
+// checksum computes a checksum byte over data, defaulting to xor
+func checksum(algo string, data []byte) uint8 {
+	switch algo {
+	case "sum":
+		var sum uint8
+		for _, b := range data {
+			sum += b
+		}
+		return sum
+	case "crc8":
+		return protocol.ComputeCRC8(data)
+	default:
+		var x uint8
+		for _, b := range data {
+			x ^= b
+		}
+		return x
+	}
+}
+
+// FieldValue gets value from state by field name
+func (f *ByteFormatter) FieldValue(state *protocol.ControllerState, field string) uint8 {
+	switch field {
+	case "N":
+		return state.North
+	case "E":
+		return state.East
+	case "S":
+		return state.South
+	case "W":
+		return state.West
+	case "LB":
+		return state.LeftBumper
+	case "RB":
+		return state.RightBumper
+	case "LS":
+		return state.LeftStick
+	case "RS":
+		return state.RightStick
+	case "SELECT":
+		return state.Select
+	case "START":
+		return state.Start
+	case "LjoyX":
+		return state.LeftX
+	case "LjoyY":
+		return state.LeftY
+	case "RjoyX":
+		return state.RightX
+	case "RjoyY":
+		return state.RightY
+	case "LT":
+		return state.LeftTrigger
+	case "RT":
+		return state.RightTrigger
+	case "dX":
+		return uint8(state.DPadX)
+	case "dY":
+		return uint8(state.DPadY)
+	case "mixL", "mixR":
+		left, right := f.arcadeMix(state)
+		if field == "mixL" {
+			return left
+		}
+		return right
+	default:
+		return 0
+	}
+}
+
+// arcadeMix converts throttle and steer axes into left/right motor values.
+// When a side would exceed full speed both are scaled down together so the
+// turn ratio is preserved.
+func (f *ByteFormatter) arcadeMix(state *protocol.ControllerState) (left, right uint8) {
+	config := f.Current()
+	if config.Mix != "arcade" {
+		return protocol.AXIS_CENTER, protocol.AXIS_CENTER
+	}
+	throttleField, steerField := config.MixThrottle, config.MixSteer
+	if throttleField == "" {
+		throttleField = "LjoyY"
+	}
+	if steerField == "" {
+		steerField = "RjoyX"
+	}
+	return ArcadeMix(f.FieldValue(state, throttleField), f.FieldValue(state, steerField), config.TurnGain, config.MaxSpeed)
+}
+
+// ArcadeMix turns a throttle axis (stick up = forward) and a steer axis
+// into left and right motor values centered on 127, as the "arcade" Mix
+// does. Zero turnGain and maxSpeed mean 1.
+func ArcadeMix(throttleAxis, steerAxis uint8, turnGain, maxSpeed float64) (left, right uint8) {
+	if maxSpeed == 0 {
+		maxSpeed = 1
+	}
+	if turnGain == 0 {
+		turnGain = 1
+	}
+
+	throttle := float64(protocol.AXIS_CENTER-int(throttleAxis)) / protocol.AXIS_CENTER
+	steer := float64(int(steerAxis)-protocol.AXIS_CENTER) / protocol.AXIS_CENTER
+	l := throttle + turnGain*steer
+	r := throttle - turnGain*steer
+	if m := math.Max(math.Abs(l), math.Abs(r)); m > 1 {
+		l, r = l/m, r/m
+	}
+
+	toByte := func(v float64) uint8 {
+		out := math.Round(protocol.AXIS_CENTER + v*maxSpeed*protocol.AXIS_CENTER)
+		return uint8(math.Max(0, math.Min(255, out)))
+	}
+	return toByte(l), toByte(r)
+}
+
+// Field16Value gets a 16-bit value for field. Axes use the full-resolution
+// value when the client sent one consistent with the 8-bit field; anything
+// else is widened from 8 bits.
+func (f *ByteFormatter) Field16Value(state *protocol.ControllerState, field string) uint16 {
+	var hi uint16
+	switch field {
+	case "LjoyX":
+		hi = state.LeftX16
+	case "LjoyY":
+		hi = state.LeftY16
+	case "RjoyX":
+		hi = state.RightX16
+	case "RjoyY":
+		hi = state.RightY16
+	case "LT":
+		hi = state.LeftTrigger16
+	case "RT":
+		hi = state.RightTrigger16
+	}
+	v := f.FieldValue(state, field)
+	if uint8(hi>>8) == v && hi != 0 {
+		return hi
+	}
+	return uint16(v)<<8 | uint16(v)
+}
+
+// usesImplicitMarkers reports whether a config looks like it was written for
+// the old formatter, which silently merged the Python start/end markers into
+// "bits" bytes 0 and 5 of any 6-byte frame
+func (c *ByteConfig) usesImplicitMarkers() bool {
+	if c.OutputSize != 6 || len(c.Bytes) != 6 {
+		return false
+	}
+	first, last := c.Bytes[0], c.Bytes[5]
+	return first.Type == "bits" && first.Value == 0 && last.Type == "bits" && last.Value == 0
+}
+
+// LoadConfig loads configuration from file. format is "json", "yaml" or
+// "toml"; "" picks it from the file extension.
+func LoadConfig(filename, format string) (*ByteConfig, error) {
+	format, err := ConfigFormat(filename, format)
+	if err != nil {
+		return nil, &ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonData, err := ConfigToJSON(data, format)
+	if err != nil {
+		return nil, &ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+
+	var config ByteConfig
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		// Positions are only meaningful in the file the user wrote
+		if format == CONFIG_JSON {
+			err = DescribeJSONError(data, err)
+		}
+		return nil, &ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+	if err := config.Validate(); err != nil {
+		var cfgErr *ConfigError
+		if errors.As(err, &cfgErr) {
+			cfgErr.File = filename
+		}
+		return nil, err
+	}
+
+	for _, dev := range config.OutputDevices() {
+		if dev.usesImplicitMarkers() {
+			slog.Warn(fmt.Sprintf("Config has no start/end marker values; 6-byte frames no longer "+
+				"get %#02x/%#02x injected, add \"value\" to its first and last \"bits\" entries",
+				PYTHON_START_BYTE, PYTHON_END_BYTE), "file", filename, "device", dev.Name)
+		}
+	}
+
+	return &config, nil
+}
+
+// InputFields marks the fields c reads, following the virtual mix fields
+// back to their inputs
+func (c *ByteConfig) InputFields(used map[string]bool) {
+	mark := func(src string) {
+		if e, err := CompileExpr(src); err == nil {
+			// eval visits every operand, so this sees every field named
+			e.Eval(func(field string) float64 {
+				used[field] = true
+				return 0
+			})
+		}
+	}
+	bytes := func(mappings []ByteMapping) {
+		for _, m := range mappings {
+			switch m.Type {
+			case "field", "scale", "field16":
+				used[m.Field] = true
+			case "bits":
+				for _, bit := range m.Bits {
+					used[bit.Field] = true
+				}
+			case "expr":
+				mark(m.Expr)
+			}
+			if m.When != "" && !DefinesProfile(c.Profiles, m.When) {
+				mark(m.When)
+			}
+		}
+	}
+
+	bytes(c.Bytes)
+	for _, p := range c.Profiles {
+		bytes(p.Bytes)
+		for _, field := range p.Combo {
+			used[field] = true
+		}
+	}
+	if c.Mix != "" && (used["mixL"] || used["mixR"]) {
+		throttleField, steerField := c.MixThrottle, c.MixSteer
+		if throttleField == "" {
+			throttleField = "LjoyY"
+		}
+		if steerField == "" {
+			steerField = "RjoyX"
+		}
+		used[throttleField] = true
+		used[steerField] = true
+	}
+}
@@ -0,0 +1,207 @@
+package formatter
+
+import (
+	"bytes"
+	"testing"
+
+	"lunabotics/pkg/protocol"
+)
+
+// neutralWith returns the neutral state with edit applied
+func neutralWith(edit func(*protocol.ControllerState)) protocol.ControllerState {
+	s := *NeutralState()
+	edit(&s)
+	return s
+}
+
+func TestFormat(t *testing.T) {
+	field := func(name string) ByteMapping { return ByteMapping{Type: "field", Field: name} }
+	one := func(m ByteMapping) *ByteConfig { return &ByteConfig{OutputSize: 1, Bytes: []ByteMapping{m}} }
+	two := func(m ByteMapping) *ByteConfig { return &ByteConfig{OutputSize: 2, Bytes: []ByteMapping{m}} }
+	profiles := &ByteConfig{
+		OutputSize: 1,
+		Bytes:      []ByteMapping{field("LT")},
+		Profiles:   []*ProfileConfig{{Name: "dig", Bytes: []ByteMapping{field("RT")}}, {Name: "flag"}},
+	}
+	triggers := neutralWith(func(s *protocol.ControllerState) { s.LeftTrigger, s.RightTrigger = 10, 20 })
+
+	tests := []struct {
+		name    string
+		config  *ByteConfig
+		profile string
+		states  []protocol.ControllerState // formatted in turn; the last frame is checked
+		want    []byte
+	}{
+		{"python default at rest", DefaultConfig(), "",
+			[]protocol.ControllerState{*NeutralState()},
+			[]byte{0xA8, 0x7F, 0x7F, 0x7F, 0x00, 0x15}},
+		{"python default driving", DefaultConfig(), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) {
+				s.South, s.North, s.RightBumper = 1, 1, 1
+				s.LeftX, s.LeftY, s.RightTrigger = 10, 200, 255
+			})},
+			[]byte{0xAC, 0x0A, 0xC8, 0x7F, 0xFF, 0xD5}},
+		{"const", one(ByteMapping{Type: "const", Value: 0x42}), "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{0x42}},
+		{"dpad is two's complement", one(field("dX")), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.DPadX = -1 })}, []byte{0xFF}},
+		{"scale", one(ByteMapping{Type: "scale", Field: "RT", OutMax: 100}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.RightTrigger = 128 })}, []byte{50}},
+		{"scale clamps", one(ByteMapping{Type: "scale", Field: "RT", InMin: 100, InMax: 200, OutMax: 100}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.RightTrigger = 250 })}, []byte{100}},
+		{"scale inverted", one(ByteMapping{Type: "scale", Field: "RT", OutMax: 100, Invert: true}), "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{100}},
+		{"scale with an empty input range", one(ByteMapping{Type: "scale", Field: "RT", InMin: 10, InMax: 10, OutMin: 5, OutMax: 9}), "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{5}},
+		{"inside the deadzone", one(ByteMapping{Type: "field", Field: "LjoyX", Deadzone: 10}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX = 135 })}, []byte{127}},
+		{"outside the deadzone", one(ByteMapping{Type: "field", Field: "LjoyX", Deadzone: 10}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX = 138 })}, []byte{138}},
+		{"expo curve", one(ByteMapping{Type: "field", Field: "LjoyX", Curve: &CurveConfig{Expo: 1}}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX = 191 })}, []byte{143}},
+		{"table curve", one(ByteMapping{Type: "field", Field: "LjoyX", Curve: &CurveConfig{Table: []int{0, 100, 255}}}), "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{100}},
+		{"field16 widened", two(ByteMapping{Type: "field16", Field: "LjoyX"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX = 0xAB })}, []byte{0xAB, 0xAB}},
+		{"field16 big endian", two(ByteMapping{Type: "field16", Field: "LjoyX"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX, s.LeftX16 = 0x12, 0x1234 })},
+			[]byte{0x12, 0x34}},
+		{"field16 little endian", two(ByteMapping{Type: "field16", Field: "LjoyX", Endian: "little"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX, s.LeftX16 = 0x12, 0x1234 })},
+			[]byte{0x34, 0x12}},
+		{"field16 signed", two(ByteMapping{Type: "field16", Field: "LjoyX", Signed: true}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX, s.LeftX16 = 0x12, 0x1234 })},
+			[]byte{0x92, 0x34}},
+		{"field16 inconsistent with the 8-bit axis", two(ByteMapping{Type: "field16", Field: "LjoyX"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftX, s.LeftX16 = 0x20, 0x1234 })},
+			[]byte{0x20, 0x20}},
+		{"expr", one(ByteMapping{Type: "expr", Expr: "(LjoyY + RjoyX) / 2"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftY, s.RightX = 100, 200 })}, []byte{150}},
+		{"expr clamps", one(ByteMapping{Type: "expr", Expr: "LjoyX - 300"}), "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{0}},
+		{"expr sees the signed dpad", one(ByteMapping{Type: "expr", Expr: "dX * 10 + 50"}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.DPadX = -1 })}, []byte{40}},
+		{"xor checksum", &ByteConfig{OutputSize: 3, Bytes: []ByteMapping{
+			{Type: "const", Value: 0x01}, {Type: "const", Value: 0x02}, {Type: "checksum"}}}, "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{0x01, 0x02, 0x03}},
+		{"sum checksum", &ByteConfig{OutputSize: 3, Bytes: []ByteMapping{
+			{Type: "const", Value: 0xFF}, {Type: "const", Value: 0x02}, {Type: "checksum", Algo: "sum"}}}, "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{0xFF, 0x02, 0x01}},
+		{"crc8 checksum", &ByteConfig{OutputSize: 3, Bytes: []ByteMapping{
+			{Type: "const", Value: 0x01}, {Type: "const", Value: 0x02}, {Type: "checksum", Algo: "crc8"}}}, "",
+			[]protocol.ControllerState{*NeutralState()}, []byte{0x01, 0x02, protocol.ComputeCRC8([]byte{0x01, 0x02})}},
+		{"counter", one(ByteMapping{Type: "counter"}), "",
+			[]protocol.ControllerState{*NeutralState(), *NeutralState(), *NeutralState()}, []byte{2}},
+		{"slew limited", one(ByteMapping{Type: "field", Field: "RT", MaxDeltaPerFrame: 10}), "",
+			[]protocol.ControllerState{*NeutralState(), neutralWith(func(s *protocol.ControllerState) { s.RightTrigger = 200 })},
+			[]byte{10}},
+		{"arcade mix forward", &ByteConfig{OutputSize: 2, Mix: "arcade", Bytes: []ByteMapping{field("mixL"), field("mixR")}}, "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftY = 0 })}, []byte{254, 254}},
+		{"arcade mix at half speed", &ByteConfig{OutputSize: 2, Mix: "arcade", MaxSpeed: 0.5, Bytes: []ByteMapping{field("mixL"), field("mixR")}}, "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.LeftY = 0 })}, []byte{191, 191}},
+		{"default profile", profiles, "", []protocol.ControllerState{triggers}, []byte{10}},
+		{"profile", profiles, "dig", []protocol.ControllerState{triggers}, []byte{20}},
+		{"profile without bytes", profiles, "flag", []protocol.ControllerState{triggers}, []byte{10}},
+		{"when expr false", one(ByteMapping{Type: "field", Field: "LT", When: "START == 1", Default: 7}), "",
+			[]protocol.ControllerState{triggers}, []byte{7}},
+		{"when expr true", one(ByteMapping{Type: "field", Field: "LT", When: "START == 1", Default: 7}), "",
+			[]protocol.ControllerState{neutralWith(func(s *protocol.ControllerState) { s.Start, s.LeftTrigger = 1, 10 })}, []byte{10}},
+		{"when profile inactive", &ByteConfig{OutputSize: 1, Profiles: profiles.Profiles,
+			Bytes: []ByteMapping{{Type: "field", Field: "LT", When: "flag", Default: 7}}}, "",
+			[]protocol.ControllerState{triggers}, []byte{7}},
+		{"when profile active", &ByteConfig{OutputSize: 1, Profiles: profiles.Profiles,
+			Bytes: []ByteMapping{{Type: "field", Field: "LT", When: "flag", Default: 7}}}, "flag",
+			[]protocol.ControllerState{triggers}, []byte{10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &ByteFormatter{Config: tt.config}
+			f.SetProfile(tt.profile)
+			var got []byte
+			for i := range tt.states {
+				got = f.Format(&tt.states[i])
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("Format = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+// FormatStop cuts to the stop frame at once, and the frames after it slew
+// from there
+func TestFormatStop(t *testing.T) {
+	f := &ByteFormatter{Config: &ByteConfig{OutputSize: 1,
+		Bytes: []ByteMapping{{Type: "field", Field: "RT", MaxDeltaPerFrame: 10}}}}
+	pulled := neutralWith(func(s *protocol.ControllerState) { s.RightTrigger = 200 })
+	f.Format(&pulled)
+	if got := f.FormatStop(NeutralState()); got[0] != 0 {
+		t.Fatalf("FormatStop = %d after RT 200, want 0", got[0])
+	}
+	if got := f.Format(&pulled); got[0] != 10 {
+		t.Fatalf("Format = %d after the stop, want one slew step to 10", got[0])
+	}
+}
+
+func TestDecodeFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *ByteConfig
+		profile string
+		state   protocol.ControllerState // only fields the config carries may differ from neutral
+	}{
+		{"python default", DefaultConfig(), "",
+			neutralWith(func(s *protocol.ControllerState) {
+				s.West, s.East, s.South, s.LeftBumper, s.RightBumper, s.North = 1, 0, 1, 1, 0, 1
+				s.LeftX, s.LeftY, s.RightY, s.RightTrigger = 3, 250, 64, 180
+			})},
+		{"python default at rest", DefaultConfig(), "", *NeutralState()},
+		{"full-range inverted scale", &ByteConfig{OutputSize: 1, Bytes: []ByteMapping{
+			{Type: "scale", Field: "RjoyX", Invert: true}}}, "",
+			neutralWith(func(s *protocol.ControllerState) { s.RightX = 40 })},
+		{"field16 signed little endian", &ByteConfig{OutputSize: 2, Bytes: []ByteMapping{
+			{Type: "field16", Field: "LT", Signed: true, Endian: "little"}}}, "",
+			neutralWith(func(s *protocol.ControllerState) { s.LeftTrigger, s.LeftTrigger16 = 0xC3, 0xC3A5 })},
+		{"dpad with checksum", &ByteConfig{OutputSize: 4, Bytes: []ByteMapping{
+			{Type: "const", Value: 0xAA}, {Type: "field", Field: "dX"}, {Type: "field", Field: "dY"}, {Type: "checksum", Algo: "crc8"}}}, "",
+			neutralWith(func(s *protocol.ControllerState) { s.DPadX, s.DPadY = -1, 1 })},
+		{"profile", &ByteConfig{OutputSize: 1, Bytes: []ByteMapping{{Type: "field", Field: "LT"}},
+			Profiles: []*ProfileConfig{{Name: "dig", Bytes: []ByteMapping{{Type: "field", Field: "RT"}}}}}, "dig",
+			neutralWith(func(s *protocol.ControllerState) { s.RightTrigger = 99 })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &ByteFormatter{Config: tt.config}
+			f.SetProfile(tt.profile)
+			frame := f.Format(&tt.state)
+			got, err := tt.config.Decode(frame, tt.profile)
+			if err != nil {
+				t.Fatalf("Decode(% X): %v", frame, err)
+			}
+			if *got != tt.state {
+				t.Fatalf("Decode(Format(s)) = %+v, want %+v", *got, tt.state)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	config := &ByteConfig{OutputSize: 3, Bytes: []ByteMapping{
+		{Type: "const", Value: 0xAA}, {Type: "bits", Value: 0x80, Bits: []BitMapping{{Pos: 0, Field: "N"}}}, {Type: "checksum"}}}
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"short frame", []byte{0xAA, 0x80}},
+		{"wrong const", []byte{0xAB, 0x80, 0x2B}},
+		{"missing fixed bits", []byte{0xAA, 0x01, 0xAB}},
+		{"bad checksum", []byte{0xAA, 0x80, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := config.Decode(tt.frame, ""); err == nil {
+				t.Fatalf("Decode(% X) succeeded", tt.frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package formatter
+
+// Fuzz target for byte configs and the states formatted with them. Run it
+// from the repository root with
+//
+//	go test -fuzz FuzzFormat -fuzzminimizetime 5s ./pkg/formatter
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// FuzzFormat formats arbitrary controller states with arbitrary configs.
+// Only configs that pass Validate reach the formatter, as in LoadConfig, and
+// those must produce a frame of their output size for any state.
+func FuzzFormat(f *testing.F) {
+	for _, name := range []string{"byte_config.json", "byte_config_8byte.json", "byte_config_devices.json"} {
+		config, err := os.ReadFile(filepath.Join("..", "..", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(config, []byte(`{"LjoyX":0,"LjoyY":255,"RT":200,"N":1,"dX":-1}`))
+	}
+	f.Add([]byte(`{"output_size":2,"bytes":[{"type":"expr","expr":"LjoyX/0"},{"type":"checksum","algo":"crc8"}]}`), []byte(`{}`))
+	f.Add([]byte(`{"output_size":1,"bytes":[{"type":"scale","field":"RT","in_min":10,"in_max":10}]}`), []byte(`{"RT":10}`))
+
+	f.Fuzz(func(t *testing.T, configJSON, stateJSON []byte) {
+		var config ByteConfig
+		dec := json.NewDecoder(bytes.NewReader(configJSON))
+		dec.DisallowUnknownFields()
+		if dec.Decode(&config) != nil || config.Validate() != nil {
+			return
+		}
+		var state protocol.ControllerState
+		if json.Unmarshal(stateJSON, &state) != nil {
+			return
+		}
+		for _, dev := range config.OutputDevices() {
+			devConfig := dev.ByteConfig
+			formatter := &ByteFormatter{Config: &devConfig}
+			for _, profile := range append([]string{""}, profileNames(&devConfig)...) {
+				formatter.SetProfile(profile)
+				if frame := formatter.Format(&state); len(frame) != devConfig.OutputSize {
+					t.Fatalf("device %s profile %q: %d byte frame, want %d", dev.Name, profile, len(frame), devConfig.OutputSize)
+				}
+			}
+			if _, err := serialout.EncodeFrame(devConfig.Framing, formatter.Format(&state)); err != nil {
+				t.Fatalf("device %s: framing a valid config failed: %v", dev.Name, err)
+			}
+		}
+	})
+}
+
+// profileNames lists the profiles a config defines
+func profileNames(config *ByteConfig) []string {
+	var names []string
+	for _, p := range config.Profiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
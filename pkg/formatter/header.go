@@ -0,0 +1,161 @@
+package formatter
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// WriteHeader emits a C header describing each device's frame layout so the
+// firmware is built from the same config as the server: frame size, the
+// offset of every mapped byte, bit masks for buttons and the ranges used by
+// scale mappings.
+func WriteHeader(w io.Writer, config *ByteConfig, source string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Generated by `server -gen-header` from %s. Do not edit.\n", source)
+	b.WriteString("#ifndef LUNABOTICS_FRAME_H\n#define LUNABOTICS_FRAME_H\n\n")
+	fmt.Fprintf(&b, "#define AXIS_CENTER %d\n", protocol.AXIS_CENTER)
+	fmt.Fprintf(&b, "#define TELEMETRY_SYNC 0x%02X\n", serialout.TELEMETRY_SYNC)
+	fmt.Fprintf(&b, "#define ACK_SYNC 0x%02X\n", serialout.ACK_SYNC)
+	fmt.Fprintf(&b, "#define ACK 0x%02X\n", serialout.ACK)
+	fmt.Fprintf(&b, "#define NACK 0x%02X\n", serialout.NACK)
+
+	fmt.Fprintf(&b, "#define IDENT_SYNC 0x%02X\n", serialout.IDENT_SYNC)
+	fmt.Fprintf(&b, "#define IDENT_REQUEST 0x%02X\n", serialout.IDENT_REQUEST)
+
+	for _, dev := range config.OutputDevices() {
+		prefix := cIdent(dev.Name)
+		ack := dev.Serial != nil && dev.Serial.Ack
+		fmt.Fprintf(&b, "\n// Device %q\n", dev.Name)
+		headerLayout(&b, prefix, &dev.ByteConfig, ack)
+		fmt.Fprintf(&b, "#define %s_LAYOUT_HASH 0x%08XUL // sent in the ident frame\n", prefix, LayoutHash(&dev.ByteConfig, ack))
+	}
+
+	b.WriteString("\n#endif // LUNABOTICS_FRAME_H\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// headerLayout writes the defines for one device's frame layout
+func headerLayout(b *strings.Builder, prefix string, config *ByteConfig, ack bool) {
+	fmt.Fprintf(b, "#define %s_FRAME_SIZE %d\n", prefix, config.OutputSize)
+	framing := config.Framing
+	if framing == serialout.FRAMING_NONE {
+		framing = "none"
+	}
+	fmt.Fprintf(b, "#define %s_FRAMING_%s 1\n", prefix, cIdent(framing))
+	if ack {
+		fmt.Fprintf(b, "#define %s_ACK_ENABLED 1 // frames are prefixed with an ID byte\n", prefix)
+	}
+
+	headerBytes(b, prefix, config.Bytes)
+	for _, p := range config.Profiles {
+		if len(p.Bytes) > 0 {
+			fmt.Fprintf(b, "\n// Profile %q\n", p.Name)
+			headerBytes(b, prefix+"_"+cIdent(p.Name), p.Bytes)
+		}
+	}
+}
+
+// LayoutHash identifies a frame layout: the CRC-32 of its header defines,
+// under a fixed prefix so renaming the device doesn't change it
+func LayoutHash(config *ByteConfig, ack bool) uint32 {
+	var b strings.Builder
+	headerLayout(&b, "FRAME", config, ack)
+	return crc32.ChecksumIEEE([]byte(b.String()))
+}
+
+// headerBytes writes the defines for one bytes list. Names are derived from
+// the field, with the offset appended when a field is mapped twice.
+func headerBytes(b *strings.Builder, prefix string, mappings []ByteMapping) {
+	used := make(map[string]bool)
+	name := func(base string, offset int) string {
+		n := prefix + "_" + cIdent(base)
+		if used[n] {
+			n = fmt.Sprintf("%s_%d", n, offset)
+		}
+		used[n] = true
+		return n
+	}
+
+	offset := 0
+	for _, m := range mappings {
+		switch m.Type {
+		case "const":
+			n := name(fmt.Sprintf("CONST%d", offset), offset)
+			fmt.Fprintf(b, "#define %s_BYTE %d\n", n, offset)
+			fmt.Fprintf(b, "#define %s_VALUE 0x%02X\n", n, m.Value)
+		case "field", "field16":
+			n := name(m.Field, offset)
+			fmt.Fprintf(b, "#define %s_BYTE %d\n", n, offset)
+			if m.Type == "field16" {
+				fmt.Fprintf(b, "#define %s_BIG_ENDIAN %d\n", n, boolInt(m.Endian != "little"))
+				fmt.Fprintf(b, "#define %s_SIGNED %d\n", n, boolInt(m.Signed))
+			}
+		case "scale":
+			n := name(m.Field, offset)
+			outMin, outMax := m.OutMin, m.OutMax
+			if outMin == 0 && outMax == 0 {
+				outMax = 255
+			}
+			fmt.Fprintf(b, "#define %s_BYTE %d\n", n, offset)
+			fmt.Fprintf(b, "#define %s_OUT_MIN %d\n", n, outMin)
+			fmt.Fprintf(b, "#define %s_OUT_MAX %d\n", n, outMax)
+			fmt.Fprintf(b, "#define %s_INVERTED %d\n", n, boolInt(m.Invert))
+		case "bits":
+			if m.Value != 0 {
+				fmt.Fprintf(b, "#define %s_MARKER%d_BYTE %d\n", prefix, offset, offset)
+				fmt.Fprintf(b, "#define %s_MARKER%d_MASK 0x%02X\n", prefix, offset, m.Value)
+			}
+			for _, bit := range m.Bits {
+				n := name(bit.Field, offset)
+				fmt.Fprintf(b, "#define %s_BYTE %d\n", n, offset)
+				fmt.Fprintf(b, "#define %s_MASK 0x%02X\n", n, 1<<bit.Pos)
+			}
+		case "checksum":
+			algo := m.Algo
+			if algo == "" {
+				algo = "xor"
+			}
+			n := name("CHECKSUM", offset)
+			fmt.Fprintf(b, "#define %s_BYTE %d\n", n, offset)
+			fmt.Fprintf(b, "#define %s_%s 1\n", n, cIdent(algo))
+		case "counter":
+			fmt.Fprintf(b, "#define %s_BYTE %d\n", name("COUNTER", offset), offset)
+		case "expr":
+			fmt.Fprintf(b, "#define %s_BYTE %d // %s\n", name(fmt.Sprintf("EXPR%d", offset), offset), offset, m.Expr)
+		}
+		offset += byteWidths[m.Type]
+	}
+}
+
+// cIdent turns a name into an upper-case C identifier
+func cIdent(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+			b.WriteRune(unicode.ToUpper(r))
+		case unicode.IsDigit(r):
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,32 @@
+package formatter
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"lunabotics/pkg/protocol"
+)
+
+// MacroConfig is a named sequence, started by holding every field in Combo
+type MacroConfig struct {
+	Name  string      `json:"name"`
+	Combo []string    `json:"combo"`
+	Steps []MacroStep `json:"steps"`
+}
+
+// MacroStep holds State for Ms milliseconds
+type MacroStep struct {
+	State json.RawMessage `json:"state"` // ControllerState fields; the rest stay neutral
+	Ms    int             `json:"ms"`
+}
+
+// DecodeState reads ControllerState fields on top of a neutral state
+func DecodeState(raw json.RawMessage) (*protocol.ControllerState, error) {
+	state := NeutralState()
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,106 @@
+package formatter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// LoadState reads a ControllerState from a JSON file ("-" for stdin).
+// Fields the file leaves out keep their neutral values.
+func LoadState(filename string) (*protocol.ControllerState, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := NeutralState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, DescribeJSONError(data, err))
+	}
+	return state, nil
+}
+
+// RunPreview prints the frame each device would receive for state, with a
+// per-byte and per-bit breakdown, without touching the network or serial
+// ports
+func RunPreview(w io.Writer, config *ByteConfig, state *protocol.ControllerState, profile string) error {
+	for _, dev := range config.OutputDevices() {
+		devConfig := dev.ByteConfig
+		f := &ByteFormatter{Config: &devConfig}
+		f.SetProfile(profile)
+		frame := f.Format(state)
+
+		fmt.Fprintf(w, "%s (%d bytes): % X\n", dev.Name, len(frame), frame)
+		if dev.Framing != "" {
+			wire, err := serialout.EncodeFrame(dev.Framing, frame)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  wire (%s): % X\n", dev.Framing, wire)
+		}
+
+		i := 0
+		for _, m := range devConfig.profileBytes(profile) {
+			width := byteWidths[m.Type]
+			for j := 0; j < width && i < len(frame); j++ {
+				fmt.Fprintf(w, "  [%d] 0x%02X %08b  %s\n", i, frame[i], frame[i], describeMapping(&m, j, frame[i]))
+				i++
+			}
+		}
+	}
+	return nil
+}
+
+// describeMapping summarizes what byte part of m contains. v is the
+// output byte, used to show which bits are set.
+func describeMapping(m *ByteMapping, part int, v byte) string {
+	var desc string
+	switch m.Type {
+	case "const":
+		desc = "const"
+	case "field", "scale", "field16":
+		desc = m.Type + " " + m.Field
+		if m.Type == "field16" {
+			half := "high"
+			if (part == 0) == (m.Endian == "little") {
+				half = "low"
+			}
+			desc += " (" + half + ")"
+		}
+	case "bits":
+		var bits []string
+		for _, b := range m.Bits {
+			bits = append(bits, fmt.Sprintf("%d:%s=%d", b.Pos, b.Field, v>>b.Pos&1))
+		}
+		desc = "bits " + strings.Join(bits, " ")
+		if m.Value != 0 {
+			desc += fmt.Sprintf(" | 0x%02X", m.Value)
+		}
+	case "checksum":
+		algo := m.Algo
+		if algo == "" {
+			algo = "xor"
+		}
+		desc = "checksum " + algo
+	case "expr":
+		desc = "expr " + m.Expr
+	default:
+		desc = m.Type
+	}
+	if m.When != "" {
+		desc += fmt.Sprintf(" when %s else %d", m.When, m.Default)
+	}
+	return desc
+}
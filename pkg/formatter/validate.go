@@ -0,0 +1,344 @@
+package formatter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// ConfigError lists every problem found in a byte mapping config
+type ConfigError struct {
+	File     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: invalid config:\n  %s", e.File, strings.Join(e.Problems, "\n  "))
+}
+
+// byteWidths gives the number of output bytes each mapping type fills
+var byteWidths = map[string]int{
+	"const": 1, "field": 1, "bits": 1, "checksum": 1, "counter": 1,
+	"scale": 1, "field16": 2, "expr": 1,
+}
+
+// Validate checks a config for mistakes that would otherwise silently
+// produce zeros: unknown types and fields, bit positions above 7, duplicate
+// bits, more bytes than OutputSize and unparseable expressions. It returns a
+// *ConfigError naming each offending entry.
+func (c *ByteConfig) Validate() error {
+	var problems []string
+	if len(c.Devices) > 0 {
+		if len(c.Bytes) > 0 || c.OutputSize != 0 {
+			problems = append(problems, "top-level bytes/output_size are ignored when devices are listed; move them into a device")
+		}
+		names := make(map[string]bool)
+		for i, dev := range c.Devices {
+			path := fmt.Sprintf("devices[%d]", i)
+			if dev.Name == "" {
+				problems = append(problems, path+": name is required")
+			} else if names[dev.Name] {
+				problems = append(problems, fmt.Sprintf("%s: duplicate device name %q", path, dev.Name))
+			}
+			names[dev.Name] = true
+			if len(dev.Devices) > 0 {
+				problems = append(problems, path+": devices cannot be nested")
+			}
+			if len(dev.Macros) > 0 {
+				problems = append(problems, path+": macros go at the top level, not in a device")
+			}
+			problems = append(problems, dev.validateMapping(path+".")...)
+		}
+	} else {
+		problems = c.validateMapping("")
+	}
+	problems = append(problems, c.validateMacros()...)
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// validateMapping checks a single device's frame. prefix locates it in the
+// file for error messages.
+func (c *ByteConfig) validateMapping(prefix string) []string {
+	var problems []string
+	add := func(path, format string, args ...any) {
+		problems = append(problems, prefix+path+": "+fmt.Sprintf(format, args...))
+	}
+	field := func(path, name string) {
+		if problem := FieldProblem(name); problem != "" {
+			add(path, "%s", problem)
+		}
+	}
+	button := func(path, name string) {
+		if err := protocol.CheckButton(name); err != nil {
+			add(path, "%v", err)
+		}
+	}
+
+	if c.OutputSize <= 0 {
+		add("output_size", "must be positive, got %d", c.OutputSize)
+	}
+	for _, problem := range c.validateBytes(c.Profiles) {
+		problems = append(problems, prefix+problem)
+	}
+
+	names := make(map[string]bool)
+	for i, profile := range c.Profiles {
+		path := fmt.Sprintf("profiles[%d]", i)
+		if profile.Name == "" {
+			add(path, "name is required")
+		} else if names[profile.Name] {
+			add(path, "duplicate profile name %q", profile.Name)
+		}
+		names[profile.Name] = true
+		for j, name := range profile.Combo {
+			button(fmt.Sprintf("%s.combo[%d]", path, j), name)
+		}
+
+		// Profiles share the frame layout, so check their bytes against the
+		// same output_size
+		variant := ByteConfig{OutputSize: c.OutputSize, Bytes: profile.Bytes}
+		for _, problem := range variant.validateBytes(c.Profiles) {
+			problems = append(problems, prefix+path+"."+problem)
+		}
+	}
+
+	switch c.Mix {
+	case "":
+	case "arcade":
+		if c.MixThrottle != "" {
+			field("mix_throttle", c.MixThrottle)
+		}
+		if c.MixSteer != "" {
+			field("mix_steer", c.MixSteer)
+		}
+		if c.MaxSpeed < 0 || c.MaxSpeed > 1 {
+			add("max_speed", "must be between 0 and 1, got %g", c.MaxSpeed)
+		}
+	default:
+		add("mix", "unknown mix %q (valid: arcade)", c.Mix)
+	}
+
+	if _, err := serialout.EncodeFrame(c.Framing, nil); err != nil {
+		add("framing", "%v", err)
+	}
+	if c.Serial != nil {
+		serialConfig := serialout.DefaultSerialConfig()
+		serialConfig.Merge(c.Serial)
+		if _, err := serialConfig.Mode(); err != nil {
+			add("serial", "%v", err)
+		}
+		if err := serialout.CheckOutputs(serialConfig.Outputs); err != nil {
+			add("serial", "%v", err)
+		}
+	}
+	return problems
+}
+
+// validateBytes checks the bytes list against output_size. profiles are
+// the names "when" conditions may refer to.
+func (c *ByteConfig) validateBytes(profiles []*ProfileConfig) []string {
+	var problems []string
+	add := func(path, format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+	field := func(path, name string) {
+		if problem := FieldProblem(name); problem != "" {
+			add(path, "%s", problem)
+		}
+	}
+
+	width := 0
+	for i, m := range c.Bytes {
+		path := fmt.Sprintf("bytes[%d]", i)
+		w, ok := byteWidths[m.Type]
+		if !ok {
+			add(path, "unknown type %q", m.Type)
+			w = 1
+		}
+		if c.OutputSize > 0 && width+w > c.OutputSize {
+			add(path, "writes byte %d but output_size is %d", width+w-1, c.OutputSize)
+		}
+		width += w
+
+		switch m.Type {
+		case "field", "scale", "field16":
+			field(path, m.Field)
+		case "bits":
+			if len(m.Bits) == 0 {
+				add(path, "bits mapping has no bits")
+			}
+			used := make(map[uint8]int)
+			for j, bit := range m.Bits {
+				bitPath := fmt.Sprintf("%s.bits[%d]", path, j)
+				if bit.Pos > 7 {
+					add(bitPath, "bit position %d out of range 0-7", bit.Pos)
+				}
+				if prev, dup := used[bit.Pos]; dup {
+					add(bitPath, "bit %d already assigned by bits[%d]", bit.Pos, prev)
+				}
+				used[bit.Pos] = j
+				if m.Value&(1<<bit.Pos) != 0 {
+					add(bitPath, "bit %d is always set by value %#02x", bit.Pos, m.Value)
+				}
+				field(bitPath, bit.Field)
+			}
+		case "checksum":
+			switch m.Algo {
+			case "", "xor", "sum", "crc8":
+			default:
+				add(path, "unknown checksum algo %q (valid: xor, sum, crc8)", m.Algo)
+			}
+		case "expr":
+			if _, err := CompileExpr(m.Expr); err != nil {
+				add(path, "expr %q: %v", m.Expr, err)
+			}
+		}
+
+		if m.Curve != nil {
+			if m.Type != "field" && m.Type != "scale" {
+				add(path, "curve only applies to field and scale mappings")
+			}
+			for _, problem := range m.Curve.Problems() {
+				add(path+".curve", "%s", problem)
+			}
+		}
+
+		if m.When != "" && !DefinesProfile(profiles, m.When) {
+			if _, err := CompileExpr(m.When); err != nil {
+				add(path, "when %q is neither a profile nor a valid expr: %v", m.When, err)
+			}
+		}
+
+		if m.MaxDeltaPerFrame > 0 && m.Type != "field" && m.Type != "scale" && m.Type != "expr" {
+			add(path, "max_delta_per_frame only applies to field, scale and expr mappings")
+		}
+
+		if m.Type == "scale" && m.InMin == m.InMax && m.InMin != 0 {
+			add(path, "in_min and in_max are both %d", m.InMin)
+		}
+		if m.Type == "field16" && m.Endian != "" && m.Endian != "big" && m.Endian != "little" {
+			add(path, "endian must be \"big\" or \"little\", got %q", m.Endian)
+		}
+	}
+	return problems
+}
+
+// Problems lists what is wrong with a curve, nil if nothing
+func (c *CurveConfig) Problems() []string {
+	var problems []string
+	if c.Expo < 0 || c.Expo > 1 {
+		problems = append(problems, fmt.Sprintf("expo must be between 0 and 1, got %g", c.Expo))
+	}
+	if len(c.Table) > 0 {
+		if c.Expo != 0 {
+			problems = append(problems, "set either expo or table, not both")
+		}
+		if len(c.Table) < 2 {
+			problems = append(problems, fmt.Sprintf("table needs at least 2 points, got %d", len(c.Table)))
+		}
+		for j, v := range c.Table {
+			if v < 0 || v > 255 {
+				problems = append(problems, fmt.Sprintf("table[%d]: %d out of range 0-255", j, v))
+			}
+		}
+	}
+	return problems
+}
+
+// DefinesProfile reports whether profiles includes name
+func DefinesProfile(profiles []*ProfileConfig, name string) bool {
+	for _, p := range profiles {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldProblem explains why name can't be read from a ControllerState, or
+// returns "" if it can
+func FieldProblem(name string) string {
+	if name == "" {
+		return "field is required"
+	}
+	if !IsStateField(name) {
+		return fmt.Sprintf("unknown field %q (valid: %s)", name, strings.Join(StateFields, ", "))
+	}
+	return ""
+}
+
+// DescribeJSONError adds the line and column to JSON decode errors, which
+// only carry a byte offset
+func DescribeJSONError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	line, col := 1, 1
+	for _, b := range data[:min(int(offset), len(data))] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+// validateMacros checks each macro has a unique name, a combo of real
+// fields and steps that decode to states
+func (c *ByteConfig) validateMacros() []string {
+	var problems []string
+	add := func(path, format string, args ...any) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	names := make(map[string]bool)
+	for i, m := range c.Macros {
+		path := fmt.Sprintf("macros[%d]", i)
+		if m.Name == "" {
+			add(path, "name is required")
+		} else if names[m.Name] {
+			add(path, "duplicate macro name %q", m.Name)
+		}
+		names[m.Name] = true
+		if len(m.Combo) == 0 {
+			add(path+".combo", "is required")
+		}
+		for j, name := range m.Combo {
+			if err := protocol.CheckButton(name); err != nil {
+				add(fmt.Sprintf("%s.combo[%d]", path, j), "%v", err)
+			}
+		}
+		if len(m.Steps) == 0 {
+			add(path+".steps", "is required")
+		}
+		for j, step := range m.Steps {
+			stepPath := fmt.Sprintf("%s.steps[%d]", path, j)
+			if step.Ms <= 0 {
+				add(stepPath+".ms", "must be positive, got %d", step.Ms)
+			}
+			if _, err := DecodeState(step.State); err != nil {
+				add(stepPath+".state", "%v", err)
+			}
+		}
+	}
+	return problems
+}
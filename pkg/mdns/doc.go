@@ -0,0 +1,3 @@
+// Package mdns is the minimal multicast DNS the server uses to advertise
+// itself and the client uses to find it.
+package mdns
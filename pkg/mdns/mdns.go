@@ -0,0 +1,266 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Just enough multicast DNS (RFC 6762) and DNS-SD (RFC 6763) for the server
+// to advertise itself and the client to find it on the field network.
+
+const (
+	MDNS_SERVICE = "_lunabotics-ctl._tcp.local."
+	MDNS_GROUP   = "224.0.0.251:5353"
+	MDNS_PORT    = 5353
+	MDNS_TTL     = 120 // seconds
+)
+
+// DNS record types and classes used by discovery
+const (
+	DNS_TYPE_A   = 1
+	DNS_TYPE_PTR = 12
+	DNS_TYPE_TXT = 16
+	DNS_TYPE_SRV = 33
+	DNS_TYPE_ANY = 255
+
+	DNS_CLASS_IN    = 1
+	DNS_CACHE_FLUSH = 0x8000 // top bit of a record's class in mDNS
+	DNS_UNICAST     = 0x8000 // top bit of a question's class: reply directly
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+type Question struct {
+	Name string
+	Type uint16
+}
+
+// Record is a resource record. Only the fields for its Type are set.
+type Record struct {
+	Name  string
+	Type  uint16
+	Flush bool // mDNS cache-flush: this is the complete set for Name
+	TTL   uint32
+
+	Target string   // PTR, SRV
+	Port   uint16   // SRV
+	IP     net.IP   // A
+	Text   []string // TXT
+}
+
+// Message is a query or response. Parsing puts answer, authority and
+// additional records all in Answers.
+type Message struct {
+	ID        uint16
+	Response  bool
+	Questions []Question
+	Answers   []Record
+}
+
+// Pack encodes the message without name compression
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	if m.Response {
+		binary.BigEndian.PutUint16(b[2:], 0x8400) // response, authoritative
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendDNSName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, DNS_CLASS_IN)
+	}
+	for _, r := range m.Answers {
+		if b, err = appendDNSName(b, r.Name); err != nil {
+			return nil, err
+		}
+		class := uint16(DNS_CLASS_IN)
+		if r.Flush {
+			class |= DNS_CACHE_FLUSH
+		}
+		b = binary.BigEndian.AppendUint16(b, r.Type)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+		lenAt := len(b)
+		b = append(b, 0, 0)
+		switch r.Type {
+		case DNS_TYPE_A:
+			ip := r.IP.To4()
+			if ip == nil {
+				return nil, fmt.Errorf("A record for %s needs an IPv4 address", r.Name)
+			}
+			b = append(b, ip...)
+		case DNS_TYPE_PTR:
+			b, err = appendDNSName(b, r.Target)
+		case DNS_TYPE_SRV:
+			b = binary.BigEndian.AppendUint16(b, 0) // priority
+			b = binary.BigEndian.AppendUint16(b, 0) // weight
+			b = binary.BigEndian.AppendUint16(b, r.Port)
+			b, err = appendDNSName(b, r.Target)
+		case DNS_TYPE_TXT:
+			if len(r.Text) == 0 {
+				b = append(b, 0)
+			}
+			for _, s := range r.Text {
+				if len(s) > 255 {
+					return nil, fmt.Errorf("TXT string %q is too long", s)
+				}
+				b = append(b, byte(len(s)))
+				b = append(b, s...)
+			}
+		default:
+			return nil, fmt.Errorf("can't encode DNS record type %d", r.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint16(b[lenAt:], uint16(len(b)-lenAt-2))
+	}
+	return b, nil
+}
+
+// appendDNSName encodes a dotted name as labels
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("bad DNS name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// Parse decodes a message. Records of types discovery doesn't use are
+// kept with only their header fields.
+func Parse(msg []byte) (*Message, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessage
+	}
+	m := &Message{
+		ID:       binary.BigEndian.Uint16(msg[0:]),
+		Response: msg[2]&0x80 != 0,
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errDNSMessage
+		}
+		m.Questions = append(m.Questions, Question{Name: name, Type: binary.BigEndian.Uint16(msg[next:])})
+		off = next + 4
+	}
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		r := Record{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Flush: binary.BigEndian.Uint16(msg[next+2:])&DNS_CACHE_FLUSH != 0,
+			TTL:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		start := next + 10
+		end := start + int(binary.BigEndian.Uint16(msg[next+8:]))
+		if end > len(msg) {
+			return nil, errDNSMessage
+		}
+		data := msg[start:end]
+		switch r.Type {
+		case DNS_TYPE_A:
+			if len(data) != 4 {
+				return nil, errDNSMessage
+			}
+			r.IP = net.IP(append([]byte(nil), data...))
+		case DNS_TYPE_PTR:
+			if r.Target, _, err = readDNSName(msg, start); err != nil {
+				return nil, err
+			}
+		case DNS_TYPE_SRV:
+			if len(data) < 7 {
+				return nil, errDNSMessage
+			}
+			r.Port = binary.BigEndian.Uint16(data[4:])
+			if r.Target, _, err = readDNSName(msg, start+6); err != nil {
+				return nil, err
+			}
+		case DNS_TYPE_TXT:
+			for len(data) > 0 {
+				n := int(data[0])
+				if 1+n > len(data) {
+					return nil, errDNSMessage
+				}
+				if n > 0 {
+					r.Text = append(r.Text, string(data[1:1+n]))
+				}
+				data = data[1+n:]
+			}
+		}
+		m.Answers = append(m.Answers, r)
+		off = end
+	}
+	return m, nil
+}
+
+// readDNSName decodes the name at off, following compression pointers, and
+// returns it with a trailing dot and the offset just past it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errDNSMessage
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// SameName compares names case-insensitively, as DNS does
+func SameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
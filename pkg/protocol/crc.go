@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// DEFAULT_MAX_PACKET_SIZE is the largest payload (in bytes) a packet may
+// carry unless both ends are configured otherwise.
+const DEFAULT_MAX_PACKET_SIZE = 8192
+
+// CRC algorithms a packet may end with. CRC-32/IEEE is the default; the
+// others are for firmware that speaks the packet protocol itself and only
+// has one of them to hand.
+const (
+	CRC_32       = "crc32"       // CRC-32/IEEE, 4 bytes
+	CRC_32C      = "crc32c"      // CRC-32C (Castagnoli), 4 bytes
+	CRC_16_CCITT = "crc16-ccitt" // CRC-16/CCITT-FALSE (0x1021, init 0xFFFF), 2 bytes
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Framing is how packets are built on a link: the largest payload allowed
+// and the CRC that follows it. Both ends of a link must use the same one.
+type Framing struct {
+	MaxPacketSize int
+	CRC           string
+}
+
+// DefaultFraming returns the framing every peer uses unless told otherwise.
+func DefaultFraming() Framing {
+	return Framing{MaxPacketSize: DEFAULT_MAX_PACKET_SIZE, CRC: CRC_32}
+}
+
+// Check returns an error for a framing that can't be used.
+func (f Framing) Check() error {
+	switch f.CRC {
+	case CRC_32, CRC_32C, CRC_16_CCITT:
+	default:
+		return fmt.Errorf("unknown CRC %q (valid: %s, %s, %s)", f.CRC, CRC_32, CRC_32C, CRC_16_CCITT)
+	}
+	if f.MaxPacketSize < 1 || f.MaxPacketSize > math.MaxInt32-4 {
+		return fmt.Errorf("max packet size %d is out of range", f.MaxPacketSize)
+	}
+	return nil
+}
+
+// Name is the framing's name in a HelloFrame, such as "len+crc32".
+func (f Framing) Name() string {
+	return "len+" + f.CRC
+}
+
+// CRCSize is the number of CRC bytes after each payload.
+func (f Framing) CRCSize() int {
+	if f.CRC == CRC_16_CCITT {
+		return 2
+	}
+	return 4
+}
+
+// ComputeCRC computes the framing's CRC for the given data.
+func (f Framing) ComputeCRC(data []byte) uint32 {
+	switch f.CRC {
+	case CRC_32C:
+		return crc32.Checksum(data, crc32cTable)
+	case CRC_16_CCITT:
+		return uint32(ComputeCRC16(data))
+	default:
+		return crc32.ChecksumIEEE(data)
+	}
+}
+
+// AppendCRC appends the big-endian CRC to the end of data and returns the new slice.
+func (f Framing) AppendCRC(data []byte) []byte {
+	n := f.CRCSize()
+	out := make([]byte, len(data)+n)
+	copy(out, data)
+	crc := f.ComputeCRC(data)
+	if n == 2 {
+		binary.BigEndian.PutUint16(out[len(data):], uint16(crc))
+	} else {
+		binary.BigEndian.PutUint32(out[len(data):], crc)
+	}
+	return out
+}
+
+// VerifyPacket verifies a packet that is structured as: payload (len bytes) followed by its CRC.
+// It returns the payload (a slice copy) and whether the CRC matched.
+func (f Framing) VerifyPacket(payloadWithCRC []byte) (payload []byte, ok bool) {
+	n := f.CRCSize()
+	if len(payloadWithCRC) < n {
+		return nil, false
+	}
+	payloadLen := len(payloadWithCRC) - n
+	payload = make([]byte, payloadLen)
+	copy(payload, payloadWithCRC[:payloadLen])
+	var expected uint32
+	if n == 2 {
+		expected = uint32(binary.BigEndian.Uint16(payloadWithCRC[payloadLen:]))
+	} else {
+		expected = binary.BigEndian.Uint32(payloadWithCRC[payloadLen:])
+	}
+	return payload, f.ComputeCRC(payload) == expected
+}
+
+// ComputeCRC16 computes CRC-16/CCITT-FALSE (polynomial 0x1021, init 0xFFFF),
+// the variant most CRC16 libraries call CCITT.
+func ComputeCRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ComputeCRC8 computes CRC-8 (polynomial 0x07, init 0x00), the variant most
+// Arduino CRC8 libraries default to.
+func ComputeCRC8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
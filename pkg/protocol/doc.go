@@ -0,0 +1,6 @@
+// Package protocol is the control link between the client and the server:
+// ControllerState, the JSON and protobuf payloads, the length-prefixed
+// framing with its CRCs, and the message types both ends exchange. Tools
+// that talk to the server, or read its recordings, import it instead of
+// copying the structs.
+package protocol
@@ -0,0 +1,148 @@
+package protocol
+
+// Fuzz targets for what a client can put on the link. A malformed packet
+// from the venue network must never crash the server. Run one from the
+// repository root, e.g.
+//
+//	go test -fuzz FuzzReadPacket -fuzzminimizetime 5s ./pkg/protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+// framings are the CRCs a link can use, each at the default size
+var framings = []Framing{
+	DefaultFraming(),
+	{MaxPacketSize: DEFAULT_MAX_PACKET_SIZE, CRC: CRC_32C},
+	{MaxPacketSize: DEFAULT_MAX_PACKET_SIZE, CRC: CRC_16_CCITT},
+}
+
+// packet frames payload as a client would
+func packet(payload []byte) []byte {
+	var b bytes.Buffer
+	DefaultFraming().WritePacket(&b, payload)
+	return b.Bytes()
+}
+
+func FuzzVerifyPacket(f *testing.F) {
+	f.Add(DefaultFraming().AppendCRC([]byte(`{"LjoyX":127}`)))
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, framing := range framings {
+			payload, ok := framing.VerifyPacket(data)
+			if ok && !bytes.Equal(framing.AppendCRC(payload), data) {
+				t.Fatalf("%s accepted %x, which is not its payload and CRC", framing.CRC, data)
+			}
+		}
+	})
+}
+
+// FuzzReadPacket covers the length and header handling every client
+// connection goes through: the stream must stay readable after bad CRCs and
+// oversized packets, and nothing it accepts may exceed the maximum size
+func FuzzReadPacket(f *testing.F) {
+	f.Add(packet([]byte(`{"LjoyX":127,"ts":1}`)))
+	f.Add(append(packet([]byte(`{"type":"ping","seq":1}`)), packet([]byte(`{}`))...))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 'x'})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte("{\"LjoyX\":127}\n"))
+	bad := packet([]byte(`{"RT":255}`))
+	bad[len(bad)-1] ^= 1
+	f.Add(bad)
+	big := binary.BigEndian.AppendUint32(nil, uint32(DEFAULT_MAX_PACKET_SIZE+5))
+	f.Add(append(big, make([]byte, DEFAULT_MAX_PACKET_SIZE+5)...))
+
+	framing := DefaultFraming()
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		r := bytes.NewReader(stream)
+		for {
+			payload, err := framing.ReadPacket(r)
+			switch {
+			case err == nil:
+				if len(payload) > framing.MaxPacketSize {
+					t.Fatalf("accepted a %d byte payload", len(payload))
+				}
+				// Whatever gets through is handed to the JSON decoders
+				var state ControllerState
+				json.Unmarshal(payload, &state)
+				PeekType(payload)
+			case errors.Is(err, ErrBadCRC), errors.Is(err, ErrPacketTooLarge):
+			case err == io.EOF, errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, ErrLegacyJSON):
+				return
+			default:
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	})
+}
+
+func FuzzWriteReadPacket(f *testing.F) {
+	f.Add([]byte(`{"LjoyX":127}`))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		for _, framing := range framings {
+			var b bytes.Buffer
+			if err := framing.WritePacket(&b, payload); err != nil {
+				if len(payload) <= framing.MaxPacketSize {
+					t.Fatal(err)
+				}
+				return
+			}
+			got, err := framing.ReadPacket(&b)
+			if err != nil {
+				t.Fatal(framing.CRC, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("%s wrote %x, read %x", framing.CRC, payload, got)
+			}
+		}
+	})
+}
+
+// FuzzProtobuf feeds arbitrary Packets to the decoder, and checks that a
+// state survives the trip through protobuf unchanged
+func FuzzProtobuf(f *testing.F) {
+	offset := int64(-1500)
+	for _, v := range []any{
+		&ControllerState{LeftX: 127, RightTrigger: 255, DPadX: -1, Timestamp: 1700000000000, LeftX16: 0x7FFF},
+		&TelemetryState{Device: "arduino", BatteryVolts: 24.6, MotorCurrents: []float64{6.5, 6.1}, LimitSwitches: 1},
+		&TelemetryState{Device: "arduino", BatteryAmps: new(float64), IMU: &IMUReading{Pitch: -12.5, AccelZ: 1}},
+		&EStopFrame{Type: MsgEStop, Reason: "button"},
+		&PingFrame{Type: MsgPing, Seq: 7, Sent: 1700000000000, RTTMs: 3.5, OffsetMs: &offset},
+		&PongFrame{Type: MsgPong, Seq: 7, Sent: 1700000000000, Recv: 1700000001500},
+	} {
+		b, _ := MarshalProtobuf(v)
+		f.Add(b)
+	}
+	f.Add([]byte{0x0A, 0x02, 0x58, 0x7F}) // state with LjoyX 127, written out
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if !IsProtobuf(payload) {
+			return
+		}
+		b, err := ProtobufToJSON(payload)
+		if err != nil {
+			return
+		}
+		if PeekType(b) != "" {
+			return
+		}
+		var state ControllerState
+		if err := json.Unmarshal(b, &state); err != nil {
+			t.Fatalf("decoded state %s doesn't unmarshal: %v", b, err)
+		}
+		again, _ := MarshalProtobuf(&state)
+		b2, err := ProtobufToJSON(again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("state changed on a round trip: %s, then %s", b, b2)
+		}
+	})
+}
@@ -0,0 +1,436 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Frames on the TCP link are [4-byte big-endian length][payload][CRC],
+// where length covers payload+CRC and the CRC is as the link's Framing
+// says, 4-byte CRC-32 by default. The server, client and mock client all
+// use this package, so both directions use the same framing.
+
+// Message types carried in the "type" field of a JSON payload. Packets without
+// a type are treated as a ControllerState for backward compatibility.
+const (
+	MsgStatus    = "status"
+	MsgTelemetry = "telemetry"
+	MsgClaim     = "claim"
+	MsgProfile   = "profile"
+	MsgEStop     = "estop"
+	MsgReset     = "estop_reset"
+	MsgReplay    = "replay"
+	MsgShutdown  = "shutdown"
+	MsgPing      = "ping"
+	MsgPong      = "pong"
+	MsgEncoding  = "encoding"
+	MsgHello     = "hello"
+	MsgGamepad   = "gamepad"
+	MsgLink      = "link"
+	MsgMode      = "mode"
+	MsgRumble    = "rumble"
+)
+
+// DRIVER_TIMEOUT is how long the driver may go without sending a state
+// before the server stops the robot: three of the client's 2 Hz keepalives
+const DRIVER_TIMEOUT = 1500 * time.Millisecond
+
+// MIN_SEND_RATE_HZ is the slowest a driver may send states. It fits three
+// into DRIVER_TIMEOUT, so one late or lost state doesn't stop the robot.
+const MIN_SEND_RATE_HZ = 3 * float64(time.Second) / float64(DRIVER_TIMEOUT)
+
+// Server modes, as StatusFrame.Mode and ModeFrame carry them
+const (
+	MODE_TELEOP   = "teleop"   // the driver's gamepad drives
+	MODE_AUTONOMY = "autonomy" // the server's local autonomy source drives
+	MODE_PAUSED   = "paused"   // nothing drives
+	MODE_ESTOP    = "estop"    // the e-stop is latched
+)
+
+// Speed levels, as StatusFrame.Speed carries them, slowest first
+const (
+	SPEED_TURTLE = "turtle"
+	SPEED_NORMAL = "normal"
+	SPEED_TURBO  = "turbo"
+)
+
+// Protocol versions. 1 is everything before the hello: a client that sends
+// none gets exactly that. Bump PROTOCOL_VERSION for any change an older
+// peer would misread, and gate it on the session's version.
+const (
+	PROTOCOL_VERSION     = 2
+	PROTOCOL_MIN_VERSION = 1
+)
+
+// Capabilities a HelloFrame may list. A peer should only rely on a feature
+// the other side listed.
+const (
+	CAP_PING      = "ping"      // latency pings and pongs
+	CAP_TELEMETRY = "telemetry" // Arduino telemetry relayed to clients
+	CAP_ESTOP     = "estop"     // e-stop and reset messages
+	CAP_PROFILES  = "profiles"  // profile switching
+	CAP_AXES16    = "axes16"    // full-resolution axis fields
+	CAP_GAMEPAD   = "gamepad"   // gamepad reports
+	CAP_DUAL_LINK = "duallink"  // numbered states duplicated over a UDP link
+	CAP_RESUME    = "resume"    // driver seat kept across reconnects
+	CAP_RUMBLE    = "rumble"    // the client can rumble its gamepad on RumbleFrames
+)
+
+// QUIC link (-quic on both ends): the same frames on one bidirectional
+// stream, with TLS 1.3 and this ALPN
+const (
+	QUIC_ALPN         = "lunabotics"
+	QUIC_KEEPALIVE    = time.Second      // idle links still exchange packets this often
+	QUIC_IDLE_TIMEOUT = 10 * time.Second // and are dropped after this long silent
+)
+
+// UNIX_PREFIX marks a server address that is a Unix domain socket path
+// rather than host:port, as in "unix:/run/lunabotics.sock"
+const UNIX_PREFIX = "unix:"
+
+// SplitNetwork returns the network and address to dial or listen on for a
+// server address: "unix" and the path for UNIX_PREFIX addresses, "tcp"
+// and addr otherwise
+func SplitNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, UNIX_PREFIX); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+var (
+	ErrBadCRC         = errors.New("crc mismatch")
+	ErrPacketTooLarge = errors.New("packet too large")
+	ErrLegacyJSON     = errors.New("unframed newline-delimited JSON")
+)
+
+// StatusFrame is pushed from the server back to the client so the driver can
+// see what actually reached the robot.
+type StatusFrame struct {
+	Type             string `json:"type"`
+	Role             string `json:"role"` // "driver" or "spectator"
+	Profile          string `json:"profile,omitempty"`
+	ArduinoConnected bool   `json:"arduino"`
+	CRCErrors        uint64 `json:"crc_errors"`
+	Output           []int  `json:"output"` // last bytes written to the Arduino
+	EStop            bool   `json:"estop"`
+	MaxRate          int    `json:"max_rate,omitempty"`  // Hz the client should not exceed
+	Congested        bool   `json:"congested,omitempty"` // serial writes fell behind since the last status
+	Battery          string `json:"battery,omitempty"`   // "low" while outputs are scaled down, "critical" while held at failsafe
+	Mode             string `json:"mode,omitempty"`      // MODE_*, left out by servers without modes
+	Speed            string `json:"speed,omitempty"`     // SPEED_*, left out without a speed button
+	Cruise           bool   `json:"cruise,omitempty"`    // triggers are latched by cruise control
+	Timestamp        int64  `json:"ts"`
+
+	// Devices lists every output device when the robot has more than one
+	// Arduino; ArduinoConnected and Output describe the first.
+	Devices []DeviceStatus `json:"devices,omitempty"`
+}
+
+// DeviceStatus is the per-Arduino part of a StatusFrame
+type DeviceStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	Output    []int  `json:"output"`
+}
+
+func (s *StatusFrame) String() string {
+	str := fmt.Sprintf("Robot[%s arduino:%t estop:%t crc_err:%d] Out[%s]",
+		s.Role, s.ArduinoConnected, s.EStop, s.CRCErrors, hexBytes(s.Output))
+	if s.Profile != "" {
+		str += " Profile[" + s.Profile + "]"
+	}
+	if s.Congested {
+		str += " CONGESTED"
+	}
+	if s.Speed != "" {
+		str += " Speed[" + s.Speed + "]"
+	}
+	if s.Cruise {
+		str += " CRUISE"
+	}
+	if s.Mode != "" && s.Mode != MODE_TELEOP {
+		str += " MODE " + strings.ToUpper(s.Mode)
+	}
+	if s.Battery != "" {
+		str += " BATTERY " + strings.ToUpper(s.Battery)
+	}
+	if len(s.Devices) > 1 {
+		for _, d := range s.Devices {
+			str += fmt.Sprintf(" %s[%t %s]", d.Name, d.Connected, hexBytes(d.Output))
+		}
+	}
+	return str
+}
+
+// hexBytes formats frame bytes as space-separated hex
+func hexBytes(frame []int) string {
+	var out strings.Builder
+	for i, b := range frame {
+		if i > 0 {
+			out.WriteByte(' ')
+		}
+		fmt.Fprintf(&out, "%02X", b)
+	}
+	return out.String()
+}
+
+// ClaimFrame is sent by a client to request the driver seat on a server that
+// was started with a driver token.
+type ClaimFrame struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// EStopFrame latches the server's e-stop (Type MsgEStop) or releases it
+// (Type MsgReset). Any client may stop the robot; only one allowed to drive
+// may reset it. The server answers a reset it refuses with a MsgReset frame
+// whose Reason says why.
+type EStopFrame struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RumbleFrame asks the driver's client to rumble its gamepad, so the
+// driver feels a fault without looking at a screen. Event is the server
+// event behind it (estop, failsafe, crc_storm or motor_stall); Strong and
+// Weak are the two motors' magnitudes from 0 to 1.
+type RumbleFrame struct {
+	Type       string  `json:"type"`
+	Event      string  `json:"event"`
+	Strong     float64 `json:"strong"`
+	Weak       float64 `json:"weak"`
+	DurationMs int     `json:"duration_ms"`
+}
+
+// ShutdownFrame is the last packet a server sends before it closes the
+// connection on purpose
+type ShutdownFrame struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// PingFrame is sent by a client about once a second, and in a short burst
+// on connect, to measure latency. Sent is the client's clock in Unix
+// milliseconds, like ControllerState.Timestamp. RTTMs reports the previous
+// round trip so the server can export it, and OffsetMs the client's
+// estimate of server clock minus client clock, once it has one.
+type PingFrame struct {
+	Type     string  `json:"type"`
+	Seq      uint32  `json:"seq"`
+	Sent     int64   `json:"sent"`
+	RTTMs    float64 `json:"rtt_ms,omitempty"`
+	OffsetMs *int64  `json:"offset_ms,omitempty"`
+}
+
+// PongFrame answers a PingFrame at once, echoing Seq and Sent. Recv is the
+// server's clock when the ping arrived; with the client's send and receive
+// times that is one NTP-style exchange.
+type PongFrame struct {
+	Type string `json:"type"`
+	Seq  uint32 `json:"seq"`
+	Sent int64  `json:"sent"`
+	Recv int64  `json:"recv"`
+}
+
+// EncodingFrame asks the server to send payloads in another encoding (see
+// protocol_pb.go), and is the server's answer naming the encoding it will
+// use. Both are always JSON.
+type EncodingFrame struct {
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+}
+
+// HelloFrame opens a connection. The client's lists the protocol versions
+// it speaks, the payload encodings it can use in order of preference, its
+// framing and capabilities. The server's answer gives the version and
+// encoding it chose and its own capabilities, or with Error set refuses the
+// client and closes the connection. Both are always JSON.
+type HelloFrame struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version,omitempty"`
+	Encodings    []string `json:"encodings,omitempty"` // client only
+	Encoding     string   `json:"encoding,omitempty"`  // server only
+	Framing      string   `json:"framing,omitempty"`
+	Capabilities []string `json:"caps,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Link         string   `json:"link,omitempty"` // server only, with CAP_DUAL_LINK
+
+	// With CAP_RESUME the server's hello carries a Resume token; the
+	// client's next hello presents it to get its driver seat back, and the
+	// answer says whether it Resumed
+	Resume  string `json:"resume,omitempty"`
+	Resumed bool   `json:"resumed,omitempty"` // server only
+}
+
+// LinkFrame is one datagram on the UDP link: a copy of a state the client
+// also sent on its connection, tagged with the Link token from the
+// server's hello so the server knows whose it is. It uses the same length
+// and CRC framing as the connection, is always JSON and only ever goes
+// from client to server.
+type LinkFrame struct {
+	Type  string           `json:"type"`
+	Link  string           `json:"link"`
+	State *ControllerState `json:"state"`
+}
+
+// GamepadFrame describes the client's gamepad: its name, its GUID when the
+// OS exposes one, how many axes and buttons it has and the ControllerState
+// fields its mapping can fill. Clients send one whenever they open a pad;
+// the server warns about mapped fields the pad can't produce, and the
+// dashboard shows only the controls it has.
+type GamepadFrame struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	GUID    string   `json:"guid,omitempty"`
+	Axes    int      `json:"axes"`
+	Buttons int      `json:"buttons"`
+	Fields  []string `json:"fields"`
+}
+
+// ProfileFrame asks the server to switch byte mapping profile. Only the
+// driver may send it; an empty name selects the default mapping.
+type ProfileFrame struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// ModeFrame asks the server to switch mode (MODE_*). Only the driver or a
+// client that presented the driver token may send it.
+type ModeFrame struct {
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// ReplayFrame carries a state from a server-side -replay to clients, stamped
+// with when it was originally recorded (Unix milliseconds)
+type ReplayFrame struct {
+	Type  string           `json:"type"`
+	Time  int64            `json:"recorded"`
+	State *ControllerState `json:"state"`
+}
+
+func (r *ReplayFrame) String() string {
+	return fmt.Sprintf("Replay[%s] %v", time.UnixMilli(r.Time).Format("15:04:05.000"), r.State)
+}
+
+// TelemetryState is the latest sensor snapshot reported by the Arduino and
+// relayed to clients by the server. The optional sensors are nil until the
+// firmware reports them.
+type TelemetryState struct {
+	Type          string    `json:"type"`
+	Device        string    `json:"device,omitempty"` // Arduino that sent it
+	BatteryVolts  float64   `json:"battery_v"`
+	MotorCurrents []float64 `json:"motor_a"`
+	LimitSwitches uint8     `json:"limits"`
+	Timestamp     int64     `json:"ts"`
+
+	BatteryAmps *float64    `json:"battery_a,omitempty"`  // negative while charging
+	BucketAngle *float64    `json:"bucket_deg,omitempty"` // degrees from the bucket's rest position
+	IMU         *IMUReading `json:"imu,omitempty"`
+}
+
+// IMUReading is the robot's orientation in degrees and acceleration in g
+type IMUReading struct {
+	Roll   float64 `json:"roll"`
+	Pitch  float64 `json:"pitch"`
+	Yaw    float64 `json:"yaw"`
+	AccelX float64 `json:"ax"`
+	AccelY float64 `json:"ay"`
+	AccelZ float64 `json:"az"`
+}
+
+func (t *TelemetryState) String() string {
+	s := fmt.Sprintf("Telemetry[%s bat:%.2fV", t.Device, t.BatteryVolts)
+	if t.BatteryAmps != nil {
+		s += fmt.Sprintf(" %.1fA", *t.BatteryAmps)
+	}
+	s += fmt.Sprintf(" motors:%v limits:%08b", t.MotorCurrents, t.LimitSwitches)
+	if t.BucketAngle != nil {
+		s += fmt.Sprintf(" bucket:%.1f°", *t.BucketAngle)
+	}
+	if i := t.IMU; i != nil {
+		s += fmt.Sprintf(" imu:r%.1f p%.1f y%.1f a(%.2f %.2f %.2f)g", i.Roll, i.Pitch, i.Yaw, i.AccelX, i.AccelY, i.AccelZ)
+	}
+	return s + "]"
+}
+
+// PeekType returns the "type" field of a JSON payload, or "" when absent.
+func PeekType(payload []byte) string {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return ""
+	}
+	return env.Type
+}
+
+// WritePacket appends a CRC to payload, prefixes the length and writes the
+// whole frame in a single call.
+func (f Framing) WritePacket(w io.Writer, payload []byte) error {
+	if len(payload) > f.MaxPacketSize {
+		return ErrPacketTooLarge
+	}
+	return WriteFrame(w, f.AppendCRC(payload))
+}
+
+// WriteFrame prefixes pkt, a payload already followed by its CRC, with its
+// length and writes it in a single call. Test tools use it to send packets
+// they have damaged on purpose; everything else wants WritePacket.
+func WriteFrame(w io.Writer, pkt []byte) error {
+	frame := make([]byte, 4+len(pkt))
+	binary.BigEndian.PutUint32(frame, uint32(len(pkt)))
+	copy(frame[4:], pkt)
+	_, err := w.Write(frame)
+	return err
+}
+
+// IsLegacyJSON reports whether a length header is really the start of a
+// JSON object from a client that predates framing and sends one
+// newline-terminated object per state. No valid length starts with '{'.
+func IsLegacyJSON(hdr []byte) bool {
+	return len(hdr) > 0 && hdr[0] == '{'
+}
+
+// ReadPacket reads one frame and returns its verified payload. Zero-length
+// frames are skipped and oversized frames are drained before ErrPacketTooLarge
+// is returned, so the stream stays aligned after either error. A stream that
+// starts a JSON object where a length belongs gets ErrLegacyJSON and can't
+// be read further.
+func (f Framing) ReadPacket(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		if IsLegacyJSON(hdr) {
+			return nil, ErrLegacyJSON
+		}
+		totalLen := binary.BigEndian.Uint32(hdr)
+		if totalLen == 0 {
+			continue
+		}
+		if totalLen > uint32(f.MaxPacketSize+f.CRCSize()) {
+			if _, err := io.CopyN(io.Discard, r, int64(totalLen)); err != nil {
+				return nil, err
+			}
+			return nil, ErrPacketTooLarge
+		}
+		buf := make([]byte, totalLen)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		payload, ok := f.VerifyPacket(buf)
+		if !ok {
+			return nil, ErrBadCRC
+		}
+		return payload, nil
+	}
+}
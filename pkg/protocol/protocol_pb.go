@@ -0,0 +1,411 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf encoding of the control link, following protocol.proto field for
+// field. It is written out by hand, like the DNS code in pkg/mdns, so the
+// programs build without generated code or the protobuf runtime.
+
+// Payload encodings a client can ask for with an EncodingFrame
+const (
+	ENCODING_JSON     = "json"
+	ENCODING_PROTOBUF = "protobuf"
+)
+
+// Protobuf wire types
+const (
+	PB_VARINT  = 0
+	PB_FIXED64 = 1
+	PB_BYTES   = 2
+	PB_FIXED32 = 5
+)
+
+// Packet fields in protocol.proto
+const (
+	PB_PACKET_STATE     = 1
+	PB_PACKET_TELEMETRY = 2
+	PB_PACKET_ESTOP     = 3
+	PB_PACKET_HEARTBEAT = 4
+)
+
+// GRPC_CONTROL_STREAM is the path of protocol.proto's Control.ControlStream
+const GRPC_CONTROL_STREAM = "/lunabotics.control.Control/ControlStream"
+
+var errProtobuf = errors.New("malformed protobuf")
+
+// IsProtobuf reports whether a payload is a protobuf Packet rather than
+// JSON. A Packet starts with the tag of one of its messages; the state's,
+// 0x0A, is also a newline, so a payload starting with it must not be JSON
+// either. Anything else is left to the JSON decoder to reject.
+func IsProtobuf(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	key := payload[0]
+	field, wire := int(key>>3), int(key&7)
+	if wire != PB_BYTES || field < PB_PACKET_STATE || field > PB_PACKET_HEARTBEAT {
+		return false
+	}
+	return key != '\n' || !json.Valid(payload)
+}
+
+// MarshalProtobuf encodes v as a protocol.proto Packet. ok is false for
+// messages the schema doesn't have, which are sent as JSON instead.
+func MarshalProtobuf(v any) (b []byte, ok bool) {
+	var field int
+	var msg []byte
+	switch m := v.(type) {
+	case *ControllerState:
+		field, msg = PB_PACKET_STATE, ProtobufState(m)
+	case *TelemetryState:
+		field, msg = PB_PACKET_TELEMETRY, ProtobufTelemetry(m)
+	case *EStopFrame:
+		field, msg = PB_PACKET_ESTOP, pbEStop(m)
+	case *PingFrame:
+		field, msg = PB_PACKET_HEARTBEAT, pbPing(m)
+	case *PongFrame:
+		field, msg = PB_PACKET_HEARTBEAT, pbPong(m)
+	default:
+		return nil, false
+	}
+	return ProtobufMessage(nil, field, msg), true
+}
+
+// ProtobufToJSON decodes a Packet into the JSON payload the same message
+// has on a JSON link, so receivers handle both encodings with one code path
+func ProtobufToJSON(payload []byte) ([]byte, error) {
+	var out any
+	err := pbFields(payload, func(field, wire int, _ uint64, msg []byte) error {
+		if wire != PB_BYTES {
+			return nil
+		}
+		var err error
+		switch field {
+		case PB_PACKET_STATE:
+			out, err = ParseProtobufState(msg)
+		case PB_PACKET_TELEMETRY:
+			out, err = ParseProtobufTelemetry(msg)
+		case PB_PACKET_ESTOP:
+			out, err = parseEStop(msg)
+		case PB_PACKET_HEARTBEAT:
+			out, err = parseHeartbeat(msg)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, fmt.Errorf("%w: packet has no message", errProtobuf)
+	}
+	return json.Marshal(out)
+}
+
+func ProtobufState(s *ControllerState) []byte {
+	var b []byte
+	for i, v := range []uint8{
+		s.North, s.East, s.South, s.West, s.LeftBumper, s.RightBumper,
+		s.LeftStick, s.RightStick, s.Select, s.Start,
+		s.LeftX, s.LeftY, s.RightX, s.RightY, s.LeftTrigger, s.RightTrigger,
+	} {
+		b = pbUint(b, i+1, uint64(v))
+	}
+	b = pbSint(b, 17, int64(s.DPadX))
+	b = pbSint(b, 18, int64(s.DPadY))
+	b = pbUint(b, 19, uint64(s.Timestamp))
+	for i, v := range []uint16{
+		s.LeftX16, s.LeftY16, s.RightX16, s.RightY16, s.LeftTrigger16, s.RightTrigger16,
+	} {
+		b = pbUint(b, i+20, uint64(v))
+	}
+	return pbUint(b, 26, s.Seq)
+}
+
+func ParseProtobufState(msg []byte) (*ControllerState, error) {
+	s := &ControllerState{}
+	u8 := []*uint8{
+		&s.North, &s.East, &s.South, &s.West, &s.LeftBumper, &s.RightBumper,
+		&s.LeftStick, &s.RightStick, &s.Select, &s.Start,
+		&s.LeftX, &s.LeftY, &s.RightX, &s.RightY, &s.LeftTrigger, &s.RightTrigger,
+	}
+	u16 := []*uint16{
+		&s.LeftX16, &s.LeftY16, &s.RightX16, &s.RightY16, &s.LeftTrigger16, &s.RightTrigger16,
+	}
+	err := pbFields(msg, func(field, wire int, v uint64, _ []byte) error {
+		if wire != PB_VARINT {
+			return nil
+		}
+		switch {
+		case field >= 1 && field <= 16:
+			*u8[field-1] = uint8(v)
+		case field == 17:
+			s.DPadX = int8(unzigzag(v))
+		case field == 18:
+			s.DPadY = int8(unzigzag(v))
+		case field == 19:
+			s.Timestamp = int64(v)
+		case field >= 20 && field <= 25:
+			*u16[field-20] = uint16(v)
+		case field == 26:
+			s.Seq = v
+		}
+		return nil
+	})
+	return s, err
+}
+
+func ProtobufTelemetry(t *TelemetryState) []byte {
+	b := pbString(nil, 1, t.Device)
+	b = pbDouble(b, 2, t.BatteryVolts)
+	if len(t.MotorCurrents) > 0 {
+		packed := make([]byte, 0, 8*len(t.MotorCurrents))
+		for _, a := range t.MotorCurrents {
+			packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(a))
+		}
+		b = ProtobufMessage(b, 3, packed)
+	}
+	b = pbUint(b, 4, uint64(t.LimitSwitches))
+	b = pbUint(b, 5, uint64(t.Timestamp))
+	b = pbOptionalDouble(b, 6, t.BatteryAmps)
+	b = pbOptionalDouble(b, 7, t.BucketAngle)
+	if i := t.IMU; i != nil {
+		var imu []byte
+		for j, v := range []float64{i.Roll, i.Pitch, i.Yaw, i.AccelX, i.AccelY, i.AccelZ} {
+			imu = pbDouble(imu, j+1, v)
+		}
+		b = ProtobufMessage(b, 8, imu)
+	}
+	return b
+}
+
+func ParseProtobufTelemetry(msg []byte) (*TelemetryState, error) {
+	t := &TelemetryState{Type: MsgTelemetry}
+	err := pbFields(msg, func(field, wire int, v uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == PB_BYTES:
+			t.Device = string(data)
+		case field == 2 && wire == PB_FIXED64:
+			t.BatteryVolts = math.Float64frombits(v)
+		case field == 3 && wire == PB_FIXED64: // unpacked
+			t.MotorCurrents = append(t.MotorCurrents, math.Float64frombits(v))
+		case field == 3 && wire == PB_BYTES:
+			if len(data)%8 != 0 {
+				return fmt.Errorf("%w: motor_a is %d bytes", errProtobuf, len(data))
+			}
+			for ; len(data) > 0; data = data[8:] {
+				t.MotorCurrents = append(t.MotorCurrents, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			}
+		case field == 4 && wire == PB_VARINT:
+			t.LimitSwitches = uint8(v)
+		case field == 5 && wire == PB_VARINT:
+			t.Timestamp = int64(v)
+		case field == 6 && wire == PB_FIXED64:
+			amps := math.Float64frombits(v)
+			t.BatteryAmps = &amps
+		case field == 7 && wire == PB_FIXED64:
+			angle := math.Float64frombits(v)
+			t.BucketAngle = &angle
+		case field == 8 && wire == PB_BYTES:
+			imu := &IMUReading{}
+			values := []*float64{&imu.Roll, &imu.Pitch, &imu.Yaw, &imu.AccelX, &imu.AccelY, &imu.AccelZ}
+			if err := pbFields(data, func(field, wire int, v uint64, _ []byte) error {
+				if field >= 1 && field <= 6 && wire == PB_FIXED64 {
+					*values[field-1] = math.Float64frombits(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			t.IMU = imu
+		}
+		return nil
+	})
+	return t, err
+}
+
+func pbEStop(e *EStopFrame) []byte {
+	var b []byte
+	if e.Type == MsgReset {
+		b = pbUint(b, 1, 1)
+	}
+	return pbString(b, 2, e.Reason)
+}
+
+func parseEStop(msg []byte) (*EStopFrame, error) {
+	e := &EStopFrame{Type: MsgEStop}
+	err := pbFields(msg, func(field, wire int, v uint64, data []byte) error {
+		switch {
+		case field == 1 && wire == PB_VARINT && v != 0:
+			e.Type = MsgReset
+		case field == 2 && wire == PB_BYTES:
+			e.Reason = string(data)
+		}
+		return nil
+	})
+	return e, err
+}
+
+func pbPing(p *PingFrame) []byte {
+	b := pbUint(nil, 1, uint64(p.Seq))
+	b = pbUint(b, 2, uint64(p.Sent))
+	b = pbDouble(b, 4, p.RTTMs)
+	if p.OffsetMs != nil {
+		// optional: present even when zero
+		b = pbTag(b, 5, PB_VARINT)
+		b = binary.AppendUvarint(b, zigzag(*p.OffsetMs))
+	}
+	return b
+}
+
+func pbPong(p *PongFrame) []byte {
+	b := pbUint(nil, 1, uint64(p.Seq))
+	b = pbUint(b, 2, uint64(p.Sent))
+	return pbUint(b, 3, uint64(p.Recv))
+}
+
+// parseHeartbeat returns a *PongFrame for the server's answer, which alone
+// carries recv_ms, and a *PingFrame otherwise
+func parseHeartbeat(msg []byte) (any, error) {
+	var seq uint32
+	var sent, recv int64
+	var rtt float64
+	var offset *int64
+	err := pbFields(msg, func(field, wire int, v uint64, _ []byte) error {
+		switch {
+		case field == 1 && wire == PB_VARINT:
+			seq = uint32(v)
+		case field == 2 && wire == PB_VARINT:
+			sent = int64(v)
+		case field == 3 && wire == PB_VARINT:
+			recv = int64(v)
+		case field == 4 && wire == PB_FIXED64:
+			rtt = math.Float64frombits(v)
+		case field == 5 && wire == PB_VARINT:
+			o := unzigzag(v)
+			offset = &o
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if recv != 0 {
+		return &PongFrame{Type: MsgPong, Seq: seq, Sent: sent, Recv: recv}, nil
+	}
+	return &PingFrame{Type: MsgPing, Seq: seq, Sent: sent, RTTMs: rtt, OffsetMs: offset}, nil
+}
+
+// pbFields calls fn for each field of msg in order, with the value of
+// varint and fixed-width fields or the contents of length-delimited ones.
+// Groups, long deprecated, are rejected.
+func pbFields(msg []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad field key", errProtobuf)
+		}
+		msg = msg[n:]
+		field, wire := key>>3, int(key&7)
+		if field == 0 || field > math.MaxInt32 {
+			return fmt.Errorf("%w: field number %d", errProtobuf, field)
+		}
+
+		var v uint64
+		var data []byte
+		switch wire {
+		case PB_VARINT:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return fmt.Errorf("%w: bad varint in field %d", errProtobuf, field)
+			}
+			msg = msg[n:]
+		case PB_FIXED64:
+			if len(msg) < 8 {
+				return fmt.Errorf("%w: field %d truncated", errProtobuf, field)
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case PB_FIXED32:
+			if len(msg) < 4 {
+				return fmt.Errorf("%w: field %d truncated", errProtobuf, field)
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case PB_BYTES:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return fmt.Errorf("%w: field %d truncated", errProtobuf, field)
+			}
+			data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		default:
+			return fmt.Errorf("%w: wire type %d in field %d", errProtobuf, wire, field)
+		}
+		if err := fn(int(field), wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pbTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// pbUint appends a varint field, left out when zero as proto3 does
+func pbUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(pbTag(b, field, PB_VARINT), v)
+}
+
+// pbSint appends a zigzag-encoded sint32/sint64 field
+func pbSint(b []byte, field int, v int64) []byte {
+	return pbUint(b, field, zigzag(v))
+}
+
+func pbDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(pbTag(b, field, PB_FIXED64), math.Float64bits(v))
+}
+
+// pbOptionalDouble appends an optional double field, present even when
+// zero and left out when nil
+func pbOptionalDouble(b []byte, field int, v *float64) []byte {
+	if v == nil {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(pbTag(b, field, PB_FIXED64), math.Float64bits(*v))
+}
+
+func pbString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return ProtobufMessage(b, field, []byte(s))
+}
+
+// ProtobufMessage appends a length-delimited field, which is always written
+func ProtobufMessage(b []byte, field int, msg []byte) []byte {
+	b = binary.AppendUvarint(pbTag(b, field, PB_BYTES), uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// GRPCMessage prefixes a message with gRPC's uncompressed flag and length
+func GRPCMessage(msg []byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestIsProtobuf(t *testing.T) {
+	state, _ := MarshalProtobuf(&ControllerState{LeftX: 127})
+	ping, _ := MarshalProtobuf(&PingFrame{Type: MsgPing, Seq: 1})
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"json", []byte(`{"type":"ping"}`), false},
+		{"json after a newline", []byte("\n{\"type\":\"ping\"}"), false},
+		{"json after spaces", []byte("  \t{\"LjoyX\":127}"), false},
+		{"json after a crlf", []byte("\r\n{}"), false},
+		{"state", state, true},
+		{"heartbeat", ping, true},
+		{"empty state", []byte{0x0A, 0x00}, true},
+		{"unknown packet field", []byte{0x2A, 0x00}, false},
+		{"varint field", []byte{0x08, 0x01}, false},
+		{"text", []byte("hello"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsProtobuf(tt.payload); got != tt.want {
+				t.Fatalf("IsProtobuf(%q) = %v, want %v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// pbSchemaField is a field of a message in protocol.proto
+type pbSchemaField struct {
+	typ  string
+	wire int
+}
+
+var (
+	pbMessageLine = regexp.MustCompile(`^message (\w+) \{`)
+	pbFieldLine   = regexp.MustCompile(`^\s*(optional |repeated )?(\w+) (\w+) = (\d+);`)
+)
+
+// readSchema reads the messages in protocol.proto and the wire type each
+// field is sent with
+func readSchema(t *testing.T) map[string]map[int]pbSchemaField {
+	t.Helper()
+	f, err := os.Open("../../protocol.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	schema := make(map[string]map[int]pbSchemaField)
+	var message string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := pbMessageLine.FindStringSubmatch(line); m != nil {
+			message = m[1]
+			schema[message] = make(map[int]pbSchemaField)
+			continue
+		}
+		m := pbFieldLine.FindStringSubmatch(line)
+		if m == nil || message == "" {
+			continue
+		}
+		number, _ := strconv.Atoi(m[4])
+		wire := PB_VARINT
+		switch {
+		case m[1] == "repeated ": // packed, as proto3 does
+			wire = PB_BYTES
+		case m[2] == "double":
+			wire = PB_FIXED64
+		case m[2] == "float":
+			wire = PB_FIXED32
+		case m[2] == "string" || m[2] == "bytes" || m[2][0] >= 'A' && m[2][0] <= 'Z':
+			wire = PB_BYTES
+		}
+		schema[message][number] = pbSchemaField{typ: m[2], wire: wire}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(schema["Packet"]) == 0 {
+		t.Fatal("no Packet message in protocol.proto")
+	}
+	return schema
+}
+
+// Every field protocol.proto declares is written, with its number and wire
+// type, and comes back unchanged
+func TestProtobufSchema(t *testing.T) {
+	schema := readSchema(t)
+	amps, angle, offset := -3.5, 41.0, int64(-1500)
+	values := []any{
+		&ControllerState{
+			North: 1, East: 1, South: 1, West: 1, LeftBumper: 1, RightBumper: 1,
+			LeftStick: 1, RightStick: 1, Select: 1, Start: 1,
+			LeftX: 1, LeftY: 2, RightX: 3, RightY: 4, LeftTrigger: 5, RightTrigger: 6,
+			DPadX: -1, DPadY: 1, Timestamp: 1700000000000,
+			LeftX16: 0x0101, LeftY16: 0x0202, RightX16: 0x0303, RightY16: 0x0404,
+			LeftTrigger16: 0x0505, RightTrigger16: 0x0606, Seq: 9,
+		},
+		&TelemetryState{
+			Type: MsgTelemetry, Device: "arduino", BatteryVolts: 24.6, MotorCurrents: []float64{6.5, 6.1},
+			LimitSwitches: 5, Timestamp: 1700000000000, BatteryAmps: &amps, BucketAngle: &angle,
+			IMU: &IMUReading{Roll: 1, Pitch: 2, Yaw: 3, AccelX: 4, AccelY: 5, AccelZ: 6},
+		},
+		&EStopFrame{Type: MsgEStop, Reason: "button"},
+		&EStopFrame{Type: MsgReset, Reason: "clear"},
+		&PingFrame{Type: MsgPing, Seq: 7, Sent: 1700000000000, RTTMs: 3.5, OffsetMs: &offset},
+		&PongFrame{Type: MsgPong, Seq: 7, Sent: 1700000000000, Recv: 1700000001500},
+	}
+
+	written := make(map[string]map[int]int)
+	var walk func(message string, msg []byte)
+	walk = func(message string, msg []byte) {
+		fields, ok := schema[message]
+		if !ok {
+			t.Fatalf("message %s isn't in protocol.proto", message)
+		}
+		if written[message] == nil {
+			written[message] = make(map[int]int)
+		}
+		err := pbFields(msg, func(field, wire int, _ uint64, data []byte) error {
+			written[message][field] = wire
+			if f, ok := fields[field]; ok && wire == PB_BYTES && schema[f.typ] != nil {
+				walk(f.typ, data)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", message, err)
+		}
+	}
+	for _, v := range values {
+		b, ok := MarshalProtobuf(v)
+		if !ok {
+			t.Fatalf("%T has no protobuf encoding", v)
+		}
+		walk("Packet", b)
+
+		want, _ := json.Marshal(v)
+		got, err := ProtobufToJSON(b)
+		if err != nil {
+			t.Fatalf("%T: %v", v, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%T changed on a round trip: %s, then %s", v, want, got)
+		}
+	}
+
+	for message, fields := range schema {
+		for number, f := range fields {
+			wire, ok := written[message][number]
+			switch {
+			case !ok:
+				t.Errorf("%s field %d (%s) is never written", message, number, f.typ)
+			case wire != f.wire:
+				t.Errorf("%s field %d (%s) is written as wire type %d, want %d", message, number, f.typ, wire, f.wire)
+			}
+		}
+		for number := range written[message] {
+			if _, ok := fields[number]; !ok {
+				t.Errorf("%s field %d is written but not in protocol.proto", message, number)
+			}
+		}
+	}
+}
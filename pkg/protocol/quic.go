@@ -0,0 +1,147 @@
+//go:build quic
+
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// QUIC_CLOSE_TIMEOUT bounds how long closing waits for the peer to
+// acknowledge the last frames, such as a shutdown notice
+const QUIC_CLOSE_TIMEOUT = time.Second
+
+// QUICConfig is the QUIC setup both ends use
+func QUICConfig(tlsConfig *tls.Config) *quic.Config {
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{QUIC_ALPN}
+	return &quic.Config{
+		TLSConfig:       tlsConfig,
+		KeepAlivePeriod: QUIC_KEEPALIVE,
+		MaxIdleTimeout:  QUIC_IDLE_TIMEOUT,
+	}
+}
+
+// QUICConn is a QUIC connection's stream as a net.Conn, so the framing in
+// this package and everything above it run over QUIC unchanged
+type QUICConn struct {
+	conn     *quic.Conn
+	stream   *quic.Stream
+	endpoint *quic.Endpoint // the client's own, closed with the connection
+
+	writeMu     sync.Mutex // the stream allows one writer at a time
+	cancelWrite context.CancelFunc
+	readMu      sync.Mutex
+	cancelRead  context.CancelFunc
+}
+
+// NewQUICConn wraps stream, the session's stream on conn. endpoint is the
+// dialling side's own, closed with the connection; nil on the server.
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream, endpoint *quic.Endpoint) *QUICConn {
+	return &QUICConn{conn: conn, stream: stream, endpoint: endpoint}
+}
+
+func (c *QUICConn) Read(b []byte) (int, error) {
+	n, err := c.stream.Read(b)
+	if err != nil && err != io.EOF && c.closedCleanly() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write sends b at once; the stream would otherwise hold it until its
+// buffer filled
+func (c *QUICConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.stream.Write(b)
+	if err == nil {
+		err = c.stream.Flush()
+	}
+	return n, err
+}
+
+// Close delivers what was written, within QUIC_CLOSE_TIMEOUT, and closes
+// the connection
+func (c *QUICConn) Close() error {
+	c.writeMu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), QUIC_CLOSE_TIMEOUT)
+	defer cancel()
+	c.stream.SetWriteContext(ctx)
+	c.writeMu.Unlock()
+
+	c.stream.Close()
+	c.conn.Abort(nil)
+	if c.endpoint != nil {
+		c.endpoint.Close(ctx)
+	}
+	return nil
+}
+
+// closedCleanly reports whether the connection has ended without an error,
+// which the peer closing it normally looks like to a stream
+func (c *QUICConn) closedCleanly() bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.conn.Wait(ctx)
+	return err == nil || errors.Is(err, &quic.ApplicationError{Code: 0})
+}
+
+// Context is done once the connection has ended, however it ended
+func (c *QUICConn) Context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c.conn.Wait(ctx)
+		cancel()
+	}()
+	return ctx
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.LocalAddr())
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.conn.RemoteAddr())
+}
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.stream.SetReadContext(deadlineContext(t, &c.cancelRead))
+	return nil
+}
+
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.stream.SetWriteContext(deadlineContext(t, &c.cancelWrite))
+	return nil
+}
+
+// deadlineContext turns a net.Conn deadline into the context a stream
+// uses, releasing the one it replaces
+func deadlineContext(t time.Time, cancel *context.CancelFunc) context.Context {
+	if *cancel != nil {
+		(*cancel)()
+		*cancel = nil
+	}
+	if t.IsZero() {
+		return context.Background()
+	}
+	ctx, c := context.WithDeadline(context.Background(), t)
+	*cancel = c
+	return ctx
+}
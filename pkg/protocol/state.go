@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AXIS_CENTER is the resting value of a stick axis
+const AXIS_CENTER = 127
+
+// DEADMAN_TRIGGER_MIN is how far a trigger used as the deadman must be
+// pulled to count as held. Client and server both check it, so they agree.
+const DEADMAN_TRIGGER_MIN = 128
+
+// ControllerState holds all controller inputs
+type ControllerState struct {
+	// Buttons (0 or 1)
+	North       uint8 `json:"N"`
+	East        uint8 `json:"E"`
+	South       uint8 `json:"S"`
+	West        uint8 `json:"W"`
+	LeftBumper  uint8 `json:"LB"`
+	RightBumper uint8 `json:"RB"`
+	LeftStick   uint8 `json:"LS"`
+	RightStick  uint8 `json:"RS"`
+	Select      uint8 `json:"SELECT"`
+	Start       uint8 `json:"START"`
+
+	// Axes (0-255)
+	LeftX        uint8 `json:"LjoyX"`
+	LeftY        uint8 `json:"LjoyY"`
+	RightX       uint8 `json:"RjoyX"`
+	RightY       uint8 `json:"RjoyY"`
+	LeftTrigger  uint8 `json:"LT"`
+	RightTrigger uint8 `json:"RT"`
+	DPadX        int8  `json:"dX"`
+	DPadY        int8  `json:"dY"`
+
+	// Full-resolution axes (0-65535) from newer clients. The 8-bit fields
+	// above are always their high byte.
+	LeftX16        uint16 `json:"LjoyX16,omitempty"`
+	LeftY16        uint16 `json:"LjoyY16,omitempty"`
+	RightX16       uint16 `json:"RjoyX16,omitempty"`
+	RightY16       uint16 `json:"RjoyY16,omitempty"`
+	LeftTrigger16  uint16 `json:"LT16,omitempty"`
+	RightTrigger16 uint16 `json:"RT16,omitempty"`
+
+	// Metadata
+	Timestamp int64  `json:"ts"`
+	Seq       uint64 `json:"seq,omitempty"` // numbers states sent over two links, so the server can drop -link2 duplicates; 0 when unnumbered
+}
+
+func (c *ControllerState) String() string {
+	return fmt.Sprintf("Btns[N:%d E:%d S:%d W:%d] Joy[LX:%d LY:%d RX:%d RY:%d] Trig[L:%d R:%d]",
+		c.North, c.East, c.South, c.West,
+		c.LeftX, c.LeftY, c.RightX, c.RightY,
+		c.LeftTrigger, c.RightTrigger)
+}
+
+// Axis16 returns the full-resolution field for an axis's JSON name, or nil
+func (c *ControllerState) Axis16(field string) *uint16 {
+	switch field {
+	case "LjoyX":
+		return &c.LeftX16
+	case "LjoyY":
+		return &c.LeftY16
+	case "RjoyX":
+		return &c.RightX16
+	case "RjoyY":
+		return &c.RightY16
+	case "LT":
+		return &c.LeftTrigger16
+	case "RT":
+		return &c.RightTrigger16
+	}
+	return nil
+}
+
+// Axis8 returns the 8-bit field for an axis's JSON name, or nil
+func (c *ControllerState) Axis8(field string) *uint8 {
+	switch field {
+	case "LjoyX":
+		return &c.LeftX
+	case "LjoyY":
+		return &c.LeftY
+	case "RjoyX":
+		return &c.RightX
+	case "RjoyY":
+		return &c.RightY
+	case "LT":
+		return &c.LeftTrigger
+	case "RT":
+		return &c.RightTrigger
+	}
+	return nil
+}
+
+// Button returns the field for a button's JSON name, or nil
+func (c *ControllerState) Button(field string) *uint8 {
+	switch field {
+	case "N":
+		return &c.North
+	case "E":
+		return &c.East
+	case "S":
+		return &c.South
+	case "W":
+		return &c.West
+	case "LB":
+		return &c.LeftBumper
+	case "RB":
+		return &c.RightBumper
+	case "LS":
+		return &c.LeftStick
+	case "RS":
+		return &c.RightStick
+	case "SELECT":
+		return &c.Select
+	case "START":
+		return &c.Start
+	}
+	return nil
+}
+
+// BUTTON_FIELDS are the JSON names of the buttons, which read 0 or 1
+var BUTTON_FIELDS = []string{"N", "E", "S", "W", "LB", "RB", "LS", "RS", "SELECT", "START"}
+
+// CheckButton rejects anything but a button. Combos and button settings
+// test for a non-zero value, which a stick resting at AXIS_CENTER always has.
+func CheckButton(field string) error {
+	var c ControllerState
+	if c.Button(field) == nil {
+		return fmt.Errorf("%q is not a button (valid: %s)", field, strings.Join(BUTTON_FIELDS, ", "))
+	}
+	return nil
+}
+
+// CheckDeadman rejects anything but a button, LT or RT as the deadman
+// control. Client and server both check it, so they agree.
+func CheckDeadman(field string) error {
+	if field == "LT" || field == "RT" || CheckButton(field) == nil {
+		return nil
+	}
+	return fmt.Errorf("deadman must be a button, LT or RT, got %q", field)
+}
+
+// DeadmanHeld reports whether the deadman control field is held: a button
+// pressed, or a trigger pulled to DEADMAN_TRIGGER_MIN. Anything CheckDeadman
+// rejects is never held.
+func (c *ControllerState) DeadmanHeld(field string) bool {
+	if field == "LT" || field == "RT" {
+		return *c.Axis8(field) >= DEADMAN_TRIGGER_MIN
+	}
+	if b := c.Button(field); b != nil {
+		return *b != 0
+	}
+	return false
+}
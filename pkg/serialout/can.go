@@ -0,0 +1,166 @@
+package serialout
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CAN_BASE_ID is the first message ID when a frame is split into 8-byte
+// chunks
+const CAN_BASE_ID = 0x100
+
+// CAN flags and limits from linux/can.h
+const (
+	CAN_EFF_FLAG = 0x80000000 // 29-bit extended ID
+	CAN_SFF_MAX  = 0x7FF
+	CAN_EFF_MAX  = 0x1FFFFFFF
+	CAN_MAX_DLEN = 8
+	CAN_MTU      = 16 // sizeof(struct can_frame)
+)
+
+// Motor controllers that speak CAN can be driven without an Arduino in
+// between: give the device "port": "none" and a can: output. The output
+// gets the formatted frame before any framing or ack ID and sends it as
+// classic CAN data frames on a SocketCAN interface (bring it up first, e.g.
+// "ip link set can0 up type can bitrate 500000"):
+//
+//	can:can0                         8-byte chunks as IDs 0x100, 0x101, ...
+//	can:can0:0x120                   the same from ID 0x120
+//	can:can0:0x201=0-1:0x202=2-3     one message per motor controller, each
+//	                                 with frame bytes FROM-TO (at most 8)
+//
+// IDs above 0x7FF are sent as 29-bit extended IDs. Bytes past the end of a
+// shorter frame are left out of a message rather than padded.
+
+// canMessage is one CAN ID and the frame bytes it carries
+type canMessage struct {
+	id       uint32
+	from, to int // inclusive
+}
+
+// openCANSocket opens a raw SocketCAN socket bound to an interface. It is
+// set in init() by can_linux.go, which only Linux builds include, and nil
+// otherwise.
+var openCANSocket func(iface string) (io.WriteCloser, error)
+
+// canTarget is a parsed can: output
+type canTarget struct {
+	iface    string
+	base     uint32       // first chunk's ID, without messages
+	messages []canMessage // nil to chunk the frame
+}
+
+// parseCANTarget reads what follows "can:": the interface, then either a
+// base ID or ID=FROM-TO messages
+func parseCANTarget(target string) (*canTarget, error) {
+	fields := strings.Split(target, ":")
+	t := &canTarget{iface: fields[0], base: CAN_BASE_ID}
+	if t.iface == "" {
+		return nil, errors.New("missing CAN interface")
+	}
+	if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+		id, err := parseCANID(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		t.base = id
+		return t, nil
+	}
+	for _, field := range fields[1:] {
+		idStr, span, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("message %q: want ID=FROM-TO", field)
+		}
+		id, err := parseCANID(idStr)
+		if err != nil {
+			return nil, err
+		}
+		fromStr, toStr, ok := strings.Cut(span, "-")
+		if !ok {
+			toStr = fromStr
+		}
+		from, err1 := strconv.Atoi(fromStr)
+		to, err2 := strconv.Atoi(toStr)
+		if err1 != nil || err2 != nil || from < 0 || to < from {
+			return nil, fmt.Errorf("message %q: bad byte range %q", field, span)
+		}
+		if to-from+1 > CAN_MAX_DLEN {
+			return nil, fmt.Errorf("message %q: %d bytes, at most %d fit", field, to-from+1, CAN_MAX_DLEN)
+		}
+		t.messages = append(t.messages, canMessage{id: id, from: from, to: to})
+	}
+	return t, nil
+}
+
+// parseCANID reads a message ID, hex with 0x or decimal, flagging IDs that
+// need the extended format
+func parseCANID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 0, 32)
+	if err != nil || id > CAN_EFF_MAX {
+		return 0, fmt.Errorf("bad CAN ID %q (0 to 0x%X)", s, CAN_EFF_MAX)
+	}
+	if id > CAN_SFF_MAX {
+		id |= CAN_EFF_FLAG
+	}
+	return uint32(id), nil
+}
+
+// canOutput sends frames as CAN messages
+type canOutput struct {
+	sock io.WriteCloser
+	*canTarget
+	writeHealth
+}
+
+func OpenCANOutput(target string) (OutputBackend, error) {
+	t, err := parseCANTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if openCANSocket == nil {
+		return nil, errors.New("this server was built without CAN support (see README)")
+	}
+	sock, err := openCANSocket(t.iface)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", t.iface, err)
+	}
+	return &canOutput{sock: sock, canTarget: t}, nil
+}
+
+func (o *canOutput) Write(frame []byte) error {
+	for _, m := range o.split(frame) {
+		data := frame[min(m.from, len(frame)):min(m.to+1, len(frame))]
+		if _, err := o.sock.Write(encodeCANFrame(m.id, data)); err != nil {
+			return o.note(err)
+		}
+	}
+	return o.note(nil)
+}
+
+func (o *canOutput) Close() error { return o.sock.Close() }
+
+// split returns the messages for frame, chunking it when the output has
+// no explicit messages
+func (o *canOutput) split(frame []byte) []canMessage {
+	if o.messages != nil {
+		return o.messages
+	}
+	var chunks []canMessage
+	for i := 0; i < len(frame); i += CAN_MAX_DLEN {
+		chunks = append(chunks, canMessage{id: o.base + uint32(i/CAN_MAX_DLEN), from: i, to: i + CAN_MAX_DLEN - 1})
+	}
+	return chunks
+}
+
+// encodeCANFrame lays data out as a struct can_frame
+func encodeCANFrame(id uint32, data []byte) []byte {
+	b := make([]byte, CAN_MTU)
+	binary.NativeEndian.PutUint32(b, id)
+	b[4] = byte(len(data))
+	copy(b[8:], data)
+	return b
+}
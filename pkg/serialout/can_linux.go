@@ -0,0 +1,32 @@
+//go:build linux
+
+package serialout
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	openCANSocket = openSocketCAN
+}
+
+// openSocketCAN opens a CAN_RAW socket bound to iface
+func openSocketCAN(iface string) (io.WriteCloser, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), iface), nil
+}
@@ -0,0 +1,5 @@
+// Package serialout is everything between a formatted frame and the
+// Arduino: opening serial, network and virtual ports, frame framing and
+// acks, the fixed-rate Writer, firmware identification, telemetry parsing
+// and the extra output backends (udp, file, CAN, Raspberry Pi pins).
+package serialout
@@ -0,0 +1,77 @@
+package serialout
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Debugging framing used to need a logic analyzer on the UART. With
+// -serial-dump FILE every byte written to or read from an Arduino's port
+// is appended to FILE as a timestamped hexdump:
+//
+//	2026-10-16T03:10:06.653412Z arduino TX 6 bytes
+//	00000000  a8 7f c8 7f 00 15                                 |......|
+//
+// TX entries are whole frames as they go on the wire (framing, ack ID and
+// failsafe frames included); RX entries are whatever each read returned,
+// so a telemetry frame may be split across several. -probe opens the port
+// without driving anything and prints what the board sends, with any
+// telemetry frames, acks and the answer to an ident request decoded, until
+// interrupted.
+
+// Dump appends hexdumps of serial traffic to a file
+type Dump struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func OpenDump(path string) (*Dump, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Dump{w: f}, nil
+}
+
+// record writes one timestamped hexdump of b
+func (sd *Dump) record(device, dir string, b []byte) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	WriteHexdump(sd.w, device, dir, b)
+}
+
+func (sd *Dump) Close() error { return sd.w.Close() }
+
+// WriteHexdump writes a header line and hex.Dump of b
+func WriteHexdump(w io.Writer, device, dir string, b []byte) {
+	fmt.Fprintf(w, "%s %s %s %d bytes\n%s", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), device, dir, len(b), hex.Dump(b))
+}
+
+// DumpPort records a port's traffic while passing it through
+type DumpPort struct {
+	serial.Port
+	Dump   *Dump
+	Device string
+}
+
+func (p *DumpPort) Write(b []byte) (int, error) {
+	n, err := p.Port.Write(b)
+	if n > 0 {
+		p.Dump.record(p.Device, "TX", b[:n])
+	}
+	return n, err
+}
+
+func (p *DumpPort) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	if n > 0 {
+		p.Dump.record(p.Device, "RX", b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package serialout
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Handshake timing. Opening the port resets an Uno, whose bootloader takes
+// up to two seconds to start the sketch, so the request is repeated until
+// HANDSHAKE_TIMEOUT.
+const (
+	HANDSHAKE_TIMEOUT = 3 * time.Second
+	HANDSHAKE_RETRY   = 250 * time.Millisecond
+)
+
+const (
+	IDENT_REQUEST = 0x3F // '?', sent after IDENT_SYNC
+	IDENT_MIN_LEN = 7    // version and layout hash, before the name
+)
+
+// Firmware that mapped bytes differently from the server's config has
+// driven a motor nobody commanded. With "handshake": true (or -handshake)
+// the server sends
+//
+//	[0xA4][0x3F]
+//
+// when the port opens and the firmware must answer, framed like telemetry,
+//
+//	[0xA4][len][major][minor][patch][layout hash (uint32 BE)][name][xor]
+//
+// The layout hash is the <DEVICE>_LAYOUT_HASH define from -gen-header, a
+// CRC-32 of the frame size, framing, ack mode and every byte mapping. If it
+// doesn't match the loaded config, or "firmware" names a different
+// firmware, or nothing answers, the port is closed without a single frame
+// written and reopened with the usual backoff, so a reflash is picked up.
+// Reloading a config whose layout doesn't match identified firmware is
+// refused.
+
+var IdentRequest = []byte{IDENT_SYNC, IDENT_REQUEST}
+
+// FirmwareIdent is what the firmware says about itself
+type FirmwareIdent struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Layout  uint32 `json:"layout"`
+}
+
+func (f *FirmwareIdent) String() string {
+	return fmt.Sprintf("%s %s (layout %08X)", f.Name, f.Version, f.Layout)
+}
+
+// decodeIdent converts a verified ident payload, or returns nil if it is
+// too short
+func decodeIdent(payload []byte) *FirmwareIdent {
+	if len(payload) < IDENT_MIN_LEN {
+		return nil
+	}
+	return &FirmwareIdent{
+		Name:    string(payload[IDENT_MIN_LEN:]),
+		Version: fmt.Sprintf("%d.%d.%d", payload[0], payload[1], payload[2]),
+		Layout:  binary.BigEndian.Uint32(payload[3:7]),
+	}
+}
+
+// encodeIdent builds the firmware's ident frame
+func encodeIdent(name string, version [3]byte, layout uint32) []byte {
+	payload := binary.BigEndian.AppendUint32(version[:], layout)
+	return telemetryFrame(IDENT_SYNC, append(payload, name...))
+}
+
+// Identify asks the firmware on port who it is, repeating the request
+// until it answers or HANDSHAKE_TIMEOUT passes
+func Identify(port serial.Port) (*FirmwareIdent, error) {
+	port.SetReadTimeout(50 * time.Millisecond)
+	defer port.SetReadTimeout(100 * time.Millisecond)
+
+	var parser TelemetryParser
+	buf := make([]byte, 256)
+	for deadline := time.Now().Add(HANDSHAKE_TIMEOUT); time.Now().Before(deadline); {
+		if _, err := port.Write(IdentRequest); err != nil {
+			return nil, err
+		}
+		for retry := time.Now().Add(HANDSHAKE_RETRY); time.Now().Before(retry); {
+			n, err := port.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			parser.Feed(buf[:n])
+			if parser.Ident != nil {
+				return parser.Ident, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no ident frame within %v", HANDSHAKE_TIMEOUT)
+}
@@ -0,0 +1,138 @@
+package serialout
+
+import "fmt"
+
+// Serial framing modes for ByteConfig.Framing
+const (
+	FRAMING_NONE = ""
+	FRAMING_COBS = "cobs"
+	FRAMING_SLIP = "slip"
+)
+
+// SLIP special bytes (RFC 1055)
+const (
+	SLIP_END     = 0xC0
+	SLIP_ESC     = 0xDB
+	SLIP_ESC_END = 0xDC
+	SLIP_ESC_ESC = 0xDD
+)
+
+// EncodeFrame wraps a frame for the wire according to framing
+func EncodeFrame(framing string, frame []byte) ([]byte, error) {
+	switch framing {
+	case FRAMING_NONE:
+		return frame, nil
+	case FRAMING_COBS:
+		return append(EncodeCOBS(frame), 0x00), nil
+	case FRAMING_SLIP:
+		return EncodeSLIP(frame), nil
+	default:
+		return nil, fmt.Errorf("unknown framing %q", framing)
+	}
+}
+
+// EncodeCOBS applies Consistent Overhead Byte Stuffing so the result contains
+// no zero bytes. The caller appends the 0x00 delimiter.
+func EncodeCOBS(data []byte) []byte {
+	out := make([]byte, 1, len(data)+len(data)/254+2)
+	codeIdx := 0
+	code := byte(1)
+
+	for _, b := range data {
+		if b == 0 {
+			out[codeIdx] = code
+			codeIdx = len(out)
+			out = append(out, 0)
+			code = 1
+			continue
+		}
+		out = append(out, b)
+		code++
+		if code == 0xFF {
+			out[codeIdx] = code
+			codeIdx = len(out)
+			out = append(out, 0)
+			code = 1
+		}
+	}
+	out[codeIdx] = code
+	return out
+}
+
+// DecodeCOBS reverses EncodeCOBS on a frame without its delimiter
+func DecodeCOBS(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		code := int(data[i])
+		if code == 0 || i+code > len(data) {
+			return nil, fmt.Errorf("invalid COBS code at offset %d", i)
+		}
+		out = append(out, data[i+1:i+code]...)
+		i += code
+		if code < 0xFF && i < len(data) {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
+
+// EncodeSLIP escapes data and terminates it with SLIP_END. A leading END
+// flushes any line noise the firmware received before the frame.
+func EncodeSLIP(data []byte) []byte {
+	out := make([]byte, 0, len(data)+2)
+	out = append(out, SLIP_END)
+	for _, b := range data {
+		switch b {
+		case SLIP_END:
+			out = append(out, SLIP_ESC, SLIP_ESC_END)
+		case SLIP_ESC:
+			out = append(out, SLIP_ESC, SLIP_ESC_ESC)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, SLIP_END)
+}
+
+// DecodeSLIP reverses EncodeSLIP, ignoring the END bytes around the frame
+func DecodeSLIP(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case SLIP_END:
+		case SLIP_ESC:
+			i++
+			if i >= len(data) {
+				return nil, fmt.Errorf("truncated SLIP escape at offset %d", i-1)
+			}
+			switch data[i] {
+			case SLIP_ESC_END:
+				out = append(out, SLIP_END)
+			case SLIP_ESC_ESC:
+				out = append(out, SLIP_ESC)
+			default:
+				return nil, fmt.Errorf("invalid SLIP escape 0x%02X at offset %d", data[i], i)
+			}
+		default:
+			out = append(out, data[i])
+		}
+	}
+	return out, nil
+}
+
+// DecodeFrame reverses encodeFrame
+func DecodeFrame(framing string, wire []byte) ([]byte, error) {
+	switch framing {
+	case FRAMING_NONE:
+		return wire, nil
+	case FRAMING_COBS:
+		if len(wire) > 0 && wire[len(wire)-1] == 0 {
+			wire = wire[:len(wire)-1]
+		}
+		return DecodeCOBS(wire)
+	case FRAMING_SLIP:
+		return DecodeSLIP(wire)
+	default:
+		return nil, fmt.Errorf("unknown framing %q", framing)
+	}
+}
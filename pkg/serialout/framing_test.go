@@ -0,0 +1,88 @@
+package serialout
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing string
+		frame   []byte
+		wire    []byte // nil to only check the round trip
+	}{
+		{"raw", FRAMING_NONE, []byte{0xAA, 0x00, 0x7F}, []byte{0xAA, 0x00, 0x7F}},
+		{"cobs zero", FRAMING_COBS, []byte{0x00}, []byte{0x01, 0x01, 0x00}},
+		{"cobs two zeros", FRAMING_COBS, []byte{0x00, 0x00}, []byte{0x01, 0x01, 0x01, 0x00}},
+		{"cobs zero inside", FRAMING_COBS, []byte{0x11, 0x22, 0x00, 0x33}, []byte{0x03, 0x11, 0x22, 0x02, 0x33, 0x00}},
+		{"cobs no zeros", FRAMING_COBS, []byte{0x11, 0x22, 0x33, 0x44}, []byte{0x05, 0x11, 0x22, 0x33, 0x44, 0x00}},
+		{"cobs trailing zeros", FRAMING_COBS, []byte{0x11, 0x00, 0x00, 0x00}, []byte{0x02, 0x11, 0x01, 0x01, 0x01, 0x00}},
+		{"cobs 6-byte frame", FRAMING_COBS, []byte{0xA8, 0x7F, 0x7F, 0x7F, 0x00, 0x15}, []byte{0x05, 0xA8, 0x7F, 0x7F, 0x7F, 0x02, 0x15, 0x00}},
+		{"cobs 253 bytes", FRAMING_COBS, counting(253, 1), nil},
+		{"cobs 254 bytes", FRAMING_COBS, counting(254, 1), nil},
+		{"cobs 255 bytes", FRAMING_COBS, counting(255, 1), nil},
+		{"cobs 254 bytes then a zero", FRAMING_COBS, append(counting(254, 1), 0x00), nil},
+		{"cobs long, with zeros", FRAMING_COBS, counting(600, 0), nil},
+		{"slip plain", FRAMING_SLIP, []byte{0x01, 0x02}, []byte{SLIP_END, 0x01, 0x02, SLIP_END}},
+		{"slip empty", FRAMING_SLIP, []byte{}, []byte{SLIP_END, SLIP_END}},
+		{"slip end byte", FRAMING_SLIP, []byte{SLIP_END}, []byte{SLIP_END, SLIP_ESC, SLIP_ESC_END, SLIP_END}},
+		{"slip esc byte", FRAMING_SLIP, []byte{SLIP_ESC}, []byte{SLIP_END, SLIP_ESC, SLIP_ESC_ESC, SLIP_END}},
+		{"slip escaped bytes", FRAMING_SLIP, []byte{SLIP_ESC_END, SLIP_ESC_ESC}, []byte{SLIP_END, SLIP_ESC_END, SLIP_ESC_ESC, SLIP_END}},
+		{"slip every byte", FRAMING_SLIP, counting(256, 0), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire, err := EncodeFrame(tt.framing, tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wire != nil && !bytes.Equal(wire, tt.wire) {
+				t.Fatalf("encoded % X, want % X", wire, tt.wire)
+			}
+			if tt.framing == FRAMING_COBS && bytes.IndexByte(wire[:len(wire)-1], 0) >= 0 {
+				t.Fatalf("COBS left a zero inside % X", wire)
+			}
+			got, err := DecodeFrame(tt.framing, wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.frame) {
+				t.Fatalf("decoded % X, want % X", got, tt.frame)
+			}
+		})
+	}
+}
+
+func TestFramingErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing string
+		wire    []byte
+	}{
+		{"cobs zero code", FRAMING_COBS, []byte{0x00, 0x11}},
+		{"cobs code past the end", FRAMING_COBS, []byte{0x05, 0x11, 0x22}},
+		{"slip truncated escape", FRAMING_SLIP, []byte{SLIP_END, 0x01, SLIP_ESC}},
+		{"slip bad escape", FRAMING_SLIP, []byte{SLIP_END, SLIP_ESC, 0x01, SLIP_END}},
+		{"unknown framing", "hdlc", []byte{0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := DecodeFrame(tt.framing, tt.wire); err == nil {
+				t.Fatalf("decoded % X to % X", tt.wire, got)
+			}
+		})
+	}
+	if _, err := EncodeFrame("hdlc", []byte{0x01}); err == nil {
+		t.Fatal("encoded with an unknown framing")
+	}
+}
+
+// counting returns n bytes counting up from first, wrapping past 0xFF
+func counting(n int, first byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
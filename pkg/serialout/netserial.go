@@ -0,0 +1,316 @@
+package serialout
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Network serial targets, for an Arduino on a ser2net or ESP-Link bridge
+// elsewhere on the robot network rather than on the Pi's USB
+const (
+	TCP_SERIAL_PREFIX     = "tcp://"     // raw TCP, the bytes as on the UART
+	RFC2217_SERIAL_PREFIX = "rfc2217://" // telnet with the RFC 2217 COM port option
+)
+
+const (
+	NETSERIAL_DIAL_TIMEOUT  = 2 * time.Second
+	NETSERIAL_WRITE_TIMEOUT = time.Second // a write that takes longer loses the port
+)
+
+// Telnet and RFC 2217 codes
+const (
+	TELNET_SE   = 240
+	TELNET_SB   = 250
+	TELNET_WILL = 251
+	TELNET_WONT = 252
+	TELNET_DO   = 253
+	TELNET_DONT = 254
+	TELNET_IAC  = 255
+
+	TELNET_BINARY   = 0
+	TELNET_SGA      = 3
+	TELNET_COM_PORT = 44
+
+	COM_PORT_SET_BAUDRATE = 1
+	COM_PORT_SET_DATASIZE = 2
+	COM_PORT_SET_PARITY   = 3
+	COM_PORT_SET_STOPSIZE = 4
+	COM_PORT_SET_CONTROL  = 5
+)
+
+// A serial port of tcp://host:port (ser2net "raw" mode, ESP-Link's port 23)
+// carries the UART's bytes as they are; baud rate and framing are whatever
+// the bridge was set up with. rfc2217://host:port (ser2net "telnet" with
+// RFC 2217 enabled) also sends the device's baud, data bits, parity and
+// stop bits to the bridge, and DTR/RTS and break reach the board. Either
+// way the port behaves like a local one: telemetry and acks are read from
+// it, and a dropped connection is reconnected with the usual backoff.
+
+// isNetworkPort reports whether name is a network serial target
+func isNetworkPort(name string) bool {
+	return strings.HasPrefix(name, TCP_SERIAL_PREFIX) || strings.HasPrefix(name, RFC2217_SERIAL_PREFIX)
+}
+
+// netPort implements serial.Port over TCP, optionally speaking RFC 2217
+type netPort struct {
+	conn    net.Conn
+	rfc2217 bool
+
+	writeMu sync.Mutex // Write and telnet replies
+
+	// Telnet parsing across reads, used only by the reader
+	inSB   bool // inside a subnegotiation, until IAC SE
+	sawIAC bool // the previous byte was IAC
+	verb   byte // WILL/WONT/DO/DONT waiting for its option, or 0
+
+	mu      sync.Mutex
+	timeout time.Duration
+}
+
+// openNetPort dials a tcp:// or rfc2217:// port and, for RFC 2217, sends
+// config's line settings
+func openNetPort(config *SerialConfig) (serial.Port, error) {
+	addr, rfc2217 := strings.CutPrefix(config.Port, RFC2217_SERIAL_PREFIX)
+	if !rfc2217 {
+		addr = strings.TrimPrefix(config.Port, TCP_SERIAL_PREFIX)
+	}
+	mode, err := config.Mode()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, NETSERIAL_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	p := &netPort{conn: conn, rfc2217: rfc2217, timeout: 100 * time.Millisecond}
+	if rfc2217 {
+		err := p.send([]byte{
+			TELNET_IAC, TELNET_WILL, TELNET_BINARY, TELNET_IAC, TELNET_DO, TELNET_BINARY,
+			TELNET_IAC, TELNET_WILL, TELNET_COM_PORT,
+		})
+		if err == nil {
+			err = p.SetMode(mode)
+		}
+		if bits := mode.InitialStatusBits; err == nil && bits != nil {
+			if err = p.SetDTR(bits.DTR); err == nil {
+				err = p.SetRTS(bits.RTS)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// send writes raw bytes, telnet commands included
+func (p *netPort) send(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(NETSERIAL_WRITE_TIMEOUT))
+	_, err := p.conn.Write(b)
+	return err
+}
+
+// comPort sends an RFC 2217 COM-PORT-OPTION subnegotiation
+func (p *netPort) comPort(command byte, value []byte) error {
+	b := []byte{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, command}
+	b = append(b, escapeIAC(value)...)
+	return p.send(append(b, TELNET_IAC, TELNET_SE))
+}
+
+// escapeIAC doubles every 0xFF so telnet passes it as data
+func escapeIAC(b []byte) []byte {
+	if bytes.IndexByte(b, TELNET_IAC) < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b)+4)
+	for _, c := range b {
+		out = append(out, c)
+		if c == TELNET_IAC {
+			out = append(out, TELNET_IAC)
+		}
+	}
+	return out
+}
+
+func (p *netPort) Write(b []byte) (int, error) {
+	wire := b
+	if p.rfc2217 {
+		wire = escapeIAC(b)
+	}
+	if err := p.send(wire); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the bridge's data, or 0 and no error once the read timeout
+// passes, like a local port. Telnet commands are answered and stripped.
+func (p *netPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	timeout := p.timeout
+	p.mu.Unlock()
+	for {
+		if timeout == serial.NoTimeout {
+			p.conn.SetReadDeadline(time.Time{})
+		} else {
+			p.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, err := p.conn.Read(b)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !p.rfc2217 {
+			return n, nil
+		}
+		if n = p.stripTelnet(b[:n]); n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// stripTelnet removes telnet commands from b in place, refusing options
+// other than binary mode, suppress-go-ahead and the COM port option, and
+// returns the number of data bytes left
+func (p *netPort) stripTelnet(b []byte) int {
+	n := 0
+	for _, c := range b {
+		switch {
+		case p.inSB:
+			if p.sawIAC {
+				p.sawIAC = false
+				p.inSB = c != TELNET_SE
+			} else if c == TELNET_IAC {
+				p.sawIAC = true
+			}
+		case p.verb != 0:
+			p.answer(p.verb, c)
+			p.verb = 0
+		case p.sawIAC:
+			p.sawIAC = false
+			switch c {
+			case TELNET_IAC:
+				b[n] = c
+				n++
+			case TELNET_SB:
+				p.inSB = true
+			case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+				p.verb = c
+			}
+		case c == TELNET_IAC:
+			p.sawIAC = true
+		default:
+			b[n] = c
+			n++
+		}
+	}
+	return n
+}
+
+// answer refuses options the port doesn't use
+func (p *netPort) answer(verb, option byte) {
+	switch {
+	case verb == TELNET_DO && option != TELNET_BINARY && option != TELNET_COM_PORT:
+		p.send([]byte{TELNET_IAC, TELNET_WONT, option})
+	case verb == TELNET_WILL && option != TELNET_BINARY && option != TELNET_SGA:
+		p.send([]byte{TELNET_IAC, TELNET_DONT, option})
+	}
+}
+
+func (p *netPort) SetReadTimeout(t time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = t
+	return nil
+}
+
+func (p *netPort) Close() error { return p.conn.Close() }
+
+// SetMode sends the line settings to an RFC 2217 bridge; raw TCP ignores
+// them
+func (p *netPort) SetMode(mode *serial.Mode) error {
+	if !p.rfc2217 {
+		return nil
+	}
+	var parity, stop byte
+	switch mode.Parity {
+	case serial.NoParity:
+		parity = 1
+	case serial.OddParity:
+		parity = 2
+	case serial.EvenParity:
+		parity = 3
+	case serial.MarkParity:
+		parity = 4
+	case serial.SpaceParity:
+		parity = 5
+	}
+	switch mode.StopBits {
+	case serial.OneStopBit:
+		stop = 1
+	case serial.TwoStopBits:
+		stop = 2
+	case serial.OnePointFiveStopBits:
+		stop = 3
+	}
+	for _, set := range []struct {
+		command byte
+		value   []byte
+	}{
+		{COM_PORT_SET_BAUDRATE, binary.BigEndian.AppendUint32(nil, uint32(mode.BaudRate))},
+		{COM_PORT_SET_DATASIZE, []byte{byte(mode.DataBits)}},
+		{COM_PORT_SET_PARITY, []byte{parity}},
+		{COM_PORT_SET_STOPSIZE, []byte{stop}},
+	} {
+		if err := p.comPort(set.command, set.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// control sends an RFC 2217 SET-CONTROL value; raw TCP can't
+func (p *netPort) control(on bool, onValue, offValue byte) error {
+	if !p.rfc2217 {
+		return nil
+	}
+	if on {
+		return p.comPort(COM_PORT_SET_CONTROL, []byte{onValue})
+	}
+	return p.comPort(COM_PORT_SET_CONTROL, []byte{offValue})
+}
+
+func (p *netPort) SetDTR(dtr bool) error { return p.control(dtr, 8, 9) }
+func (p *netPort) SetRTS(rts bool) error { return p.control(rts, 11, 12) }
+
+func (p *netPort) Break(d time.Duration) error {
+	if err := p.control(true, 5, 6); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.control(false, 5, 6)
+}
+
+func (p *netPort) Drain() error             { return nil }
+func (p *netPort) ResetInputBuffer() error  { return nil }
+func (p *netPort) ResetOutputBuffer() error { return nil }
+
+func (p *netPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
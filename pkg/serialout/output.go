@@ -0,0 +1,161 @@
+package serialout
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// SERIAL_NONE as a device's port sends its frames only to its outputs
+const SERIAL_NONE = "none"
+
+// Besides its serial port, a device can copy every frame it writes to more
+// outputs, listed under "outputs" in its serial settings (or the server
+// config's, or -outputs with one device):
+//
+//	serial:/dev/ttyACM1   a second board on the same bytes, with the
+//	                      device's serial settings
+//	mock:[telemetry.json] a virtual Arduino, logging what it is sent
+//	udp:HOST:PORT         one datagram per frame; HOST may be a broadcast
+//	                      address, for a logger or second robot on the LAN
+//	file:PATH             appends "unixms hex" lines, one per frame
+//	can:IFACE[:...]       CAN messages on a SocketCAN interface; see
+//	                      can.go
+//	pi:PIN=BYTE[:...]     the Raspberry Pi's own PWM channels and GPIO
+//	                      pins; see pi.go
+//
+// Outputs get the frame exactly as it goes on the wire, framing and ack ID
+// included (CAN and Pi outputs get it before both), and the failsafe frame when the last client leaves. They only
+// write: telemetry and acks come from the device's own port, and with
+// "port": "none" there is none. A failing output is logged and retried
+// with every frame without holding back the others, and one that failed to
+// open is tried again every OUTPUT_RETRY while frames are being written.
+
+// OutputBackend is somewhere a device's frames go
+type OutputBackend interface {
+	Write(frame []byte) error
+	Close() error
+	Healthy() bool // the last write succeeded
+}
+
+// CheckOutput reports whether spec names a known kind of output
+func CheckOutput(spec string) error {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("output %q: want KIND:TARGET (kinds: serial, mock, udp, file, can, pi)", spec)
+	}
+	switch kind + ":" {
+	case "serial:", "file:":
+		if target == "" {
+			return fmt.Errorf("output %q: missing path", spec)
+		}
+	case VIRTUAL_PREFIX:
+	case "udp:":
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("output %q: %w", spec, err)
+		}
+	case "can:":
+		if _, err := parseCANTarget(target); err != nil {
+			return fmt.Errorf("output %q: %w", spec, err)
+		}
+	case "pi:":
+		if _, err := parsePiTarget(target); err != nil {
+			return fmt.Errorf("output %q: %w", spec, err)
+		}
+	default:
+		return fmt.Errorf("output %q: unknown kind %q (kinds: serial, mock, udp, file, can, pi)", spec, kind)
+	}
+	return nil
+}
+
+// CheckOutputs checks every spec in an outputs list
+func CheckOutputs(specs []string) error {
+	for _, spec := range specs {
+		if err := CheckOutput(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHealth tracks the result of the last write for Healthy
+type writeHealth struct {
+	failed atomic.Bool
+}
+
+func (w *writeHealth) note(err error) error {
+	w.failed.Store(err != nil)
+	return err
+}
+
+func (w *writeHealth) Healthy() bool { return !w.failed.Load() }
+
+// portOutput writes to a serial port, real or virtual
+type portOutput struct {
+	port serial.Port
+	writeHealth
+}
+
+func NewPortOutput(port serial.Port) OutputBackend {
+	return &portOutput{port: port}
+}
+
+func (o *portOutput) Write(frame []byte) error {
+	_, err := o.port.Write(frame)
+	return o.note(err)
+}
+
+func (o *portOutput) Close() error { return o.port.Close() }
+
+// udpOutput sends each frame as a datagram, with broadcast allowed
+type udpOutput struct {
+	conn net.PacketConn
+	addr *net.UDPAddr
+	writeHealth
+}
+
+func OpenUDPOutput(target string) (OutputBackend, error) {
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", ":0") // Go sets SO_BROADCAST
+	if err != nil {
+		return nil, err
+	}
+	return &udpOutput{conn: conn, addr: addr}, nil
+}
+
+func (o *udpOutput) Write(frame []byte) error {
+	_, err := o.conn.WriteTo(frame, o.addr)
+	return o.note(err)
+}
+
+func (o *udpOutput) Close() error { return o.conn.Close() }
+
+// fileOutput appends each frame to a file as a timestamped hex line
+type fileOutput struct {
+	file *os.File
+	writeHealth
+}
+
+func OpenFileOutput(path string) (OutputBackend, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{file: f}, nil
+}
+
+func (o *fileOutput) Write(frame []byte) error {
+	_, err := fmt.Fprintf(o.file, "%d %s\n", time.Now().UnixMilli(), hex.EncodeToString(frame))
+	return o.note(err)
+}
+
+func (o *fileOutput) Close() error { return o.file.Close() }
@@ -0,0 +1,283 @@
+package serialout
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PWM timing for pi: outputs. Servo-style channels send a 1-2 ms pulse
+// every 20 ms, as hobby ESCs and motor controllers in PWM mode expect;
+// duty channels switch at 20 kHz for an H-bridge driven directly.
+const (
+	PI_SERVO_PERIOD_NS = 20_000_000
+	PI_SERVO_MIN_NS    = 1_000_000
+	PI_SERVO_MAX_NS    = 2_000_000
+	PI_DUTY_PERIOD_NS  = 50_000
+)
+
+// PI_EXPORT_WAIT is how long to wait for udev to make a newly exported
+// PWM channel or GPIO writable
+const PI_EXPORT_WAIT = time.Second
+
+const (
+	PI_PWM_SYSFS  = "/sys/class/pwm"
+	PI_GPIO_SYSFS = "/sys/class/gpio"
+)
+
+// On the test rig the Pi drives the motor controllers itself, with no
+// microcontroller in the loop. A pi: output takes the formatted frame
+// (before framing or ack ID) and sets hardware PWM channels and GPIO pins
+// from its bytes, through sysfs:
+//
+//	pi:pwm0.0=1:pwm0.1=2:gpio17=3.0:gpio27=4
+//
+// pwmC.N=B drives channel N of pwmchipC with a servo pulse from byte B
+// (0 = 1 ms, 255 = 2 ms), and pwmC.N=B% with a 20 kHz duty cycle of B/255.
+// gpioP=B.K sets BCM GPIO P high while bit K of byte B is set, and gpioP=B
+// while byte B is non-zero. The Pi's hardware PWM needs an overlay, e.g.
+// dtoverlay=pwm-2chan in config.txt for GPIO 18 and 19. Closing the output
+// stops the channels and drives the pins low.
+
+// piPin is one PWM channel or GPIO pin and the frame byte behind it
+type piPin struct {
+	pwm      bool
+	chip, ch int  // PWM
+	duty     bool // PWM duty cycle rather than servo pulse
+	gpio     int  // GPIO, BCM numbering
+	bit      int  // GPIO: bit of the byte, -1 for the whole byte
+	byteIdx  int
+
+	value *os.File // duty_cycle or value, once opened
+	last  int64    // last written, -1 before any
+}
+
+// parsePiTarget reads what follows "pi:"
+func parsePiTarget(target string) ([]*piPin, error) {
+	var pins []*piPin
+	for _, item := range strings.Split(target, ":") {
+		name, source, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want pwmC.N=BYTE or gpioP=BYTE[.BIT]", item)
+		}
+		pin := &piPin{bit: -1, last: -1}
+		var err error
+		if channel, ok := strings.CutPrefix(name, "pwm"); ok {
+			pin.pwm = true
+			chip, ch, ok := strings.Cut(channel, ".")
+			pin.chip, err = strconv.Atoi(chip)
+			if err == nil {
+				pin.ch, err = strconv.Atoi(ch)
+			}
+			if !ok || err != nil || pin.chip < 0 || pin.ch < 0 {
+				return nil, fmt.Errorf("%q: want pwmCHIP.CHANNEL", name)
+			}
+			source, pin.duty = strings.CutSuffix(source, "%")
+		} else if gpio, ok := strings.CutPrefix(name, "gpio"); ok {
+			if pin.gpio, err = strconv.Atoi(gpio); err != nil || pin.gpio < 0 {
+				return nil, fmt.Errorf("%q: want gpioBCM", name)
+			}
+			var bit string
+			if source, bit, ok = strings.Cut(source, "."); ok {
+				if pin.bit, err = strconv.Atoi(bit); err != nil || pin.bit < 0 || pin.bit > 7 {
+					return nil, fmt.Errorf("%q: bit must be 0-7", item)
+				}
+			}
+		} else {
+			return nil, fmt.Errorf("%q: want pwmC.N or gpioP", name)
+		}
+		if pin.byteIdx, err = strconv.Atoi(source); err != nil || pin.byteIdx < 0 {
+			return nil, fmt.Errorf("%q: bad byte index %q", item, source)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// level returns what pin should be set to for frame, or -1 if the frame
+// doesn't reach its byte
+func (pin *piPin) level(frame []byte) int64 {
+	if pin.byteIdx >= len(frame) {
+		return -1
+	}
+	b := int64(frame[pin.byteIdx])
+	switch {
+	case pin.pwm && pin.duty:
+		return b * PI_DUTY_PERIOD_NS / 255
+	case pin.pwm:
+		return PI_SERVO_MIN_NS + b*(PI_SERVO_MAX_NS-PI_SERVO_MIN_NS)/255
+	case pin.bit >= 0:
+		return b >> pin.bit & 1
+	default:
+		return min(b, 1)
+	}
+}
+
+// dir is the pin's sysfs directory
+func (pin *piPin) dir(gpioBase int) string {
+	if pin.pwm {
+		return filepath.Join(PI_PWM_SYSFS, fmt.Sprintf("pwmchip%d", pin.chip), fmt.Sprintf("pwm%d", pin.ch))
+	}
+	return filepath.Join(PI_GPIO_SYSFS, fmt.Sprintf("gpio%d", gpioBase+pin.gpio))
+}
+
+// open exports the pin and sets it up as an idle output
+func (pin *piPin) open(gpioBase int) error {
+	dir := pin.dir(gpioBase)
+	export := filepath.Join(filepath.Dir(dir), "export")
+	id := strconv.Itoa(pin.ch)
+	if !pin.pwm {
+		export = filepath.Join(PI_GPIO_SYSFS, "export")
+		id = strconv.Itoa(gpioBase + pin.gpio)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if err := writeSysfs(export, id); err != nil {
+			return err
+		}
+	}
+
+	// udev fixes the new files' permissions shortly after the export
+	var err error
+	for deadline := time.Now().Add(PI_EXPORT_WAIT); ; time.Sleep(20 * time.Millisecond) {
+		if err = pin.setup(dir); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	return err
+}
+
+func (pin *piPin) setup(dir string) error {
+	name := "value"
+	if pin.pwm {
+		period := int64(PI_SERVO_PERIOD_NS)
+		if pin.duty {
+			period = PI_DUTY_PERIOD_NS
+		}
+		// duty_cycle may not exceed the period, in either order of change
+		writeSysfs(filepath.Join(dir, "duty_cycle"), "0")
+		if err := writeSysfs(filepath.Join(dir, "period"), strconv.FormatInt(period, 10)); err != nil {
+			return err
+		}
+		if err := writeSysfs(filepath.Join(dir, "enable"), "1"); err != nil {
+			return err
+		}
+		name = "duty_cycle"
+	} else if err := writeSysfs(filepath.Join(dir, "direction"), "low"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	pin.value = f
+	return nil
+}
+
+// set writes level if it changed
+func (pin *piPin) set(level int64) error {
+	if level < 0 || level == pin.last {
+		return nil
+	}
+	if _, err := pin.value.WriteAt([]byte(strconv.FormatInt(level, 10)), 0); err != nil {
+		return err
+	}
+	pin.last = level
+	return nil
+}
+
+// close stops the channel or drives the pin low
+func (pin *piPin) close(gpioBase int) {
+	if pin.value == nil {
+		return
+	}
+	pin.value.WriteAt([]byte("0"), 0)
+	pin.value.Close()
+	pin.value = nil
+	if pin.pwm {
+		writeSysfs(filepath.Join(pin.dir(gpioBase), "enable"), "0")
+	}
+}
+
+// writeSysfs writes one value to a sysfs attribute
+func writeSysfs(path, value string) error {
+	return os.WriteFile(path, []byte(value), 0)
+}
+
+// piGPIOBase finds the sysfs number of BCM GPIO 0. Newer kernels number
+// the SoC's pins from 512 rather than 0; its chip is labelled
+// pinctrl-bcm2835, pinctrl-bcm2711 or pinctrl-rp1.
+func piGPIOBase() int {
+	chips, _ := filepath.Glob(filepath.Join(PI_GPIO_SYSFS, "gpiochip*"))
+	for _, chip := range chips {
+		label, err := os.ReadFile(filepath.Join(chip, "label"))
+		if err != nil || !strings.HasPrefix(string(label), "pinctrl-") {
+			continue
+		}
+		base, err := os.ReadFile(filepath.Join(chip, "base"))
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(string(base))); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// piOutput drives the Pi's PWM channels and GPIO pins from frames
+type piOutput struct {
+	pins     []*piPin
+	gpioBase int
+	writeHealth
+}
+
+func OpenPiOutput(target string) (OutputBackend, error) {
+	pins, err := parsePiTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	o := &piOutput{pins: pins, gpioBase: piGPIOBase()}
+	for _, pin := range pins {
+		if err := pin.open(o.gpioBase); err != nil {
+			o.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *piOutput) Write(frame []byte) error {
+	var errs []error
+	for _, pin := range o.pins {
+		if err := pin.set(pin.level(frame)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return o.note(errors.Join(errs...))
+}
+
+func (o *piOutput) Close() error {
+	for _, pin := range o.pins {
+		pin.close(o.gpioBase)
+	}
+	return nil
+}
+
+// PulseGPIO drives a BCM pin high for d, then low
+func PulseGPIO(gpio int, d time.Duration) error {
+	base := piGPIOBase()
+	pin := &piPin{gpio: gpio, bit: -1, last: -1}
+	if err := pin.open(base); err != nil {
+		return err
+	}
+	defer pin.close(base)
+	if err := pin.set(1); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package serialout
+
+// ARDUINO_PORT is where an Uno's CDC ACM port appears on Linux
+const ARDUINO_PORT = "/dev/ttyACM0"
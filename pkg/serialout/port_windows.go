@@ -0,0 +1,8 @@
+//go:build windows
+
+package serialout
+
+// ARDUINO_PORT is the COM port Windows usually gives the first USB serial
+// board. COM10 and up work too; the serial library adds the \\.\ prefix
+// they need.
+const ARDUINO_PORT = "COM3"
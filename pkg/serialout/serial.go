@@ -0,0 +1,355 @@
+package serialout
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// BAUD_RATE is the default; ARDUINO_PORT, the port used when no known
+// VID:PID is found, depends on the OS (port_windows.go, port_other.go)
+const BAUD_RATE = 9600
+
+// SerialConfig describes how to open the Arduino's serial port. An empty
+// Port means auto-detect by USB VID/PID, and "none" opens no port.
+type SerialConfig struct {
+	Port     string `json:"port,omitempty"`
+	Baud     int    `json:"baud,omitempty"`
+	DataBits int    `json:"data_bits,omitempty"`
+	Parity   string `json:"parity,omitempty"`    // none, odd, even, mark, space
+	StopBits string `json:"stop_bits,omitempty"` // 1, 1.5, 2
+
+	// Acknowledged mode: every frame is prefixed with a rolling ID and the
+	// firmware must ACK it within AckTimeoutMs or it is resent up to
+	// AckRetries times.
+	Ack          bool `json:"ack,omitempty"`
+	AckTimeoutMs int  `json:"ack_timeout_ms,omitempty"`
+	AckRetries   int  `json:"ack_retries,omitempty"`
+
+	// DTR and RTS are the modem lines' levels once the port is open; nil
+	// leaves them asserted, as the OS opens it. An Uno resets on DTR, so
+	// boards that shouldn't see it toggled can have "dtr": false.
+	DTR *bool `json:"dtr,omitempty"`
+	RTS *bool `json:"rts,omitempty"`
+
+	// RateHz writes the latest frame at a steady rate, however packets
+	// arrive; 0 writes each frame as it is produced
+	RateHz int `json:"rate_hz,omitempty"`
+
+	// Handshake makes the firmware identify itself before it is driven;
+	// see firmware.go. Firmware, if set, is the name it must give.
+	Handshake bool   `json:"handshake,omitempty"`
+	Firmware  string `json:"firmware,omitempty"`
+
+	// Outputs also get every frame; see output.go
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// DefaultSerialConfig returns the historical 9600 8N1 auto-detected port
+func DefaultSerialConfig() *SerialConfig {
+	return &SerialConfig{
+		Baud:     BAUD_RATE,
+		DataBits: 8,
+		Parity:   "none",
+		StopBits: "1",
+
+		AckTimeoutMs: 50,
+		AckRetries:   2,
+	}
+}
+
+// Merge copies every field set in other over c
+func (c *SerialConfig) Merge(other *SerialConfig) {
+	if other.Port != "" {
+		c.Port = other.Port
+	}
+	if other.Baud != 0 {
+		c.Baud = other.Baud
+	}
+	if other.DataBits != 0 {
+		c.DataBits = other.DataBits
+	}
+	if other.Parity != "" {
+		c.Parity = other.Parity
+	}
+	if other.StopBits != "" {
+		c.StopBits = other.StopBits
+	}
+	if other.Ack {
+		c.Ack = true
+	}
+	if other.AckTimeoutMs != 0 {
+		c.AckTimeoutMs = other.AckTimeoutMs
+	}
+	if other.AckRetries != 0 {
+		c.AckRetries = other.AckRetries
+	}
+	if other.DTR != nil {
+		c.DTR = other.DTR
+	}
+	if other.RTS != nil {
+		c.RTS = other.RTS
+	}
+	if other.Outputs != nil {
+		c.Outputs = other.Outputs
+	}
+	if other.RateHz != 0 {
+		c.RateHz = other.RateHz
+	}
+	if other.Handshake {
+		c.Handshake = true
+	}
+	if other.Firmware != "" {
+		c.Firmware = other.Firmware
+	}
+}
+
+// Mode converts the settings to a serial.Mode
+func (c *SerialConfig) Mode() (*serial.Mode, error) {
+	mode := &serial.Mode{
+		BaudRate: c.Baud,
+		DataBits: c.DataBits,
+	}
+	if c.Baud <= 0 {
+		return nil, fmt.Errorf("baud rate must be positive, got %d", c.Baud)
+	}
+	if c.DataBits < 5 || c.DataBits > 8 {
+		return nil, fmt.Errorf("data bits must be 5-8, got %d", c.DataBits)
+	}
+	if c.RateHz < 0 {
+		return nil, fmt.Errorf("rate can't be negative, got %d Hz", c.RateHz)
+	}
+
+	switch strings.ToLower(c.Parity) {
+	case "none", "n":
+		mode.Parity = serial.NoParity
+	case "odd", "o":
+		mode.Parity = serial.OddParity
+	case "even", "e":
+		mode.Parity = serial.EvenParity
+	case "mark", "m":
+		mode.Parity = serial.MarkParity
+	case "space", "s":
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, fmt.Errorf("unknown parity %q", c.Parity)
+	}
+
+	switch c.StopBits {
+	case "1":
+		mode.StopBits = serial.OneStopBit
+	case "1.5":
+		mode.StopBits = serial.OnePointFiveStopBits
+	case "2":
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, fmt.Errorf("unknown stop bits %q", c.StopBits)
+	}
+	if c.DTR != nil || c.RTS != nil {
+		mode.InitialStatusBits = &serial.ModemOutputBits{
+			DTR: c.DTR == nil || *c.DTR,
+			RTS: c.RTS == nil || *c.RTS,
+		}
+	}
+	return mode, nil
+}
+
+func (c *SerialConfig) String() string {
+	port := c.Port
+	if port == "" {
+		port = "auto"
+	}
+	str := fmt.Sprintf("%s %d %d%s%s", port, c.Baud, c.DataBits,
+		strings.ToUpper(c.Parity[:1]), c.StopBits)
+	if c.Ack {
+		str += fmt.Sprintf(" ack(%dms x%d)", c.AckTimeoutMs, c.AckRetries)
+	}
+	if c.RateHz > 0 {
+		str += fmt.Sprintf(" %dHz", c.RateHz)
+	}
+	if c.Handshake {
+		str += " handshake"
+		if c.Firmware != "" {
+			str += "(" + c.Firmware + ")"
+		}
+	}
+	if c.DTR != nil && !*c.DTR {
+		str += " dtr=off"
+	}
+	if c.RTS != nil && !*c.RTS {
+		str += " rts=off"
+	}
+	for _, out := range c.Outputs {
+		str += " +" + out
+	}
+	return str
+}
+
+// Open opens serial connection, local or over the network
+func Open(config *SerialConfig) (serial.Port, error) {
+	if isNetworkPort(config.Port) {
+		return openNetPort(config)
+	}
+	mode, err := config.Mode()
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.Port
+	if name == "" {
+		name, err = findArduinoPort()
+		if err != nil {
+			slog.Warn("Arduino discovery failed", "fallback", ARDUINO_PORT, "err", err)
+			name = ARDUINO_PORT
+		} else {
+			slog.Info("Arduino found", "port", name)
+		}
+	}
+
+	port, err := serial.Open(name, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	port.SetReadTimeout(100 * time.Millisecond)
+	return port, nil
+}
+
+// usbID is a USB vendor/product pair. An empty PID matches any product.
+type usbID struct {
+	VID, PID string
+}
+
+// knownArduinoIDs lists the USB IDs we accept as the robot's board, in order
+// of preference when several are plugged in
+var knownArduinoIDs = []usbID{
+	{"2341", ""},     // Arduino SA
+	{"2A03", ""},     // Arduino.org
+	{"1A86", "7523"}, // CH340 clones
+	{"0403", "6001"}, // FTDI FT232R
+	{"10C4", "EA60"}, // Silicon Labs CP210x
+}
+
+// arduinoRank returns the preference index of a port in knownArduinoIDs,
+// or -1 if it doesn't look like an Arduino
+func arduinoRank(port *enumerator.PortDetails) int {
+	if !port.IsUSB {
+		return -1
+	}
+	for i, id := range knownArduinoIDs {
+		if !strings.EqualFold(port.VID, id.VID) {
+			continue
+		}
+		if id.PID == "" || strings.EqualFold(port.PID, id.PID) {
+			return i
+		}
+	}
+	return -1
+}
+
+// findArduinoPort scans the serial ports for a known Arduino VID:PID and
+// returns its device path
+func findArduinoPort() (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+
+	var matches []*enumerator.PortDetails
+	for _, port := range ports {
+		if arduinoRank(port) >= 0 {
+			matches = append(matches, port)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no Arduino among %d serial ports", len(ports))
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		ri, rj := arduinoRank(matches[i]), arduinoRank(matches[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	if len(matches) > 1 {
+		slog.Warn("Several candidate Arduinos", "count", len(matches), "using", matches[0].Name)
+	}
+	return matches[0].Name, nil
+}
+
+// Writer funnels every Arduino write through one goroutine fed by a
+// 1-deep channel. submit never blocks: if the port is slow, a frame that
+// hasn't been written yet is replaced by the newer one, so the Arduino always
+// gets the freshest state and writes from different connections can't
+// interleave. With a rate set, the goroutine writes on its own ticker
+// instead, repeating the latest frame, so the firmware sees a steady stream
+// rather than the network's bursts and gaps.
+type Writer struct {
+	latest  chan []byte
+	Dropped atomic.Uint64 // frames replaced before they were written
+}
+
+func NewWriter() *Writer {
+	return &Writer{latest: make(chan []byte, 1)}
+}
+
+// Submit queues frame, replacing any frame still waiting to be written
+func (w *Writer) Submit(frame []byte) {
+	for {
+		select {
+		case w.latest <- frame:
+			return
+		default:
+		}
+		select {
+		case <-w.latest: // drop the stale frame
+			w.Dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Pending reports whether a frame is waiting to be written
+func (w *Writer) Pending() bool {
+	return len(w.latest) > 0
+}
+
+// Run writes queued frames with write until the channel is closed: each
+// as it arrives, or with a positive period the latest one on every tick
+func (w *Writer) Run(write func([]byte), period time.Duration) {
+	if period <= 0 {
+		for frame := range w.latest {
+			write(frame)
+		}
+		return
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	var current []byte
+	written := true
+	for {
+		select {
+		case frame, ok := <-w.latest:
+			if !ok {
+				return
+			}
+			if !written {
+				w.Dropped.Add(1)
+			}
+			current, written = frame, false
+		case <-ticker.C:
+			if current != nil {
+				write(current)
+				written = true
+			}
+		}
+	}
+}
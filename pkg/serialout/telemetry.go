@@ -0,0 +1,221 @@
+package serialout
+
+import (
+	"encoding/binary"
+	"time"
+
+	"go.bug.st/serial"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Telemetry frames sent by the Arduino firmware:
+//
+//	[0xA5][len][payload (len bytes)][xor of payload]
+//
+// payload is battery millivolts (uint16 BE), the limit switch bitmask (uint8)
+// and then one uint16 BE milliamp reading per motor.
+//
+// Firmware with more sensors also sends sensor frames, framed the same way
+// but starting 0xA7, as often as it likes:
+//
+//	[0xA7][len][records (len bytes)][xor of records]
+//
+// Each record is a tag byte and int16 BE values: battery current in 10 mA
+// (SENSOR_BATTERY_AMPS), the bucket angle in 0.01° (SENSOR_BUCKET), or roll,
+// pitch and yaw in 0.01° and X, Y and Z acceleration in mg (SENSOR_IMU).
+// A sensor frame updates those readings in the latest telemetry and is
+// relayed as a whole snapshot, like a telemetry frame.
+//
+// In acknowledged mode the firmware also answers every frame with
+//
+//	[0xA6][frame id][ACK (0x06) or NACK (0x15)]
+//
+// and it answers an ident request with an ident frame; see firmware.go.
+const (
+	TELEMETRY_SYNC    = 0xA5
+	TELEMETRY_MIN_LEN = 3
+	TELEMETRY_MAX_LEN = 64
+	ACK_SYNC          = 0xA6
+	ACK               = 0x06
+	NACK              = 0x15
+	SENSOR_SYNC       = 0xA7
+	IDENT_SYNC        = 0xA4
+)
+
+// Sensor frame record tags
+const (
+	SENSOR_BATTERY_AMPS = 0x01 // 1 value
+	SENSOR_BUCKET       = 0x02 // 1 value
+	SENSOR_IMU          = 0x03 // 6 values
+)
+
+// AckReply is the firmware's answer to an acknowledged frame
+type AckReply struct {
+	ID uint8
+	OK bool
+}
+
+// TelemetryParser reassembles telemetry and ack frames from an arbitrary
+// byte stream, resynchronizing on the sync bytes after a bad frame.
+type TelemetryParser struct {
+	buf   []byte
+	last  *protocol.TelemetryState // the snapshot sensor frames update
+	Ident *FirmwareIdent           // the latest ident frame, nil before any
+}
+
+// Feed consumes raw serial bytes and returns any complete frames decoded
+func (p *TelemetryParser) Feed(data []byte) (frames []*protocol.TelemetryState, acks []AckReply) {
+	p.buf = append(p.buf, data...)
+
+	for {
+		// Drop everything before the next sync byte
+		start := 0
+		for start < len(p.buf) && !isTelemetrySync(p.buf[start]) {
+			start++
+		}
+		p.buf = p.buf[start:]
+		if len(p.buf) < 2 {
+			return frames, acks
+		}
+
+		if p.buf[0] == ACK_SYNC {
+			if len(p.buf) < 3 {
+				return frames, acks
+			}
+			if code := p.buf[2]; code == ACK || code == NACK {
+				acks = append(acks, AckReply{ID: p.buf[1], OK: code == ACK})
+				p.buf = p.buf[3:]
+			} else {
+				p.buf = p.buf[1:]
+			}
+			continue
+		}
+
+		n := int(p.buf[1])
+		if n < TELEMETRY_MIN_LEN || n > TELEMETRY_MAX_LEN {
+			p.buf = p.buf[1:]
+			continue
+		}
+		if len(p.buf) < n+3 {
+			return frames, acks
+		}
+		payload := p.buf[2 : 2+n]
+		var sum uint8
+		for _, b := range payload {
+			sum ^= b
+		}
+		if sum != p.buf[2+n] {
+			// Not a real frame start, skip the sync byte and rescan
+			p.buf = p.buf[1:]
+			continue
+		}
+
+		if p.buf[0] == IDENT_SYNC {
+			if ident := decodeIdent(payload); ident != nil {
+				p.Ident = ident
+			}
+			p.buf = p.buf[n+3:]
+			continue
+		}
+		var t *protocol.TelemetryState
+		if p.buf[0] == SENSOR_SYNC {
+			t = decodeSensors(payload, p.last)
+		} else {
+			t = decodeTelemetry(payload)
+			if p.last != nil {
+				t.BatteryAmps, t.BucketAngle, t.IMU = p.last.BatteryAmps, p.last.BucketAngle, p.last.IMU
+			}
+		}
+		p.last = t
+		frames = append(frames, t)
+		p.buf = p.buf[n+3:]
+	}
+}
+
+// isTelemetrySync reports whether b starts a frame from the firmware
+func isTelemetrySync(b byte) bool {
+	return b == TELEMETRY_SYNC || b == ACK_SYNC || b == SENSOR_SYNC || b == IDENT_SYNC
+}
+
+// decodeTelemetry converts a verified payload into a TelemetryState
+func decodeTelemetry(payload []byte) *protocol.TelemetryState {
+	t := &protocol.TelemetryState{
+		Type:          protocol.MsgTelemetry,
+		BatteryVolts:  float64(binary.BigEndian.Uint16(payload[0:2])) / 1000,
+		LimitSwitches: payload[2],
+		Timestamp:     time.Now().UnixMilli(),
+	}
+	for i := TELEMETRY_MIN_LEN; i+1 < len(payload); i += 2 {
+		mA := binary.BigEndian.Uint16(payload[i : i+2])
+		t.MotorCurrents = append(t.MotorCurrents, float64(mA)/1000)
+	}
+	return t
+}
+
+// decodeSensors applies a verified sensor frame to a copy of last, the
+// latest telemetry, stopping at an unknown or short record
+func decodeSensors(records []byte, last *protocol.TelemetryState) *protocol.TelemetryState {
+	t := &protocol.TelemetryState{Type: protocol.MsgTelemetry}
+	if last != nil {
+		*t = *last
+	}
+	t.Timestamp = time.Now().UnixMilli()
+	value := func(i int) float64 {
+		return float64(int16(binary.BigEndian.Uint16(records[1+2*i:])))
+	}
+	for len(records) > 0 {
+		var n int
+		switch records[0] {
+		case SENSOR_BATTERY_AMPS, SENSOR_BUCKET:
+			n = 1
+		case SENSOR_IMU:
+			n = 6
+		default:
+			return t
+		}
+		if len(records) < 1+2*n {
+			return t
+		}
+		switch records[0] {
+		case SENSOR_BATTERY_AMPS:
+			amps := value(0) / 100
+			t.BatteryAmps = &amps
+		case SENSOR_BUCKET:
+			angle := value(0) / 100
+			t.BucketAngle = &angle
+		case SENSOR_IMU:
+			t.IMU = &protocol.IMUReading{
+				Roll: value(0) / 100, Pitch: value(1) / 100, Yaw: value(2) / 100,
+				AccelX: value(3) / 1000, AccelY: value(4) / 1000, AccelZ: value(5) / 1000,
+			}
+		}
+		records = records[1+2*n:]
+	}
+	return t
+}
+
+// ReadTelemetry reads the Arduino's serial output and hands every decoded
+// telemetry frame to onFrame and ack reply to onAck. It returns once the port
+// is closed.
+func ReadTelemetry(port serial.Port, onFrame func(*protocol.TelemetryState), onAck func(AckReply)) {
+	var parser TelemetryParser
+	buf := make([]byte, 256)
+
+	for {
+		n, err := port.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue // read timeout
+		}
+		frames, acks := parser.Feed(buf[:n])
+		for _, t := range frames {
+			onFrame(t)
+		}
+		for _, a := range acks {
+			onAck(a)
+		}
+	}
+}
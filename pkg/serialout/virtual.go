@@ -0,0 +1,260 @@
+package serialout
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+
+	"lunabotics/pkg/protocol"
+)
+
+// VIRTUAL_PREFIX selects the in-memory Arduino: -serial mock: on its own,
+// or mock:telemetry.json to also play scripted telemetry back
+const VIRTUAL_PREFIX = "mock:"
+
+// VIRTUAL_SCRIPT_GAP is the pause before a telemetry script starts over
+const VIRTUAL_SCRIPT_GAP = time.Second
+
+var errVirtualClosed = errors.New("virtual Arduino closed")
+
+// virtualTelemetry is one entry of a telemetry script, sent At seconds
+// into each pass
+type virtualTelemetry struct {
+	At            float64   `json:"t"`
+	BatteryVolts  float64   `json:"battery_v"`
+	MotorCurrents []float64 `json:"motor_a"`
+	LimitSwitches uint8     `json:"limits"`
+
+	BatteryAmps *float64             `json:"battery_a"` // sent in a sensor frame, as are the rest
+	BucketAngle *float64             `json:"bucket_deg"`
+	IMU         *protocol.IMUReading `json:"imu"`
+}
+
+// virtualArduino implements serial.Port in memory for machines without the
+// robot. It logs every frame the server writes, acknowledges frames in
+// acknowledged mode and can play telemetry from a script, so the whole
+// write path runs as it would against a board.
+type virtualArduino struct {
+	device  string
+	framing string
+	ack     bool
+	layout  uint32 // reported in the ident frame
+
+	out     chan []byte // acks and telemetry waiting to be read
+	pending []byte      // rest of a chunk Read couldn't fit
+	closed  chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	timeout time.Duration
+	last    []byte // previous frame, to log changes at INFO
+}
+
+func NewVirtualArduino(device, framing string, ack bool, layout uint32, script string) (serial.Port, error) {
+	v := &virtualArduino{
+		device:  device,
+		framing: framing,
+		ack:     ack,
+		layout:  layout,
+		out:     make(chan []byte, 64),
+		closed:  make(chan struct{}),
+		timeout: serial.NoTimeout,
+	}
+	if script != "" {
+		entries, err := loadTelemetryScript(script)
+		if err != nil {
+			return nil, err
+		}
+		go v.playTelemetry(entries)
+	}
+	slog.Info("Using virtual Arduino", "device", device, "telemetry", script)
+	return v, nil
+}
+
+// loadTelemetryScript reads a JSON list of virtualTelemetry entries
+func loadTelemetryScript(filename string) ([]virtualTelemetry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []virtualTelemetry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no telemetry entries", filename)
+	}
+	return entries, nil
+}
+
+// playTelemetry queues the script's frames at their times, over and over,
+// until the port is closed
+func (v *virtualArduino) playTelemetry(entries []virtualTelemetry) {
+	for {
+		start := time.Now()
+		for _, e := range entries {
+			select {
+			case <-v.closed:
+				return
+			case <-time.After(time.Until(start.Add(time.Duration(e.At * float64(time.Second))))):
+			}
+			v.queue(encodeTelemetry(&e))
+			if sensors := encodeSensors(&e); sensors != nil {
+				v.queue(sensors)
+			}
+		}
+		select {
+		case <-v.closed:
+			return
+		case <-time.After(VIRTUAL_SCRIPT_GAP):
+		}
+	}
+}
+
+// encodeTelemetry builds the firmware's telemetry frame for e
+func encodeTelemetry(e *virtualTelemetry) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(e.BatteryVolts*1000))
+	payload = append(payload, e.LimitSwitches)
+	for _, amps := range e.MotorCurrents {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(amps*1000))
+	}
+	return telemetryFrame(TELEMETRY_SYNC, payload)
+}
+
+// encodeSensors builds the firmware's sensor frame for e, or returns nil if
+// it has no sensor readings
+func encodeSensors(e *virtualTelemetry) []byte {
+	var records []byte
+	record := func(tag byte, values ...float64) {
+		records = append(records, tag)
+		for _, v := range values {
+			records = binary.BigEndian.AppendUint16(records, uint16(int16(math.Round(v))))
+		}
+	}
+	if e.BatteryAmps != nil {
+		record(SENSOR_BATTERY_AMPS, *e.BatteryAmps*100)
+	}
+	if e.BucketAngle != nil {
+		record(SENSOR_BUCKET, *e.BucketAngle*100)
+	}
+	if i := e.IMU; i != nil {
+		record(SENSOR_IMU, i.Roll*100, i.Pitch*100, i.Yaw*100, i.AccelX*1000, i.AccelY*1000, i.AccelZ*1000)
+	}
+	if records == nil {
+		return nil
+	}
+	return telemetryFrame(SENSOR_SYNC, records)
+}
+
+// telemetryFrame wraps payload with sync, its length and its xor
+func telemetryFrame(sync byte, payload []byte) []byte {
+	var sum uint8
+	for _, b := range payload {
+		sum ^= b
+	}
+	frame := append([]byte{sync, byte(len(payload))}, payload...)
+	return append(frame, sum)
+}
+
+// queue hands bytes to the reader, dropping them if nobody is reading, as
+// a UART would
+func (v *virtualArduino) queue(b []byte) {
+	select {
+	case v.out <- b:
+	default:
+	}
+}
+
+func (v *virtualArduino) Write(p []byte) (int, error) {
+	select {
+	case <-v.closed:
+		return 0, errVirtualClosed
+	default:
+	}
+	if bytes.Equal(p, IdentRequest) {
+		v.queue(encodeIdent("virtual", [3]byte{}, v.layout))
+		return len(p), nil
+	}
+
+	frame, err := DecodeFrame(v.framing, p)
+	if err != nil {
+		slog.Warn("Virtual Arduino got a bad frame", "device", v.device, "bytes", fmt.Sprintf("% X", p), "err", err)
+		return len(p), nil
+	}
+	if v.ack && len(frame) > 0 {
+		id := frame[0]
+		frame = frame[1:]
+		v.queue([]byte{ACK_SYNC, id, ACK})
+	}
+
+	v.mu.Lock()
+	changed := string(frame) != string(v.last)
+	v.last = append(v.last[:0], frame...)
+	v.mu.Unlock()
+
+	level := slog.LevelDebug
+	if changed {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, "Virtual Arduino received", "device", v.device, "frame", fmt.Sprintf("% X", frame))
+	return len(p), nil
+}
+
+// Read returns queued bytes, or 0 and no error once the read timeout
+// passes, like a real port
+func (v *virtualArduino) Read(p []byte) (int, error) {
+	if len(v.pending) == 0 {
+		v.mu.Lock()
+		timeout := v.timeout
+		v.mu.Unlock()
+		var expired <-chan time.Time
+		if timeout >= 0 {
+			expired = time.After(timeout)
+		}
+		select {
+		case b := <-v.out:
+			v.pending = b
+		case <-expired:
+			return 0, nil
+		case <-v.closed:
+			return 0, errVirtualClosed
+		}
+	}
+	n := copy(p, v.pending)
+	v.pending = v.pending[n:]
+	return n, nil
+}
+
+func (v *virtualArduino) SetReadTimeout(t time.Duration) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.timeout = t
+	return nil
+}
+
+func (v *virtualArduino) Close() error {
+	v.once.Do(func() { close(v.closed) })
+	return nil
+}
+
+func (v *virtualArduino) SetMode(mode *serial.Mode) error { return nil }
+func (v *virtualArduino) Drain() error                    { return nil }
+func (v *virtualArduino) ResetInputBuffer() error         { return nil }
+func (v *virtualArduino) ResetOutputBuffer() error        { return nil }
+func (v *virtualArduino) SetDTR(dtr bool) error           { return nil }
+func (v *virtualArduino) SetRTS(rts bool) error           { return nil }
+func (v *virtualArduino) Break(time.Duration) error       { return nil }
+
+func (v *virtualArduino) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{CTS: true, DSR: true, DCD: true}, nil
+}
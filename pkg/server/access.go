@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// AccessConfig is the server config's access section: which client
+// addresses may connect, as CIDR prefixes or single IPs
+type AccessConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// accessList decides which addresses may open a control connection. Deny
+// rules win over allow rules, and an empty allow list allows everyone not
+// denied.
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parseAccessList reads comma-separated -allow and -deny values
+func parseAccessList(allow, deny string) (*accessList, error) {
+	a := &accessList{}
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return a, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDR prefixes; a bare
+// address is a prefix of just itself
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits reports whether a client at addr may connect, and if not which
+// rule refused it
+func (a *accessList) permits(addr net.Addr) (bool, string) {
+	var raw net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		raw = addr.IP
+	case *net.UDPAddr: // QUIC
+		raw = addr.IP
+	default:
+		return true, ""
+	}
+	ip, ok := netip.AddrFromSlice(raw)
+	if !ok {
+		return false, "unparseable address"
+	}
+	ip = ip.Unmap()
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return false, "deny " + p.String()
+		}
+	}
+	if len(a.allow) == 0 {
+		return true, ""
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return true, ""
+		}
+	}
+	return false, "not in allow list"
+}
+
+// empty reports whether the list lets everyone in
+func (a *accessList) empty() bool {
+	return len(a.allow) == 0 && len(a.deny) == 0
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 9000} }
+	tests := []struct {
+		name        string
+		allow, deny string
+		addr        net.Addr
+		want        bool
+	}{
+		{"no rules", "", "", tcp("203.0.113.7"), true},
+		{"allowed prefix", "10.0.0.0/8", "", tcp("10.1.2.3"), true},
+		{"outside the allow list", "10.0.0.0/8", "", tcp("192.168.1.5"), false},
+		{"bare address", "192.168.1.5", "", tcp("192.168.1.5"), true},
+		{"bare address, other host", "192.168.1.5", "", tcp("192.168.1.6"), false},
+		{"deny wins", "10.0.0.0/8", "10.0.0.66", tcp("10.0.0.66"), false},
+		{"deny only", "", "10.0.0.0/24", tcp("10.0.1.1"), true},
+		{"unmasked prefix", "10.1.2.3/16", "", tcp("10.1.200.1"), true},
+		{"mapped IPv4", "10.0.0.0/8", "", tcp("::ffff:10.0.0.1"), true},
+		{"IPv6", "fd00::/8", "", tcp("fd12::1"), true},
+		{"IPv6 outside", "fd00::/8", "", tcp("2001:db8::1"), false},
+		{"QUIC", "10.0.0.0/8", "", &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: 9001}, true},
+		{"unix socket", "10.0.0.0/8", "", &net.UnixAddr{Name: "/tmp/planner", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseAccessList(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, rule := a.permits(tt.addr); got != tt.want {
+				t.Fatalf("permits(%v) = %v (%s), want %v", tt.addr, got, rule, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "nope", "10.0.0.0/8, 300.1.1.1"} {
+		if _, err := parseAccessList(bad, ""); err == nil {
+			t.Errorf("allow %q parsed", bad)
+		}
+	}
+}
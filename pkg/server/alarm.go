@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/serialout"
+)
+
+// Alarm events, as published on the hub's event bus
+const (
+	ALARM_DRIVER_LOST        = BUS_DRIVER_LOST        // the driver disconnected
+	ALARM_FAILSAFE           = BUS_FAILSAFE           // the robot was put in failsafe by a fault
+	ALARM_ESTOP              = BUS_ESTOP              // the e-stop latched
+	ALARM_CRC_STORM          = BUS_CRC_STORM          // CRC_STORM_COUNT bad packets within CRC_STORM_WINDOW
+	ALARM_SERIAL_LOST        = BUS_SERIAL_LOST        // an Arduino's port failed
+	ALARM_SERIAL_RECONNECTED = BUS_SERIAL_RECONNECTED // an Arduino's port is back
+	ALARM_BATTERY_CRITICAL   = BUS_BATTERY_CRITICAL   // the battery went critical
+	ALARM_MODE_CHANGED       = BUS_MODE_CHANGED       // the server switched mode
+	ALARM_MOTOR_STALL        = BUS_MOTOR_STALL        // a motor drew -stall-current
+)
+
+var alarmEvents = []string{ALARM_DRIVER_LOST, ALARM_FAILSAFE, ALARM_ESTOP, ALARM_CRC_STORM, ALARM_SERIAL_LOST,
+	ALARM_SERIAL_RECONNECTED, ALARM_BATTERY_CRITICAL, ALARM_MODE_CHANGED, ALARM_MOTOR_STALL}
+
+// Alarm defaults
+const (
+	ALARM_PULSE           = 2 * time.Second  // how long a GPIO stays high
+	ALARM_COOLDOWN        = 5 * time.Second  // least time between firings of a hook
+	ALARM_COMMAND_TIMEOUT = 10 * time.Second // a command still running is killed
+)
+
+// A CRC_STORM_COUNT'th bad-CRC packet within CRC_STORM_WINDOW of the first
+// is a CRC storm: a failing link, or someone on the port who shouldn't be
+const (
+	CRC_STORM_COUNT  = 10
+	CRC_STORM_WINDOW = time.Second
+)
+
+// The robot's beacon and the pit's speakers can follow what the server
+// sees. Each entry of the server config's alarms list names the events it
+// fires on and one or more actions:
+//
+//	alarms:
+//	  - on: [estop, serial_lost]
+//	    gpio: 17            # BCM pin held high for duration_ms
+//	  - on: [driver_lost, failsafe]
+//	    command: "aplay /usr/share/sounds/alarm.wav"
+//	  - on: [crc_storm]
+//	    send: udp:192.168.1.20:5007
+//	    bytes: "BE EF 01"
+//
+// Commands run through the shell with LUNABOTICS_EVENT and
+// LUNABOTICS_DETAIL set; send takes udp:HOST:PORT, serial:PATH (9600 8N1)
+// or file:PATH. A hook fires at most once every cooldown_ms, in the
+// background, so a slow command or missing GPIO never holds up the robot.
+
+// AlarmConfig is one entry of the server config's alarms list
+type AlarmConfig struct {
+	On         []string `json:"on"`
+	Command    string   `json:"command,omitempty"`
+	GPIO       *int     `json:"gpio,omitempty"`  // BCM numbering
+	Send       string   `json:"send,omitempty"`  // udp:, serial: or file: target for Bytes
+	Bytes      string   `json:"bytes,omitempty"` // hex, as for -decode
+	DurationMs int      `json:"duration_ms,omitempty"`
+	CooldownMs int      `json:"cooldown_ms,omitempty"`
+}
+
+// check returns what is wrong with the hook, or nil
+func (c *AlarmConfig) check() error {
+	if len(c.On) == 0 {
+		return fmt.Errorf("on: no events (events: %s)", strings.Join(alarmEvents, ", "))
+	}
+	for _, event := range c.On {
+		if !slices.Contains(alarmEvents, event) {
+			return fmt.Errorf("on: unknown event %q (events: %s)", event, strings.Join(alarmEvents, ", "))
+		}
+	}
+	if c.Command == "" && c.GPIO == nil && c.Send == "" {
+		return fmt.Errorf("needs a command, gpio or send")
+	}
+	if c.GPIO != nil && *c.GPIO < 0 {
+		return fmt.Errorf("gpio: %d is negative", *c.GPIO)
+	}
+	if c.Send != "" {
+		kind, target, _ := strings.Cut(c.Send, ":")
+		if kind != "udp" && kind != "serial" && kind != "file" {
+			return fmt.Errorf("send %q: want udp:HOST:PORT, serial:PATH or file:PATH", c.Send)
+		}
+		if err := serialout.CheckOutput(c.Send); err != nil || target == "" {
+			return fmt.Errorf("send %q: want udp:HOST:PORT, serial:PATH or file:PATH", c.Send)
+		}
+		if b, err := formatter.ParseHexFrame(c.Bytes); err != nil || len(b) == 0 {
+			return fmt.Errorf("bytes %q: want hex, e.g. \"BE EF 01\"", c.Bytes)
+		}
+	}
+	if c.DurationMs < 0 || c.CooldownMs < 0 {
+		return fmt.Errorf("duration_ms and cooldown_ms can't be negative")
+	}
+	return nil
+}
+
+// alarmHook is a configured hook and when it last fired
+type alarmHook struct {
+	config   AlarmConfig
+	bytes    []byte
+	pulse    time.Duration
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	last    time.Time
+	running bool
+}
+
+// alarmHooks runs the configured hooks. A nil alarmHooks fires nothing.
+type alarmHooks struct {
+	hooks []*alarmHook
+}
+
+// crcStorm counts bad-CRC packets in CRC_STORM_WINDOW windows
+type crcStorm struct {
+	mu     sync.Mutex
+	start  time.Time // first bad CRC of the current window
+	errors int
+}
+
+func newAlarmHooks(configs []AlarmConfig) (*alarmHooks, error) {
+	a := &alarmHooks{}
+	for i, config := range configs {
+		if err := config.check(); err != nil {
+			return nil, fmt.Errorf("alarm %d: %w", i+1, err)
+		}
+		hook := &alarmHook{config: config, pulse: ALARM_PULSE, cooldown: ALARM_COOLDOWN}
+		hook.bytes, _ = formatter.ParseHexFrame(config.Bytes)
+		if config.DurationMs > 0 {
+			hook.pulse = ms(config.DurationMs)
+		}
+		if config.CooldownMs > 0 {
+			hook.cooldown = ms(config.CooldownMs)
+		}
+		a.hooks = append(a.hooks, hook)
+	}
+	return a, nil
+}
+
+// fire runs every hook listening for event that isn't cooling down or
+// still running
+func (a *alarmHooks) fire(event, detail string) {
+	if a == nil {
+		return
+	}
+	for _, hook := range a.hooks {
+		if !slices.Contains(hook.config.On, event) {
+			continue
+		}
+		hook.mu.Lock()
+		ready := !hook.running && time.Since(hook.last) >= hook.cooldown
+		if ready {
+			hook.running = true
+			hook.last = time.Now()
+		}
+		hook.mu.Unlock()
+		if ready {
+			slog.Info("Alarm", "event", event, "detail", detail)
+			go hook.run(event, detail)
+		}
+	}
+}
+
+// subscribe fires the hooks from the hub's events
+func (a *alarmHooks) subscribe(bus *eventBus) {
+	bus.subscribe(func(e *serverEvent) {
+		switch {
+		case e.Detail != "":
+			a.fire(e.Kind, e.Detail)
+		case e.Device != "":
+			a.fire(e.Kind, e.Device)
+		default:
+			a.fire(e.Kind, e.Client)
+		}
+	}, alarmEvents...)
+}
+
+// count counts a bad-CRC packet and reports whether it makes a storm, which
+// happens once per window
+func (c *crcStorm) count() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.start) > CRC_STORM_WINDOW {
+		c.start, c.errors = now, 0
+	}
+	c.errors++
+	return c.errors == CRC_STORM_COUNT
+}
+
+// run performs the hook's actions, the GPIO pulse alongside the rest
+func (hook *alarmHook) run(event, detail string) {
+	defer func() {
+		hook.mu.Lock()
+		hook.running = false
+		hook.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	if hook.config.GPIO != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serialout.PulseGPIO(*hook.config.GPIO, hook.pulse); err != nil {
+				slog.Warn("Alarm GPIO failed", "event", event, "gpio", *hook.config.GPIO, "err", err)
+			}
+		}()
+	}
+	if hook.config.Send != "" {
+		if err := sendAlarmBytes(hook.config.Send, hook.bytes); err != nil {
+			slog.Warn("Alarm send failed", "event", event, "send", hook.config.Send, "err", err)
+		}
+	}
+	if hook.config.Command != "" {
+		if err := runAlarmCommand(hook.config.Command, event, detail); err != nil {
+			slog.Warn("Alarm command failed", "event", event, "command", hook.config.Command, "err", err)
+		}
+	}
+	wg.Wait()
+}
+
+// sendAlarmBytes writes b once to a udp:, serial: or file: target
+func sendAlarmBytes(spec string, b []byte) error {
+	kind, target, _ := strings.Cut(spec, ":")
+	var out serialout.OutputBackend
+	var err error
+	switch kind {
+	case "udp":
+		out, err = serialout.OpenUDPOutput(target)
+	case "serial":
+		config := serialout.DefaultSerialConfig()
+		config.Port = target
+		port, openErr := serialout.Open(config)
+		if openErr != nil {
+			return openErr
+		}
+		out = serialout.NewPortOutput(port)
+	default:
+		out, err = serialout.OpenFileOutput(target)
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return out.Write(b)
+}
+
+// runAlarmCommand runs command through the shell, killing it after
+// ALARM_COMMAND_TIMEOUT
+func runAlarmCommand(command, event, detail string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ALARM_COMMAND_TIMEOUT)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "LUNABOTICS_EVENT="+event, "LUNABOTICS_DETAIL="+detail)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
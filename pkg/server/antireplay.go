@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// REPLAY_WINDOW is how far from the server's clock a state's timestamp may
+// be, by default, before the state is taken for a replay and dropped
+const REPLAY_WINDOW = 2 * time.Second
+
+// OFFSET_WAIT is how long states are held back for a clock offset that
+// doesn't come before the client is disconnected
+const OFFSET_WAIT = 5 * time.Second
+
+// Captured traffic played back onto the network, by accident or on
+// purpose, must not drive the robot. A state is only handled if its
+// Timestamp, shifted by the client's clock offset, is within the replay
+// window of now, and its Seq is above every one the session has handled
+// (see fresh). The window stops old captures on any connection; the
+// sequence stops copies of recent ones on the session they came from.
+// Until the client's pings have told the server its clock offset, its
+// clock is taken to be right, and a state outside the window is held back
+// rather than called a replay: a client with a badly set clock drives once
+// the offset arrives, a moment after connecting. One that still hasn't
+// sent it OFFSET_WAIT later never pings, so it would never drive, and is
+// disconnected with the reason rather than left waiting. States without a
+// timestamp, from clients that predate it, are let through.
+
+// inWindow reports whether state is recent enough to handle, counting and
+// logging the states it rejects as replays. Callers hold s.stateMu.
+func (s *clientSession) inWindow(state *protocol.ControllerState) bool {
+	window := s.hub.replayWindow
+	if window <= 0 || state.Timestamp == 0 {
+		return true
+	}
+	s.mu.Lock()
+	offset, known := s.offset, s.offsetKnown
+	s.mu.Unlock()
+	skew := time.Since(time.UnixMilli(state.Timestamp).Add(offset))
+	if skew.Abs() <= window {
+		return true
+	}
+	attrs := []any{"client", s.conn.RemoteAddr(), "age", skew.Round(time.Millisecond), "window", window}
+	if !known {
+		// Its clock may just be off
+		if s.heldSince.IsZero() {
+			slog.Info("Holding states until the client's clock offset is known", attrs...)
+			s.heldSince = time.Now()
+		} else if time.Since(s.heldSince) > OFFSET_WAIT {
+			slog.Warn("Disconnecting client: its clock is off and it never sent its offset", attrs...)
+			s.close(fmt.Sprintf("your clock is %v off the server's and no ping corrected it; set the clock or update the client", skew.Round(time.Second)))
+		}
+		return false
+	}
+	s.hub.reject(s.conn.RemoteAddr().String(), REJECT_REPLAY)
+	if time.Since(s.lastReplayLog) > time.Second {
+		slog.Warn("Dropping state outside the replay window", append(attrs, "seq", state.Seq)...)
+		s.lastReplayLog = time.Now()
+	}
+	return false
+}
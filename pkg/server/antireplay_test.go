@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestInWindow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		sent      time.Time     // the state's timestamp, by the client's clock
+		offset    time.Duration // known clock offset, with offsetKnown
+		known     bool
+		heldSince time.Duration // how long states have been held back, 0 for none
+		want      bool
+		closed    bool
+	}{
+		{"no timestamp", time.Time{}, 0, false, 0, true, false},
+		{"fresh", now, 0, true, 0, true, false},
+		{"fresh before the offset", now, 0, false, 0, true, false},
+		{"old capture", now.Add(-time.Minute), 0, true, 0, false, false},
+		{"slow clock, corrected", now.Add(-time.Minute), time.Minute, true, 0, true, false},
+		{"fast clock, corrected", now.Add(time.Minute), -time.Minute, true, 0, true, false},
+		{"slow clock, offset pending", now.Add(-time.Minute), 0, false, 0, false, false},
+		{"slow clock, offset never sent", now.Add(-time.Minute), 0, false, 2 * OFFSET_WAIT, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newClientHub("")
+			s := testSession(t, h)
+			s.offset, s.offsetKnown = tt.offset, tt.known
+			if tt.heldSince > 0 {
+				s.heldSince = time.Now().Add(-tt.heldSince)
+			}
+			state := &protocol.ControllerState{}
+			if !tt.sent.IsZero() {
+				state.Timestamp = tt.sent.UnixMilli()
+			}
+
+			if got := s.inWindow(state); got != tt.want {
+				t.Fatalf("inWindow = %v, want %v", got, tt.want)
+			}
+			s.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, err := s.conn.Read(make([]byte, 1))
+			if closed := errors.Is(err, io.ErrClosedPipe); closed != tt.closed {
+				t.Fatalf("session closed = %v, want %v", closed, tt.closed)
+			}
+		})
+	}
+}
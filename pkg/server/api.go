@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// apiStatus is the body of GET /status
+type apiStatus struct {
+	Time    int64                   `json:"ts"`
+	EStop   bool                    `json:"estop"`
+	Profile string                  `json:"profile"`
+	Mode    string                  `json:"mode"`
+	Driver  string                  `json:"driver,omitempty"`
+	Clients int                     `json:"clients"`
+	Devices []protocol.DeviceStatus `json:"devices"`
+
+	Health   string        `json:"health"` // HEALTH_OK or HEALTH_DEGRADED
+	Problems []string      `json:"problems,omitempty"`
+	Serial   []serialStats `json:"serial"`
+}
+
+// apiHealth is the body of GET /health
+type apiHealth struct {
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// apiServer is the admin REST API for pit tooling and scripts:
+//
+//	GET    /status         robot and link state, serial statistics
+//	GET    /health         ok, or 503 and why the server is degraded
+//	GET    /clients        connected clients and their roles
+//	GET    /estop          whether the e-stop is latched
+//	POST   /estop          latch it, optional body {"reason": "..."}
+//	DELETE /estop          release it
+//	GET    /profile        active profile
+//	PUT    /profile        switch, body {"name": "..."}
+//	GET    /mode           teleop, autonomy, paused or estop
+//	PUT    /mode           switch, body {"mode": "..."}
+//	POST   /config/reload  reload the byte config file
+//	POST   /blackbox       dump the black box now
+//
+// The access list applies as it does to clients. Anyone it lets in may
+// trigger the e-stop, like any client. Everything else that changes state
+// needs the driver token as "Authorization: Bearer TOKEN", or, on a server
+// without one, a request from this machine. DELETE /estop only releases an
+// e-stop the API or the autonomy source latched; one a client latched is
+// for the driver or that client to release.
+type apiServer struct {
+	hub          *clientHub
+	access       *accessList
+	configFile   string
+	configFormat string
+}
+
+// serveAPI serves the admin API on addr until the listener fails
+func serveAPI(addr string, api *apiServer) {
+	slog.Info("Admin API listening", "url", "http://"+addr+"/")
+	if err := http.ListenAndServe(addr, api.handler()); err != nil {
+		slog.Error("Admin API server stopped", "err", err)
+	}
+}
+
+// handler routes the admin API's requests
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.status)
+	mux.HandleFunc("GET /health", a.health)
+	mux.HandleFunc("GET /clients", a.clients)
+	mux.HandleFunc("GET /estop", a.getEStop)
+	mux.HandleFunc("POST /estop", a.triggerEStop)
+	mux.HandleFunc("DELETE /estop", a.authorized(a.resetEStop))
+	mux.HandleFunc("GET /profile", a.getProfile)
+	mux.HandleFunc("PUT /profile", a.authorized(a.setProfile))
+	mux.HandleFunc("GET /mode", a.getMode)
+	mux.HandleFunc("PUT /mode", a.authorized(a.setMode))
+	mux.HandleFunc("POST /config/reload", a.authorized(a.reload))
+	mux.HandleFunc("POST /blackbox", a.authorized(a.dumpBlackBox))
+	return a.permitted(mux)
+}
+
+// permitted refuses requests from addresses the access list refuses
+func (a *apiServer) permitted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, rule := a.access.permits(httpRemoteAddr(r.RemoteAddr)); !ok {
+			slog.Warn("Refused admin API request", "remote", r.RemoteAddr, "path", r.URL.Path, "rule", rule)
+			apiError(w, http.StatusForbidden, errors.New("refused by "+rule))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized wraps a handler that needs the driver token. A server without
+// one only takes such requests from this machine.
+func (a *apiServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.hub.token == "" {
+			if !httpRemoteAddr(r.RemoteAddr).IP.IsLoopback() {
+				slog.Warn("Rejected admin API request", "remote", r.RemoteAddr, "path", r.URL.Path)
+				apiError(w, http.StatusForbidden, errors.New("the server has no -driver-token, so this is only allowed from the server's own machine"))
+				return
+			}
+			next(w, r)
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.hub.token)) != 1 {
+			slog.Warn("Rejected admin API request", "remote", r.RemoteAddr, "path", r.URL.Path)
+			apiError(w, http.StatusUnauthorized, errors.New("driver token required"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *apiServer) status(w http.ResponseWriter, r *http.Request) {
+	h := a.hub
+	h.mu.Lock()
+	status := &apiStatus{
+		Time:    time.Now().UnixMilli(),
+		EStop:   h.estop,
+		Profile: h.profile,
+		Clients: len(h.sessions),
+	}
+	if h.driver != nil {
+		status.Driver = h.driver.conn.RemoteAddr().String()
+	}
+	frames := h.lastFrames
+	h.mu.Unlock()
+
+	status.Mode = h.currentMode()
+	status.Devices = h.deviceStatus(frames)
+	status.Health, status.Problems = h.health()
+	for _, d := range h.devices {
+		status.Serial = append(status.Serial, d.serialStats(h.degradedAfter))
+	}
+	apiReply(w, status)
+}
+
+func (a *apiServer) health(w http.ResponseWriter, r *http.Request) {
+	status, problems := a.hub.health()
+	if status != HEALTH_OK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&apiHealth{Status: status, Problems: problems})
+		return
+	}
+	apiReply(w, &apiHealth{Status: status})
+}
+
+func (a *apiServer) clients(w http.ResponseWriter, r *http.Request) {
+	clients := a.hub.snapshot().Clients
+	if clients == nil {
+		clients = []dashboardClient{}
+	}
+	apiReply(w, clients)
+}
+
+func (a *apiServer) getEStop(w http.ResponseWriter, r *http.Request) {
+	apiReply(w, map[string]bool{"estop": a.hub.estopped()})
+}
+
+func (a *apiServer) triggerEStop(w http.ResponseWriter, r *http.Request) {
+	var req protocol.EStopFrame
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	a.hub.triggerEStop("API "+r.RemoteAddr, req.Reason)
+	apiReply(w, map[string]bool{"estop": true})
+}
+
+func (a *apiServer) resetEStop(w http.ResponseWriter, r *http.Request) {
+	if why := a.hub.resetEStop(nil, "API "+r.RemoteAddr); why != "" {
+		slog.Warn("Rejected e-stop reset", "remote", r.RemoteAddr, "why", why)
+		apiError(w, http.StatusForbidden, errors.New(why))
+		return
+	}
+	apiReply(w, map[string]bool{"estop": false})
+}
+
+func (a *apiServer) getProfile(w http.ResponseWriter, r *http.Request) {
+	apiReply(w, map[string]string{"profile": a.hub.activeProfile()})
+}
+
+func (a *apiServer) setProfile(w http.ResponseWriter, r *http.Request) {
+	var req protocol.ProfileFrame
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.hub.setProfile(req.Name); err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	apiReply(w, map[string]string{"profile": req.Name})
+}
+
+func (a *apiServer) getMode(w http.ResponseWriter, r *http.Request) {
+	apiReply(w, map[string]string{"mode": a.hub.currentMode()})
+}
+
+func (a *apiServer) setMode(w http.ResponseWriter, r *http.Request) {
+	var req protocol.ModeFrame
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.hub.setMode(req.Mode, "API "+r.RemoteAddr); err != nil {
+		apiError(w, http.StatusConflict, err)
+		return
+	}
+	apiReply(w, map[string]string{"mode": a.hub.currentMode()})
+}
+
+func (a *apiServer) reload(w http.ResponseWriter, r *http.Request) {
+	if a.configFile == "" {
+		apiError(w, http.StatusConflict, errors.New("server was started without a config file"))
+		return
+	}
+	slog.Info("Reloading config from the admin API", "file", a.configFile, "remote", r.RemoteAddr)
+	if err := a.hub.reloadConfig(a.configFile, a.configFormat); err != nil {
+		apiError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	apiReply(w, map[string]string{"reloaded": a.configFile})
+}
+
+func (a *apiServer) dumpBlackBox(w http.ResponseWriter, r *http.Request) {
+	if a.hub.blackbox == nil {
+		apiError(w, http.StatusConflict, errors.New("server was started without -blackbox"))
+		return
+	}
+	name, err := a.hub.blackbox.dump("api", true)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.Info("Black box dumped", "reason", "api", "file", name, "remote", r.RemoteAddr)
+	apiReply(w, map[string]string{"file": name})
+}
+
+// apiReply writes v as JSON
+func apiReply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Admin API write error", "err", err)
+	}
+}
+
+// apiError writes {"error": "..."} with status code
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
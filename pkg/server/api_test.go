@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // the server's -driver-token
+		allow  string
+		method string
+		path   string
+		remote string
+		auth   string // Authorization header
+		want   int
+	}{
+		{"status from anywhere", "", "", "GET", "/estop", "192.0.2.1:1234", "", http.StatusOK},
+		{"e-stop from anywhere", "", "", "POST", "/estop", "192.0.2.1:1234", "", http.StatusOK},
+		{"mode without a token, remote", "", "", "PUT", "/mode", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"reset without a token, remote", "", "", "DELETE", "/estop", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"reset without a token, local", "", "", "DELETE", "/estop", "127.0.0.1:1234", "", http.StatusOK},
+		{"reset with a wrong token", "secret", "", "DELETE", "/estop", "127.0.0.1:1234", "Bearer nope", http.StatusUnauthorized},
+		{"reset with the token", "secret", "", "DELETE", "/estop", "192.0.2.1:1234", "Bearer secret", http.StatusOK},
+		{"outside the allow list", "", "10.0.0.0/8", "GET", "/estop", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"inside the allow list", "", "10.0.0.0/8", "GET", "/estop", "10.1.2.3:1234", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, err := parseAccessList(tt.allow, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &apiServer{hub: newClientHub(tt.token), access: access}
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.RemoteAddr = tt.remote
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			api.handler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIResetOwner(t *testing.T) {
+	h := newClientHub("")
+	s := testSession(t, h)
+	h.latchEStop(s, "s", "test")
+	if why := h.resetEStop(nil, "API"); why == "" || !h.estopped() {
+		t.Fatal("API released an e-stop a client latched")
+	}
+	h.resetEStop(s, "s")
+
+	h.triggerEStop("API", "test")
+	if why := h.resetEStop(nil, "API"); why != "" || h.estopped() {
+		t.Fatalf("API couldn't release its own e-stop: %s", why)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Battery failsafe. Brown-outs mid-run can corrupt the Pi's SD card, so
+// once the battery telemetry sags below -low-battery the driver's outputs
+// are scaled down by -low-battery-scale, and below -critical-battery they
+// are replaced by the failsafe input, which goes out to every board as soon
+// as the level drops. A level only clears once the voltage is
+// BATTERY_HYSTERESIS above its threshold again, so the sag under load
+// doesn't flap it. Clients see the level in their status frames.
+const (
+	BATTERY_LOW_SCALE  = 0.5 // default -low-battery-scale
+	BATTERY_HYSTERESIS = 0.3 // volts
+	AXIS16_CENTER      = 0x7FFF
+)
+
+// Battery levels, as StatusFrame.Battery carries them
+const (
+	BATTERY_OK       = ""
+	BATTERY_LOW      = "low"
+	BATTERY_CRITICAL = "critical"
+)
+
+// BatteryConfig is the server config's battery section, as -low-battery,
+// -critical-battery and -low-battery-scale
+type BatteryConfig struct {
+	LowVolts      float64 `json:"low_volts,omitempty"`
+	CriticalVolts float64 `json:"critical_volts,omitempty"`
+	LowScale      float64 `json:"low_scale,omitempty"`
+}
+
+// batteryPolicy is the failsafe the hub applies; zero thresholds are off
+type batteryPolicy struct {
+	low, critical float64 // volts
+	scale         float64 // output fraction while low
+}
+
+// nextBatteryLevel returns the level for a reading of volts, given the
+// level before it
+func (p batteryPolicy) nextBatteryLevel(prev string, volts float64) string {
+	switch {
+	case p.critical > 0 && volts < p.critical:
+		return BATTERY_CRITICAL
+	case prev == BATTERY_CRITICAL && volts < p.critical+BATTERY_HYSTERESIS:
+		return BATTERY_CRITICAL
+	case p.low > 0 && volts < p.low:
+		return BATTERY_LOW
+	case prev != BATTERY_OK && p.low > 0 && volts < p.low+BATTERY_HYSTERESIS:
+		return BATTERY_LOW
+	}
+	return BATTERY_OK
+}
+
+// checkBattery updates the battery level from the lowest voltage any board
+// last reported. Boards reporting 0 V have no battery sense and are
+// ignored.
+func (h *clientHub) checkBattery() {
+	if h.battery.low <= 0 && h.battery.critical <= 0 {
+		return
+	}
+	volts := math.Inf(1)
+	for _, d := range h.devices {
+		if t := d.latestTelemetry(); t != nil && t.BatteryVolts > 0 {
+			volts = min(volts, t.BatteryVolts)
+		}
+	}
+	if math.IsInf(volts, 1) {
+		return
+	}
+
+	h.mu.Lock()
+	prev := h.batteryLevel
+	level := h.battery.nextBatteryLevel(prev, volts)
+	h.batteryLevel = level
+	h.mu.Unlock()
+	if level == prev {
+		return
+	}
+	switch level {
+	case BATTERY_CRITICAL:
+		slog.Error("Battery critical, outputs held at failsafe", "volts", volts, "threshold", h.battery.critical)
+		h.publish(&serverEvent{Kind: BUS_BATTERY_CRITICAL, Detail: fmt.Sprintf("%.2f V", volts)})
+		h.publish(&serverEvent{Kind: BUS_FAILSAFE, Detail: "battery critical"})
+		// Don't wait for the next state to stop the robot: the driver may
+		// be holding still, or silent
+		for _, d := range h.devices {
+			d.formatter.ResetSlew()
+			d.submit(d.formatter.Format(FailsafeState()))
+		}
+	case BATTERY_LOW:
+		slog.Warn("Battery low, outputs scaled down", "volts", volts, "threshold", h.battery.low, "scale", h.battery.scale)
+	default:
+		slog.Info("Battery recovered", "volts", volts)
+	}
+}
+
+// batteryState returns the current battery level
+func (h *clientHub) batteryState() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.batteryLevel
+}
+
+// applyBattery limits the driver's state for the battery level: scaled
+// toward neutral while low, the failsafe input while critical
+func (h *clientHub) applyBattery(state *protocol.ControllerState) *protocol.ControllerState {
+	switch h.batteryState() {
+	case BATTERY_CRITICAL:
+		h.cutSlew()
+		return FailsafeState()
+	case BATTERY_LOW:
+		return scaleState(state, h.battery.scale)
+	}
+	return state
+}
+
+// scaleState returns a copy of state with every stick axis moved toward its
+// center and every trigger toward released by factor; buttons are kept
+func scaleState(state *protocol.ControllerState, factor float64) *protocol.ControllerState {
+	scaled := scaleSticks(state, factor)
+	scaleAxis(&scaled.LeftTrigger, &scaled.LeftTrigger16, 0, factor)
+	scaleAxis(&scaled.RightTrigger, &scaled.RightTrigger16, 0, factor)
+	return scaled
+}
+
+// scaleSticks returns a copy of state with every stick axis moved toward
+// its center by factor; triggers and buttons are kept
+func scaleSticks(state *protocol.ControllerState, factor float64) *protocol.ControllerState {
+	scaled := *state
+	scaleAxis(&scaled.LeftX, &scaled.LeftX16, AXIS16_CENTER, factor)
+	scaleAxis(&scaled.LeftY, &scaled.LeftY16, AXIS16_CENTER, factor)
+	scaleAxis(&scaled.RightX, &scaled.RightX16, AXIS16_CENTER, factor)
+	scaleAxis(&scaled.RightY, &scaled.RightY16, AXIS16_CENTER, factor)
+	return &scaled
+}
+
+// scaleAxis moves one axis, as its 8-bit and 16-bit fields, toward center
+// (in 16-bit units) by factor, setting both fields
+func scaleAxis(v8 *uint8, v16 *uint16, center, factor float64) {
+	v := float64(*v16)
+	if v == 0 {
+		v = float64(uint16(*v8) << 8)
+		if *v8 == protocol.AXIS_CENTER {
+			v = AXIS16_CENTER
+		}
+	}
+	*v16 = uint16(math.Round(center + (v-center)*factor))
+	*v8 = uint8(*v16 >> 8)
+}
@@ -0,0 +1,35 @@
+package server
+
+import "testing"
+
+func TestNextBatteryLevel(t *testing.T) {
+	policy := batteryPolicy{low: 22, critical: 20, scale: BATTERY_LOW_SCALE}
+	tests := []struct {
+		name   string
+		policy batteryPolicy
+		prev   string
+		volts  float64
+		want   string
+	}{
+		{"healthy", policy, BATTERY_OK, 24.5, BATTERY_OK},
+		{"sags low", policy, BATTERY_OK, 21.9, BATTERY_LOW},
+		{"low, inside the hysteresis", policy, BATTERY_LOW, 22.1, BATTERY_LOW},
+		{"low, recovered", policy, BATTERY_LOW, 22.4, BATTERY_OK},
+		{"ok, inside the hysteresis", policy, BATTERY_OK, 22.1, BATTERY_OK},
+		{"straight to critical", policy, BATTERY_OK, 19.9, BATTERY_CRITICAL},
+		{"critical, inside the hysteresis", policy, BATTERY_CRITICAL, 20.2, BATTERY_CRITICAL},
+		{"critical, back to low", policy, BATTERY_CRITICAL, 20.4, BATTERY_LOW},
+		{"critical, inside low's hysteresis", policy, BATTERY_CRITICAL, 22.1, BATTERY_LOW},
+		{"critical, recovered", policy, BATTERY_CRITICAL, 22.5, BATTERY_OK},
+		{"no thresholds", batteryPolicy{}, BATTERY_OK, 0, BATTERY_OK},
+		{"critical only", batteryPolicy{critical: 20}, BATTERY_OK, 21, BATTERY_OK},
+		{"critical only, recovered", batteryPolicy{critical: 20}, BATTERY_CRITICAL, 20.4, BATTERY_OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.nextBatteryLevel(tt.prev, tt.volts); got != tt.want {
+				t.Fatalf("%q at %gV = %q, want %q", tt.prev, tt.volts, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Black box defaults
+const (
+	BLACKBOX_SECONDS      = 30    // history kept for each dump
+	BLACKBOX_CAPACITY     = 16384 // events held, whatever their age
+	BLACKBOX_MIN_INTERVAL = 5 * time.Second
+)
+
+// Black box event kinds
+const (
+	EVENT_STATE = "state" // controller state received from a client
+	EVENT_FRAME = "frame" // bytes sent to an Arduino
+	EVENT_LOG   = "log"
+)
+
+// BlackBoxConfig holds the -blackbox flags, or the server config's
+// blackbox section
+type BlackBoxConfig struct {
+	Dir     string `json:"dir,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+}
+
+// blackboxEvent is one line of a dump
+type blackboxEvent struct {
+	Time    time.Time                 `json:"t"`
+	Kind    string                    `json:"kind"`
+	Client  string                    `json:"client,omitempty"`
+	State   *protocol.ControllerState `json:"state,omitempty"`
+	Device  string                    `json:"device,omitempty"`
+	Frame   string                    `json:"frame,omitempty"` // hex
+	Level   string                    `json:"level,omitempty"`
+	Message string                    `json:"msg,omitempty"`
+}
+
+// blackboxHeader is the first line of a dump
+type blackboxHeader struct {
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"t"`
+	Seconds int       `json:"seconds"`
+	Events  int       `json:"events"`
+}
+
+// blackBox keeps the last few seconds of input, output and log events in
+// a ring buffer and writes them to a file when something goes wrong. A nil
+// blackBox records nothing.
+type blackBox struct {
+	dir    string
+	window time.Duration
+
+	mu       sync.Mutex
+	events   []blackboxEvent // ring of BLACKBOX_CAPACITY
+	next     int             // slot the next event goes in
+	full     bool
+	lastDump time.Time
+}
+
+func newBlackBox(config *BlackBoxConfig) (*blackBox, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	seconds := config.Seconds
+	if seconds <= 0 {
+		seconds = BLACKBOX_SECONDS
+	}
+	return &blackBox{
+		dir:    config.Dir,
+		window: time.Duration(seconds) * time.Second,
+		events: make([]blackboxEvent, BLACKBOX_CAPACITY),
+	}, nil
+}
+
+func (b *blackBox) add(e blackboxEvent) {
+	if b == nil {
+		return
+	}
+	e.Time = time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events[b.next] = e
+	b.next = (b.next + 1) % len(b.events)
+	b.full = b.full || b.next == 0
+}
+
+// state records a controller state from client
+func (b *blackBox) state(client string, state *protocol.ControllerState) {
+	if b == nil {
+		return
+	}
+	copied := *state
+	b.add(blackboxEvent{Kind: EVENT_STATE, Client: client, State: &copied})
+}
+
+// frames records the frames sent to each device
+func (b *blackBox) frames(devices []*serialDevice, frames [][]byte) {
+	if b == nil {
+		return
+	}
+	for i, frame := range frames {
+		b.add(blackboxEvent{Kind: EVENT_FRAME, Device: devices[i].name, Frame: fmt.Sprintf("% X", frame)})
+	}
+}
+
+// subscribe keeps the driver's states and the frames sent for them from
+// the hub's events, and dumps on an e-stop, a lost port or a critical
+// battery
+func (b *blackBox) subscribe(h *clientHub) {
+	h.events.subscribe(func(e *serverEvent) {
+		switch e.Kind {
+		case BUS_STATE:
+			b.state(e.Client, e.State)
+		case BUS_OUTPUT:
+			if !e.Replay {
+				b.frames(h.devices, e.Frames)
+			}
+		case BUS_ESTOP:
+			b.trigger("estop")
+		case BUS_SERIAL_LOST:
+			b.trigger("serial " + e.Device)
+		case BUS_BATTERY_CRITICAL:
+			b.trigger("battery critical")
+		}
+	}, BUS_STATE, BUS_OUTPUT, BUS_ESTOP, BUS_SERIAL_LOST, BUS_BATTERY_CRITICAL)
+}
+
+// recent returns the events inside the window, oldest first. Callers hold
+// b.mu.
+func (b *blackBox) recent() []blackboxEvent {
+	cutoff := time.Now().Add(-b.window)
+	var events []blackboxEvent
+	start, count := 0, b.next
+	if b.full {
+		start, count = b.next, len(b.events)
+	}
+	for i := 0; i < count; i++ {
+		e := b.events[(start+i)%len(b.events)]
+		if e.Time.After(cutoff) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// dump writes the window to a timestamped file in the black box directory
+// and returns its path. Automatic dumps closer together than
+// BLACKBOX_MIN_INTERVAL are skipped, so a flapping port doesn't fill the
+// disk; force is for explicit requests.
+func (b *blackBox) dump(reason string, force bool) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	if !force && now.Sub(b.lastDump) < BLACKBOX_MIN_INTERVAL {
+		b.mu.Unlock()
+		return "", nil
+	}
+	b.lastDump = now
+	events := b.recent()
+	b.mu.Unlock()
+
+	slug := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(reason))
+	name := filepath.Join(b.dir, fmt.Sprintf("blackbox-%s-%s.jsonl", now.Format("20060102-150405.000"), slug))
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(file)
+	enc.Encode(blackboxHeader{Reason: reason, Time: now, Seconds: int(b.window / time.Second), Events: len(events)})
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			file.Close()
+			return "", err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// trigger dumps in the background after something went wrong
+func (b *blackBox) trigger(reason string) {
+	if b == nil {
+		return
+	}
+	go func() {
+		name, err := b.dump(reason, false)
+		if err != nil {
+			slog.Error("Black box dump failed", "reason", reason, "err", err)
+		} else if name != "" {
+			slog.Info("Black box dumped", "reason", reason, "file", name)
+		}
+	}()
+}
+
+// dumpOnPanic is deferred by goroutines that handle client input. It
+// writes a dump before letting the panic crash the server.
+func (b *blackBox) dumpOnPanic() {
+	if b == nil {
+		return
+	}
+	if r := recover(); r != nil {
+		b.add(blackboxEvent{Kind: EVENT_LOG, Level: "PANIC", Message: fmt.Sprint(r)})
+		if name, err := b.dump("panic", true); err == nil {
+			fmt.Fprintf(os.Stderr, "Black box dumped to %s\n", name)
+		}
+		panic(r)
+	}
+}
+
+// blackboxHandler copies INFO and above into the black box before passing
+// records on to the real handler
+type blackboxHandler struct {
+	next  slog.Handler
+	box   *blackBox
+	attrs string // from WithAttrs
+}
+
+func (h *blackboxHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || h.next.Enabled(ctx, level)
+}
+
+func (h *blackboxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		var msg strings.Builder
+		msg.WriteString(r.Message)
+		msg.WriteString(h.attrs)
+		r.Attrs(func(a slog.Attr) bool {
+			fmt.Fprintf(&msg, " %s=%v", a.Key, a.Value)
+			return true
+		})
+		h.box.add(blackboxEvent{Kind: EVENT_LOG, Level: r.Level.String(), Message: msg.String()})
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *blackboxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var extra strings.Builder
+	for _, a := range attrs {
+		fmt.Fprintf(&extra, " %s=%v", a.Key, a.Value)
+	}
+	return &blackboxHandler{next: h.next.WithAttrs(attrs), box: h.box, attrs: h.attrs + extra.String()}
+}
+
+func (h *blackboxHandler) WithGroup(name string) slog.Handler {
+	return &blackboxHandler{next: h.next.WithGroup(name), box: h.box, attrs: h.attrs}
+}
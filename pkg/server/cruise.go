@@ -0,0 +1,121 @@
+package server
+
+import (
+	"log/slog"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// CRUISE_TRIGGER_MIN is how far a trigger must be pulled to be latched by
+// cruise control, and to cancel it by being pulled again
+const CRUISE_TRIGGER_MIN = 24
+
+// CRUISE_STICK_DEADZONE is how far the drive stick may leave center before
+// moving it releases cruise control
+const CRUISE_STICK_DEADZONE = 24
+
+// Cruise control saves the driver holding a trigger for a whole traverse.
+// Pressing -cruise-button latches LT and RT at their current values, and
+// the server keeps sending those while the driver lets go. Moving the
+// drive (left) stick out of its deadzone, pulling a latched trigger again,
+// pressing the button again, releasing the deadman, the e-stop, a mode
+// switch or any change of driver all release the latch. The deadman and speed level still apply
+// on top.
+
+// cruiseLatch is the latched trigger values. A trigger is armed once it
+// has been let go after latching, and the stick once it has been centered;
+// moving an armed control releases the latch.
+type cruiseLatch struct {
+	lt, rt           uint8
+	lt16, rt16       uint16
+	hasLT, hasRT     bool
+	armedLT, armedRT bool
+	armedStick       bool
+}
+
+// checkCruiseButton latches the triggers, or releases the latch, when the
+// driver presses the cruise button
+func (h *clientHub) checkCruiseButton(state *protocol.ControllerState) {
+	if h.cruiseButton == "" {
+		return
+	}
+	var f formatter.ByteFormatter
+	held := f.FieldValue(state, h.cruiseButton) != 0
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pressed := held && !h.cruiseHeld
+	h.cruiseHeld = held
+	if !pressed {
+		return
+	}
+	if h.cruise != nil {
+		h.releaseCruise("button pressed again")
+		return
+	}
+	latch := &cruiseLatch{
+		lt: state.LeftTrigger, lt16: state.LeftTrigger16, hasLT: state.LeftTrigger >= CRUISE_TRIGGER_MIN,
+		rt: state.RightTrigger, rt16: state.RightTrigger16, hasRT: state.RightTrigger >= CRUISE_TRIGGER_MIN,
+	}
+	if !latch.hasLT && !latch.hasRT {
+		slog.Info("Cruise not engaged: no trigger pulled", "button", h.cruiseButton)
+		return
+	}
+	h.cruise = latch
+	slog.Info("Cruise engaged", "LT", latch.lt, "RT", latch.rt)
+}
+
+// applyCruise replaces the driver's triggers with the latched values,
+// releasing the latch if the drive stick moves or a latched trigger is
+// pulled again
+func (h *clientHub) applyCruise(state *protocol.ControllerState) *protocol.ControllerState {
+	if h.cruiseButton == "" {
+		return state
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latch := h.cruise
+	if latch == nil {
+		return state
+	}
+	pulledLT := state.LeftTrigger >= CRUISE_TRIGGER_MIN
+	pulledRT := state.RightTrigger >= CRUISE_TRIGGER_MIN
+	if (latch.hasLT && latch.armedLT && pulledLT) || (latch.hasRT && latch.armedRT && pulledRT) {
+		h.releaseCruise("trigger pulled")
+		return state
+	}
+	moved := offCenter(state.LeftX, CRUISE_STICK_DEADZONE) || offCenter(state.LeftY, CRUISE_STICK_DEADZONE)
+	if latch.armedStick && moved {
+		h.releaseCruise("stick moved")
+		return state
+	}
+	latch.armedLT = latch.armedLT || !pulledLT
+	latch.armedRT = latch.armedRT || !pulledRT
+	latch.armedStick = latch.armedStick || !moved
+
+	cruised := *state
+	if latch.hasLT {
+		cruised.LeftTrigger, cruised.LeftTrigger16 = latch.lt, latch.lt16
+	}
+	if latch.hasRT {
+		cruised.RightTrigger, cruised.RightTrigger16 = latch.rt, latch.rt16
+	}
+	return &cruised
+}
+
+// cruising reports whether a cruise latch is engaged
+func (h *clientHub) cruising() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cruise != nil
+}
+
+// releaseCruise releases the cruise latch, if any. Callers hold h.mu.
+func (h *clientHub) releaseCruise(reason string) {
+	if h.cruise == nil {
+		return
+	}
+	h.cruise = nil
+	slog.Info("Cruise released", "reason", reason)
+}
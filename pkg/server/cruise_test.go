@@ -0,0 +1,128 @@
+package server
+
+import (
+	"testing"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestCruise(t *testing.T) {
+	center := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER,
+		RightX: protocol.AXIS_CENTER, RightY: protocol.AXIS_CENTER}
+	with := func(edit func(*protocol.ControllerState)) protocol.ControllerState {
+		s := center
+		edit(&s)
+		return s
+	}
+	latchRT := with(func(s *protocol.ControllerState) { s.RightTrigger, s.East = 200, 1 })
+	released := center
+	pulled := with(func(s *protocol.ControllerState) { s.RightTrigger = 150 })
+	forward := with(func(s *protocol.ControllerState) { s.LeftY = 255 })
+	nudged := with(func(s *protocol.ControllerState) { s.LeftY = protocol.AXIS_CENTER + CRUISE_STICK_DEADZONE })
+	steered := with(func(s *protocol.ControllerState) { s.RightX = 0 })
+	latchMoving := with(func(s *protocol.ControllerState) { s.RightTrigger, s.LeftY, s.East = 200, 255, 1 })
+
+	tests := []struct {
+		name   string
+		states []protocol.ControllerState // after the latching one
+		want   bool                       // still cruising
+	}{
+		{"let go", []protocol.ControllerState{released}, true},
+		{"stick inside the deadzone", []protocol.ControllerState{released, nudged}, true},
+		{"other stick", []protocol.ControllerState{released, steered}, true},
+		{"drive stick moved", []protocol.ControllerState{released, forward}, false},
+		{"trigger pulled again", []protocol.ControllerState{released, pulled}, false},
+		{"trigger still held", []protocol.ControllerState{latchRT}, true},
+		{"button pressed again", []protocol.ControllerState{released, latchRT}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newClientHub("")
+			h.cruiseButton = "E"
+			drive := func(s protocol.ControllerState) *protocol.ControllerState {
+				h.checkCruiseButton(&s)
+				return h.applyCruise(&s)
+			}
+			if out := drive(latchRT); out.RightTrigger != 200 || !h.cruising() {
+				t.Fatal("cruise didn't latch RT")
+			}
+			var out *protocol.ControllerState
+			for _, s := range tt.states {
+				out = drive(s)
+			}
+			if h.cruising() != tt.want {
+				t.Fatalf("cruising = %v, want %v", h.cruising(), tt.want)
+			}
+			if tt.want && out.RightTrigger != 200 {
+				t.Fatalf("RT %d while cruising, want the latched 200", out.RightTrigger)
+			}
+		})
+	}
+
+	// A stick already off center when the button is pressed has to come
+	// back before it can release the latch
+	t.Run("latched on the move", func(t *testing.T) {
+		h := newClientHub("")
+		h.cruiseButton = "E"
+		for _, s := range []protocol.ControllerState{latchMoving, forward} {
+			h.checkCruiseButton(&s)
+			h.applyCruise(&s)
+		}
+		if !h.cruising() {
+			t.Fatal("the stick that was held when latching released it")
+		}
+	})
+}
+
+// A driver who takes the seat over never pressed the cruise button, so it
+// must not inherit the old driver's latch
+func TestCruiseReleasedOnTakeover(t *testing.T) {
+	h := newClientHub("")
+	h.cruiseButton = "E"
+	h.policy = POLICY_TAKEOVER
+	a, b := testSession(t, h), testSession(t, h)
+	if !h.claimDriver(a) {
+		t.Fatal("first session didn't get the seat")
+	}
+	latch := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER, RightTrigger: 200, East: 1}
+	h.checkCruiseButton(&latch)
+	if !h.cruising() {
+		t.Fatal("cruise didn't latch")
+	}
+
+	if !h.claimDriver(b) {
+		t.Fatal("takeover didn't hand over the seat")
+	}
+	if h.cruising() {
+		t.Fatal("the new driver inherited the cruise latch")
+	}
+	rest := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER}
+	if out := h.applyCruise(&rest); out.RightTrigger != 0 {
+		t.Fatalf("RT %d for a driver with the triggers at rest", out.RightTrigger)
+	}
+}
+
+// Letting go of the deadman stops the robot for good: grabbing it again
+// with the triggers at rest mustn't pick the latched values back up
+func TestCruiseReleasedWithDeadman(t *testing.T) {
+	h := newClientHub("")
+	h.cruiseButton = "E"
+	h.deadman = "LB"
+	drive := func(s protocol.ControllerState) *protocol.ControllerState {
+		h.checkCruiseButton(&s)
+		return h.applyDeadman(h.applyCruise(&s))
+	}
+	rest := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER, LeftBumper: 1}
+	latch := rest
+	latch.RightTrigger, latch.East = 200, 1
+	if out := drive(latch); out.RightTrigger != 200 {
+		t.Fatal("cruise didn't latch RT")
+	}
+	drive(protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER})
+	if h.cruising() {
+		t.Fatal("cruise still latched after the deadman was released")
+	}
+	if out := drive(rest); out.RightTrigger != 0 {
+		t.Fatalf("RT %d after grabbing the deadman again, want 0", out.RightTrigger)
+	}
+}
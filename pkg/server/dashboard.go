@@ -0,0 +1,184 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// DASHBOARD_RATE_HZ is how often the dashboard pushes a snapshot
+const DASHBOARD_RATE_HZ = 10
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardSnapshot is what the dashboard page renders, pushed as one
+// server-sent event per update
+type dashboardSnapshot struct {
+	Time      int64                     `json:"ts"`
+	State     *protocol.ControllerState `json:"state"`
+	Profile   string                    `json:"profile"`
+	EStop     bool                      `json:"estop"`
+	Battery   string                    `json:"battery"` // BATTERY_* failsafe level
+	Mode      string                    `json:"mode"`    // MODE_*, apart from the e-stop
+	Speed     string                    `json:"speed"`   // SPEED_*, "" without a speed button
+	Cruise    bool                      `json:"cruise"`
+	Devices   []dashboardDevice         `json:"devices"`
+	Clients   []dashboardClient         `json:"clients"`
+	Packets   uint64                    `json:"packets"`
+	CRCErrors uint64                    `json:"crc_errors"`
+	JSONErrs  uint64                    `json:"json_errors"`
+	Limited   uint64                    `json:"rate_limited"`
+	Replays   uint64                    `json:"replays"`
+	Telemetry *protocol.TelemetryState  `json:"telemetry"`
+	Gamepad   *protocol.GamepadFrame    `json:"gamepad"` // the driver's, nil if unreported
+}
+
+type dashboardDevice struct {
+	Name        string `json:"name"`
+	Connected   bool   `json:"connected"`
+	Frame       string `json:"frame"` // last frame sent, hex
+	WriteErrors uint64 `json:"write_errors"`
+	Reconnects  uint64 `json:"reconnects"`
+	Dropped     uint64 `json:"dropped"`
+
+	Outputs map[string]bool `json:"outputs,omitempty"` // healthy, by spec
+}
+
+type dashboardClient struct {
+	Addr      string   `json:"addr"`
+	Role      string   `json:"role"`
+	FPS       float64  `json:"fps"`
+	CRCErrors uint64   `json:"crc_errors"`
+	RTTMs     float64  `json:"rtt_ms"`
+	DelayMs   float64  `json:"delay_ms"`   // state age on arrival
+	Version   int      `json:"version"`    // protocol version, 1 for clients without a hello
+	Gamepad   string   `json:"gamepad"`    // pad name, "" if unreported
+	Missing   []string `json:"missing"`    // mapped fields the pad can't produce
+	LinkFirst uint64   `json:"link_first"` // states the UDP link delivered first
+	Dups      uint64   `json:"duplicates"` // states that came on both links
+}
+
+// noteOutput keeps the driver's latest state and frames for the dashboard
+func (h *clientHub) noteOutput(e *serverEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastState = e.State
+	h.lastFrames = e.Frames
+}
+
+// snapshot gathers everything the dashboard shows
+func (h *clientHub) snapshot() *dashboardSnapshot {
+	h.mu.Lock()
+	snap := &dashboardSnapshot{
+		Time:      time.Now().UnixMilli(),
+		State:     h.lastState,
+		Profile:   h.profile,
+		EStop:     h.estop,
+		Battery:   h.batteryLevel,
+		Mode:      h.mode,
+		Speed:     h.speedLevel(),
+		Cruise:    h.cruise != nil,
+		Telemetry: h.telemetry,
+	}
+	frames := h.lastFrames
+	sessions := make([]*clientSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for i, d := range h.devices {
+		dev := dashboardDevice{
+			Name:        d.name,
+			Connected:   d.connected(),
+			WriteErrors: d.writeErrors.Load(),
+			Reconnects:  d.reconnects.Load(),
+			Dropped:     d.writer.Dropped.Load(),
+			Outputs:     d.outputHealth(),
+		}
+		if i < len(frames) {
+			dev.Frame = fmt.Sprintf("% X", frames[i])
+		}
+		snap.Devices = append(snap.Devices, dev)
+	}
+	for _, s := range sessions {
+		role := h.role(s)
+		c := dashboardClient{Addr: s.conn.RemoteAddr().String(), Role: role, FPS: s.frameRate()}
+		rtt, oneWay := s.latency()
+		c.RTTMs = float64(rtt) / float64(time.Millisecond)
+		c.DelayMs = float64(oneWay) / float64(time.Millisecond)
+		s.mu.Lock()
+		c.CRCErrors = s.crcErrors
+		c.Version = s.version
+		c.LinkFirst, c.Dups = s.linkFirst, s.duplicates
+		pad := s.gamepad
+		s.mu.Unlock()
+		if pad != nil {
+			c.Gamepad = pad.Name
+			c.Missing = h.missingFields(pad)
+			if role == ROLE_DRIVER {
+				snap.Gamepad = pad
+			}
+		}
+		snap.Clients = append(snap.Clients, c)
+	}
+	snap.Packets = h.stats.packets.Load()
+	snap.CRCErrors = h.stats.crcErrors.Load()
+	snap.JSONErrs = h.stats.jsonErrors.Load()
+	snap.Limited = h.stats.rateLimited.Load()
+	snap.Replays = h.stats.replays.Load()
+	return snap
+}
+
+// serveDashboard serves the pit crew dashboard on addr: the page at / and
+// a stream of snapshots at /events
+func serveDashboard(addr string, hub *clientHub) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ticker := time.NewTicker(time.Second / DASHBOARD_RATE_HZ)
+		defer ticker.Stop()
+		for {
+			b, err := json.Marshal(hub.snapshot())
+			if err != nil {
+				slog.Error("Dashboard marshal error", "err", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	slog.Info("Dashboard listening", "url", "http://"+addr+"/")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Dashboard server stopped", "err", err)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"log/slog"
+
+	"lunabotics/pkg/protocol"
+)
+
+// applyDeadman replaces the driver's state with the failsafe input unless
+// the deadman control is held. Releasing it also drops any slew limiting so
+// the failsafe frame goes out at once instead of ramping down, and releases
+// cruise control.
+func (h *clientHub) applyDeadman(state *protocol.ControllerState) *protocol.ControllerState {
+	if h.deadman == "" {
+		return state
+	}
+	held := state.DeadmanHeld(h.deadman)
+
+	h.mu.Lock()
+	released := h.deadmanWasHeld && !held
+	pressed := !h.deadmanWasHeld && held
+	h.deadmanWasHeld = held
+	if !held {
+		h.slewed = nil // see cutSlew
+	}
+	if released {
+		// Letting go means stop; grabbing it again mustn't resume a cruise
+		h.releaseCruise("deadman released")
+	}
+	h.mu.Unlock()
+
+	if released {
+		slog.Info("Deadman released, sending failsafe", "control", h.deadman)
+		h.publish(&serverEvent{Kind: BUS_FAILSAFE, Detail: "deadman released"})
+		for _, d := range h.devices {
+			d.formatter.ResetSlew()
+		}
+	} else if pressed {
+		slog.Info("Deadman held", "control", h.deadman)
+	}
+	if !held {
+		return FailsafeState()
+	}
+	return state
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.bug.st/serial"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+const (
+	RECONNECT_MIN_BACKOFF = 250 * time.Millisecond
+	RECONNECT_MAX_BACKOFF = 8 * time.Second
+)
+
+// serialDevice is one Arduino output: its byte mapping, port settings and
+// the open port, if any. Each device has its own writer goroutine so a slow
+// board can't hold back the others.
+type serialDevice struct {
+	name        string
+	formatter   *formatter.ByteFormatter
+	config      *serialout.SerialConfig
+	writer      *serialout.Writer
+	onTelemetry func(*protocol.TelemetryState)
+	onLost      func()          // called when an open port fails
+	onReconnect func()          // called when a lost port is back
+	dump        *serialout.Dump // -serial-dump, nil for none
+
+	writeErrors atomic.Uint64
+	reconnects  atomic.Uint64
+	stats       writeStats
+	firmware    atomic.Pointer[firmwareCheck] // latest handshake, nil before any
+
+	acks   chan serialout.AckReply
+	nextID uint8 // rolling frame ID for acknowledged mode, under writeMu
+
+	writeMu sync.Mutex   // held for each frame written, so shutdown goes last
+	writing atomic.Int64 // UnixNano the current write began, 0 when idle
+
+	mu           sync.Mutex
+	port         serial.Port
+	outputs      []deviceOutput // open while active
+	missing      []string       // outputs that failed to open
+	retryAt      time.Time      // when to try missing again
+	reconnecting bool
+	active       bool                     // keep the port open, until shutdown
+	telemetry    *protocol.TelemetryState // latest from this board, nil before any
+}
+
+func newSerialDevice(name string, formatter *formatter.ByteFormatter, config *serialout.SerialConfig, onTelemetry func(*protocol.TelemetryState)) *serialDevice {
+	d := &serialDevice{
+		name:        name,
+		formatter:   formatter,
+		config:      config,
+		writer:      serialout.NewWriter(),
+		onTelemetry: onTelemetry,
+		acks:        make(chan serialout.AckReply, 16),
+	}
+	var period time.Duration
+	if config.RateHz > 0 {
+		period = time.Second / time.Duration(config.RateHz)
+	}
+	go d.writer.Run(d.writePort, period)
+	return d
+}
+
+// open opens the port and outputs for the life of the server, retrying in
+// the background if the board isn't there
+func (d *serialDevice) open() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.active = true
+	d.outputs, d.missing = d.openOutputs(d.config.Outputs)
+	d.retryAt = time.Now().Add(OUTPUT_RETRY)
+	if d.port != nil || d.reconnecting || d.config.Port == serialout.SERIAL_NONE {
+		return
+	}
+
+	port, err := d.connect()
+	if err != nil {
+		if !errors.Is(err, errFirmwareRefused) {
+			slog.Warn("Arduino not connected (debug mode, retrying)", "device", d.name, "err", err)
+		}
+		d.startReconnect()
+		return
+	}
+	slog.Info("Arduino connected", "device", d.name)
+	d.attach(port)
+}
+
+// idle writes the failsafe frame once nobody has a claim on the robot. The
+// port stays open: closing it drops DTR, which resets an Uno.
+func (d *serialDevice) idle() {
+	d.formatter.ResetSlew()
+	d.submit(d.formatter.Format(FailsafeState()))
+}
+
+// connected reports whether the port is open
+func (d *serialDevice) connected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.port != nil
+}
+
+// submit queues a frame for the writer goroutine
+func (d *serialDevice) submit(frame []byte) {
+	d.writer.Submit(frame)
+}
+
+// attach makes port the active one. Callers hold d.mu.
+func (d *serialDevice) attach(port serial.Port) {
+	d.port = port
+	go func() {
+		serialout.ReadTelemetry(port, d.relayTelemetry, d.relayAck)
+		d.lost(port)
+	}()
+}
+
+// relayTelemetry tags telemetry with the device name before passing it on
+func (d *serialDevice) relayTelemetry(t *protocol.TelemetryState) {
+	t.Device = d.name
+	d.mu.Lock()
+	d.telemetry = t
+	d.mu.Unlock()
+	d.onTelemetry(t)
+}
+
+// latestTelemetry returns the board's most recent telemetry, or nil
+func (d *serialDevice) latestTelemetry() *protocol.TelemetryState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.telemetry
+}
+
+// relayAck hands an ack reply to the writer, dropping it if nobody waits
+func (d *serialDevice) relayAck(a serialout.AckReply) {
+	select {
+	case d.acks <- a:
+	default:
+	}
+}
+
+// wireFrame prefixes frame with the next rolling ID in acknowledged mode and
+// applies the configured framing. Callers hold d.writeMu.
+func (d *serialDevice) wireFrame(frame []byte) (uint8, []byte) {
+	var id uint8
+	if d.config.Ack {
+		id = d.nextID
+		d.nextID++
+		frame = append([]byte{id}, frame...)
+	}
+	wire, err := serialout.EncodeFrame(d.formatter.Current().Framing, frame)
+	if err != nil {
+		// Validated at startup; send raw rather than drop the frame
+		slog.Error("Framing failed, sending unframed", "device", d.name, "err", err)
+		return id, frame
+	}
+	return id, wire
+}
+
+// writePort performs the actual serial write. It is only called from the
+// writer goroutine, and d.mu is not held during the write so a slow port
+// doesn't stall status frames.
+func (d *serialDevice) writePort(frame []byte) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.writing.Store(time.Now().UnixNano())
+	defer d.writing.Store(0)
+
+	d.retryOutputs()
+	d.mu.Lock()
+	port := d.port
+	outputs := d.outputs
+	d.mu.Unlock()
+	if port == nil && outputs == nil {
+		return
+	}
+
+	id, wire := d.wireFrame(frame)
+	d.writeOutputs(outputs, frame, wire)
+	if port == nil {
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		if _, err := port.Write(wire); err != nil {
+			slog.Error("Arduino write error", "device", d.name, "err", err)
+			d.writeErrors.Add(1)
+			d.stats.refused()
+			d.lost(port)
+			return
+		}
+		d.stats.observeWrite(time.Since(start))
+		if !d.config.Ack || d.awaitAck(id) {
+			d.stats.accepted()
+			return
+		}
+		if attempt >= d.config.AckRetries {
+			slog.Warn("Arduino never acknowledged frame", "device", d.name, "id", id)
+			d.stats.refused()
+			return
+		}
+		if d.writer.Pending() {
+			d.stats.refused()
+			return // a newer frame supersedes the retry
+		}
+	}
+}
+
+// awaitAck waits for the firmware's answer to frame id, logging NACKs
+func (d *serialDevice) awaitAck(id uint8) bool {
+	timeout := time.After(time.Duration(d.config.AckTimeoutMs) * time.Millisecond)
+	for {
+		select {
+		case a := <-d.acks:
+			if a.ID != id {
+				continue // late reply to an earlier frame
+			}
+			if !a.OK {
+				slog.Warn("Arduino NACKed frame", "device", d.name, "id", id)
+			}
+			return a.OK
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// lost closes port if it is still the active one and starts reconnecting
+// unless the server is shutting down
+func (d *serialDevice) lost(port serial.Port) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.port != port {
+		return
+	}
+	port.Close()
+	d.port = nil
+	if d.active {
+		slog.Warn("Arduino lost, reconnecting", "device", d.name)
+		d.startReconnect()
+	}
+	if d.onLost != nil {
+		d.onLost()
+	}
+}
+
+// startReconnect launches the reconnect loop unless one is running. Callers
+// hold d.mu.
+func (d *serialDevice) startReconnect() {
+	if !d.reconnecting {
+		d.reconnecting = true
+		go d.reconnectLoop()
+	}
+}
+
+// reconnectLoop reopens the port with exponential backoff until it comes
+// back or the server shuts down. The failsafe frame is written before the
+// port is handed to the writer so the board never resumes on a stale command.
+func (d *serialDevice) reconnectLoop() {
+	backoff := ms(timeouts().ReconnectMinMs)
+	for {
+		time.Sleep(backoff)
+
+		d.mu.Lock()
+		if !d.active {
+			d.reconnecting = false
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		port, err := d.connect()
+		if err != nil {
+			backoff *= 2
+			if backoff > ms(timeouts().ReconnectMaxMs) {
+				backoff = ms(timeouts().ReconnectMaxMs)
+			}
+			continue
+		}
+		// The board restarted from rest, so ramp from neutral rather than
+		// from whatever was last sent
+		d.formatter.ResetSlew()
+		if err := d.writeFailsafe(port); err != nil {
+			slog.Error("Failsafe write after reconnect failed", "device", d.name, "err", err)
+			port.Close()
+			continue
+		}
+
+		d.mu.Lock()
+		d.reconnecting = false
+		reconnected := d.active
+		if !reconnected {
+			port.Close()
+		} else {
+			slog.Info("Arduino reconnected", "device", d.name)
+			d.reconnects.Add(1)
+			d.attach(port)
+		}
+		d.mu.Unlock()
+		if reconnected && d.onReconnect != nil {
+			d.onReconnect()
+		}
+		return
+	}
+}
+
+// writeFailsafe writes the failsafe frame straight to a port not yet handed
+// to the writer, taking the writer's lock so frame IDs stay in sequence
+func (d *serialDevice) writeFailsafe(port serial.Port) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, failsafe := d.wireFrame(d.formatter.Format(FailsafeState()))
+	_, err := port.Write(failsafe)
+	return err
+}
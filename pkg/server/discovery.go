@@ -0,0 +1,201 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/mdns"
+)
+
+// advertiser answers mDNS queries for the control service, so clients can
+// find the Pi with -discover instead of hunting for its DHCP address
+type advertiser struct {
+	instance string // <instance>._lunabotics-ctl._tcp.local.
+	host     string // <hostname>.local.
+	port     int
+	ip       net.IP // the one address to advertise, nil for every interface's
+	conn     *net.UDPConn
+	group    *net.UDPAddr
+}
+
+// advertise starts answering for a server listening on addr. It returns nil
+// (after logging why) if the multicast group can't be joined, or if addr
+// is a single IPv6 address, which the IPv4-only responder can't announce.
+func advertise(name string, addr *net.TCPAddr) *advertiser {
+	var ip net.IP
+	if !addr.IP.IsUnspecified() {
+		if ip = addr.IP.To4(); ip == nil {
+			slog.Info("mDNS advertisement disabled: listening on IPv6 only", "addr", addr)
+			return nil
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "lunabotics"
+	}
+	hostname = dnsLabel(hostname)
+	if name == "" {
+		name = hostname
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", mdns.MDNS_GROUP)
+	if err != nil {
+		slog.Warn("mDNS advertisement disabled", "err", err)
+		return nil
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		slog.Warn("mDNS advertisement disabled", "err", err)
+		return nil
+	}
+	a := &advertiser{
+		instance: name + "." + mdns.MDNS_SERVICE,
+		host:     hostname + ".local.",
+		port:     addr.Port,
+		ip:       ip,
+		conn:     conn,
+		group:    group,
+	}
+	slog.Info("Advertising over mDNS", "service", a.instance, "host", a.host, "port", addr.Port)
+
+	go a.serve()
+	// Announce twice, a second apart, so browsers already looking see us
+	go func() {
+		for i := 0; i < 2; i++ {
+			a.send(a.records(mdns.MDNS_TTL), 0, nil, a.group)
+			time.Sleep(time.Second)
+		}
+	}()
+	return a
+}
+
+// serve answers queries until the connection is closed
+func (a *advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query, err := mdns.Parse(buf[:n])
+		if err != nil || query.Response {
+			continue
+		}
+		var asked []mdns.Question
+		for _, q := range query.Questions {
+			if a.answers(q) {
+				asked = append(asked, q)
+			}
+		}
+		if len(asked) == 0 {
+			continue
+		}
+		slog.Debug("Answering mDNS query", "from", src)
+		if src.Port != mdns.MDNS_PORT {
+			// A one-shot resolver like the client: reply to it directly,
+			// echoing its ID and questions (RFC 6762 section 6.7)
+			a.send(a.records(10), query.ID, asked, src)
+		} else {
+			a.send(a.records(mdns.MDNS_TTL), 0, nil, a.group)
+		}
+	}
+}
+
+// answers reports whether q asks about this server
+func (a *advertiser) answers(q mdns.Question) bool {
+	switch {
+	case mdns.SameName(q.Name, mdns.MDNS_SERVICE):
+		return q.Type == mdns.DNS_TYPE_PTR || q.Type == mdns.DNS_TYPE_ANY
+	case mdns.SameName(q.Name, a.instance):
+		return q.Type == mdns.DNS_TYPE_SRV || q.Type == mdns.DNS_TYPE_TXT || q.Type == mdns.DNS_TYPE_ANY
+	case mdns.SameName(q.Name, a.host):
+		return q.Type == mdns.DNS_TYPE_A || q.Type == mdns.DNS_TYPE_ANY
+	}
+	return false
+}
+
+// records is the full answer: the service pointer, where it is, and the
+// host's current IPv4 addresses
+func (a *advertiser) records(ttl uint32) []mdns.Record {
+	records := []mdns.Record{
+		{Name: mdns.MDNS_SERVICE, Type: mdns.DNS_TYPE_PTR, TTL: ttl, Target: a.instance},
+		{Name: a.instance, Type: mdns.DNS_TYPE_SRV, Flush: true, TTL: ttl, Target: a.host, Port: uint16(a.port)},
+		{Name: a.instance, Type: mdns.DNS_TYPE_TXT, Flush: true, TTL: ttl, Text: []string{"proto=1"}},
+	}
+	ips := hostIPv4s()
+	if a.ip != nil {
+		ips = []net.IP{a.ip}
+	}
+	for _, ip := range ips {
+		records = append(records, mdns.Record{Name: a.host, Type: mdns.DNS_TYPE_A, Flush: true, TTL: ttl, IP: ip})
+	}
+	return records
+}
+
+func (a *advertiser) send(records []mdns.Record, id uint16, questions []mdns.Question, to *net.UDPAddr) {
+	msg := &mdns.Message{ID: id, Response: true, Questions: questions, Answers: records}
+	b, err := msg.Pack()
+	if err != nil {
+		slog.Warn("mDNS encode error", "err", err)
+		return
+	}
+	if _, err := a.conn.WriteToUDP(b, to); err != nil {
+		slog.Debug("mDNS send error", "to", to, "err", err)
+	}
+}
+
+// close says goodbye (TTL 0) so browsers forget us at once, then stops
+func (a *advertiser) close() {
+	if a == nil {
+		return
+	}
+	a.send(a.records(0), 0, nil, a.group)
+	a.conn.Close()
+}
+
+// hostIPv4s returns the addresses of every interface that is up, apart
+// from loopback
+func hostIPv4s() []net.IP {
+	var ips []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// dnsLabel makes a hostname safe to use as a single DNS label
+func dnsLabel(s string) string {
+	s, _, _ = strings.Cut(s, ".")
+	s = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	if s == "" {
+		return "lunabotics"
+	}
+	return s
+}
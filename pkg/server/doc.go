@@ -0,0 +1,4 @@
+// Package server is the robot-side program: it accepts clients, picks the
+// driver, runs the state pipeline and writes the result to the Arduinos.
+// Main is the whole program; cmd/server calls it.
+package server
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+
+	"lunabotics/pkg/protocol"
+)
+
+// LINK_DATAGRAM_MAX bounds a LinkFrame datagram; states are far smaller
+const LINK_DATAGRAM_MAX = 2048
+
+// The UDP link (-udp-link) is a second path for the driver's states, for a
+// client that also reaches the server another way, such as a tether next
+// to the Wi-Fi. The client numbers every state and sends it on both; the
+// server handles whichever copy arrives first and drops the other, so
+// losing either link costs nothing while the other holds. Everything else,
+// status included, stays on the connection the session opened with.
+
+// openLink gives s a token for the UDP link, or returns "" when the server
+// has none
+func (h *clientHub) openLink(s *clientSession) string {
+	if !h.udpLink {
+		return ""
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	old := s.link
+	s.link = token
+	s.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.links == nil {
+		h.links = make(map[string]*clientSession)
+	}
+	delete(h.links, old) // a repeated hello replaces the token
+	h.links[token] = s
+	return token
+}
+
+// linkSession returns the session a UDP link token belongs to, or nil
+func (h *clientHub) linkSession(token string) *clientSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.links[token]
+}
+
+// fresh reports whether a state numbered seq is newer than every state
+// already handled, counting the copies it rejects. Unnumbered states, from
+// clients without the UDP link, are always fresh.
+func (s *clientSession) fresh(seq uint64, viaLink bool) bool {
+	if seq == 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.lastSeq {
+		s.duplicates++
+		return false
+	}
+	s.lastSeq = seq
+	if viaLink {
+		s.linkFirst++
+	}
+	return true
+}
+
+// serveUDPLink receives LinkFrames on addr and hands each state to its
+// session until the socket fails
+func serveUDPLink(addr string, hub *clientHub, access *accessList) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("UDP link listening", "addr", conn.LocalAddr())
+
+	buf := make([]byte, LINK_DATAGRAM_MAX)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if ok, _ := access.permits(src); !ok {
+			continue
+		}
+		client := src.String()
+		hub.publish(&serverEvent{Kind: BUS_PACKET, Client: client})
+		payload, err := hub.framing.ReadPacket(bytes.NewReader(buf[:n]))
+		if err != nil {
+			if errors.Is(err, protocol.ErrBadCRC) {
+				hub.reject(client, REJECT_CRC)
+			}
+			slog.Debug("Bad UDP link datagram", "client", src, "err", err)
+			continue
+		}
+		var frame protocol.LinkFrame
+		if err := json.Unmarshal(payload, &frame); err != nil || frame.Type != protocol.MsgLink || frame.State == nil {
+			hub.reject(client, REJECT_DECODE)
+			continue
+		}
+		session := hub.linkSession(frame.Link)
+		if session == nil {
+			slog.Debug("UDP link datagram for no session", "client", src)
+			continue
+		}
+		if session.linkLimiter == nil {
+			session.linkLimiter = hub.newLimiter()
+		}
+		if ok, _ := session.linkLimiter.allow(n, src); !ok {
+			hub.reject(client, REJECT_RATE_LIMITED)
+			continue
+		}
+		session.handleState(frame.State, true)
+	}
+}
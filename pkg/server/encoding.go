@@ -0,0 +1,42 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"lunabotics/pkg/protocol"
+)
+
+// setEncoding answers a client's EncodingFrame. Protobuf is granted; any
+// other request leaves the session on JSON. The answer is JSON either way
+// so the client can read it before it switches.
+func (s *clientSession) setEncoding(requested string) error {
+	encoding := protocol.ENCODING_JSON
+	if requested == protocol.ENCODING_PROTOBUF {
+		encoding = protocol.ENCODING_PROTOBUF
+	}
+	s.mu.Lock()
+	s.protobuf = encoding == protocol.ENCODING_PROTOBUF
+	s.mu.Unlock()
+	slog.Info("Client encoding", "client", s.conn.RemoteAddr(), "requested", requested, "encoding", encoding)
+
+	b, err := json.Marshal(&protocol.EncodingFrame{Type: protocol.MsgEncoding, Encoding: encoding})
+	if err != nil {
+		return err
+	}
+	return s.send(b)
+}
+
+// encode marshals a message for the client: as protobuf once it has asked
+// for that and the schema has the message, as JSON otherwise
+func (s *clientSession) encode(v any) ([]byte, error) {
+	s.mu.Lock()
+	protobuf := s.protobuf
+	s.mu.Unlock()
+	if protobuf {
+		if b, ok := protocol.MarshalProtobuf(v); ok {
+			return b, nil
+		}
+	}
+	return json.Marshal(v)
+}
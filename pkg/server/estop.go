@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// ESTOP_RATE_HZ is how often the failsafe frame is rewritten while the
+// e-stop is latched, so a board that resets or drops a frame still stops
+const ESTOP_RATE_HZ = 20
+
+// triggerEStop latches the e-stop: every device gets the failsafe frame
+// now and repeatedly until resetEStop, and driver states are refused.
+// Any session may trigger it, spectators included.
+func (h *clientHub) triggerEStop(by, reason string) {
+	h.latchEStop(nil, by, reason)
+}
+
+// latchEStop is triggerEStop on behalf of session s, nil for the API or
+// the planner. The session that latches the e-stop may reset it, even if
+// it isn't driving.
+func (h *clientHub) latchEStop(s *clientSession, by, reason string) {
+	h.mu.Lock()
+	already := h.estop
+	h.estop = true
+	if !already {
+		h.estopDone = make(chan struct{})
+		h.estopBy = s
+		h.resetDriving("e-stop")
+	}
+	done := h.estopDone
+	h.mu.Unlock()
+
+	if already {
+		return
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	slog.Warn("E-STOP triggered", "by", by, "reason", reason)
+	h.publish(&serverEvent{Kind: BUS_ESTOP, Client: by, Detail: reason})
+	h.publish(&serverEvent{Kind: BUS_FAILSAFE, Detail: "e-stop"})
+	go h.holdFailsafe(done)
+}
+
+// resetEStop releases a latched e-stop on behalf of s, nil for the API.
+// Only the driver or the session that latched it may, and only with the
+// driver token when the server has one; the API, which has checked the
+// token itself, may only release an e-stop no session latched. It returns
+// why the reset was refused, "" if it wasn't.
+func (h *clientHub) resetEStop(s *clientSession, by string) string {
+	authorized := true
+	if s != nil {
+		s.mu.Lock()
+		authorized = s.authorized || h.token == ""
+		s.mu.Unlock()
+	}
+	h.mu.Lock()
+	owner := h.estopBy == s || s != nil && h.driver == s
+	var held time.Duration
+	if h.driver == nil && h.seatHeld() {
+		held = time.Until(h.held.until)
+	}
+	h.mu.Unlock()
+
+	switch {
+	case !authorized:
+		return "resetting needs the driver token"
+	case owner:
+		h.releaseEStop(by)
+		return ""
+	case held > 0:
+		return fmt.Sprintf("the driver seat is held for %v more for a driver that dropped; it can reset once it reconnects, or retry after that", held.Round(time.Second))
+	}
+	return "only the driver or the client that latched the e-stop may reset it"
+}
+
+// refuseReset answers a reset the hub refused with a reset frame of its
+// own, saying why
+func (s *clientSession) refuseReset(why string) error {
+	b, err := s.encode(&protocol.EStopFrame{Type: protocol.MsgReset, Reason: why})
+	if err != nil {
+		return err
+	}
+	return s.send(b)
+}
+
+// releaseEStop clears a latched e-stop. Callers have checked that by may
+// drive.
+func (h *clientHub) releaseEStop(by string) {
+	h.mu.Lock()
+	paused := false
+	if h.estop {
+		h.estop = false
+		h.estopBy = nil
+		close(h.estopDone)
+		// The filters missed every state dropped while e-stopped
+		h.resetDriving("e-stop reset")
+		slog.Warn("E-STOP reset", "by", by)
+		if h.mode == protocol.MODE_AUTONOMY {
+			// Someone has to choose to let the planner drive again
+			h.mode = protocol.MODE_PAUSED
+			paused = true
+			slog.Warn("Mode switched", "from", protocol.MODE_AUTONOMY, "to", protocol.MODE_PAUSED, "by", "e-stop reset")
+		}
+	}
+	h.mu.Unlock()
+	if paused {
+		h.publish(&serverEvent{Kind: BUS_MODE_CHANGED, Client: by, Detail: protocol.MODE_PAUSED})
+	}
+}
+
+// estopped reports whether the e-stop is latched
+func (h *clientHub) estopped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.estop
+}
+
+// holdFailsafe writes the failsafe frame to every device until done closes.
+// Each frame skips the slew limit, so a driver frame formatted as the
+// e-stop landed can't make it ramp down.
+func (h *clientHub) holdFailsafe(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second / ESTOP_RATE_HZ)
+	defer ticker.Stop()
+	for {
+		for _, d := range h.devices {
+			d.submit(d.formatter.FormatStop(FailsafeState()))
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetEStop(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string // the server's -driver-token
+		authorized bool   // the resetting session presented it
+		driving    bool   // the resetting session drives
+		latched    bool   // the resetting session latched the e-stop
+		want       bool
+	}{
+		{"driver", "", false, true, false, true},
+		{"latching spectator", "", false, false, true, true},
+		{"other spectator", "", false, false, false, false},
+		{"driver with the token", "secret", true, true, false, true},
+		{"latching spectator without the token", "secret", false, false, true, false},
+		{"latching spectator with the token", "secret", true, false, true, true},
+		{"spectator with the token", "secret", true, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newClientHub(tt.token)
+			s, other := testSession(t, h), testSession(t, h)
+			s.authorized = tt.authorized
+			other.authorized = true
+			if tt.driving {
+				s.authorized = true // to take the seat
+				h.claimDriver(s)
+				s.authorized = tt.authorized
+			}
+			if tt.latched {
+				h.latchEStop(s, "s", "test")
+			} else {
+				h.latchEStop(other, "other", "test")
+			}
+
+			if why := h.resetEStop(s, "s"); (why == "") != tt.want {
+				t.Fatalf("reset refused with %q, want accepted = %v", why, tt.want)
+			}
+			if h.estopped() == tt.want {
+				t.Fatalf("e-stop latched = %v after the reset", h.estopped())
+			}
+		})
+	}
+}
+
+func TestResetEStopSeatHeld(t *testing.T) {
+	h := newClientHub("")
+	s, other := testSession(t, h), testSession(t, h)
+	h.latchEStop(other, "other", "test")
+	h.held = &heldSeat{token: "dropped", until: time.Now().Add(5 * time.Second)}
+
+	why := h.resetEStop(s, "s")
+	if !strings.Contains(why, "held") {
+		t.Fatalf("reset refused with %q, want the held seat named", why)
+	}
+	if !h.estopped() {
+		t.Fatal("e-stop released while the seat is held")
+	}
+}
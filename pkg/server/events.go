@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Bus event kinds
+const (
+	BUS_CLIENT_CONNECTED    = "client_connected"    // a session joined; Client
+	BUS_CLIENT_DISCONNECTED = "client_disconnected" // a session left; Client
+	BUS_PACKET              = "packet"              // a packet read from a client, valid or not
+	BUS_PACKET_REJECTED     = "packet_rejected"     // a client packet dropped; Client, Reason (REJECT_*)
+	BUS_CRC_STORM           = "crc_storm"           // CRC_STORM_COUNT bad CRCs within CRC_STORM_WINDOW; Client, Detail
+	BUS_STATE               = "state"               // a driver state past the replay and duplicate checks; Client, State, Age
+	BUS_OUTPUT              = "output"              // frames given to the Arduinos; State, Frames
+	BUS_MODE_CHANGED        = "mode_changed"        // Detail is the new mode, Client who or what switched
+	BUS_ESTOP               = "estop"               // the e-stop latched; Client, Detail is the reason
+	BUS_FAILSAFE            = "failsafe"            // a fault put the robot in failsafe; Detail
+	BUS_DRIVER_LOST         = "driver_lost"         // the driver disconnected, or went silent (Detail); Client
+	BUS_SERIAL_LOST         = "serial_lost"         // an Arduino's port failed; Device
+	BUS_SERIAL_RECONNECTED  = "serial_reconnected"  // Device
+	BUS_TELEMETRY           = "telemetry"           // an Arduino telemetry frame; Device, Telemetry
+	BUS_BATTERY_CRITICAL    = "battery_critical"    // Detail is the voltage
+	BUS_MOTOR_STALL         = "motor_stall"         // a motor's current reached -stall-current; Device, Detail
+)
+
+// Reasons a client packet is rejected
+const (
+	REJECT_CRC          = "crc"
+	REJECT_DECODE       = "decode" // bad JSON or protobuf
+	REJECT_RATE_LIMITED = "rate_limited"
+	REJECT_REPLAY       = "replay" // outside the replay window
+	REJECT_TOO_LARGE    = "too_large"
+)
+
+// Things that happen in the server are published on the hub's event bus,
+// and the features that care (metrics, the dashboard, alarm hooks, the
+// black box, the recorder and MQTT) subscribe to the kinds they need,
+// rather than each being called from handleClient and its neighbours.
+// Handlers run synchronously on the publisher's goroutine, in the order
+// they subscribed, so they must be quick: anything slow goes to its own
+// goroutine or queue. Events are never published with h.mu held, so a
+// handler may take it.
+
+// serverEvent is one event on the bus. Only the fields its kind lists are
+// set.
+type serverEvent struct {
+	Kind   string
+	Time   time.Time
+	Client string // remote address
+	Device string
+	Reason string // REJECT_* for BUS_PACKET_REJECTED
+	Detail string
+
+	State     *protocol.ControllerState
+	Frames    [][]byte      // one per device, in hub order
+	Replay    bool          // BUS_OUTPUT played back from a -replay recording
+	Age       time.Duration // BUS_STATE: age on arrival by the client's clock
+	AgeKnown  bool          // Age could be worked out
+	Telemetry *protocol.TelemetryState
+}
+
+// eventBus delivers events to the handlers subscribed to their kind
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]func(*serverEvent)
+}
+
+// subscribe calls handler for every event of the given kinds
+func (b *eventBus) subscribe(handler func(*serverEvent), kinds ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[string][]func(*serverEvent))
+	}
+	for _, kind := range kinds {
+		b.handlers[kind] = append(b.handlers[kind], handler)
+	}
+}
+
+// publish hands e to its kind's handlers, stamping the time if unset
+func (b *eventBus) publish(e *serverEvent) {
+	b.mu.RLock()
+	handlers := b.handlers[e.Kind]
+	b.mu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+// publish puts e on the hub's bus
+func (h *clientHub) publish(e *serverEvent) {
+	h.events.publish(e)
+}
+
+// reject publishes a client packet dropped for reason, and a CRC storm
+// when bad CRCs pile up
+func (h *clientHub) reject(client, reason string) {
+	h.publish(&serverEvent{Kind: BUS_PACKET_REJECTED, Client: client, Reason: reason})
+	if reason == REJECT_CRC && h.crcStorm.count() {
+		h.publish(&serverEvent{Kind: BUS_CRC_STORM, Client: client,
+			Detail: fmt.Sprintf("%d bad packets within %v", CRC_STORM_COUNT, CRC_STORM_WINDOW)})
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"go.bug.st/serial"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/serialout"
+)
+
+var errFirmwareRefused = errors.New("firmware refused")
+
+// firmwareCheck is the outcome of a device's latest handshake
+type firmwareCheck struct {
+	ident *serialout.FirmwareIdent // nil if the firmware never answered
+	err   error
+}
+
+func (c *firmwareCheck) String() string {
+	if c.err != nil {
+		return c.err.Error()
+	}
+	return c.ident.String()
+}
+
+// handshake identifies the firmware on a newly opened port, if the device
+// asks for it, and returns an error wrapping errFirmwareRefused if it
+// mustn't be driven. A changed outcome is logged.
+func (d *serialDevice) handshake(port serial.Port) error {
+	if !d.config.Handshake {
+		return nil
+	}
+	check := &firmwareCheck{}
+	check.ident, check.err = serialout.Identify(port)
+	if check.ident != nil {
+		want := formatter.LayoutHash(d.formatter.Current(), d.config.Ack)
+		switch {
+		case check.ident.Layout != want:
+			check.err = fmt.Errorf("firmware %s expects a different frame layout than the config's %08X; flash firmware built from -gen-header", check.ident, want)
+		case d.config.Firmware != "" && check.ident.Name != d.config.Firmware:
+			check.err = fmt.Errorf("firmware %s is not %q", check.ident, d.config.Firmware)
+		}
+	}
+	if check.err != nil {
+		check.err = fmt.Errorf("%w: %w", errFirmwareRefused, check.err)
+	}
+
+	if prev := d.firmware.Swap(check); prev == nil || prev.String() != check.String() {
+		if check.err != nil {
+			slog.Error("Refusing to drive Arduino", "device", d.name, "err", check.err)
+		} else {
+			slog.Info("Firmware identified", "device", d.name, "firmware", check.ident.Name, "version", check.ident.Version)
+		}
+	}
+	return check.err
+}
+
+// connect opens the port and checks the firmware, closing the port again
+// if it is refused
+func (d *serialDevice) connect() (serial.Port, error) {
+	port, err := d.openPort()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.handshake(port); err != nil {
+		port.Close()
+		return nil, err
+	}
+	return port, nil
+}
+
+// checkFirmwareLayouts makes sure every identified firmware matches the
+// layouts in devices, as a reloaded config must
+func (h *clientHub) checkFirmwareLayouts(devices []*formatter.DeviceConfig) error {
+	for i, dev := range devices {
+		d := h.devices[i]
+		check := d.firmware.Load()
+		if check == nil || check.ident == nil {
+			continue
+		}
+		if hash := formatter.LayoutHash(&dev.ByteConfig, d.config.Ack); hash != check.ident.Layout {
+			return fmt.Errorf("device %q: layout %08X doesn't match firmware %s, reflash and restart to apply", dev.Name, hash, check.ident)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"log/slog"
+	"slices"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// setGamepad stores the pad a client reported and warns about mapped fields
+// it can't produce
+func (s *clientSession) setGamepad(pad *protocol.GamepadFrame) {
+	s.mu.Lock()
+	s.gamepad = pad
+	s.mu.Unlock()
+	slog.Info("Client gamepad", "client", s.conn.RemoteAddr(), "name", pad.Name, "guid", pad.GUID,
+		"axes", pad.Axes, "buttons", pad.Buttons)
+	s.hub.checkGamepad(s)
+}
+
+// checkGamepad warns when the mapping reads fields the pad s reported
+// can't produce, which would otherwise sit at neutral
+func (h *clientHub) checkGamepad(s *clientSession) {
+	s.mu.Lock()
+	pad := s.gamepad
+	s.mu.Unlock()
+	if pad == nil {
+		return
+	}
+	if missing := h.missingFields(pad); len(missing) > 0 {
+		slog.Warn("Gamepad can't produce mapped fields", "client", s.conn.RemoteAddr(), "name", pad.Name, "missing", missing)
+	}
+}
+
+// missingFields lists the fields the mapping and deadman read that pad
+// doesn't fill
+func (h *clientHub) missingFields(pad *protocol.GamepadFrame) []string {
+	var missing []string
+	for _, field := range h.inputFields() {
+		if !slices.Contains(pad.Fields, field) {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+// inputFields lists, in stateFields order, every controller field any
+// device's mapping, profile or the deadman reads
+func (h *clientHub) inputFields() []string {
+	used := make(map[string]bool)
+	if h.deadman != "" {
+		used[h.deadman] = true
+	}
+	for _, d := range h.devices {
+		d.formatter.Current().InputFields(used)
+	}
+	var fields []string
+	for _, field := range formatter.StateFields {
+		if used[field] && field != "mixL" && field != "mixR" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+const (
+	GRPC_KEEPALIVE         = 10 * time.Second // HTTP/2 ping a connection quiet this long
+	GRPC_KEEPALIVE_TIMEOUT = 5 * time.Second  // and drop it if the ping goes unanswered
+)
+
+// gRPC status codes the server returns
+const (
+	GRPC_OK                 = 0
+	GRPC_INVALID_ARGUMENT   = 3
+	GRPC_PERMISSION_DENIED  = 7
+	GRPC_RESOURCE_EXHAUSTED = 8
+	GRPC_UNIMPLEMENTED      = 12
+	GRPC_UNAVAILABLE        = 14
+)
+
+// GRPCConfig is the server config's grpc section
+type GRPCConfig struct {
+	Addr string `json:"addr,omitempty"`
+	Cert string `json:"cert,omitempty"` // with Key, serve over TLS
+	Key  string `json:"key,omitempty"`
+}
+
+// grpcServer is a second front end for drivers: each ControlStream call
+// becomes an ordinary client session, so arbitration, the deadman, e-stop
+// and the formatter treat it like a TCP client. The stream's states go in
+// as protobuf packets and the telemetry pushed to the session comes back
+// as the response stream. Hand-rolled over net/http's HTTP/2 like the
+// protobuf itself, so there is no gRPC library to vendor.
+type grpcServer struct {
+	hub    *clientHub
+	access *accessList
+}
+
+// serveGRPC serves the Control service until the listener fails: over TLS
+// when a certificate is configured, over cleartext HTTP/2 (h2c) otherwise
+func serveGRPC(config *GRPCConfig, g *grpcServer) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+protocol.GRPC_CONTROL_STREAM, g.controlStream)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		grpcFail(w, GRPC_UNIMPLEMENTED, "unknown method "+r.URL.Path)
+	})
+
+	protocols := new(http.Protocols)
+	server := &http.Server{
+		Addr:      config.Addr,
+		Handler:   mux,
+		Protocols: protocols,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: GRPC_KEEPALIVE,
+			PingTimeout:     GRPC_KEEPALIVE_TIMEOUT,
+		},
+	}
+	var err error
+	if config.Cert != "" {
+		protocols.SetHTTP2(true)
+		slog.Info("gRPC listening", "addr", config.Addr, "tls", true)
+		err = server.ListenAndServeTLS(config.Cert, config.Key)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+		slog.Info("gRPC listening", "addr", config.Addr, "tls", false)
+		err = server.ListenAndServe()
+	}
+	slog.Error("gRPC server stopped", "err", err)
+}
+
+// controlStream runs one ControlStream call as a client session
+func (g *grpcServer) controlStream(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "" && enc != "identity" {
+		grpcFail(w, GRPC_UNIMPLEMENTED, "compression "+enc+" not supported")
+		return
+	}
+	remote := httpRemoteAddr(r.RemoteAddr)
+	if ok, rule := g.access.permits(remote); !ok {
+		slog.Warn("Refused connection", "client", remote, "rule", rule, "transport", "grpc")
+		grpcFail(w, GRPC_PERMISSION_DENIED, "refused by "+rule)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go handleClient(&grpcConn{Conn: serverSide, remote: remote}, g.hub)
+
+	// Requests: each ControllerState message becomes a state packet
+	status := make(chan grpcStatus, 1)
+	go func() {
+		defer clientSide.Close()
+		status <- forwardStates(r.Body, clientSide, g.hub.framing)
+	}()
+
+	// Responses: telemetry the session is pushed goes back on the stream
+	var shutdown string
+	for {
+		payload, err := g.hub.framing.ReadPacket(clientSide)
+		if errors.Is(err, protocol.ErrBadCRC) || errors.Is(err, protocol.ErrPacketTooLarge) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if protocol.IsProtobuf(payload) {
+			continue // the session is never asked for protobuf
+		}
+		switch protocol.PeekType(payload) {
+		case protocol.MsgTelemetry:
+			var t protocol.TelemetryState
+			if json.Unmarshal(payload, &t) != nil {
+				continue
+			}
+			if _, err := w.Write(protocol.GRPCMessage(protocol.ProtobufTelemetry(&t))); err != nil {
+				return
+			}
+			flusher.Flush()
+		case protocol.MsgShutdown:
+			var bye protocol.ShutdownFrame
+			json.Unmarshal(payload, &bye)
+			shutdown = bye.Reason
+		}
+	}
+
+	// The session ended on its own, or after the requests did
+	final := grpcStatus{code: GRPC_OK}
+	select {
+	case final = <-status:
+	default:
+		if shutdown != "" {
+			final = grpcStatus{code: GRPC_UNAVAILABLE, message: shutdown}
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(final.code))
+	if final.message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(final.message))
+	}
+}
+
+// grpcStatus is how a call ends
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+// forwardStates copies ControllerState messages from a request stream into
+// the session as protobuf packets until the client half-closes or sends
+// something unusable
+func forwardStates(body io.Reader, session net.Conn, framing protocol.Framing) grpcStatus {
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(body, hdr); err != nil {
+			if err == io.EOF {
+				return grpcStatus{code: GRPC_OK}
+			}
+			return grpcStatus{code: GRPC_UNAVAILABLE, message: err.Error()}
+		}
+		if hdr[0] != 0 {
+			return grpcStatus{code: GRPC_UNIMPLEMENTED, message: "compressed messages not supported"}
+		}
+		size := binary.BigEndian.Uint32(hdr[1:])
+		if size > uint32(framing.MaxPacketSize) {
+			return grpcStatus{code: GRPC_RESOURCE_EXHAUSTED, message: fmt.Sprintf("message of %d bytes is over %d", size, framing.MaxPacketSize)}
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(body, msg); err != nil {
+			return grpcStatus{code: GRPC_UNAVAILABLE, message: err.Error()}
+		}
+		if _, err := protocol.ParseProtobufState(msg); err != nil {
+			return grpcStatus{code: GRPC_INVALID_ARGUMENT, message: err.Error()}
+		}
+		if err := framing.WritePacket(session, protocol.ProtobufMessage(nil, protocol.PB_PACKET_STATE, msg)); err != nil {
+			return grpcStatus{code: GRPC_UNAVAILABLE, message: "session closed"}
+		}
+	}
+}
+
+// grpcFail ends a call before any message, as a trailers-only response
+func grpcFail(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape percent-encodes a status message as the gRPC spec asks
+func grpcEscape(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&out, "%%%02X", c)
+		} else {
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+// httpRemoteAddr parses an HTTP request's remote address so access lists
+// and logs see the caller as they see TCP clients
+func httpRemoteAddr(addr string) *net.TCPAddr {
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcp
+}
+
+// grpcConn is the session's end of the pipe, reporting the gRPC caller as
+// its remote address
+type grpcConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *grpcConn) RemoteAddr() net.Addr {
+	return c.remote
+}
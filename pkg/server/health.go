@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"lunabotics/pkg/serialout"
+)
+
+// SERIAL_DEGRADED_AFTER is how long an Arduino may go without accepting an
+// offered frame before the server reports itself degraded
+const SERIAL_DEGRADED_AFTER = time.Second
+
+// SERIAL_WRITE_BUCKETS are the histogram bounds (seconds) for how long a
+// frame takes to write to the port
+var SERIAL_WRITE_BUCKETS = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}
+
+const (
+	HEALTH_OK       = "ok"
+	HEALTH_DEGRADED = "degraded"
+)
+
+// Each device keeps statistics on its serial writes for /status, /health
+// and /metrics. A frame counts as accepted once the port took it, or in
+// acknowledged mode once the firmware ACKed it. The server is degraded
+// while any Arduino's port is closed, a write has been stuck, or frames have
+// been offered without one being accepted, for longer than -degraded-after.
+// An idle robot isn't degraded: with nothing to write, nothing is refused.
+
+// writeStats are a device's serial write statistics
+type writeStats struct {
+	writes    atomic.Uint64
+	lastWrite atomic.Int64 // UnixNano of the last accepted frame, 0 before any
+	failing   atomic.Int64 // UnixNano of the first frame not accepted since, or 0
+	latency   histogram    // seconds per port write
+	lastNanos atomic.Int64 // the last write's latency
+}
+
+// observeWrite records how long a port write took
+func (st *writeStats) observeWrite(took time.Duration) {
+	st.lastNanos.Store(int64(took))
+	st.latency.observe(SERIAL_WRITE_BUCKETS, took.Seconds())
+}
+
+// accepted records a frame the Arduino took
+func (st *writeStats) accepted() {
+	st.writes.Add(1)
+	st.lastWrite.Store(time.Now().UnixNano())
+	st.failing.Store(0)
+}
+
+// refused records a frame the Arduino didn't take, keeping the time of the
+// first in a run
+func (st *writeStats) refused() {
+	st.failing.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// lastWriteAge returns how long ago a frame was last accepted, and false
+// if none ever was
+func (st *writeStats) lastWriteAge() (time.Duration, bool) {
+	last := st.lastWrite.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, last)), true
+}
+
+// serialStats is one device's entry in GET /status
+type serialStats struct {
+	Device        string  `json:"device"`
+	Connected     bool    `json:"connected"`
+	Writes        uint64  `json:"writes"` // frames accepted
+	WriteErrors   uint64  `json:"write_errors"`
+	Reconnects    uint64  `json:"reconnects"`
+	Dropped       uint64  `json:"dropped"`
+	LastWriteAge  float64 `json:"last_write_age_ms"` // -1 before any
+	LatencyMs     float64 `json:"latency_ms"`        // the last write
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	RefusingSince int64   `json:"refusing_since,omitempty"` // unix ms of the first frame not accepted since
+	Problem       string  `json:"problem,omitempty"`
+
+	Firmware *serialout.FirmwareIdent `json:"firmware,omitempty"` // as identified in the handshake
+}
+
+// serialStats gathers the device's write statistics
+func (d *serialDevice) serialStats(limit time.Duration) serialStats {
+	st := serialStats{
+		Device:       d.name,
+		Connected:    d.connected(),
+		Writes:       d.stats.writes.Load(),
+		WriteErrors:  d.writeErrors.Load(),
+		Reconnects:   d.reconnects.Load(),
+		Dropped:      d.writer.Dropped.Load(),
+		LastWriteAge: -1,
+		LatencyMs:    float64(d.stats.lastNanos.Load()) / float64(time.Millisecond),
+	}
+	if age, ok := d.stats.lastWriteAge(); ok {
+		st.LastWriteAge = float64(age) / float64(time.Millisecond)
+	}
+	d.stats.latency.mu.Lock()
+	if d.stats.latency.total > 0 {
+		st.AvgLatencyMs = d.stats.latency.sum / float64(d.stats.latency.total) * 1000
+	}
+	d.stats.latency.mu.Unlock()
+	if failing := d.stats.failing.Load(); failing != 0 {
+		st.RefusingSince = time.Unix(0, failing).UnixMilli()
+	}
+	if check := d.firmware.Load(); check != nil {
+		st.Firmware = check.ident
+	}
+	st.Problem = d.degraded(limit)
+	return st
+}
+
+// degraded says what is wrong with the device, or "" if nothing
+func (d *serialDevice) degraded(limit time.Duration) string {
+	if d.config.Port == serialout.SERIAL_NONE {
+		return ""
+	}
+	d.mu.Lock()
+	port, active := d.port, d.active
+	d.mu.Unlock()
+	if port == nil {
+		if !active {
+			return ""
+		}
+		if check := d.firmware.Load(); check != nil && check.err != nil {
+			return check.err.Error()
+		}
+		return "serial port not connected"
+	}
+	if started := d.writing.Load(); started != 0 {
+		if stuck := time.Since(time.Unix(0, started)); stuck > limit {
+			return fmt.Sprintf("write stuck for %v", stuck.Round(time.Millisecond))
+		}
+	}
+	if failing := d.stats.failing.Load(); failing != 0 {
+		if since := time.Since(time.Unix(0, failing)); since > limit {
+			return fmt.Sprintf("no frame accepted for %v", since.Round(time.Millisecond))
+		}
+	}
+	return ""
+}
+
+// health reports HEALTH_OK or HEALTH_DEGRADED and, if degraded, why
+func (h *clientHub) health() (string, []string) {
+	var problems []string
+	for _, d := range h.devices {
+		if problem := d.degraded(h.degradedAfter); problem != "" {
+			problems = append(problems, d.name+": "+problem)
+		}
+	}
+	if len(problems) > 0 {
+		return HEALTH_DEGRADED, problems
+	}
+	return HEALTH_OK, nil
+}
+
+// lastWriteAgeSeconds is the metric value for the device's last accepted
+// frame, NaN before any
+func (d *serialDevice) lastWriteAgeSeconds() float64 {
+	if age, ok := d.stats.lastWriteAge(); ok {
+		return age.Seconds()
+	}
+	return math.NaN()
+}
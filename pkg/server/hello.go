@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"lunabotics/pkg/protocol"
+)
+
+// serverCaps are the capabilities the server advertises in its hello
+var serverCaps = []string{protocol.CAP_PING, protocol.CAP_TELEMETRY, protocol.CAP_ESTOP, protocol.CAP_PROFILES, protocol.CAP_AXES16, protocol.CAP_GAMEPAD, protocol.CAP_RESUME}
+
+// hello answers a client's HelloFrame with the newest protocol version both
+// sides speak and the first of its encodings the server has. A client with
+// no version in common is told why and disconnected; hello then returns
+// false.
+func (s *clientSession) hello(h *protocol.HelloFrame) bool {
+	minVersion := max(h.MinVersion, protocol.PROTOCOL_MIN_VERSION)
+	version := min(h.Version, protocol.PROTOCOL_VERSION)
+	if version < minVersion {
+		reason := fmt.Sprintf("client speaks protocol %d-%d, server %d-%d",
+			h.MinVersion, h.Version, protocol.PROTOCOL_MIN_VERSION, protocol.PROTOCOL_VERSION)
+		slog.Warn("Incompatible client", "client", s.conn.RemoteAddr(), "problem", reason)
+		b, err := json.Marshal(&protocol.HelloFrame{Type: protocol.MsgHello, Version: protocol.PROTOCOL_VERSION, MinVersion: protocol.PROTOCOL_MIN_VERSION, Error: reason})
+		if err == nil {
+			s.send(b)
+		}
+		s.close(reason)
+		return false
+	}
+
+	encoding := protocol.ENCODING_JSON
+	for _, e := range h.Encodings {
+		if e == protocol.ENCODING_JSON || e == protocol.ENCODING_PROTOBUF {
+			encoding = e
+			break
+		}
+	}
+	if framing := s.hub.framing.Name(); h.Framing != "" && h.Framing != framing {
+		// It framed this packet as we expect, whatever it calls that
+		slog.Warn("Client names a different framing", "client", s.conn.RemoteAddr(), "framing", h.Framing, "server", framing)
+	}
+
+	s.mu.Lock()
+	s.version = version
+	s.caps = slices.Clone(h.Capabilities)
+	s.protobuf = encoding == protocol.ENCODING_PROTOBUF
+	s.mu.Unlock()
+	slog.Info("Client hello", "client", s.conn.RemoteAddr(), "version", version, "encoding", encoding, "caps", h.Capabilities)
+
+	resumed := s.hub.resume(s, h.Resume)
+	caps := serverCaps
+	resume := ""
+	if slices.Contains(h.Capabilities, protocol.CAP_RESUME) {
+		resume = s.hub.issueResume(s)
+	}
+	link := ""
+	if slices.Contains(h.Capabilities, protocol.CAP_DUAL_LINK) {
+		if link = s.hub.openLink(s); link != "" {
+			caps = append(slices.Clone(caps), protocol.CAP_DUAL_LINK)
+		}
+	}
+	b, err := json.Marshal(&protocol.HelloFrame{
+		Type:         protocol.MsgHello,
+		Version:      version,
+		MinVersion:   protocol.PROTOCOL_MIN_VERSION,
+		Encoding:     encoding,
+		Framing:      s.hub.framing.Name(),
+		Capabilities: caps,
+		Link:         link,
+		Resume:       resume,
+		Resumed:      resumed,
+	})
+	if err != nil {
+		return true
+	}
+	if err := s.send(b); err != nil {
+		slog.Warn("Hello reply failed", "client", s.conn.RemoteAddr(), "err", err)
+	}
+	return true
+}
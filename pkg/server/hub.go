@@ -0,0 +1,346 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// Client roles reported in status frames
+const (
+	ROLE_DRIVER    = "driver"
+	ROLE_SPECTATOR = "spectator"
+)
+
+// clientHub tracks every connected session and arbitrates which one drives.
+// Only the driver's states reach the Arduinos; everyone else is a spectator
+// that receives status and telemetry. The role is first-come: the first
+// session to send a state while the seat is empty takes it, and policy
+// decides what happens to the next. When token is set, only sessions that
+// presented it in a claim packet may drive.
+type clientHub struct {
+	token   string
+	devices []*serialDevice
+	deadman string // field the driver must hold for non-neutral output
+	maxRate int    // highest state rate clients should send, 0 for no limit
+
+	packetRate int // inbound packets per second from each client, 0 for no limit
+	byteRate   int // inbound bytes per second from each client, 0 for no limit
+
+	statusRate int // status frames per second to each client
+
+	framing protocol.Framing // -max-packet-size and -crc, for every client link
+
+	policy        string // POLICY_* for a second would-be driver
+	takeoverGrace time.Duration
+	replayWindow  time.Duration // see inWindow, 0 to accept any timestamp
+	degradedAfter time.Duration // see health
+	battery       batteryPolicy
+	stallAmps     float64         // -stall-current, 0 for no stall detection
+	modeCombo     []string        // -mode-combo fields, nil without one
+	speedButton   string          // -speed-button, "" for no speed levels
+	speedScales   []float64       // per speedLevels entry
+	cruiseButton  string          // -cruise-button, "" for no cruise control
+	smoothing     SmoothingConfig // -smooth alpha per axis, nil for none
+	pipeline      []stateStage    // see runPipeline
+	macroRest     []stateStage    // the pipeline's stages after macro, for its steps
+	script        *stateScript    // -script rules, nil for none
+	maxClients    int             // 0 for no limit
+
+	blackbox *blackBox       // nil without -blackbox
+	dump     *serialout.Dump // nil without -serial-dump
+	udpLink  bool            // -udp-link is listening
+	events   eventBus        // see events.go
+	crcStorm crcStorm
+	rumbled  rumbleCooldown
+	stats    hubStats
+
+	mu         sync.Mutex
+	sessions   map[*clientSession]struct{}
+	links      map[string]*clientSession // by UDP link token
+	driver     *clientSession
+	telemetry  *protocol.TelemetryState
+	lastState  *protocol.ControllerState // driver's latest state, for the dashboard
+	lastFrames [][]byte
+	profile    string // active byte mapping profile
+	comboHeld  string // profile whose combo the driver was holding
+
+	contender    *clientSession // waiting to take over the seat
+	contendSince time.Time
+	contendLast  time.Time
+
+	closing        bool // shutting down, nothing more reaches the Arduinos
+	deadmanWasHeld bool
+	replaying      bool // a -replay recording owns the Arduinos
+
+	held *heldSeat // driver seat kept for a reconnect, nil if none
+
+	driverLast   time.Time // the driver's last state; see watchDriver
+	driverSilent bool      // the driver went DRIVER_TIMEOUT without one
+
+	batteryLevel string            // BATTERY_*
+	stalled      map[string][]bool // per device, the motors at -stall-current
+
+	mode          string    // MODE_TELEOP, MODE_AUTONOMY or MODE_PAUSED; see currentMode
+	modeComboHeld bool      // the driver was holding the mode combo
+	autonomyConn  net.Conn  // the planner on -autonomy, nil if none
+	autonomyLast  time.Time // its last state, or the switch to AUTONOMY
+
+	smoothed map[string]float64 // moving average per axis, in 16-bit units
+
+	stages       StagesConfig       // see setStages
+	failsafeWhen formatter.Expr     // stages.failsafe, nil for none
+	slewed       map[string]float64 // slew-limited value per axis, in 16-bit units
+	slewAt       time.Time          // when slewed was last updated
+
+	cruise     *cruiseLatch // nil while not cruising
+	cruiseHeld bool         // the driver was holding the cruise button
+
+	speed     int  // index into speedLevels
+	speedHeld bool // the driver was holding the speed button
+
+	macros    []*formatter.MacroConfig
+	macroHeld string    // macro whose combo the driver was holding
+	macro     *macroRun // nil while no macro plays
+
+	estop     bool           // latched until an explicit reset
+	estopBy   *clientSession // the session that latched it, nil for another source
+	estopDone chan struct{}  // closed on reset to stop the failsafe writer
+}
+
+func newClientHub(token string) *clientHub {
+	h := &clientHub{
+		token:        token,
+		statusRate:   STATUS_RATE_HZ,
+		framing:      protocol.DefaultFraming(),
+		replayWindow: REPLAY_WINDOW,
+		policy:       POLICY_SPECTATE,
+		mode:         protocol.MODE_TELEOP,
+		sessions:     make(map[*clientSession]struct{}),
+	}
+	h.degradedAfter = SERIAL_DEGRADED_AFTER
+	h.events.subscribe(h.countEvent, BUS_PACKET, BUS_PACKET_REJECTED, BUS_STATE)
+	h.events.subscribe(h.noteOutput, BUS_OUTPUT)
+	h.events.subscribe(h.rumble, BUS_ESTOP, BUS_FAILSAFE, BUS_CRC_STORM, BUS_MOTOR_STALL)
+	names, _ := parsePipeline(DEFAULT_PIPELINE)
+	h.setPipeline(names)
+	return h
+}
+
+// addDevice registers an output device. All devices must be added before
+// openDevices.
+func (h *clientHub) addDevice(name string, formatter *formatter.ByteFormatter, config *serialout.SerialConfig) {
+	d := newSerialDevice(name, formatter, config, h.broadcastTelemetry)
+	d.dump = h.dump
+	d.onLost = func() {
+		h.publish(&serverEvent{Kind: BUS_SERIAL_LOST, Device: name})
+	}
+	d.onReconnect = func() {
+		h.publish(&serverEvent{Kind: BUS_SERIAL_RECONNECTED, Device: name})
+	}
+	h.devices = append(h.devices, d)
+}
+
+// openDevices opens every Arduino for the life of the server. Opening a
+// port can reset the board (an Uno reboots on DTR), so it happens once at
+// startup rather than for each client.
+func (h *clientHub) openDevices() {
+	for _, d := range h.devices {
+		d.open()
+	}
+}
+
+// join registers a session. It refuses once the server has maxClients
+// sessions.
+func (h *clientHub) join(s *clientSession) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxClients > 0 && len(h.sessions) >= h.maxClients {
+		return false
+	}
+	h.sessions[s] = struct{}{}
+	return true
+}
+
+// leave unregisters a session, stopping the robot and freeing the driver
+// seat if it held it, and idling the Arduinos once nobody is connected
+func (h *clientHub) leave(s *clientSession) {
+	client := s.conn.RemoteAddr().String()
+	events := []*serverEvent{{Kind: BUS_CLIENT_DISCONNECTED, Client: client}}
+	// Published once h.mu is released
+	defer func() {
+		for _, e := range events {
+			h.publish(e)
+		}
+	}()
+	s.mu.Lock()
+	link, resume, lastSeq := s.link, s.resume, s.lastSeq
+	s.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, s)
+	delete(h.links, link)
+	if h.driver == s {
+		h.driver = nil
+		slog.Info("Driver released control", "client", s.conn.RemoteAddr())
+		events = append(events, &serverEvent{Kind: BUS_DRIVER_LOST, Client: client})
+		if failsafe := h.stopDriving("driver left"); failsafe != nil {
+			events = append(events, failsafe)
+		}
+		h.holdSeat(s, resume, lastSeq)
+	}
+	if h.contender == s {
+		h.contender = nil
+	}
+	// A held seat or a connected autonomy source still has a claim on the
+	// robot
+	if len(h.sessions) == 0 && !h.replaying && !h.seatHeld() && h.autonomyConn == nil {
+		for _, d := range h.devices {
+			d.idle()
+		}
+	}
+}
+
+// authorize checks a claim token and marks the session as allowed to drive
+func (h *clientHub) authorize(s *clientSession, token string) bool {
+	ok := h.token == "" || token == h.token
+	s.mu.Lock()
+	s.authorized = ok
+	s.mu.Unlock()
+	return ok
+}
+
+// claimDriver gives s the driver seat if it is free and s may drive, and
+// reports whether s is now the driver. If the seat is taken the driver
+// policy decides; a rejected session is disconnected. Nobody drives during
+// a replay.
+func (h *clientHub) claimDriver(s *clientSession) bool {
+	s.mu.Lock()
+	authorized := s.authorized || h.token == ""
+	s.mu.Unlock()
+
+	h.mu.Lock()
+	reject := false
+	_, joined := h.sessions[s] // a late UDP link state may outlive its session
+	if authorized && joined && !h.replaying {
+		if h.driver == nil && h.seatHeld() {
+			// Kept for a driver that dropped; s waits like a spectator
+		} else if h.driver == nil {
+			h.driver = s
+			s.demoted = false
+			h.resetDriving("driver changed")
+			slog.Info("Driver changed", "client", s.conn.RemoteAddr())
+		} else if h.driver != s {
+			reject = h.contend(s)
+		}
+	}
+	isDriver := h.driver == s
+	if isDriver {
+		h.heardDriver()
+	}
+	h.mu.Unlock()
+
+	if reject {
+		s.close("another client is driving")
+	}
+	return isDriver
+}
+
+// role returns the role of s for status frames
+func (h *clientHub) role(s *clientSession) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.driver == s {
+		return ROLE_DRIVER
+	}
+	return ROLE_SPECTATOR
+}
+
+// deviceStatus reports each output device's connection state alongside the
+// last frame a session sent to it
+func (h *clientHub) deviceStatus(outputs [][]byte) []protocol.DeviceStatus {
+	status := make([]protocol.DeviceStatus, len(h.devices))
+	for i, d := range h.devices {
+		status[i] = protocol.DeviceStatus{Name: d.name, Connected: d.connected()}
+		if i < len(outputs) {
+			status[i].Output = frameInts(outputs[i])
+		}
+	}
+	return status
+}
+
+// format builds one frame per output device from state
+func (h *clientHub) format(state *protocol.ControllerState) [][]byte {
+	frames := make([][]byte, len(h.devices))
+	for i, d := range h.devices {
+		frames[i] = d.formatter.Format(state)
+	}
+	return frames
+}
+
+// write queues frames (one per device, as returned by format) on behalf of
+// s. Frames from anyone but the driver, or sent outside TELEOP, while
+// e-stopped or shutting down, are dropped.
+func (h *clientHub) write(s *clientSession, frames [][]byte) bool {
+	return h.submitWhile(func() bool {
+		return h.driver == s && h.mode == protocol.MODE_TELEOP && !h.estop && !h.closing
+	}, frames)
+}
+
+// submitWhile queues frames, one per device, if still holds. It is checked
+// and the frames queued under h.mu, so an e-stop can't land in between and
+// be followed by a frame that drives; it reports whether they were queued.
+func (h *clientHub) submitWhile(still func() bool, frames [][]byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !still() {
+		return false
+	}
+	for i, d := range h.devices {
+		d.submit(frames[i])
+	}
+	return true
+}
+
+// droppedFrames totals the frames every device's writer has had to skip
+// because the serial port couldn't keep up
+func (h *clientHub) droppedFrames() uint64 {
+	var n uint64
+	for _, d := range h.devices {
+		n += d.writer.Dropped.Load()
+	}
+	return n
+}
+
+// latestTelemetry returns the most recent Arduino telemetry, or nil
+func (h *clientHub) latestTelemetry() *protocol.TelemetryState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.telemetry
+}
+
+// broadcastTelemetry relays an Arduino telemetry frame to every session
+func (h *clientHub) broadcastTelemetry(t *protocol.TelemetryState) {
+	h.mu.Lock()
+	h.telemetry = t
+	sessions := make([]*clientSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.setTelemetry(t)
+	}
+	h.publish(&serverEvent{Kind: BUS_TELEMETRY, Device: t.Device, Telemetry: t})
+	h.checkBattery()
+	h.checkStall(t)
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// LOCK_TEST_TIMEOUT is how long the lock tests wait before calling it a
+// deadlock
+const LOCK_TEST_TIMEOUT = 10 * time.Second
+
+// LOCK_TEST_ROUNDS is how often each goroutine of a lock test goes round
+const LOCK_TEST_ROUNDS = 20000
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testSession joins a session to h over an in-memory connection whose far
+// end discards whatever the server sends
+func testSession(t *testing.T, h *clientHub) *clientSession {
+	t.Helper()
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	s := &clientSession{conn: conn, hub: h}
+	if !h.join(s) {
+		t.Fatal("hub refused the session")
+	}
+	return s
+}
+
+// finish fails the test if run doesn't return within LOCK_TEST_TIMEOUT
+func finish(t *testing.T, run func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(LOCK_TEST_TIMEOUT):
+		t.Fatal("deadlocked")
+	}
+}
+
+// freeSeat empties the driver seat, so the next claim takes it again
+func freeSeat(h *clientHub) {
+	h.mu.Lock()
+	h.driver = nil
+	h.mu.Unlock()
+}
+
+// status() reads the hub and the session; claimDriver and takeovers lock
+// them the other way round. Neither may hold one lock while taking the
+// other.
+func TestStatusAgainstClaimDriver(t *testing.T) {
+	for _, policy := range []string{POLICY_SPECTATE, POLICY_TAKEOVER} {
+		t.Run(policy, func(t *testing.T) {
+			h := newClientHub("")
+			h.policy = policy
+			a, b := testSession(t, h), testSession(t, h)
+
+			finish(t, func() {
+				var wg sync.WaitGroup
+				for _, s := range []*clientSession{a, b} {
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						for range LOCK_TEST_ROUNDS {
+							s.status()
+						}
+					}()
+					go func() {
+						defer wg.Done()
+						for range LOCK_TEST_ROUNDS {
+							h.claimDriver(s)
+							freeSeat(h)
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		})
+	}
+}
+
+// leave drops the session's UDP link under h.mu, so it mustn't lock the
+// session there either
+func TestStatusAgainstLeave(t *testing.T) {
+	h := newClientHub("")
+	h.udpLink = true
+	s := testSession(t, h)
+
+	finish(t, func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range LOCK_TEST_ROUNDS {
+				s.status()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range LOCK_TEST_ROUNDS {
+				h.openLink(s)
+				h.claimDriver(s)
+				h.leave(s)
+				h.join(s)
+			}
+		}()
+		wg.Wait()
+	})
+	if n := len(h.links); n != 0 {
+		t.Fatalf("%d UDP link tokens outlived their session", n)
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		leave   bool   // the old driver's connection drops first
+		driving bool   // the old session holds the seat
+		token   string // presented by the new connection
+		want    bool
+	}{
+		{"live driver", false, true, "tok", true},
+		{"held seat", true, true, "tok", true},
+		{"wrong token", false, true, "other", false},
+		{"spectator's token", false, false, "tok", false},
+		{"no token", true, true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newClientHub("")
+			old, s := testSession(t, h), testSession(t, h)
+			old.resume, old.lastSeq = "tok", 42
+			if tt.driving {
+				h.claimDriver(old)
+			}
+			if tt.leave {
+				h.leave(old)
+			}
+
+			if got := h.resume(s, tt.token); got != tt.want {
+				t.Fatalf("resume = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			if h.driver != s || h.held != nil {
+				t.Fatal("the resumed session isn't driving, or the seat is still held")
+			}
+			if s.lastSeq != 42 || !s.authorized {
+				t.Fatalf("resumed with lastSeq %d, authorized %v", s.lastSeq, s.authorized)
+			}
+			if !tt.leave && old.resume != "" {
+				t.Fatal("the old connection's token still works")
+			}
+		})
+	}
+}
+
+// resume looks at every session's token, so it mustn't hold h.mu then
+func TestStatusAgainstResume(t *testing.T) {
+	h := newClientHub("")
+	old, s := testSession(t, h), testSession(t, h)
+
+	finish(t, func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range LOCK_TEST_ROUNDS {
+				old.status()
+				s.status()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range LOCK_TEST_ROUNDS {
+				h.issueResume(old)
+				freeSeat(h)
+				h.claimDriver(old)
+				old.mu.Lock()
+				token := old.resume
+				old.mu.Unlock()
+				if !h.resume(s, token) {
+					t.Error("resume refused the driver's token")
+					return
+				}
+			}
+		}()
+		wg.Wait()
+	})
+}
+
+func TestDriverSilence(t *testing.T) {
+	h := newClientHub("")
+	var lost []string
+	h.events.subscribe(func(e *serverEvent) { lost = append(lost, e.Detail) }, BUS_DRIVER_LOST)
+	s := testSession(t, h)
+	h.claimDriver(s)
+
+	h.checkDriver()
+	if len(lost) != 0 {
+		t.Fatal("a driver that just sent a state counted as lost")
+	}
+	h.mu.Lock()
+	h.driverLast = time.Now().Add(-2 * protocol.DRIVER_TIMEOUT)
+	h.mu.Unlock()
+	h.checkDriver()
+	h.checkDriver()
+	if len(lost) != 1 {
+		t.Fatalf("%d driver_lost events for one silence, want 1", len(lost))
+	}
+
+	// Its next state drives again, and a second silence counts again
+	if !h.claimDriver(s) {
+		t.Fatal("the silent driver lost its seat")
+	}
+	h.mu.Lock()
+	h.driverLast = time.Now().Add(-2 * protocol.DRIVER_TIMEOUT)
+	h.mu.Unlock()
+	h.checkDriver()
+	if len(lost) != 2 {
+		t.Fatalf("%d driver_lost events for two silences, want 2", len(lost))
+	}
+}
+
+// closed reports whether the hub hung up on s
+func closed(s *clientSession) bool {
+	return s.conn.SetDeadline(time.Time{}) != nil
+}
+
+func TestDriverPolicyReject(t *testing.T) {
+	h := newClientHub("")
+	h.policy = POLICY_REJECT
+	a, b := testSession(t, h), testSession(t, h)
+	h.claimDriver(a)
+	if h.claimDriver(b) {
+		t.Fatal("second session took the seat under the reject policy")
+	}
+	if !closed(b) {
+		t.Fatal("rejected session is still connected")
+	}
+	if !h.claimDriver(a) || closed(a) {
+		t.Fatal("the driver lost its seat to a rejected session")
+	}
+}
+
+func TestDriverPolicyTakeover(t *testing.T) {
+	// backdate moves the contention's start back by since and the
+	// contender's latest claim back by last
+	backdate := func(h *clientHub, since, last time.Duration) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.contendSince = h.contendSince.Add(-since)
+		h.contendLast = h.contendLast.Add(-last)
+	}
+
+	t.Run("after the grace period", func(t *testing.T) {
+		h := newClientHub("")
+		h.policy = POLICY_TAKEOVER
+		h.takeoverGrace = time.Minute
+		a, b := testSession(t, h), testSession(t, h)
+		h.claimDriver(a)
+		if h.claimDriver(b) {
+			t.Fatal("takeover before the grace period")
+		}
+		backdate(h, time.Minute, 0)
+		if !h.claimDriver(b) {
+			t.Fatal("no takeover after the grace period")
+		}
+		if closed(a) {
+			t.Fatal("the old driver was disconnected")
+		}
+		// The old driver waits as a spectator rather than taking it back
+		if h.claimDriver(a) {
+			t.Fatal("the demoted driver took the seat back")
+		}
+		if !h.claimDriver(b) {
+			t.Fatal("the new driver lost the seat")
+		}
+	})
+
+	t.Run("contender goes quiet", func(t *testing.T) {
+		h := newClientHub("")
+		h.policy = POLICY_TAKEOVER
+		h.takeoverGrace = time.Minute
+		a, b := testSession(t, h), testSession(t, h)
+		h.claimDriver(a)
+		h.claimDriver(b)
+		// Long enough for the grace period, but with a gap past
+		// TAKEOVER_IDLE: the contention starts over
+		backdate(h, time.Minute, 2*TAKEOVER_IDLE)
+		if h.claimDriver(b) {
+			t.Fatal("a contender that went quiet took over")
+		}
+		if !h.claimDriver(a) {
+			t.Fatal("the driver lost the seat")
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// CLOCK_OFFSET_WARN is how far off a client clock may be before it is
+// worth a warning; ages are corrected either way
+const CLOCK_OFFSET_WARN = time.Second
+
+// pong answers a latency ping straight away and keeps the round trip and
+// clock offset the client worked out from earlier ones
+func (s *clientSession) pong(ping *protocol.PingFrame) error {
+	recv := time.Now().UnixMilli()
+	s.mu.Lock()
+	if ping.RTTMs > 0 {
+		s.rtt = time.Duration(ping.RTTMs * float64(time.Millisecond))
+	}
+	if ping.OffsetMs != nil {
+		offset := time.Duration(*ping.OffsetMs) * time.Millisecond
+		if !s.offsetKnown {
+			attrs := []any{"client", s.conn.RemoteAddr(), "offset", offset}
+			if offset.Abs() > CLOCK_OFFSET_WARN {
+				slog.Warn("Client clock is off, correcting state ages", attrs...)
+			} else {
+				slog.Info("Client clock offset", attrs...)
+			}
+		}
+		s.offset = offset
+		s.offsetKnown = true
+	}
+	s.mu.Unlock()
+
+	b, err := s.encode(&protocol.PongFrame{Type: protocol.MsgPong, Seq: ping.Seq, Sent: ping.Sent, Recv: recv})
+	if err != nil {
+		return err
+	}
+	return s.send(b)
+}
+
+// stateAge returns how old state was on arrival by the server's clock,
+// shifting its Timestamp by the client's clock offset once that is known.
+// States without a timestamp have no age.
+func (s *clientSession) stateAge(state *protocol.ControllerState) (time.Duration, bool) {
+	if state.Timestamp == 0 {
+		return 0, false
+	}
+	s.mu.Lock()
+	offset := s.offset
+	s.mu.Unlock()
+	return time.Since(time.UnixMilli(state.Timestamp).Add(offset)), true
+}
+
+// noteDelay keeps the age of the client's latest state
+func (s *clientSession) noteDelay(age time.Duration) {
+	s.mu.Lock()
+	s.oneWay = max(age, 0)
+	s.mu.Unlock()
+}
+
+// latency returns the last reported round trip and state delay, zero when
+// unknown
+func (s *clientSession) latency() (rtt, oneWay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt, s.oneWay
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"lunabotics/pkg/protocol"
+)
+
+// listen opens the client listener for addr: host:port, where host may be
+// an IPv6 literal, a zoned link-local address or an interface name, or
+// unix:/path. A socket file left behind by a server that didn't shut down
+// cleanly is removed first; one that still answers is left alone.
+func listen(addr string) (net.Listener, error) {
+	network, address := protocol.SplitNetwork(addr)
+	if network == "tcp" {
+		var err error
+		if address, err = interfaceAddr(address); err != nil {
+			return nil, err
+		}
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another server", address)
+			}
+			os.Remove(address)
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		return &unixListener{Listener: l, path: address}, nil
+	}
+	return l, nil
+}
+
+// interfaceAddr replaces an interface name in host:port, as in
+// "usb0:8080", with that interface's address, so the server only listens
+// on it: the first IPv4 address, or failing that the first IPv6 one, zoned
+// if link-local. Anything else is returned unchanged.
+func interfaceAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "localhost" || strings.Contains(host, "%") || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return addr, nil // a hostname
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %w", host, err)
+	}
+	var v6 string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+		if v6 == "" {
+			v6 = ipnet.IP.String()
+			if ipnet.IP.IsLinkLocalUnicast() {
+				v6 += "%" + iface.Name
+			}
+		}
+	}
+	if v6 == "" {
+		return "", fmt.Errorf("interface %s has no address", host)
+	}
+	return net.JoinHostPort(v6, port), nil
+}
+
+// unixListener names each connection it accepts, since a Unix socket
+// client has no address and logs, the dashboard and the black box tell
+// clients apart by it. The socket file goes when the listener closes.
+type unixListener struct {
+	net.Listener
+	path string
+	n    atomic.Uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{Conn: conn, remote: unixPeer(fmt.Sprintf("%s%s#%d", protocol.UNIX_PREFIX, l.path, l.n.Add(1)))}, nil
+}
+
+// unixPeer is a Unix socket client's name as a net.Addr
+type unixPeer string
+
+func (p unixPeer) Network() string { return "unix" }
+func (p unixPeer) String() string  { return string(p) }
+
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// checkListenAddr returns an error for a listen address that can't work
+func checkListenAddr(addr string) error {
+	if network, address := protocol.SplitNetwork(addr); network == "unix" {
+		if address == "" {
+			return errors.New("no socket path")
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log output formats for -log-format
+const (
+	LOG_TEXT = "text" // key=value
+	LOG_JSON = "json"
+)
+
+// LogConfig holds the -log-* flags, or the server config's log section
+type LogConfig struct {
+	Level      string `json:"level,omitempty"`
+	File       string `json:"file,omitempty"`
+	Format     string `json:"format,omitempty"`
+	MaxSizeMB  int    `json:"max_size_mb,omitempty"`
+	MaxBackups int    `json:"backups,omitempty"`
+}
+
+// setupLogging installs the default slog logger, copying records into box
+// when there is one. Anything still written through the standard log
+// package ends up there too, at INFO.
+func setupLogging(opts *LogConfig, box *blackBox) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return fmt.Errorf("-log-level: %q is not debug, info, warn or error", opts.Level)
+	}
+
+	var out io.Writer = os.Stderr
+	if opts.File != "" {
+		f, err := newRotatingFile(opts.File, int64(opts.MaxSizeMB)<<20, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case LOG_TEXT:
+		handler = slog.NewTextHandler(out, handlerOpts)
+	case LOG_JSON:
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	default:
+		return fmt.Errorf("-log-format: %q is not %s or %s", opts.Format, LOG_TEXT, LOG_JSON)
+	}
+	if box != nil {
+		handler = &blackboxHandler{next: handler, box: box}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at ERROR and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// rotatingFile appends to a log file, renaming it to name.1 (and older
+// copies to name.2 and so on, keeping backups of them) once it would grow
+// past maxSize bytes
+type rotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current file for appending. Callers hold r.mu.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts name.N to name.N+1, dropping the oldest, and starts a new
+// file. Callers hold r.mu.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	if r.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.name, r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		}
+		if err := os.Rename(r.name, r.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.name); err != nil {
+		return err
+	}
+	return r.open()
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// MACRO_TICK is how often a running macro rewrites its step's frame
+const MACRO_TICK = 20 * time.Millisecond
+
+// MACRO_ABORT_DEADZONE is how far a stick may leave center, or a trigger
+// leave rest, before it counts as the driver taking over from a macro
+const MACRO_ABORT_DEADZONE = 24
+
+// A macro is a timed sequence of states the server plays to the Arduinos
+// when the driver presses its combo, for routines like a dump cycle that
+// are tedious and error-prone to drive by hand. The driver's own states
+// are ignored while it runs, except that moving any stick or trigger
+// aborts it at once; so do releasing the deadman, the e-stop, a mode
+// switch and the driver leaving, going silent or being taken over. Each step still passes
+// through the pipeline's stages after macro, so speed levels, the failsafe
+// override and battery limits apply to it as they would to the driver. An
+// aborted or finished macro leaves the failsafe frame behind.
+
+// macroRun is the macro being played
+type macroRun struct {
+	name string
+	stop chan struct{} // closed to abort
+}
+
+// setMacros replaces the macros the driver's combos start
+func (h *clientHub) setMacros(macros []*formatter.MacroConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.macros = macros
+}
+
+// checkMacro aborts the running macro if the driver moved a stick or let
+// go of the deadman, or starts one whose combo the driver just pressed
+// while holding it. It reports whether the driver's state should be
+// dropped because a macro owns the outputs.
+func (h *clientHub) checkMacro(state *protocol.ControllerState) bool {
+	var f formatter.ByteFormatter
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var held *formatter.MacroConfig
+	for _, m := range h.macros {
+		if len(m.Combo) > 0 && comboHeld(&f, state, m.Combo) && (held == nil || len(m.Combo) > len(held.Combo)) {
+			held = m
+		}
+	}
+	pressed := held != nil && held.Name != h.macroHeld
+	h.macroHeld = ""
+	if held != nil {
+		h.macroHeld = held.Name
+	}
+
+	deadman := h.deadman == "" || state.DeadmanHeld(h.deadman)
+	if h.macro != nil {
+		if !deadman {
+			// Falls through to the deadman stage, which reports the release
+			h.stopMacro("deadman released")
+			return false
+		}
+		if !sticksMoved(state, h.deadman) {
+			return true
+		}
+		h.stopMacro("driver moved a stick")
+		return false
+	}
+	if !pressed || !deadman {
+		return false
+	}
+	steps := make([]*protocol.ControllerState, len(held.Steps))
+	for i, step := range held.Steps {
+		s, err := formatter.DecodeState(step.State)
+		if err != nil {
+			// Validate caught this when the config loaded
+			slog.Error("Macro step unreadable", "macro", held.Name, "step", i, "err", err)
+			return false
+		}
+		steps[i] = s
+	}
+	run := &macroRun{name: held.Name, stop: make(chan struct{})}
+	h.macro = run
+	h.releaseCruise("macro started")
+	if h.deadman != "" {
+		h.deadmanWasHeld = true
+	}
+	slog.Info("Macro started", "macro", held.Name, "steps", len(steps))
+	go h.runMacro(run, held, steps)
+	return true
+}
+
+// sticksMoved reports whether any stick is off center or any trigger
+// pressed by more than MACRO_ABORT_DEADZONE. A trigger used as the deadman
+// is meant to be held, so it doesn't count.
+func sticksMoved(state *protocol.ControllerState, deadman string) bool {
+	return offCenter(state.LeftX, MACRO_ABORT_DEADZONE) || offCenter(state.LeftY, MACRO_ABORT_DEADZONE) ||
+		offCenter(state.RightX, MACRO_ABORT_DEADZONE) || offCenter(state.RightY, MACRO_ABORT_DEADZONE) ||
+		deadman != "LT" && state.LeftTrigger > MACRO_ABORT_DEADZONE ||
+		deadman != "RT" && state.RightTrigger > MACRO_ABORT_DEADZONE
+}
+
+// offCenter reports whether a stick axis is more than deadzone from center
+func offCenter(v uint8, deadzone int) bool {
+	d := int(v) - protocol.AXIS_CENTER
+	return d > deadzone || d < -deadzone
+}
+
+// runMacro plays m's steps until they end or run is stopped
+func (h *clientHub) runMacro(run *macroRun, m *formatter.MacroConfig, steps []*protocol.ControllerState) {
+	ticker := time.NewTicker(MACRO_TICK)
+	defer ticker.Stop()
+	for i, state := range steps {
+		end := time.Now().Add(ms(m.Steps[i].Ms))
+		for {
+			if !h.macroWrite(run, state) {
+				return
+			}
+			if !time.Now().Before(end) {
+				break
+			}
+			select {
+			case <-run.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.macro == run {
+		h.macro = nil
+		for _, d := range h.devices {
+			d.formatter.ResetSlew()
+			d.submit(d.formatter.Format(FailsafeState()))
+		}
+		slog.Info("Macro finished", "macro", run.name)
+	}
+}
+
+// macroWrite passes one of run's states through the stages after macro
+// and sends it to the Arduinos, reporting false once run has been stopped
+func (h *clientHub) macroWrite(run *macroRun, state *protocol.ControllerState) bool {
+	out := h.runMacroRest(state)
+	if out == nil {
+		out = FailsafeState()
+	}
+	frames := h.format(out)
+	if !h.submitWhile(func() bool { return h.macro == run && !h.estop && !h.closing }, frames) {
+		return false
+	}
+	h.publish(&serverEvent{Kind: BUS_OUTPUT, State: state, Frames: frames})
+	return true
+}
+
+// macroDeadman stands in for the deadman stage on macro steps: it passes
+// them while the driver was last seen holding the deadman
+func (h *clientHub) macroDeadman(state *protocol.ControllerState) *protocol.ControllerState {
+	if h.deadman == "" {
+		return state
+	}
+	h.mu.Lock()
+	held := h.deadmanWasHeld
+	h.mu.Unlock()
+	if !held {
+		return FailsafeState()
+	}
+	return state
+}
+
+// stopMacro stops the running macro, if any, and sends the failsafe frame.
+// Callers hold h.mu.
+func (h *clientHub) stopMacro(reason string) {
+	if h.macro == nil {
+		return
+	}
+	close(h.macro.stop)
+	slog.Warn("Macro aborted", "macro", h.macro.name, "reason", reason)
+	h.macro = nil
+	for _, d := range h.devices {
+		d.formatter.ResetSlew()
+		d.submit(d.formatter.Format(FailsafeState()))
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// macroDevice adds a device with config to h and returns a check for the
+// frame last written to it. It is built by hand so the test, not
+// writePort, consumes its frames.
+func macroDevice(h *clientHub, config *formatter.ByteConfig) func(want []byte) func() bool {
+	d := &serialDevice{name: "test", formatter: &formatter.ByteFormatter{Config: config},
+		config: &serialout.SerialConfig{}, writer: serialout.NewWriter()}
+	h.devices = append(h.devices, d)
+
+	var mu sync.Mutex
+	var written []byte
+	go d.writer.Run(func(frame []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = frame
+	}, 0)
+	return func(want []byte) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return bytes.Equal(written, want)
+		}
+	}
+}
+
+// dumpMacro is a one-step macro on SELECT that lasts ms
+func dumpMacro(ms int) []*formatter.MacroConfig {
+	return []*formatter.MacroConfig{{
+		Name:  "dump",
+		Combo: []string{"SELECT"},
+		Steps: []formatter.MacroStep{{State: json.RawMessage(`{"RjoyY": 255}`), Ms: ms}},
+	}}
+}
+
+// macroRunning reports whether h is playing a macro
+func macroRunning(h *clientHub) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.macro != nil
+}
+
+// Letting go of the deadman mid-macro must stop the robot, not leave the
+// macro driving it
+func TestMacroStopsOnDeadmanRelease(t *testing.T) {
+	config := &formatter.ByteConfig{OutputSize: 1, Bytes: []formatter.ByteMapping{{Type: "field", Field: "RjoyY"}}}
+	h := newClientHub("")
+	h.deadman = "LB"
+	wrote := macroDevice(h, config)
+	h.setMacros(dumpMacro(10000))
+	f := &formatter.ByteFormatter{Config: config}
+	step := f.Format(&protocol.ControllerState{RightY: 255})
+	failsafe := f.Format(FailsafeState())
+
+	state := formatter.NeutralState()
+	state.LeftBumper, state.Select = 1, 1
+	if out := h.runPipeline(state); out != nil {
+		t.Fatalf("driver state %+v passed while the macro starts", *out)
+	}
+	waitFor(t, wrote(step))
+
+	state = formatter.NeutralState()
+	out := h.runPipeline(state)
+	if out == nil || *out != *FailsafeState() {
+		t.Fatalf("released deadman gave %+v, want the failsafe state", out)
+	}
+	if macroRunning(h) {
+		t.Fatal("macro still running after the deadman was released")
+	}
+	waitFor(t, wrote(failsafe))
+	time.Sleep(3 * MACRO_TICK)
+	if !wrote(failsafe)() {
+		t.Fatal("macro wrote a step after the deadman was released")
+	}
+}
+
+// The frame a finished macro leaves behind is the failsafe frame itself,
+// not one slew step toward it
+func TestMacroFinishSkipsSlew(t *testing.T) {
+	config := &formatter.ByteConfig{OutputSize: 1,
+		Bytes: []formatter.ByteMapping{{Type: "field", Field: "RjoyY", MaxDeltaPerFrame: 10}}}
+	h := newClientHub("")
+	wrote := macroDevice(h, config)
+	h.setMacros(dumpMacro(2 * int(MACRO_TICK/time.Millisecond)))
+	failsafe := (&formatter.ByteFormatter{Config: config}).Format(FailsafeState())
+
+	state := formatter.NeutralState()
+	state.Select = 1
+	h.runPipeline(state)
+	waitFor(t, func() bool { return !macroRunning(h) })
+	waitFor(t, wrote(failsafe))
+}
+
+// A driver who takes the seat over didn't start the macro, so it stops
+func TestMacroStopsOnTakeover(t *testing.T) {
+	h := newClientHub("")
+	h.policy = POLICY_TAKEOVER
+	h.setMacros(dumpMacro(10000))
+	a, b := testSession(t, h), testSession(t, h)
+	h.claimDriver(a)
+	state := formatter.NeutralState()
+	state.Select = 1
+	h.runPipeline(state)
+	if !macroRunning(h) {
+		t.Fatal("macro didn't start")
+	}
+
+	if !h.claimDriver(b) {
+		t.Fatal("takeover didn't hand over the seat")
+	}
+	if macroRunning(h) {
+		t.Fatal("macro still running for the new driver")
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// PACKET_AGE_BUCKETS are the histogram bounds (seconds) for how old a
+// controller state is when the server handles it, by the client's clock
+var PACKET_AGE_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// hubStats are the server-wide counters exported on /metrics
+type hubStats struct {
+	packets     atomic.Uint64 // packets read from clients, valid or not
+	crcErrors   atomic.Uint64
+	jsonErrors  atomic.Uint64
+	rateLimited atomic.Uint64 // packets dropped for exceeding a client's rate limit
+	replays     atomic.Uint64 // states dropped outside the replay window
+	packetAge   histogram
+}
+
+// histogram is a cumulative Prometheus-style histogram
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, plus +Inf
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets)+1)
+	}
+	i := sort.SearchFloat64s(buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// write prints the histogram in the text exposition format. labels, if
+// not empty, go on every line, e.g. `device="arduino"`.
+func (h *histogram) write(w io.Writer, name, labels string, buckets []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	prefix, set := "", ""
+	if labels != "" {
+		prefix, set = labels+",", "{"+labels+"}"
+	}
+	for i, le := range buckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.total)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, set, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, set, h.total)
+}
+
+// countEvent updates the counters for a client packet or state. A state's
+// age on arrival is as worked out by clientSession.stateAge.
+func (h *clientHub) countEvent(e *serverEvent) {
+	switch e.Kind {
+	case BUS_PACKET:
+		h.stats.packets.Add(1)
+	case BUS_STATE:
+		if e.AgeKnown {
+			h.stats.packetAge.observe(PACKET_AGE_BUCKETS, max(e.Age.Seconds(), 0))
+		}
+	case BUS_PACKET_REJECTED:
+		switch e.Reason {
+		case REJECT_CRC:
+			h.stats.crcErrors.Add(1)
+		case REJECT_DECODE:
+			h.stats.jsonErrors.Add(1)
+		case REJECT_RATE_LIMITED:
+			h.stats.rateLimited.Add(1)
+		case REJECT_REPLAY:
+			h.stats.replays.Add(1)
+		}
+	}
+}
+
+// countFrame updates the session's controller frame rate, measured over
+// one-second windows
+func (s *clientSession) countFrame() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frames++
+	now := time.Now()
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+		s.windowFrames = s.frames
+		return
+	}
+	if elapsed := now.Sub(s.windowStart); elapsed >= time.Second {
+		s.fps = float64(s.frames-s.windowFrames) / elapsed.Seconds()
+		s.windowStart = now
+		s.windowFrames = s.frames
+	}
+}
+
+// frameRate returns the last measured frame rate, or 0 once the client has
+// gone quiet for more than a window
+func (s *clientSession) frameRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.windowStart) > 2*time.Second {
+		return 0
+	}
+	return s.fps
+}
+
+// writeMetrics prints every metric in the Prometheus text format
+func (h *clientHub) writeMetrics(w io.Writer) {
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("lunabotics_packets_received_total", "Packets read from clients.", h.stats.packets.Load())
+	counter("lunabotics_crc_failures_total", "Client packets dropped for a bad CRC.", h.stats.crcErrors.Load())
+	counter("lunabotics_json_errors_total", "Client packets that failed to decode, as JSON or protobuf.", h.stats.jsonErrors.Load())
+	counter("lunabotics_rate_limited_total", "Client packets dropped for exceeding the per-client rate limit.", h.stats.rateLimited.Load())
+	counter("lunabotics_replayed_states_total", "Client states dropped for a timestamp outside the replay window.", h.stats.replays.Load())
+
+	fmt.Fprintf(w, "# HELP lunabotics_packet_age_seconds Age of controller states on arrival, corrected for client clock offset.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_packet_age_seconds histogram\n")
+	h.stats.packetAge.write(w, "lunabotics_packet_age_seconds", "", PACKET_AGE_BUCKETS)
+
+	perDevice := func(name, help, kind string, value func(d *serialDevice) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, d := range h.devices {
+			fmt.Fprintf(w, "%s{device=%q} %s\n", name, d.name, value(d))
+		}
+	}
+	perDevice("lunabotics_serial_write_errors_total", "Failed serial writes.", "counter",
+		func(d *serialDevice) string { return fmt.Sprint(d.writeErrors.Load()) })
+	perDevice("lunabotics_serial_reconnects_total", "Times the serial port was reopened after being lost.", "counter",
+		func(d *serialDevice) string { return fmt.Sprint(d.reconnects.Load()) })
+	perDevice("lunabotics_serial_dropped_frames_total", "Frames replaced before the serial port could write them.", "counter",
+		func(d *serialDevice) string { return fmt.Sprint(d.writer.Dropped.Load()) })
+	perDevice("lunabotics_serial_connected", "Whether the serial port is open.", "gauge",
+		func(d *serialDevice) string { return fmt.Sprint(boolInt(d.connected())) })
+	perDevice("lunabotics_serial_frames_accepted_total", "Frames the Arduino accepted (ACKed, in acknowledged mode).", "counter",
+		func(d *serialDevice) string { return fmt.Sprint(d.stats.writes.Load()) })
+	perDevice("lunabotics_serial_last_write_age_seconds", "Time since the Arduino last accepted a frame (NaN before any).", "gauge",
+		func(d *serialDevice) string { return fmt.Sprint(d.lastWriteAgeSeconds()) })
+	perDevice("lunabotics_serial_degraded", "Whether the Arduino's port is closed or hasn't accepted an offered frame within -degraded-after.", "gauge",
+		func(d *serialDevice) string { return fmt.Sprint(boolInt(d.degraded(h.degradedAfter) != "")) })
+	fmt.Fprintf(w, "# HELP lunabotics_serial_write_seconds Time taken by each serial port write.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_serial_write_seconds histogram\n")
+	for _, d := range h.devices {
+		d.stats.latency.write(w, "lunabotics_serial_write_seconds", fmt.Sprintf("device=%q", d.name), SERIAL_WRITE_BUCKETS)
+	}
+	fmt.Fprintf(w, "# HELP lunabotics_output_healthy Whether the last write to an extra output succeeded.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_output_healthy gauge\n")
+	for _, d := range h.devices {
+		health := d.outputHealth()
+		outputs := make([]string, 0, len(health))
+		for output := range health {
+			outputs = append(outputs, output)
+		}
+		sort.Strings(outputs)
+		for _, output := range outputs {
+			fmt.Fprintf(w, "lunabotics_output_healthy{device=%q,output=%q} %d\n", d.name, output, boolInt(health[output]))
+		}
+	}
+	h.writeTelemetryMetrics(w)
+
+	h.mu.Lock()
+	sessions := make([]*clientSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP lunabotics_client_frames_per_second Controller states received per second.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_client_frames_per_second gauge\n")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "lunabotics_client_frames_per_second{client=%q,role=%q} %g\n",
+			s.conn.RemoteAddr(), h.role(s), s.frameRate())
+	}
+	fmt.Fprintf(w, "# HELP lunabotics_client_rtt_seconds Round trip time the client last measured with a ping.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_client_rtt_seconds gauge\n")
+	for _, s := range sessions {
+		rtt, _ := s.latency()
+		fmt.Fprintf(w, "lunabotics_client_rtt_seconds{client=%q,role=%q} %g\n",
+			s.conn.RemoteAddr(), h.role(s), rtt.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP lunabotics_client_state_delay_seconds Age of the client's latest state on arrival, corrected for clock offset.\n")
+	fmt.Fprintf(w, "# TYPE lunabotics_client_state_delay_seconds gauge\n")
+	for _, s := range sessions {
+		_, oneWay := s.latency()
+		fmt.Fprintf(w, "lunabotics_client_state_delay_seconds{client=%q,role=%q} %g\n",
+			s.conn.RemoteAddr(), h.role(s), oneWay.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP lunabotics_clients Connected clients.\n# TYPE lunabotics_clients gauge\n")
+	fmt.Fprintf(w, "lunabotics_clients %d\n", len(sessions))
+	fmt.Fprintf(w, "# HELP lunabotics_estop Whether the e-stop is latched.\n# TYPE lunabotics_estop gauge\n")
+	fmt.Fprintf(w, "lunabotics_estop %d\n", boolInt(h.estopped()))
+	fmt.Fprintf(w, "# HELP lunabotics_battery_failsafe Battery failsafe level: 0 off, 1 outputs scaled down, 2 held at failsafe.\n# TYPE lunabotics_battery_failsafe gauge\n")
+	fmt.Fprintf(w, "lunabotics_battery_failsafe %d\n", map[string]int{BATTERY_LOW: 1, BATTERY_CRITICAL: 2}[h.batteryState()])
+	if h.speedButton != "" {
+		fmt.Fprintf(w, "# HELP lunabotics_speed_scale Stick scale of the driver's speed level.\n# TYPE lunabotics_speed_scale gauge\n")
+		h.mu.Lock()
+		fmt.Fprintf(w, "lunabotics_speed_scale{speed=%q} %g\n", h.speedLevel(), h.speedScales[h.speed])
+		h.mu.Unlock()
+	}
+	fmt.Fprintf(w, "# HELP lunabotics_mode Current mode, 1 for the active one.\n# TYPE lunabotics_mode gauge\n")
+	mode := h.currentMode()
+	for _, m := range []string{protocol.MODE_TELEOP, protocol.MODE_AUTONOMY, protocol.MODE_PAUSED, protocol.MODE_ESTOP} {
+		fmt.Fprintf(w, "lunabotics_mode{mode=%q} %d\n", m, boolInt(m == mode))
+	}
+}
+
+// writeTelemetryMetrics prints each board's latest sensor readings as
+// gauges, leaving out boards and sensors that haven't reported
+func (h *clientHub) writeTelemetryMetrics(w io.Writer) {
+	latest := make([]*protocol.TelemetryState, 0, len(h.devices))
+	for _, d := range h.devices {
+		if t := d.latestTelemetry(); t != nil {
+			latest = append(latest, t)
+		}
+	}
+	gauge := func(name, help string, values func(t *protocol.TelemetryState, emit func(labels string, v float64))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, t := range latest {
+			values(t, func(labels string, v float64) {
+				fmt.Fprintf(w, "%s{device=%q%s} %g\n", name, t.Device, labels, v)
+			})
+		}
+	}
+	gauge("lunabotics_battery_volts", "Battery voltage the Arduino last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		emit("", t.BatteryVolts)
+	})
+	gauge("lunabotics_battery_amps", "Battery current the Arduino last reported, negative while charging.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		if t.BatteryAmps != nil {
+			emit("", *t.BatteryAmps)
+		}
+	})
+	gauge("lunabotics_motor_current_amps", "Motor currents the Arduino last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		for i, a := range t.MotorCurrents {
+			emit(fmt.Sprintf(",motor=\"%d\"", i), a)
+		}
+	})
+	gauge("lunabotics_limit_switches", "Limit switch bitmask the Arduino last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		emit("", float64(t.LimitSwitches))
+	})
+	gauge("lunabotics_bucket_angle_degrees", "Bucket angle the Arduino last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		if t.BucketAngle != nil {
+			emit("", *t.BucketAngle)
+		}
+	})
+	gauge("lunabotics_imu_degrees", "Orientation the IMU last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		if i := t.IMU; i != nil {
+			emit(`,axis="roll"`, i.Roll)
+			emit(`,axis="pitch"`, i.Pitch)
+			emit(`,axis="yaw"`, i.Yaw)
+		}
+	})
+	gauge("lunabotics_imu_accel_g", "Acceleration the IMU last reported.", func(t *protocol.TelemetryState, emit func(string, float64)) {
+		if i := t.IMU; i != nil {
+			emit(`,axis="x"`, i.AccelX)
+			emit(`,axis="y"`, i.AccelY)
+			emit(`,axis="z"`, i.AccelZ)
+		}
+	})
+}
+
+// serveMetrics serves /metrics on addr until the listener fails
+func serveMetrics(addr string, hub *clientHub) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		hub.writeMetrics(w)
+	})
+	slog.Info("Metrics listening", "url", "http://"+addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Metrics server stopped", "err", err)
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// AUTONOMY_TIMEOUT is how long the autonomy source may go without sending
+// a state while it drives before the robot is paused
+const AUTONOMY_TIMEOUT = 500 * time.Millisecond
+
+// The server is always in one mode (protocol.MODE_*). In TELEOP the
+// driver's gamepad drives, as it always has. In AUTONOMY the states come
+// from a local planner connected to -autonomy instead, and the gamepad is
+// only read for the mode combo. In PAUSED nothing drives. ESTOP is the
+// latched e-stop, whatever the mode underneath. Every switch sends the
+// failsafe frame first, so one source never hands the other a moving
+// robot. A driver with the token switches with a mode message, the
+// -mode-combo on the gamepad or PUT /mode on the admin API; the planner
+// can hand back by asking for TELEOP or PAUSED itself. Losing the planner,
+// or AUTONOMY_TIMEOUT without a state from it, pauses the robot, and
+// resetting an e-stop latched during AUTONOMY leaves it PAUSED.
+
+// AutonomyConfig is the server config's autonomy section, as -autonomy and
+// -mode-combo
+type AutonomyConfig struct {
+	Source string `json:"source,omitempty"`
+	Combo  string `json:"combo,omitempty"`
+}
+
+var errNoAutonomy = errors.New("no autonomy source connected (-autonomy)")
+
+// currentMode returns the mode clients are told about
+func (h *clientHub) currentMode() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.estop {
+		return protocol.MODE_ESTOP
+	}
+	return h.mode
+}
+
+// setMode switches to mode on behalf of by. MODE_ESTOP latches the e-stop;
+// leaving it takes an e-stop reset, not a mode switch.
+func (h *clientHub) setMode(mode, by string) error {
+	switch mode {
+	case protocol.MODE_ESTOP:
+		h.triggerEStop(by, "mode switch")
+		return nil
+	case protocol.MODE_TELEOP, protocol.MODE_AUTONOMY, protocol.MODE_PAUSED:
+	default:
+		return fmt.Errorf("unknown mode %q (valid: %s, %s, %s, %s)", mode, protocol.MODE_TELEOP, protocol.MODE_AUTONOMY, protocol.MODE_PAUSED, protocol.MODE_ESTOP)
+	}
+
+	h.mu.Lock()
+	switch {
+	case h.estop:
+		h.mu.Unlock()
+		return errors.New("e-stop is latched; reset it first")
+	case mode == protocol.MODE_AUTONOMY && h.autonomyConn == nil:
+		h.mu.Unlock()
+		return errNoAutonomy
+	case mode == h.mode:
+		h.mu.Unlock()
+		return nil
+	}
+	prev := h.mode
+	h.mode = mode
+	h.autonomyLast = time.Now()
+	h.resetDriving("mode switch")
+	h.mu.Unlock()
+
+	slog.Warn("Mode switched", "from", prev, "to", mode, "by", by)
+	h.publish(&serverEvent{Kind: BUS_MODE_CHANGED, Client: by, Detail: mode})
+	for _, d := range h.devices {
+		d.formatter.ResetSlew()
+		d.submit(d.formatter.Format(FailsafeState()))
+	}
+	return nil
+}
+
+// modeCombo returns the fields of a -mode-combo such as "SELECT+RB"
+func modeCombo(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	combo := strings.Split(s, "+")
+	for _, field := range combo {
+		if err := protocol.CheckButton(field); err != nil {
+			return nil, err
+		}
+	}
+	return combo, nil
+}
+
+// checkModeCombo switches between TELEOP and AUTONOMY, or from PAUSED back
+// to TELEOP, when the driver starts holding the mode combo
+func (h *clientHub) checkModeCombo(state *protocol.ControllerState) {
+	if len(h.modeCombo) == 0 {
+		return
+	}
+	var f formatter.ByteFormatter
+	held := comboHeld(&f, state, h.modeCombo)
+
+	h.mu.Lock()
+	pressed := held && !h.modeComboHeld
+	h.modeComboHeld = held
+	mode := h.mode
+	h.mu.Unlock()
+	if !pressed {
+		return
+	}
+	next := protocol.MODE_AUTONOMY
+	if mode != protocol.MODE_TELEOP {
+		next = protocol.MODE_TELEOP
+	}
+	if err := h.setMode(next, "driver combo"); err != nil {
+		slog.Warn("Mode combo ignored", "err", err)
+	}
+}
+
+// mayCommand reports whether s may switch modes: the driver, or a client
+// that presented the driver token
+func (h *clientHub) mayCommand(s *clientSession) bool {
+	h.mu.Lock()
+	driver := h.driver == s
+	h.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return driver || s.authorized
+}
+
+// serveAutonomy accepts the planner on addr (unix:/path or host:port) and
+// drives from its states while the server is in AUTONOMY. A new connection
+// replaces the old one. TCP connections must pass the client access list.
+func serveAutonomy(addr string, hub *clientHub, access *accessList) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	slog.Info("Autonomy source listening", "addr", addr)
+	go hub.watchAutonomy()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if ok, rule := access.permits(conn.RemoteAddr()); !ok {
+			slog.Warn("Refused autonomy source", "source", conn.RemoteAddr(), "rule", rule)
+			conn.Close()
+			continue
+		}
+		// The new connection is current before the old one closes, so the
+		// old reader's cleanup doesn't take the planner for lost
+		if old := hub.attachAutonomy(conn); old != nil {
+			old.Close()
+		}
+		go hub.readAutonomy(conn)
+	}
+}
+
+// attachAutonomy makes conn the planner connection, returning the one it
+// replaces, if any
+func (h *clientHub) attachAutonomy(conn net.Conn) net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.autonomyConn
+	h.autonomyConn = conn
+	return old
+}
+
+// readAutonomy handles one planner connection, attached with
+// attachAutonomy: framed packets as from a client, carrying states and
+// mode messages
+func (h *clientHub) readAutonomy(conn net.Conn) {
+	defer conn.Close()
+	slog.Info("Autonomy source connected", "source", conn.RemoteAddr())
+
+	defer func() {
+		h.mu.Lock()
+		current := h.autonomyConn == conn
+		if current {
+			h.autonomyConn = nil
+			if len(h.sessions) == 0 && !h.replaying && !h.seatHeld() {
+				for _, d := range h.devices {
+					d.idle()
+				}
+			}
+		}
+		mode := h.mode
+		h.mu.Unlock()
+		slog.Warn("Autonomy source disconnected", "source", conn.RemoteAddr())
+		if current && mode == protocol.MODE_AUTONOMY {
+			h.setMode(protocol.MODE_PAUSED, "autonomy source lost")
+		}
+	}()
+
+	for {
+		payload, err := h.framing.ReadPacket(conn)
+		if errors.Is(err, protocol.ErrBadCRC) || errors.Is(err, protocol.ErrPacketTooLarge) {
+			slog.Warn("Dropping autonomy packet", "err", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if protocol.IsProtobuf(payload) {
+			if payload, err = protocol.ProtobufToJSON(payload); err != nil {
+				slog.Warn("Autonomy protobuf decode error", "err", err)
+				continue
+			}
+		}
+		switch protocol.PeekType(payload) {
+		case "":
+			var state protocol.ControllerState
+			if err := json.Unmarshal(payload, &state); err != nil {
+				slog.Warn("Autonomy state decode error", "err", err)
+				continue
+			}
+			h.autonomyState(&state)
+		case protocol.MsgMode:
+			var req protocol.ModeFrame
+			json.Unmarshal(payload, &req)
+			if req.Mode != protocol.MODE_TELEOP && req.Mode != protocol.MODE_PAUSED {
+				// Only the driver may hand the robot to the planner
+				slog.Warn("Autonomy mode switch refused: the planner may only hand back", "mode", req.Mode)
+				continue
+			}
+			if err := h.setMode(req.Mode, "autonomy source"); err != nil {
+				slog.Warn("Autonomy mode switch refused", "mode", req.Mode, "err", err)
+			}
+		case protocol.MsgEStop:
+			var req protocol.EStopFrame
+			json.Unmarshal(payload, &req)
+			h.triggerEStop("autonomy source", req.Reason)
+		}
+	}
+}
+
+// autonomyState sends a planner state to the Arduinos if the server is in
+// AUTONOMY, and drops it otherwise
+func (h *clientHub) autonomyState(state *protocol.ControllerState) {
+	driving := func() bool {
+		return h.mode == protocol.MODE_AUTONOMY && !h.estop && !h.closing
+	}
+	h.mu.Lock()
+	ok := driving()
+	if ok {
+		h.autonomyLast = time.Now()
+	}
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	frames := h.format(h.applyBattery(state))
+	if !h.submitWhile(driving, frames) {
+		return
+	}
+	h.publish(&serverEvent{Kind: BUS_OUTPUT, State: state, Frames: frames})
+}
+
+// watchAutonomy pauses the robot when the planner stops sending while it
+// drives
+func (h *clientHub) watchAutonomy() {
+	ticker := time.NewTicker(AUTONOMY_TIMEOUT / 5)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		silent := h.mode == protocol.MODE_AUTONOMY && !h.estop && time.Since(h.autonomyLast) > AUTONOMY_TIMEOUT
+		h.mu.Unlock()
+		if silent {
+			h.setMode(protocol.MODE_PAUSED, "autonomy source silent")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// The planner may hand the robot back, but never take it
+func TestAutonomyModeRequests(t *testing.T) {
+	tests := []struct {
+		from, ask, want string
+	}{
+		{protocol.MODE_TELEOP, protocol.MODE_AUTONOMY, protocol.MODE_TELEOP},
+		{protocol.MODE_PAUSED, protocol.MODE_AUTONOMY, protocol.MODE_PAUSED},
+		{protocol.MODE_AUTONOMY, protocol.MODE_TELEOP, protocol.MODE_TELEOP},
+		{protocol.MODE_AUTONOMY, protocol.MODE_PAUSED, protocol.MODE_PAUSED},
+		{protocol.MODE_TELEOP, protocol.MODE_ESTOP, protocol.MODE_TELEOP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.ask, func(t *testing.T) {
+			h := newClientHub("")
+			planner, peer := net.Pipe()
+			defer peer.Close()
+			h.attachAutonomy(planner)
+			go h.readAutonomy(planner)
+			h.mu.Lock()
+			h.mode = tt.from
+			h.mu.Unlock()
+
+			b, _ := json.Marshal(&protocol.ModeFrame{Type: protocol.MsgMode, Mode: tt.ask})
+			if err := h.framing.WritePacket(peer, b); err != nil {
+				t.Fatal(err)
+			}
+			// A second packet is only read once the first is handled
+			h.framing.WritePacket(peer, []byte(`{"type":"ping"}`))
+			if got := h.currentMode(); got != tt.want {
+				t.Fatalf("mode %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A planner that reconnects replaces its old connection without the old
+// reader pausing the robot on its way out
+func TestAutonomyReconnect(t *testing.T) {
+	h := newClientHub("")
+	first, firstPeer := net.Pipe()
+	defer firstPeer.Close()
+	h.attachAutonomy(first)
+	done := make(chan struct{})
+	go func() {
+		h.readAutonomy(first)
+		close(done)
+	}()
+	h.mu.Lock()
+	h.mode = protocol.MODE_AUTONOMY
+	h.mu.Unlock()
+
+	second, secondPeer := net.Pipe()
+	defer secondPeer.Close()
+	if old := h.attachAutonomy(second); old != first {
+		t.Fatal("attachAutonomy didn't return the old connection")
+	}
+	first.Close()
+	<-done
+	if got := h.currentMode(); got != protocol.MODE_AUTONOMY {
+		t.Fatalf("mode %s after the planner reconnected, want %s", got, protocol.MODE_AUTONOMY)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
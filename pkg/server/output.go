@@ -0,0 +1,136 @@
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/serialout"
+)
+
+// OUTPUT_RETRY is how often outputs that failed to open are tried again
+const OUTPUT_RETRY = 5 * time.Second
+
+// deviceOutput is an opened output and the spec it came from
+type deviceOutput struct {
+	spec string
+	raw  bool // takes frames before framing and the ack ID
+	serialout.OutputBackend
+}
+
+// openOutput opens one of the device's outputs
+func (d *serialDevice) openOutput(spec string) (serialout.OutputBackend, error) {
+	if err := serialout.CheckOutput(spec); err != nil {
+		return nil, err
+	}
+	kind, target, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "serial":
+		config := *d.config
+		config.Port = target
+		port, err := serialout.Open(&config)
+		if err != nil {
+			return nil, err
+		}
+		return serialout.NewPortOutput(port), nil
+	case "mock":
+		port, err := serialout.NewVirtualArduino(d.name+" "+spec, d.formatter.Current().Framing, d.config.Ack, formatter.LayoutHash(d.formatter.Current(), d.config.Ack), target)
+		if err != nil {
+			return nil, err
+		}
+		return serialout.NewPortOutput(port), nil
+	case "udp":
+		return serialout.OpenUDPOutput(target)
+	case "can":
+		return serialout.OpenCANOutput(target)
+	case "pi":
+		return serialout.OpenPiOutput(target)
+	default:
+		return serialout.OpenFileOutput(target)
+	}
+}
+
+// openOutputs opens the outputs in specs, returning those that failed to
+// open with a warning as missing
+func (d *serialDevice) openOutputs(specs []string) (outputs []deviceOutput, missing []string) {
+	for _, spec := range specs {
+		out, err := d.openOutput(spec)
+		if err != nil {
+			slog.Warn("Output not opened", "device", d.name, "output", spec, "err", err)
+			missing = append(missing, spec)
+			continue
+		}
+		raw := strings.HasPrefix(spec, "can:") || strings.HasPrefix(spec, "pi:")
+		outputs = append(outputs, deviceOutput{spec, raw, out})
+	}
+	return outputs, missing
+}
+
+// retryOutputs tries the outputs that failed to open again, at most every
+// OUTPUT_RETRY. It is only called from the writer goroutine.
+func (d *serialDevice) retryOutputs() {
+	d.mu.Lock()
+	missing := d.missing
+	due := d.active && len(missing) > 0 && time.Now().After(d.retryAt)
+	if due {
+		d.retryAt = time.Now().Add(OUTPUT_RETRY)
+	}
+	d.mu.Unlock()
+	if !due {
+		return
+	}
+
+	opened, missing := d.openOutputs(missing)
+	for _, out := range opened {
+		slog.Info("Output opened", "device", d.name, "output", out.spec)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active { // shut down meanwhile
+		closeOutputs(opened)
+		return
+	}
+	d.outputs = append(d.outputs, opened...)
+	d.missing = missing
+}
+
+// writeOutputs copies a frame to every output, as it goes on the wire or
+// raw as the output wants, logging when one starts or stops failing
+func (d *serialDevice) writeOutputs(outputs []deviceOutput, frame, wire []byte) {
+	for _, out := range outputs {
+		was := out.Healthy()
+		b := wire
+		if out.raw {
+			b = frame
+		}
+		err := out.Write(b)
+		switch {
+		case err != nil && was:
+			slog.Error("Output write error", "device", d.name, "output", out.spec, "err", err)
+		case err == nil && !was:
+			slog.Info("Output recovered", "device", d.name, "output", out.spec)
+		}
+	}
+}
+
+// closeOutputs closes every output
+func closeOutputs(outputs []deviceOutput) {
+	for _, out := range outputs {
+		out.Close()
+	}
+}
+
+// outputHealth reports each open output's health by spec
+func (d *serialDevice) outputHealth() map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.outputs) == 0 {
+		return nil
+	}
+	health := make(map[string]bool, len(d.outputs))
+	for _, out := range d.outputs {
+		health[out.spec] = out.Healthy()
+	}
+	return health
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"lunabotics/pkg/protocol"
+)
+
+// DEFAULT_PIPELINE is the -pipeline used unless one is given
+const DEFAULT_PIPELINE = "deadzone,curve,smooth,macro,cruise,script,mix,deadman,speed,failsafe,battery,slew"
+
+// The driver's state passes through an ordered pipeline of stages between
+// being decoded and being formatted, each taking the state the previous
+// one returned. -pipeline (or pipeline in the server config) chooses the
+// stages and their order, so a team can drop or reorder behaviors without
+// touching handleState; adding one means writing the function and listing
+// it in stateStages. Stages that aren't enabled by their own flag pass the
+// state through. The byte mapping runs last, once per device; its
+// deadzone, curve, mix and slew limit have pipeline counterparts (see
+// stages.go) for when they should apply before the safety stages.
+
+// stateStage transforms the driver's state. Returning nil drops it, and no
+// frame is written for it.
+type stateStage func(h *clientHub, state *protocol.ControllerState) *protocol.ControllerState
+
+// stateStages are the stages -pipeline can name
+var stateStages = map[string]stateStage{
+	"deadzone": (*clientHub).applyDeadzone,
+	"curve":    (*clientHub).applyCurve,
+	"smooth":   (*clientHub).applySmoothing,
+	"script":   (*clientHub).applyScript,
+	"macro":    (*clientHub).macroStage,
+	"cruise":   (*clientHub).applyCruise,
+	"mix":      (*clientHub).applyMix,
+	"slew":     (*clientHub).applySlew,
+	"deadman":  (*clientHub).applyDeadman,
+	"speed":    (*clientHub).applySpeed,
+	"failsafe": (*clientHub).applyFailsafeOverride,
+	"battery":  (*clientHub).applyBattery,
+}
+
+// parsePipeline reads a comma-separated -pipeline. Each stage may appear
+// once.
+func parsePipeline(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := stateStages[name]; !ok {
+			valid := make([]string, 0, len(stateStages))
+			for n := range stateStages {
+				valid = append(valid, n)
+			}
+			slices.Sort(valid)
+			return nil, fmt.Errorf("unknown stage %q (valid: %s)", name, strings.Join(valid, ", "))
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("stage %q listed twice", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// setPipeline installs the named stages, warning about safety stages left
+// out while their flags are set
+func (h *clientHub) setPipeline(names []string) {
+	h.pipeline = make([]stateStage, len(names))
+	for i, name := range names {
+		h.pipeline[i] = stateStages[name]
+	}
+	h.macroRest = nil
+	if i := slices.Index(names, "macro"); i >= 0 {
+		for _, name := range names[i+1:] {
+			stage := stateStages[name]
+			if name == "deadman" {
+				// A step never holds the deadman; the driver's hand does
+				stage = (*clientHub).macroDeadman
+			}
+			h.macroRest = append(h.macroRest, stage)
+		}
+	}
+	if h.deadman != "" && !slices.Contains(names, "deadman") {
+		slog.Warn("-deadman is set but the pipeline has no deadman stage; it won't be enforced", "pipeline", strings.Join(names, ","))
+	}
+	if h.script != nil && !slices.Contains(names, "script") {
+		slog.Warn("-script is set but the pipeline has no script stage; it won't run", "pipeline", strings.Join(names, ","))
+	}
+	if script := slices.Index(names, "script"); h.script != nil && script >= 0 {
+		for _, stage := range []string{"macro", "cruise"} {
+			if i := slices.Index(names, stage); i > script {
+				slog.Warn("The script stage runs before "+stage+"; its rules won't apply to what "+stage+" sends", "pipeline", strings.Join(names, ","))
+			}
+		}
+	}
+	for _, stage := range h.stages.configured() {
+		if !slices.Contains(names, stage) {
+			slog.Warn("stages."+stage+" is set but the pipeline has no "+stage+" stage; it won't run", "pipeline", strings.Join(names, ","))
+		}
+	}
+	if (h.battery.low > 0 || h.battery.critical > 0) && !slices.Contains(names, "battery") {
+		slog.Warn("Battery thresholds are set but the pipeline has no battery stage; they won't be enforced", "pipeline", strings.Join(names, ","))
+	}
+}
+
+// runPipeline passes state through every stage, returning nil if one
+// dropped it
+func (h *clientHub) runPipeline(state *protocol.ControllerState) *protocol.ControllerState {
+	for _, stage := range h.pipeline {
+		if state = stage(h, state); state == nil {
+			return nil
+		}
+	}
+	return state
+}
+
+// runMacroRest passes a macro step through the stages after macro,
+// returning nil if one dropped it
+func (h *clientHub) runMacroRest(state *protocol.ControllerState) *protocol.ControllerState {
+	for _, stage := range h.macroRest {
+		if state = stage(h, state); state == nil {
+			return nil
+		}
+	}
+	return state
+}
+
+// macroStage drops the driver's state while a macro owns the outputs
+func (h *clientHub) macroStage(state *protocol.ControllerState) *protocol.ControllerState {
+	if h.checkMacro(state) {
+		return nil
+	}
+	return state
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Driver policies: what happens when another session tries to drive while
+// the seat is taken
+const (
+	POLICY_SPECTATE = "spectate" // it waits as a spectator until the seat is free
+	POLICY_REJECT   = "reject"   // it is disconnected
+	POLICY_TAKEOVER = "takeover" // it gets the seat after the grace period
+)
+
+// DriverPolicies lists the valid -driver-policy values
+var DriverPolicies = []string{POLICY_SPECTATE, POLICY_REJECT, POLICY_TAKEOVER}
+
+const (
+	TAKEOVER_GRACE = 2 * time.Second // default -takeover-grace
+	TAKEOVER_IDLE  = time.Second     // a contender quiet this long starts over
+)
+
+// ClientsConfig is the server config's clients section
+type ClientsConfig struct {
+	DriverPolicy    string `json:"driver_policy,omitempty"`
+	TakeoverGraceMs int    `json:"takeover_grace_ms,omitempty"`
+	MaxClients      int    `json:"max_clients,omitempty"`
+	ReplayWindowMs  int    `json:"replay_window_ms,omitempty"` // as -replay-window, -1 accepts any timestamp
+}
+
+// checkDriverPolicy returns an error for an unknown policy
+func checkDriverPolicy(policy string) error {
+	for _, p := range DriverPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("driver policy %q is not %s, %s or %s", policy, POLICY_SPECTATE, POLICY_REJECT, POLICY_TAKEOVER)
+}
+
+// contend applies the driver policy to s, which may drive but found the
+// seat taken, and reports whether s should be disconnected. Callers hold
+// h.mu.
+func (h *clientHub) contend(s *clientSession) (reject bool) {
+	switch h.policy {
+	case POLICY_REJECT:
+		slog.Warn("Rejected second driver", "client", s.conn.RemoteAddr(), "driver", h.driver.conn.RemoteAddr())
+		return true
+	case POLICY_TAKEOVER:
+		if s.demoted {
+			return false // lost the seat to takeover, waits like a spectator
+		}
+		now := time.Now()
+		if h.contender != s || now.Sub(h.contendLast) > TAKEOVER_IDLE {
+			h.contender = s
+			h.contendSince = now
+			slog.Warn("Driver takeover requested", "client", s.conn.RemoteAddr(), "driver", h.driver.conn.RemoteAddr(), "grace", h.takeoverGrace)
+		}
+		h.contendLast = now
+		if now.Sub(h.contendSince) >= h.takeoverGrace {
+			old := h.driver
+			old.demoted = true
+			h.driver = s
+			h.contender = nil
+			h.resetDriving("driver taken over")
+			slog.Warn("Driver taken over", "client", s.conn.RemoteAddr(), "from", old.conn.RemoteAddr())
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/serialout"
+)
+
+// runProbe opens the named device's port (the first device's if name is
+// empty) and prints what the board sends until interrupted
+func runProbe(w io.Writer, hub *clientHub, name string) error {
+	var d *serialDevice
+	for _, dev := range hub.devices {
+		if name == "" || dev.name == name {
+			d = dev
+			break
+		}
+	}
+	if d == nil {
+		return fmt.Errorf("no device %q", name)
+	}
+	if d.config.Port == serialout.SERIAL_NONE {
+		return fmt.Errorf("device %q has no serial port", d.name)
+	}
+	port, err := d.openPort()
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	port.SetReadTimeout(100 * time.Millisecond)
+	fmt.Fprintf(w, "Probing %s (%s), Ctrl+C to stop\n", d.name, d.config)
+	if _, err := port.Write(serialout.IdentRequest); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var parser serialout.TelemetryParser
+	buf := make([]byte, 256)
+	for ctx.Err() == nil {
+		n, err := port.Read(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		serialout.WriteHexdump(w, d.name, "RX", buf[:n])
+		frames, acks := parser.Feed(buf[:n])
+		for _, t := range frames {
+			b, _ := json.Marshal(t)
+			fmt.Fprintf(w, "telemetry %s\n", b)
+		}
+		for _, a := range acks {
+			fmt.Fprintf(w, "ack id=%d ok=%t\n", a.ID, a.OK)
+		}
+		if ident := parser.Ident; ident != nil {
+			fmt.Fprintf(w, "firmware %s, config layout %08X\n", ident, formatter.LayoutHash(d.formatter.Current(), d.config.Ack))
+			parser.Ident = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// setProfile switches every device to the named profile. Devices that don't
+// define it fall back to their default bytes; "" selects the defaults
+// everywhere.
+func (h *clientHub) setProfile(name string) error {
+	if name != "" && !h.hasProfile(name) {
+		return fmt.Errorf("no device defines profile %q", name)
+	}
+
+	h.mu.Lock()
+	changed := h.profile != name
+	h.profile = name
+	h.mu.Unlock()
+
+	for _, d := range h.devices {
+		d.formatter.SetProfile(name)
+	}
+	if changed {
+		slog.Info("Profile changed", "profile", name)
+	}
+	return nil
+}
+
+// activeProfile returns the current profile name
+func (h *clientHub) activeProfile() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.profile
+}
+
+// hasProfile reports whether any device's config defines the profile
+func (h *clientHub) hasProfile(name string) bool {
+	for _, d := range h.devices {
+		if formatter.DefinesProfile(d.formatter.Current().Profiles, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProfileCombo switches profile when the driver starts holding a
+// profile's button combo. Only the press is acted on, so holding the combo
+// doesn't keep re-selecting it; when combos overlap the longest one held
+// wins.
+func (h *clientHub) checkProfileCombo(state *protocol.ControllerState) {
+	held, best := "", 0
+	for _, d := range h.devices {
+		for _, p := range d.formatter.Current().Profiles {
+			if len(p.Combo) <= best || !comboHeld(d.formatter, state, p.Combo) {
+				continue
+			}
+			held, best = p.Name, len(p.Combo)
+		}
+	}
+
+	h.mu.Lock()
+	pressed := held != "" && held != h.comboHeld
+	h.comboHeld = held
+	h.mu.Unlock()
+
+	if pressed {
+		h.setProfile(held)
+	}
+}
+
+// comboHeld reports whether every field in combo is non-zero
+func comboHeld(f *formatter.ByteFormatter, state *protocol.ControllerState, combo []string) bool {
+	for _, field := range combo {
+		if f.FieldValue(state, field) == 0 {
+			return false
+		}
+	}
+	return true
+}
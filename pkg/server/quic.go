@@ -0,0 +1,19 @@
+package server
+
+import "time"
+
+// QUIC_STREAM_WAIT is how long a new QUIC connection has to open its stream
+const QUIC_STREAM_WAIT = 10 * time.Second
+
+// QUICConfig holds the -quic flags, or the server config's quic section.
+// QUIC always uses TLS, so a certificate and key are required.
+type QUICConfig struct {
+	Addr string `json:"addr,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// serveQUIC accepts drivers over QUIC until the endpoint fails. It is set
+// by quic_server.go, which needs golang.org/x/net and so is only built in
+// on request (see the README); nil means this server has no QUIC.
+var serveQUIC func(config *QUICConfig, hub *clientHub, access *accessList) error
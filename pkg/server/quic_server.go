@@ -0,0 +1,63 @@
+//go:build quic
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/quic"
+
+	"lunabotics/pkg/protocol"
+)
+
+// QUIC_REFUSED is the application error code sent to a refused client
+const QUIC_REFUSED = 1
+
+func init() {
+	serveQUIC = listenQUIC
+}
+
+// listenQUIC accepts drivers over QUIC. Each connection is one session
+// whose first stream carries the usual frames, so handleClient serves it
+// as it serves a TCP client.
+func listenQUIC(config *QUICConfig, hub *clientHub, access *accessList) error {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return err
+	}
+	endpoint, err := quic.Listen("udp", config.Addr, protocol.QUICConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		return err
+	}
+	slog.Info("QUIC listening", "addr", endpoint.LocalAddr())
+	for {
+		conn, err := endpoint.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go acceptQUIC(conn, hub, access)
+	}
+}
+
+// acceptQUIC checks a new connection against the access list and serves
+// its stream
+func acceptQUIC(conn *quic.Conn, hub *clientHub, access *accessList) {
+	remote := net.UDPAddrFromAddrPort(conn.RemoteAddr())
+	if ok, rule := access.permits(remote); !ok {
+		slog.Warn("Refused connection", "client", remote, "rule", rule, "transport", "quic")
+		conn.Abort(&quic.ApplicationError{Code: QUIC_REFUSED, Reason: "refused by " + rule})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), QUIC_STREAM_WAIT)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		slog.Warn("QUIC client opened no stream", "client", remote, "err", err)
+		conn.Abort(nil)
+		return
+	}
+	handleClient(protocol.NewQUICConn(conn, stream, nil), hub)
+}
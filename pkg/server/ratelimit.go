@@ -0,0 +1,128 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Inbound limits per connection. Any client gets the budget of a fast
+// driver; a sender far beyond it, such as a mock client left at 10 kHz, is
+// cut off before it can starve the real driver of CPU.
+const (
+	PACKET_RATE_LIMIT = 100       // default -max-packet-rate, packets per second
+	BYTE_RATE_LIMIT   = 64 * 1024 // default -max-byte-rate, bytes per second
+	RATE_BURST        = 250 * time.Millisecond
+	FLOOD_STRIKES     = 3 // seconds in a row of dropping more than was let through
+)
+
+// rateLimiter is a pair of token buckets, for packets and bytes, over one
+// client's inbound packets. Packets beyond the budget are dropped
+// unprocessed. A client that has more dropped than let through for
+// FLOOD_STRIKES one-second windows in a row is flooding. Only the reading
+// goroutine uses it, so it has no lock.
+type rateLimiter struct {
+	packetRate, byteRate float64 // per second, 0 for no limit
+	packets, bytes       float64 // tokens
+	maxPacket            int     // largest frame, which must always fit
+	last                 time.Time
+
+	windowStart   time.Time
+	windowAllowed int
+	windowDropped int
+	strikes       int
+}
+
+// newLimiter returns a limiter for one of a session's inbound paths, or nil
+// when the server has no limits
+func (h *clientHub) newLimiter() *rateLimiter {
+	if h.packetRate == 0 && h.byteRate == 0 {
+		return nil
+	}
+	return newRateLimiter(h.packetRate, h.byteRate, h.framing.MaxPacketSize+h.framing.CRCSize()+4)
+}
+
+func newRateLimiter(packetRate, byteRate, maxPacket int) *rateLimiter {
+	l := &rateLimiter{packetRate: float64(packetRate), byteRate: float64(byteRate), maxPacket: maxPacket}
+	l.packets, l.bytes = l.packetBurst(), l.byteBurst()
+	return l
+}
+
+func (l *rateLimiter) packetBurst() float64 {
+	return max(l.packetRate*RATE_BURST.Seconds(), 1)
+}
+
+// byteBurst always fits the largest packet, or it could never pass
+func (l *rateLimiter) byteBurst() float64 {
+	return max(l.byteRate*RATE_BURST.Seconds(), float64(l.maxPacket))
+}
+
+// allow reports whether a packet of n bytes fits the budget, and whether
+// the client is flooding. A nil limiter allows everything.
+func (l *rateLimiter) allow(n int, client net.Addr) (ok, flooding bool) {
+	if l == nil {
+		return true, false
+	}
+	now := time.Now()
+	if !l.last.IsZero() {
+		elapsed := now.Sub(l.last).Seconds()
+		l.packets = min(l.packets+elapsed*l.packetRate, l.packetBurst())
+		l.bytes = min(l.bytes+elapsed*l.byteRate, l.byteBurst())
+	}
+	l.last = now
+
+	ok = (l.packetRate == 0 || l.packets >= 1) && (l.byteRate == 0 || l.bytes >= float64(n))
+	if ok {
+		l.packets--
+		l.bytes -= float64(n)
+		l.windowAllowed++
+	} else {
+		l.windowDropped++
+	}
+
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	if now.Sub(l.windowStart) >= time.Second {
+		if l.windowDropped > 0 {
+			slog.Warn("Client over rate limit, dropping packets", "client", client,
+				"dropped", l.windowDropped, "allowed", l.windowAllowed, "max_packet_rate", l.packetRate, "max_byte_rate", l.byteRate)
+		}
+		if l.windowDropped > l.windowAllowed {
+			l.strikes++
+		} else {
+			l.strikes = 0
+		}
+		l.windowStart, l.windowAllowed, l.windowDropped = now, 0, 0
+	}
+	return ok, l.strikes >= FLOOD_STRIKES
+}
+
+// limit runs a packet of n bytes through the session's connection limiter,
+// whether or not it could be read: garbage costs the same as a state.
+// allowed reports whether the packet may be handled; ok is false once the
+// client is flooding, and the session is closed.
+func (s *clientSession) limit(n int) (allowed, ok bool) {
+	allowed, flooding := s.limiter.allow(n, s.conn.RemoteAddr())
+	if flooding {
+		slog.Warn("Disconnecting flooding client", "client", s.conn.RemoteAddr())
+		s.close("too many packets")
+		return false, false
+	}
+	return allowed, true
+}
+
+// warnBadPacket logs a packet that couldn't be read, at most once a second
+// per client, so a client sending garbage can't flood the log either
+func (s *clientSession) warnBadPacket(msg string, attrs ...any) {
+	s.badSinceLog++
+	if time.Since(s.lastBadLog) < time.Second {
+		return
+	}
+	attrs = append([]any{"client", s.conn.RemoteAddr()}, attrs...)
+	if s.badSinceLog > 1 {
+		attrs = append(attrs, "bad_packets", s.badSinceLog)
+	}
+	slog.Warn(msg, attrs...)
+	s.lastBadLog, s.badSinceLog = time.Now(), 0
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name                 string
+		packetRate, byteRate int
+		maxPacket            int
+		size, sent           int // packets sent at once
+		want                 int // let through
+	}{
+		{"packet burst", 100, 0, 100, 10, 40, 25},
+		{"burst of at least one", 1, 0, 100, 10, 5, 1},
+		{"byte burst", 0, 1000, 100, 100, 5, 2},
+		{"largest packet always fits", 0, 10, 500, 500, 3, 1},
+		{"both limits", 100, 1000, 100, 50, 10, 5},
+		{"within the budget", 100, 64 * 1024, 100, 100, 20, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.packetRate, tt.byteRate, tt.maxPacket)
+			allowed := 0
+			for range tt.sent {
+				if ok, _ := l.allow(tt.size, nil); ok {
+					allowed++
+				}
+			}
+			if allowed != tt.want {
+				t.Fatalf("let %d of %d through, want %d", allowed, tt.sent, tt.want)
+			}
+		})
+	}
+
+	t.Run("no limits", func(t *testing.T) {
+		var l *rateLimiter
+		if ok, flooding := l.allow(1<<20, nil); !ok || flooding {
+			t.Fatal("a nil limiter refused a packet")
+		}
+	})
+
+	t.Run("flooding", func(t *testing.T) {
+		l := newRateLimiter(10, 0, 100)
+		for window := 1; window <= FLOOD_STRIKES; window++ {
+			for range 50 {
+				l.allow(1, nil)
+			}
+			l.windowStart = l.windowStart.Add(-time.Second) // end the window
+			if _, flooding := l.allow(1, nil); flooding != (window == FLOOD_STRIKES) {
+				t.Fatalf("flooding = %v after %d windows over the limit", flooding, window)
+			}
+		}
+	})
+}
+
+// Unreadable packets use up the budget, and an e-stop gets through anyway
+func TestLimitedClient(t *testing.T) {
+	h := newClientHub("")
+	h.packetRate, h.byteRate = 1, 0 // a burst of one packet
+	rejects := make(chan string, 16)
+	h.events.subscribe(func(e *serverEvent) { rejects <- e.Reason }, BUS_PACKET_REJECTED)
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	go handleClient(conn, h)
+
+	send := func(payload string, corrupt bool) {
+		t.Helper()
+		var buf bytes.Buffer
+		h.framing.WritePacket(&buf, []byte(payload))
+		b := buf.Bytes()
+		if corrupt {
+			b[len(b)-1] ^= 0xFF
+		}
+		if _, err := peer.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-rejects:
+			if got != want {
+				t.Fatalf("rejected as %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s reject", want)
+		}
+	}
+
+	send(`{"type":"ping"}`, true)
+	expect(REJECT_CRC)
+	send(`{"type":"ping"}`, false)
+	expect(REJECT_RATE_LIMITED)
+	send(`{"type":"estop","reason":"test"}`, false)
+	send(`{"type":"ping"}`, false)
+	expect(REJECT_RATE_LIMITED)
+	if !h.estopped() {
+		t.Fatal("the rate limiter dropped an e-stop")
+	}
+}
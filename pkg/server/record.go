@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// REPLAY_CONNECT_WAIT is how long a replay waits for the Arduinos to open
+// (and finish resetting) before it starts writing frames
+const REPLAY_CONNECT_WAIT = 3 * time.Second
+
+// Session recordings (.ctl files) are JSON lines, one per controller state
+// the driver sent: when it arrived, the state as received and the frame each
+// device was given for it, before serial framing.
+type ctlRecord struct {
+	Time   time.Time                 `json:"time"`
+	State  *protocol.ControllerState `json:"state"`
+	Frames []ctlFrame                `json:"frames"`
+}
+
+// ctlFrame is one device's frame in a recording, as hex
+type ctlFrame struct {
+	Device string `json:"device"`
+	Bytes  string `json:"bytes"`
+}
+
+// sessionRecorder appends records to a .ctl file
+type sessionRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// newSessionRecorder opens filename for appending, so restarting the server
+// with the same -record file keeps the earlier session
+func newSessionRecorder(filename string) (*sessionRecorder, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionRecorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// record writes one state and the frames produced for it
+func (r *sessionRecorder) record(state *protocol.ControllerState, devices []*serialDevice, frames [][]byte) {
+	rec := ctlRecord{Time: time.Now(), State: state, Frames: make([]ctlFrame, len(frames))}
+	for i, frame := range frames {
+		rec.Frames[i] = ctlFrame{Device: devices[i].name, Bytes: fmt.Sprintf("% X", frame)}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(&rec); err != nil {
+		slog.Error("Recording write error", "err", err)
+	}
+}
+
+// Close flushes and closes the file
+func (r *sessionRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// subscribe records every state the Arduinos are given, except those
+// played back from a recording
+func (r *sessionRecorder) subscribe(h *clientHub) {
+	h.events.subscribe(func(e *serverEvent) {
+		if !e.Replay {
+			r.record(e.State, h.devices, e.Frames)
+		}
+	}, BUS_OUTPUT)
+}
+
+// loadRecording reads every record of a .ctl file
+func loadRecording(filename string) ([]ctlRecord, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []ctlRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec ctlRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: no records", filename)
+	}
+	return records, nil
+}
+
+// replay plays records back with their original timing: each device gets
+// the recorded frame under its name, and every connected client sees the
+// recorded state in a replay frame and the bytes in its status. Live
+// driving is refused while it runs, and an e-stop still holds the failsafe
+// frame. The failsafe frame is sent once the recording ends.
+func (h *clientHub) replay(records []ctlRecord) {
+	h.mu.Lock()
+	h.replaying = true
+	h.mu.Unlock()
+	defer h.endReplay()
+	defer h.blackbox.dumpOnPanic()
+
+	h.waitConnected(ms(timeouts().ReplayConnectMs))
+
+	index := make(map[string]int, len(h.devices))
+	for i, d := range h.devices {
+		index[d.name] = i
+	}
+	missing := make(map[string]bool)
+
+	first := records[0].Time
+	start := time.Now()
+	slog.Info("Replaying", "states", len(records), "recorded", first.Format(time.DateTime),
+		"duration", records[len(records)-1].Time.Sub(first).Round(time.Millisecond))
+
+	for n, rec := range records {
+		time.Sleep(time.Until(start.Add(rec.Time.Sub(first))))
+
+		frames := make([][]byte, len(h.devices))
+		for _, f := range rec.Frames {
+			i, ok := index[f.Device]
+			if !ok {
+				if !missing[f.Device] {
+					slog.Warn("Replay: no such device, skipping its frames", "device", f.Device)
+					missing[f.Device] = true
+				}
+				continue
+			}
+			frame, err := formatter.ParseHexFrame(f.Bytes)
+			if err != nil {
+				slog.Warn("Replay: bad frame", "record", n+1, "device", f.Device, "err", err)
+				continue
+			}
+			frames[i] = frame
+		}
+
+		if !h.estopped() {
+			for i, d := range h.devices {
+				if frames[i] != nil {
+					d.submit(frames[i])
+				}
+			}
+		}
+		h.publish(&serverEvent{Kind: BUS_OUTPUT, State: rec.State, Frames: frames, Replay: true})
+		h.broadcastReplay(&protocol.ReplayFrame{Type: protocol.MsgReplay, Time: rec.Time.UnixMilli(), State: rec.State}, frames)
+	}
+	slog.Info("Replay finished")
+}
+
+// waitConnected waits up to timeout for every device's port to open
+func (h *clientHub) waitConnected(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		connected := true
+		for _, d := range h.devices {
+			connected = connected && d.connected()
+		}
+		if connected {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// endReplay sends the failsafe frame and hands the robot back to live
+// clients
+func (h *clientHub) endReplay() {
+	for _, d := range h.devices {
+		d.formatter.ResetSlew()
+		d.submit(d.formatter.Format(FailsafeState()))
+	}
+	time.Sleep(time.Second / ESTOP_RATE_HZ) // let the writers send it
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.replaying = false
+}
+
+// broadcastReplay hands a replayed state and its frames to every session
+func (h *clientHub) broadcastReplay(r *protocol.ReplayFrame, frames [][]byte) {
+	h.mu.Lock()
+	sessions := make([]*clientSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.mu.Lock()
+		s.replay = r
+		s.outputs = frames
+		s.mu.Unlock()
+	}
+}
+
+// takeReplay returns a replay frame that hasn't been relayed yet, or nil
+func (s *clientSession) takeReplay() *protocol.ReplayFrame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.replay
+	s.replay = nil
+	return r
+}
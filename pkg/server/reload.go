@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"lunabotics/pkg/formatter"
+)
+
+const CONFIG_POLL_INTERVAL = time.Second
+
+// watchConfig reloads the byte mapping config on SIGHUP or whenever the
+// file's modification time changes. A config that fails to load or validate
+// is logged and the running mapping is kept.
+func watchConfig(filename, format string, hub *clientHub) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(CONFIG_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	lastMod := modTime(filename)
+	for {
+		select {
+		case <-hup:
+			slog.Info("SIGHUP, reloading", "file", filename)
+		case <-ticker.C:
+			mod := modTime(filename)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			slog.Info("Config changed, reloading", "file", filename)
+		}
+
+		if err := hub.reloadConfig(filename, format); err != nil {
+			slog.Error("Config reload failed, keeping current mapping", "err", err)
+		}
+	}
+}
+
+// modTime returns a file's modification time, or the zero time if it can't
+// be read
+func modTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig loads filename (in format, as for LoadConfig) and swaps
+// every device's byte mapping in one step. The device list must be
+// unchanged; serial settings are only read at startup.
+func (h *clientHub) reloadConfig(filename, format string) error {
+	config, err := formatter.LoadConfig(filename, format)
+	if err != nil {
+		return err
+	}
+
+	devices := config.OutputDevices()
+	if len(devices) != len(h.devices) {
+		return fmt.Errorf("device count changed from %d to %d, restart to apply", len(h.devices), len(devices))
+	}
+	for i, dev := range devices {
+		if dev.Name != h.devices[i].name {
+			return fmt.Errorf("device %d renamed from %q to %q, restart to apply", i, h.devices[i].name, dev.Name)
+		}
+	}
+
+	if err := h.checkFirmwareLayouts(devices); err != nil {
+		return err
+	}
+
+	for i, dev := range devices {
+		config := dev.ByteConfig
+		h.devices[i].formatter.SetConfig(&config)
+		slog.Info("Reloaded mapping", "device", dev.Name, "bytes", dev.OutputSize)
+	}
+	h.setMacros(config.Macros)
+	h.mu.Lock()
+	driver := h.driver
+	h.mu.Unlock()
+	if driver != nil {
+		h.checkGamepad(driver)
+	}
+	return nil
+}
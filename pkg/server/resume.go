@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// RESUME_WINDOW is how long a driver whose connection dropped keeps the
+// seat, by default
+const RESUME_WINDOW = 10 * time.Second
+
+// heldSeat is the driver seat kept for a driver whose connection dropped,
+// with what the reconnecting client gets back
+type heldSeat struct {
+	token   string
+	profile string
+	lastSeq uint64
+	until   time.Time
+}
+
+// Every client that lists CAP_RESUME in its hello gets a resume token in
+// the answer. If the driver's connection drops, the seat is held for it for
+// timeouts().ResumeMs: the robot stops as usual, but nobody else can drive
+// and the Arduinos stay open. A client that reconnects in time and presents
+// the token in its new hello is the driver again straight away, with its
+// profile and state numbering, instead of starting over as a spectator.
+// It can also present the token before the server has noticed the old
+// connection die, which is then closed.
+
+// issueResume gives s a fresh resume token
+func (h *clientHub) issueResume(s *clientSession) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	s.resume = token
+	s.mu.Unlock()
+	return token
+}
+
+// holdSeat keeps the seat for s, the driver, which is leaving with the
+// given resume token and last state number. Callers hold h.mu.
+func (h *clientHub) holdSeat(s *clientSession, token string, lastSeq uint64) {
+	seat := &heldSeat{token: token, profile: h.profile, lastSeq: lastSeq, until: time.Now().Add(ms(timeouts().ResumeMs))}
+	if seat.token == "" || h.closing || timeouts().ResumeMs <= 0 {
+		return
+	}
+	h.held = seat
+	slog.Info("Holding driver seat for reconnect", "client", s.conn.RemoteAddr(), "for", ms(timeouts().ResumeMs))
+	time.AfterFunc(ms(timeouts().ResumeMs), func() { h.releaseSeat(seat) })
+}
+
+// releaseSeat gives up a held seat nobody resumed, idling the Arduinos if
+// everyone has gone
+func (h *clientHub) releaseSeat(seat *heldSeat) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held != seat {
+		return // resumed
+	}
+	h.held = nil
+	slog.Info("Driver didn't reconnect, seat released")
+	if len(h.sessions) == 0 && !h.replaying && h.autonomyConn == nil {
+		for _, d := range h.devices {
+			d.idle()
+		}
+	}
+}
+
+// seatHeld reports whether the seat is being kept for a driver that
+// dropped. Callers hold h.mu.
+func (h *clientHub) seatHeld() bool {
+	return h.held != nil && time.Now().Before(h.held.until)
+}
+
+// resume makes s the driver again if token is the driver's, whether its
+// seat is being held or its old connection is still open, and reports
+// whether it did
+func (h *clientHub) resume(s *clientSession, token string) bool {
+	if token == "" {
+		return false
+	}
+	// Sessions are looked at with h.mu released, as it can't be held while
+	// locking one
+	h.mu.Lock()
+	others := make([]*clientSession, 0, len(h.sessions))
+	for o := range h.sessions {
+		if o != s {
+			others = append(others, o)
+		}
+	}
+	h.mu.Unlock()
+
+	var old *clientSession
+	var oldSeq uint64
+	for _, o := range others {
+		o.mu.Lock()
+		if o.resume == token {
+			old, oldSeq = o, o.lastSeq
+		}
+		o.mu.Unlock()
+		if old != nil {
+			break
+		}
+	}
+
+	h.mu.Lock()
+	var profile string
+	var lastSeq uint64
+	_, joined := h.sessions[old] // it may have left since, holding the seat
+	switch {
+	case old != nil && joined && h.driver == old:
+		profile, lastSeq = h.profile, oldSeq
+	case (old == nil || !joined) && h.seatHeld() && h.held.token == token:
+		profile, lastSeq = h.held.profile, h.held.lastSeq
+		h.held = nil
+	default:
+		h.mu.Unlock()
+		return false
+	}
+	if h.driver != s {
+		h.resetDriving("driver resumed")
+	}
+	h.driver = s
+	s.demoted = false
+	h.heardDriver()
+	h.mu.Unlock()
+
+	if old != nil {
+		old.mu.Lock()
+		old.resume = ""
+		old.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.authorized = true
+	s.lastSeq = lastSeq
+	s.mu.Unlock()
+
+	slog.Info("Driver resumed", "client", s.conn.RemoteAddr(), "profile", profile)
+	if old != nil {
+		old.close("resumed on a new connection")
+	}
+	if profile != h.activeProfile() {
+		if err := h.setProfile(profile); err != nil {
+			slog.Warn("Profile restore failed", "client", s.conn.RemoteAddr(), "err", err)
+		}
+	}
+	return true
+}
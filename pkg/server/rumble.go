@@ -0,0 +1,68 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Rumble feedback. A driver whose client lists CAP_RUMBLE feels trouble
+// through the gamepad without looking at a screen: the e-stop latching, a
+// failsafe, a CRC storm on the link or a motor stall each rumble it in
+// their own pattern, harder for the worse ones. There is at most one
+// rumble per RUMBLE_COOLDOWN, so an e-stop (published as a failsafe too)
+// or a burst of stalls is felt once.
+const RUMBLE_COOLDOWN = time.Second
+
+// rumblePatterns are the rumbles for each event
+var rumblePatterns = map[string]protocol.RumbleFrame{
+	BUS_ESTOP:       {Strong: 1, Weak: 1, DurationMs: 1000},
+	BUS_FAILSAFE:    {Strong: 0.8, Weak: 0.4, DurationMs: 600},
+	BUS_CRC_STORM:   {Weak: 0.7, DurationMs: 300},
+	BUS_MOTOR_STALL: {Strong: 0.5, Weak: 0.5, DurationMs: 400},
+}
+
+// rumbleCooldown spaces rumbles RUMBLE_COOLDOWN apart
+type rumbleCooldown struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// ready reports whether a rumble may go out now, and if so starts the
+// cooldown
+func (c *rumbleCooldown) ready(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.last) < RUMBLE_COOLDOWN {
+		return false
+	}
+	c.last = now
+	return true
+}
+
+// rumble sends the event's pattern to the driver, if its client can rumble
+func (h *clientHub) rumble(e *serverEvent) {
+	h.mu.Lock()
+	driver := h.driver
+	h.mu.Unlock()
+	if driver == nil {
+		return
+	}
+	driver.mu.Lock()
+	canRumble := slices.Contains(driver.caps, protocol.CAP_RUMBLE)
+	driver.mu.Unlock()
+	if !canRumble || !h.rumbled.ready(e.Time) {
+		return
+	}
+
+	frame := rumblePatterns[e.Kind]
+	frame.Type = protocol.MsgRumble
+	frame.Event = e.Kind
+	b, err := driver.encode(&frame)
+	if err != nil {
+		return
+	}
+	go driver.send(b) // handlers mustn't wait on a slow client
+}
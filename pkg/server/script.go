@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// A -script file holds control rules the pit crew can change on the robot
+// without rebuilding the server, one per line:
+//
+//	# stop digging once the bucket's limit switch closes
+//	RT = 0 if bit(limits, 0)
+//	LjoyY = 127 + (LjoyY - 127) / 2 if bucket_deg > 40
+//
+// Each rule assigns an expression (the same language as "expr" bytes) to
+// a ControllerState field, optionally only while the condition after "if"
+// is non-zero. Rules run top to bottom on every driver state in the
+// script pipeline stage, each seeing the fields as the rules above left
+// them. The stage comes after macro and cruise by default, so a rule like
+// the one above also stops a macro step or a latched trigger. Besides the fields, expressions can read the Arduinos' latest
+// telemetry: battery_v, battery_a, motor_a0, motor_a1, ..., limits,
+// bucket_deg, roll, pitch, yaw, ax, ay and az (0 until reported). With
+// several Arduinos, the first device in the config that reports a sensor
+// provides it. The file is reloaded when it changes; a version with
+// mistakes is logged and the running rules are kept.
+
+// scriptTelemetry are the telemetry names scripts may read, apart from
+// motor_aN
+var scriptTelemetry = []string{"battery_v", "battery_a", "limits", "bucket_deg", "roll", "pitch", "yaw", "ax", "ay", "az"}
+
+// stateScript is a compiled -script file
+type stateScript struct {
+	rules []scriptRule
+}
+
+// scriptRule is one "FIELD = EXPR [if COND]" line
+type scriptRule struct {
+	field string
+	value formatter.Expr
+	cond  formatter.Expr // nil to always apply
+}
+
+// isScriptName reports whether name may appear in a script expression
+func isScriptName(name string) bool {
+	if formatter.IsStateField(name) {
+		return true
+	}
+	for _, t := range scriptTelemetry {
+		if t == name {
+			return true
+		}
+	}
+	n, ok := strings.CutPrefix(name, "motor_a")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(n)
+	return err == nil
+}
+
+// isScriptTarget reports whether a rule may assign field
+func isScriptTarget(field string) bool {
+	return formatter.IsStateField(field) && field != "mixL" && field != "mixR"
+}
+
+// loadScript reads and compiles a -script file, reporting every bad line
+// in a *ConfigError
+func loadScript(filename string) (*stateScript, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	script := &stateScript{}
+	var problems []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseScriptRule(line)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", n, err))
+			continue
+		}
+		script.rules = append(script.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &formatter.ConfigError{File: filename, Problems: problems}
+	}
+	return script, nil
+}
+
+// parseScriptRule compiles one rule
+func parseScriptRule(line string) (scriptRule, error) {
+	field, rhs, ok := strings.Cut(line, "=")
+	if !ok || strings.HasPrefix(rhs, "=") {
+		return scriptRule{}, fmt.Errorf("want FIELD = EXPR [if COND]")
+	}
+	rule := scriptRule{field: strings.TrimSpace(field)}
+	if !isScriptTarget(rule.field) {
+		return scriptRule{}, fmt.Errorf("can't assign %q; it isn't a ControllerState field", rule.field)
+	}
+	value, cond, hasCond := strings.Cut(rhs, " if ")
+	var err error
+	if rule.value, err = formatter.CompileExprNames(value, isScriptName); err != nil {
+		return scriptRule{}, err
+	}
+	if hasCond {
+		if rule.cond, err = formatter.CompileExprNames(cond, isScriptName); err != nil {
+			return scriptRule{}, fmt.Errorf("if: %w", err)
+		}
+	}
+	return rule, nil
+}
+
+// setScript replaces the running rules; nil turns scripting off
+func (h *clientHub) setScript(script *stateScript) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.script = script
+}
+
+// applyScript runs the script's rules over a copy of the driver's state
+func (h *clientHub) applyScript(state *protocol.ControllerState) *protocol.ControllerState {
+	h.mu.Lock()
+	script := h.script
+	h.mu.Unlock()
+	if script == nil {
+		return state
+	}
+
+	out := *state
+	lookup := h.scriptLookup(&out)
+	for _, rule := range script.rules {
+		if rule.cond != nil && rule.cond.Eval(lookup) == 0 {
+			continue
+		}
+		setStateField(&out, rule.field, rule.value.Eval(lookup))
+	}
+	return &out
+}
+
+// scriptLookup resolves the names in a script expression against state
+// and the latest telemetry
+func (h *clientHub) scriptLookup(state *protocol.ControllerState) func(string) float64 {
+	telemetry := h.scriptTelemetry()
+	var f formatter.ByteFormatter
+	return func(name string) float64 {
+		if v, ok := telemetry[name]; ok {
+			return v
+		}
+		switch name {
+		case "dX":
+			return float64(state.DPadX)
+		case "dY":
+			return float64(state.DPadY)
+		}
+		return float64(f.FieldValue(state, name))
+	}
+}
+
+// scriptTelemetry returns the telemetry names scripts read, from the first
+// device reporting each sensor
+func (h *clientHub) scriptTelemetry() map[string]float64 {
+	vars := make(map[string]float64)
+	set := func(name string, v float64) {
+		if _, ok := vars[name]; !ok {
+			vars[name] = v
+		}
+	}
+	for _, d := range h.devices {
+		t := d.latestTelemetry()
+		if t == nil {
+			continue
+		}
+		set("battery_v", t.BatteryVolts)
+		set("limits", float64(t.LimitSwitches))
+		for i, amps := range t.MotorCurrents {
+			set("motor_a"+strconv.Itoa(i), amps)
+		}
+		if t.BatteryAmps != nil {
+			set("battery_a", *t.BatteryAmps)
+		}
+		if t.BucketAngle != nil {
+			set("bucket_deg", *t.BucketAngle)
+		}
+		if imu := t.IMU; imu != nil {
+			set("roll", imu.Roll)
+			set("pitch", imu.Pitch)
+			set("yaw", imu.Yaw)
+			set("ax", imu.AccelX)
+			set("ay", imu.AccelY)
+			set("az", imu.AccelZ)
+		}
+	}
+	return vars
+}
+
+// setStateField stores a rule's result in field, rounded and clamped to
+// the field's range. Assigning an axis drops its full-resolution value.
+func setStateField(state *protocol.ControllerState, field string, v float64) {
+	v = math.Round(v)
+	b := uint8(math.Max(0, math.Min(255, v)))
+	dpad := int8(math.Max(-1, math.Min(1, v)))
+	switch field {
+	case "N":
+		state.North = b
+	case "E":
+		state.East = b
+	case "S":
+		state.South = b
+	case "W":
+		state.West = b
+	case "LB":
+		state.LeftBumper = b
+	case "RB":
+		state.RightBumper = b
+	case "LS":
+		state.LeftStick = b
+	case "RS":
+		state.RightStick = b
+	case "SELECT":
+		state.Select = b
+	case "START":
+		state.Start = b
+	case "LjoyX":
+		state.LeftX, state.LeftX16 = b, 0
+	case "LjoyY":
+		state.LeftY, state.LeftY16 = b, 0
+	case "RjoyX":
+		state.RightX, state.RightX16 = b, 0
+	case "RjoyY":
+		state.RightY, state.RightY16 = b, 0
+	case "LT":
+		state.LeftTrigger, state.LeftTrigger16 = b, 0
+	case "RT":
+		state.RightTrigger, state.RightTrigger16 = b, 0
+	case "dX":
+		state.DPadX = dpad
+	case "dY":
+		state.DPadY = dpad
+	}
+}
+
+// watchScript reloads the -script file whenever its modification time
+// changes
+func watchScript(filename string, hub *clientHub) {
+	ticker := time.NewTicker(CONFIG_POLL_INTERVAL)
+	defer ticker.Stop()
+	lastMod := modTime(filename)
+	for range ticker.C {
+		mod := modTime(filename)
+		if mod.Equal(lastMod) {
+			continue
+		}
+		lastMod = mod
+		script, err := loadScript(filename)
+		if err != nil {
+			slog.Error("Script reload failed, keeping current rules", "err", err)
+			continue
+		}
+		hub.setScript(script)
+		slog.Info("Reloaded script", "file", filename, "rules", len(script.rules))
+	}
+}
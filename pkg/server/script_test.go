@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+func TestParseScriptRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		problem string // substring of the error, "" for none
+	}{
+		{"RT = 0 if bit(limits, 0)", ""},
+		{"LjoyY = 127 + (LjoyY - 127) / 2 if bucket_deg > 40", ""},
+		{"dX = -1 if motor_a3 > 20", ""},
+		{"  N = START  ", ""},
+		{"RT 0", "want FIELD = EXPR"},
+		{"RT == 0", "want FIELD = EXPR"},
+		{"mixL = 10", "can't assign"},
+		{"battery_v = 10", "can't assign"},
+		{"RT = nope", "nope"},
+		{"RT = 0 if (", "if:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			_, err := parseScriptRule(tt.line)
+			if tt.problem == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Fatalf("err = %v, want one mentioning %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestLoadScript(t *testing.T) {
+	write := func(t *testing.T, text string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "rules.txt")
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	script, err := loadScript(write(t, "# comment\n\nRT = 0 if START\n  LT = LT / 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script.rules) != 2 || script.rules[0].field != "RT" || script.rules[1].field != "LT" {
+		t.Fatalf("rules = %+v, want RT then LT", script.rules)
+	}
+
+	_, err = loadScript(write(t, "RT = 0\nRT 0\n# fine\nmixR = 1\n"))
+	var config *formatter.ConfigError
+	if !errors.As(err, &config) {
+		t.Fatalf("err = %v, want a *ConfigError", err)
+	}
+	if len(config.Problems) != 2 || !strings.HasPrefix(config.Problems[0], "line 2:") || !strings.HasPrefix(config.Problems[1], "line 4:") {
+		t.Fatalf("problems = %q, want lines 2 and 4", config.Problems)
+	}
+
+	if _, err := loadScript(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("loaded a file that doesn't exist")
+	}
+}
+
+func TestSetStateField(t *testing.T) {
+	tests := []struct {
+		field string
+		v     float64
+		check func(*protocol.ControllerState) bool
+	}{
+		{"RT", 99.6, func(s *protocol.ControllerState) bool { return s.RightTrigger == 100 }},
+		{"RT", 300, func(s *protocol.ControllerState) bool { return s.RightTrigger == 255 }},
+		{"RT", -5, func(s *protocol.ControllerState) bool { return s.RightTrigger == 0 }},
+		{"LjoyY", 200, func(s *protocol.ControllerState) bool { return s.LeftY == 200 && s.LeftY16 == 0 }},
+		{"RjoyX", 10, func(s *protocol.ControllerState) bool { return s.RightX == 10 && s.RightX16 == 0 }},
+		{"LT", 40, func(s *protocol.ControllerState) bool { return s.LeftTrigger == 40 && s.LeftTrigger16 == 0 }},
+		{"SELECT", 1, func(s *protocol.ControllerState) bool { return s.Select == 1 }},
+		{"dX", -7, func(s *protocol.ControllerState) bool { return s.DPadX == -1 }},
+		{"dY", 0.4, func(s *protocol.ControllerState) bool { return s.DPadY == 0 }},
+		{"dY", 3, func(s *protocol.ControllerState) bool { return s.DPadY == 1 }},
+	}
+	for _, tt := range tests {
+		state := protocol.ControllerState{LeftY16: 0xFFFF, RightX16: 0xFFFF, LeftTrigger16: 0xFFFF}
+		setStateField(&state, tt.field, tt.v)
+		if !tt.check(&state) {
+			t.Errorf("%s = %g gave %+v", tt.field, tt.v, state)
+		}
+	}
+}
+
+// A rule that stops the bucket must hold against a latched cruise trigger
+func TestScriptAfterCruise(t *testing.T) {
+	rule, err := parseScriptRule("RT = 0 if START")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newClientHub("")
+	h.cruiseButton = "E"
+	h.setScript(&stateScript{rules: []scriptRule{rule}})
+	drive := func(s protocol.ControllerState) *protocol.ControllerState {
+		h.checkCruiseButton(&s)
+		return h.runPipeline(&s)
+	}
+	rest := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER,
+		RightX: protocol.AXIS_CENTER, RightY: protocol.AXIS_CENTER}
+	latch := rest
+	latch.RightTrigger, latch.East = 200, 1
+	if out := drive(latch); out.RightTrigger != 200 {
+		t.Fatalf("RT %d, want the latched 200", out.RightTrigger)
+	}
+	limit := rest
+	limit.Start = 1
+	if out := drive(limit); out.RightTrigger != 0 {
+		t.Fatalf("RT %d with the rule's condition true, want 0", out.RightTrigger)
+	}
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+	"lunabotics/pkg/serialout"
+)
+
+// ServerConfig is the -server-config file: everything about how the server
+// runs, as opposed to the byte mapping it loads from ByteConfig. It may be
+// JSON, YAML or TOML like the byte config. Command-line flags override it.
+type ServerConfig struct {
+	Listen           string                  `json:"listen,omitempty"` // as -listen, instead of -port/-public
+	DriverToken      string                  `json:"driver_token,omitempty"`
+	Deadman          string                  `json:"deadman,omitempty"`
+	CruiseButton     string                  `json:"cruise_button,omitempty"`
+	Smoothing        SmoothingConfig         `json:"smoothing,omitempty"`
+	Stages           StagesConfig            `json:"stages"`
+	Pipeline         []string                `json:"pipeline,omitempty"`    // stage names, as -pipeline
+	Script           string                  `json:"script,omitempty"`      // relative to this file
+	ByteConfig       string                  `json:"byte_config,omitempty"` // relative to this file
+	ByteConfigFormat string                  `json:"byte_config_format,omitempty"`
+	Serial           *serialout.SerialConfig `json:"serial,omitempty"`   // defaults for every device
+	Failsafe         json.RawMessage         `json:"failsafe,omitempty"` // ControllerState fields; the rest stay neutral
+	Transport        TransportConfig         `json:"transport"`
+	Clients          ClientsConfig           `json:"clients"`
+	Access           AccessConfig            `json:"access"`
+	Timeouts         TimeoutConfig           `json:"timeouts"`
+	Log              LogConfig               `json:"log"`
+	Metrics          string                  `json:"metrics,omitempty"`
+	Dashboard        string                  `json:"dashboard,omitempty"`
+	API              string                  `json:"api,omitempty"`
+	GRPC             GRPCConfig              `json:"grpc"`
+	QUIC             QUICConfig              `json:"quic"`
+	MQTT             MQTTConfig              `json:"mqtt"`
+	MDNSName         string                  `json:"mdns_name,omitempty"`
+	Record           string                  `json:"record,omitempty"`
+	BlackBox         BlackBoxConfig          `json:"blackbox"`
+	Battery          BatteryConfig           `json:"battery"`
+	Motors           MotorsConfig            `json:"motors"`
+	Autonomy         AutonomyConfig          `json:"autonomy"`
+	Speed            SpeedConfig             `json:"speed"`
+
+	Alarms []AlarmConfig `json:"alarms,omitempty"` // see alarm.go
+}
+
+// TransportConfig tunes the client-facing TCP side
+type TransportConfig struct {
+	MaxRate      int    `json:"max_rate,omitempty"`       // as -max-rate
+	StatusRateHz int    `json:"status_rate_hz,omitempty"` // status frames per second to each client
+	KeepAliveSec int    `json:"keepalive_sec,omitempty"`  // TCP keepalive period, -1 disables
+	NoDelay      *bool  `json:"no_delay,omitempty"`       // disable Nagle (the default)
+	UDPLink      string `json:"udp_link,omitempty"`       // as -udp-link
+
+	// Inbound limits per client, as -max-packet-rate and -max-byte-rate;
+	// -1 removes the limit
+	MaxPacketRate int `json:"max_packet_rate,omitempty"`
+	MaxByteRate   int `json:"max_byte_rate,omitempty"`
+
+	// Packet framing, as -max-packet-size and -crc; clients must match
+	MaxPacketSize int    `json:"max_packet_size,omitempty"`
+	CRC           string `json:"crc,omitempty"`
+}
+
+// TimeoutConfig holds the server's timeouts in milliseconds. Zero keeps
+// the built-in value.
+type TimeoutConfig struct {
+	ShutdownMs      int `json:"shutdown_ms,omitempty"`
+	StatusWriteMs   int `json:"status_write_ms,omitempty"`
+	ReconnectMinMs  int `json:"reconnect_min_ms,omitempty"`
+	ReconnectMaxMs  int `json:"reconnect_max_ms,omitempty"`
+	ReplayConnectMs int `json:"replay_connect_ms,omitempty"`
+	ResumeMs        int `json:"resume_ms,omitempty"` // how long a dropped driver's seat is held, -1 not at all
+}
+
+// defaultTimeouts are the built-in timeouts
+var defaultTimeouts = TimeoutConfig{
+	ShutdownMs:      int(SHUTDOWN_TIMEOUT / time.Millisecond),
+	StatusWriteMs:   1000,
+	ReconnectMinMs:  int(RECONNECT_MIN_BACKOFF / time.Millisecond),
+	ReconnectMaxMs:  int(RECONNECT_MAX_BACKOFF / time.Millisecond),
+	ReplayConnectMs: int(REPLAY_CONNECT_WAIT / time.Millisecond),
+	ResumeMs:        int(RESUME_WINDOW / time.Millisecond),
+}
+
+// liveTimeouts replaces defaultTimeouts once the server config is applied.
+// Device writers and sessions read it from their own goroutines.
+var liveTimeouts atomic.Pointer[TimeoutConfig]
+
+// timeouts returns the effective timeouts, built-in values unless the
+// server config changes them. Callers must not modify them.
+func timeouts() *TimeoutConfig {
+	if t := liveTimeouts.Load(); t != nil {
+		return t
+	}
+	return &defaultTimeouts
+}
+
+// ms converts a millisecond setting to a duration
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// liveFailsafe is what the Arduinos are sent whenever the robot must stop
+// (e-stop, deadman release, reconnects and shutdown) when the server config
+// sets it, nil for the neutral state
+var liveFailsafe atomic.Pointer[protocol.ControllerState]
+
+// FailsafeState returns a copy of the configured failsafe input
+func FailsafeState() *protocol.ControllerState {
+	if p := liveFailsafe.Load(); p != nil {
+		state := *p
+		return &state
+	}
+	return formatter.NeutralState()
+}
+
+// LoadServerConfig reads and checks a server config. format is as for
+// LoadConfig.
+func LoadServerConfig(filename, format string) (*ServerConfig, error) {
+	format, err := formatter.ConfigFormat(filename, format)
+	if err != nil {
+		return nil, &formatter.ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	jsonData, err := formatter.ConfigToJSON(data, format)
+	if err != nil {
+		return nil, &formatter.ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+
+	var config ServerConfig
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		if format == formatter.CONFIG_JSON {
+			err = formatter.DescribeJSONError(data, err)
+		}
+		return nil, &formatter.ConfigError{File: filename, Problems: []string{err.Error()}}
+	}
+
+	if config.ByteConfig != "" && !filepath.IsAbs(config.ByteConfig) {
+		config.ByteConfig = filepath.Join(filepath.Dir(filename), config.ByteConfig)
+	}
+	if config.Script != "" && !filepath.IsAbs(config.Script) {
+		config.Script = filepath.Join(filepath.Dir(filename), config.Script)
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, &formatter.ConfigError{File: filename, Problems: problems}
+	}
+	return &config, nil
+}
+
+// validate returns one line per problem
+func (c *ServerConfig) validate() []string {
+	var problems []string
+	if c.Listen != "" {
+		if err := checkListenAddr(c.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("listen: %v", err))
+		}
+	}
+	if c.Deadman != "" {
+		if err := protocol.CheckDeadman(c.Deadman); err != nil {
+			problems = append(problems, "deadman: "+err.Error())
+		}
+	}
+	if c.Serial != nil {
+		merged := serialout.DefaultSerialConfig()
+		merged.Merge(c.Serial)
+		if _, err := merged.Mode(); err != nil {
+			problems = append(problems, fmt.Sprintf("serial: %v", err))
+		}
+		if err := serialout.CheckOutputs(merged.Outputs); err != nil {
+			problems = append(problems, fmt.Sprintf("serial: %v", err))
+		}
+	}
+	if len(c.Failsafe) > 0 {
+		if _, err := c.failsafe(); err != nil {
+			problems = append(problems, fmt.Sprintf("failsafe: %v", err))
+		}
+	}
+	if c.Clients.DriverPolicy != "" {
+		if err := checkDriverPolicy(c.Clients.DriverPolicy); err != nil {
+			problems = append(problems, "clients: "+err.Error())
+		}
+	}
+	if c.Clients.TakeoverGraceMs < 0 || c.Clients.MaxClients < 0 {
+		problems = append(problems, "clients: takeover_grace_ms and max_clients can't be negative")
+	}
+	if b := c.Battery; b.LowVolts < 0 || b.CriticalVolts < 0 || b.LowScale < 0 || b.LowScale > 1 {
+		problems = append(problems, "battery: volts can't be negative and low_scale must be between 0 and 1")
+	}
+	if c.Motors.StallAmps < 0 {
+		problems = append(problems, "motors: stall_amps can't be negative")
+	}
+	if len(c.Pipeline) > 0 {
+		if _, err := parsePipeline(strings.Join(c.Pipeline, ",")); err != nil {
+			problems = append(problems, fmt.Sprintf("pipeline: %v", err))
+		}
+	}
+	problems = append(problems, c.Stages.problems()...)
+	if _, err := parseSmoothing(formatSmoothing(c.Smoothing)); err != nil {
+		problems = append(problems, fmt.Sprintf("smoothing: %v", err))
+	}
+	if c.CruiseButton != "" {
+		if err := protocol.CheckButton(c.CruiseButton); err != nil {
+			problems = append(problems, "cruise_button: "+err.Error())
+		}
+	}
+	if c.Speed.Button != "" {
+		if err := protocol.CheckButton(c.Speed.Button); err != nil {
+			problems = append(problems, "speed.button: "+err.Error())
+		}
+	}
+	if len(c.Speed.Scales) > 0 {
+		if _, err := parseSpeedScales(joinFloats(c.Speed.Scales)); err != nil {
+			problems = append(problems, fmt.Sprintf("speed.scales: %v", err))
+		}
+	}
+	if _, err := modeCombo(c.Autonomy.Combo); err != nil {
+		problems = append(problems, fmt.Sprintf("autonomy.combo: %v", err))
+	}
+	if c.Clients.ReplayWindowMs < -1 {
+		problems = append(problems, fmt.Sprintf("clients.replay_window_ms: %d is negative (-1 accepts any timestamp)", c.Clients.ReplayWindowMs))
+	}
+	if _, err := parseAccessList(strings.Join(c.Access.Allow, ","), strings.Join(c.Access.Deny, ",")); err != nil {
+		problems = append(problems, "access."+err.Error())
+	}
+	if (c.GRPC.Cert == "") != (c.GRPC.Key == "") {
+		problems = append(problems, "grpc: cert and key go together")
+	}
+	if c.QUIC.Addr != "" && (c.QUIC.Cert == "" || c.QUIC.Key == "") {
+		problems = append(problems, "quic: cert and key are required")
+	}
+	if c.MQTT.Broker != "" {
+		if _, _, err := parseMQTTBroker(c.MQTT.Broker); err != nil {
+			problems = append(problems, "mqtt.broker: "+err.Error())
+		}
+	}
+	for i := range c.Alarms {
+		if err := c.Alarms[i].check(); err != nil {
+			problems = append(problems, fmt.Sprintf("alarms[%d]: %v", i, err))
+		}
+	}
+	if c.BlackBox.Seconds < 0 {
+		problems = append(problems, "blackbox.seconds: can't be negative")
+	}
+	if c.Transport.MaxRate < 0 || c.Transport.StatusRateHz < 0 {
+		problems = append(problems, "transport: rates can't be negative")
+	}
+	if c.Transport.MaxRate > 0 && float64(c.Transport.MaxRate) < protocol.MIN_SEND_RATE_HZ {
+		problems = append(problems, fmt.Sprintf("transport: max_rate must be 0 or at least %g Hz, or drivers time out", protocol.MIN_SEND_RATE_HZ))
+	}
+	if c.Transport.MaxPacketRate < -1 || c.Transport.MaxByteRate < -1 {
+		problems = append(problems, "transport: max_packet_rate and max_byte_rate must be positive, or -1 for no limit")
+	}
+	if c.Transport.MaxPacketSize != 0 || c.Transport.CRC != "" {
+		framing := protocol.DefaultFraming()
+		if c.Transport.MaxPacketSize != 0 {
+			framing.MaxPacketSize = c.Transport.MaxPacketSize
+		}
+		if c.Transport.CRC != "" {
+			framing.CRC = c.Transport.CRC
+		}
+		if err := framing.Check(); err != nil {
+			problems = append(problems, "transport: "+err.Error())
+		}
+	}
+	t := c.Timeouts
+	for _, timeout := range []struct {
+		name string
+		ms   int
+	}{
+		{"shutdown_ms", t.ShutdownMs},
+		{"status_write_ms", t.StatusWriteMs},
+		{"reconnect_min_ms", t.ReconnectMinMs},
+		{"reconnect_max_ms", t.ReconnectMaxMs},
+		{"replay_connect_ms", t.ReplayConnectMs},
+	} {
+		if timeout.ms < 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s: %d is negative", timeout.name, timeout.ms))
+		}
+	}
+	if t.ResumeMs < -1 {
+		problems = append(problems, fmt.Sprintf("timeouts.resume_ms: %d is negative (-1 disables)", t.ResumeMs))
+	}
+	return problems
+}
+
+// failsafe decodes the failsafe section over a neutral state
+func (c *ServerConfig) failsafe() (*protocol.ControllerState, error) {
+	return formatter.DecodeState(c.Failsafe)
+}
+
+// apply makes the file's settings the defaults for every flag the user
+// didn't pass, and installs its timeouts and failsafe state
+func (c *ServerConfig) apply() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	values := map[string]string{
+		"driver-token":  c.DriverToken,
+		"deadman":       c.Deadman,
+		"cruise-button": c.CruiseButton,
+		"script":        c.Script,
+		"config":        c.ByteConfig,
+		"config-format": c.ByteConfigFormat,
+		"metrics":       c.Metrics,
+		"dashboard":     c.Dashboard,
+		"api":           c.API,
+		"grpc":          c.GRPC.Addr,
+		"grpc-cert":     c.GRPC.Cert,
+		"grpc-key":      c.GRPC.Key,
+		"quic":          c.QUIC.Addr,
+		"quic-cert":     c.QUIC.Cert,
+		"quic-key":      c.QUIC.Key,
+		"udp-link":      c.Transport.UDPLink,
+		"crc":           c.Transport.CRC,
+		"mqtt":          c.MQTT.Broker,
+		"mqtt-prefix":   c.MQTT.Prefix,
+		"mdns-name":     c.MDNSName,
+		"record":        c.Record,
+		"log-level":     c.Log.Level,
+		"log-file":      c.Log.File,
+		"log-format":    c.Log.Format,
+		"blackbox":      c.BlackBox.Dir,
+		"driver-policy": c.Clients.DriverPolicy,
+		"autonomy":      c.Autonomy.Source,
+		"mode-combo":    c.Autonomy.Combo,
+		"speed-button":  c.Speed.Button,
+		"allow":         strings.Join(c.Access.Allow, ","),
+		"deny":          strings.Join(c.Access.Deny, ","),
+	}
+	if c.Transport.MaxRate != 0 {
+		values["max-rate"] = strconv.Itoa(c.Transport.MaxRate)
+	}
+	if c.Transport.MaxPacketRate != 0 {
+		values["max-packet-rate"] = strconv.Itoa(max(c.Transport.MaxPacketRate, 0))
+	}
+	if c.Transport.MaxByteRate != 0 {
+		values["max-byte-rate"] = strconv.Itoa(max(c.Transport.MaxByteRate, 0))
+	}
+	if c.Transport.MaxPacketSize != 0 {
+		values["max-packet-size"] = strconv.Itoa(c.Transport.MaxPacketSize)
+	}
+	if c.Log.MaxSizeMB != 0 {
+		values["log-max-size"] = strconv.Itoa(c.Log.MaxSizeMB)
+	}
+	if c.Log.MaxBackups != 0 {
+		values["log-backups"] = strconv.Itoa(c.Log.MaxBackups)
+	}
+	if c.Clients.TakeoverGraceMs != 0 {
+		values["takeover-grace"] = ms(c.Clients.TakeoverGraceMs).String()
+	}
+	for name, v := range map[string]float64{
+		"low-battery":       c.Battery.LowVolts,
+		"critical-battery":  c.Battery.CriticalVolts,
+		"low-battery-scale": c.Battery.LowScale,
+		"stall-current":     c.Motors.StallAmps,
+	} {
+		if v != 0 {
+			values[name] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	if len(c.Pipeline) > 0 {
+		values["pipeline"] = strings.Join(c.Pipeline, ",")
+	}
+	if len(c.Smoothing) > 0 {
+		values["smooth"] = formatSmoothing(c.Smoothing)
+	}
+	if len(c.Speed.Scales) > 0 {
+		values["speed-scales"] = joinFloats(c.Speed.Scales)
+	}
+	if c.Clients.ReplayWindowMs != 0 {
+		values["replay-window"] = ms(max(c.Clients.ReplayWindowMs, 0)).String()
+	}
+	if c.Clients.MaxClients != 0 {
+		values["max-clients"] = strconv.Itoa(c.Clients.MaxClients)
+	}
+	if c.BlackBox.Seconds != 0 {
+		values["blackbox-seconds"] = strconv.Itoa(c.BlackBox.Seconds)
+	}
+	for name, v := range values {
+		if v == "" || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	t := *timeouts()
+	if c.Timeouts.ShutdownMs != 0 {
+		t.ShutdownMs = c.Timeouts.ShutdownMs
+	}
+	if c.Timeouts.StatusWriteMs != 0 {
+		t.StatusWriteMs = c.Timeouts.StatusWriteMs
+	}
+	if c.Timeouts.ReconnectMinMs != 0 {
+		t.ReconnectMinMs = c.Timeouts.ReconnectMinMs
+	}
+	if c.Timeouts.ReconnectMaxMs != 0 {
+		t.ReconnectMaxMs = c.Timeouts.ReconnectMaxMs
+	}
+	if c.Timeouts.ReplayConnectMs != 0 {
+		t.ReplayConnectMs = c.Timeouts.ReplayConnectMs
+	}
+	if c.Timeouts.ResumeMs != 0 {
+		t.ResumeMs = c.Timeouts.ResumeMs
+	}
+	liveTimeouts.Store(&t)
+
+	if len(c.Failsafe) > 0 {
+		state, err := c.failsafe()
+		if err != nil {
+			return err
+		}
+		liveFailsafe.Store(state)
+	}
+	return nil
+}
+
+// listenAddr returns the address to listen on: -listen, or the file's
+// listen setting unless -port or -public was given
+func (c *ServerConfig) listenAddr(listen string, port int, public bool) string {
+	if listen != "" {
+		return listen
+	}
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "port" || f.Name == "public" })
+	if c != nil && c.Listen != "" && !explicit {
+		return c.Listen
+	}
+	if public {
+		return fmt.Sprintf(":%d", port) // every IPv4 and IPv6 address
+	}
+	return fmt.Sprintf("localhost:%d", port)
+}
+
+// tune applies the transport settings to an accepted connection
+func (t *TransportConfig) tune(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if t.NoDelay != nil {
+		tcp.SetNoDelay(*t.NoDelay)
+	}
+	switch {
+	case t.KeepAliveSec < 0:
+		tcp.SetKeepAlive(false)
+	case t.KeepAliveSec > 0:
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(time.Duration(t.KeepAliveSec) * time.Second)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestButtonSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ServerConfig
+		problem string // prefix of the one expected problem, "" for none
+	}{
+		{"button deadman", ServerConfig{Deadman: "LB"}, ""},
+		{"trigger deadman", ServerConfig{Deadman: "RT"}, ""},
+		{"stick deadman", ServerConfig{Deadman: "LjoyX"}, "deadman:"},
+		{"mix deadman", ServerConfig{Deadman: "mixL"}, "deadman:"},
+		{"button cruise", ServerConfig{CruiseButton: "E"}, ""},
+		{"trigger cruise", ServerConfig{CruiseButton: "LT"}, "cruise_button:"},
+		{"dpad speed", ServerConfig{Speed: SpeedConfig{Button: "dY"}}, "speed.button:"},
+		{"button mode combo", ServerConfig{Autonomy: AutonomyConfig{Combo: "SELECT+RB"}}, ""},
+		{"stick in the mode combo", ServerConfig{Autonomy: AutonomyConfig{Combo: "SELECT+RjoyY"}}, "autonomy.combo:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.config.validate()
+			if tt.problem == "" {
+				if len(problems) > 0 {
+					t.Fatalf("problems: %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.HasPrefix(problems[0], tt.problem) {
+				t.Fatalf("problems = %v, want one starting %q", problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestDeadmanHeldAtRest(t *testing.T) {
+	// A centered stick must never count as a held deadman
+	state := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER}
+	for _, field := range []string{"LjoyX", "LjoyY", "dX", "mixL"} {
+		if state.DeadmanHeld(field) {
+			t.Errorf("DeadmanHeld(%q) at rest", field)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// SHUTDOWN_TIMEOUT bounds how long a graceful shutdown may take before the
+// server exits anyway
+const SHUTDOWN_TIMEOUT = 3 * time.Second
+
+// shutdown stops the robot and disconnects everyone: driver states are
+// refused from here on, every Arduino gets the failsafe frame before its
+// port is closed, and each client is told why before its connection drops
+func (h *clientHub) shutdown(reason string) {
+	h.mu.Lock()
+	h.closing = true
+	sessions := make([]*clientSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, d := range h.devices {
+		d.shutdown()
+	}
+	for _, s := range sessions {
+		s.close(reason)
+	}
+}
+
+// shutdown writes the failsafe frame, waits for it to leave the UART and
+// closes the port. No reconnect is attempted afterwards.
+func (d *serialDevice) shutdown() {
+	d.writeMu.Lock() // after any write in progress
+	defer d.writeMu.Unlock()
+
+	d.mu.Lock()
+	port, outputs := d.port, d.outputs
+	d.port, d.outputs = nil, nil
+	d.active = false
+	d.mu.Unlock()
+	if port == nil && outputs == nil {
+		return
+	}
+
+	d.formatter.ResetSlew()
+	frame := d.formatter.Format(FailsafeState())
+	_, failsafe := d.wireFrame(frame)
+	d.writeOutputs(outputs, frame, failsafe)
+	closeOutputs(outputs)
+	if port == nil {
+		return
+	}
+	if _, err := port.Write(failsafe); err != nil {
+		slog.Error("Failsafe write on shutdown failed", "device", d.name, "err", err)
+	} else if err := port.Drain(); err != nil {
+		slog.Warn("Serial drain on shutdown failed", "device", d.name, "err", err)
+	}
+	port.Close()
+	slog.Info("Arduino stopped and closed", "device", d.name)
+}
+
+// close tells the client the server is going away and disconnects it
+func (s *clientSession) close(reason string) {
+	b, err := json.Marshal(&protocol.ShutdownFrame{Type: protocol.MsgShutdown, Reason: reason})
+	if err == nil {
+		s.send(b)
+	}
+	s.conn.Close()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"lunabotics/pkg/protocol"
+)
+
+// A driver whose link stalls without closing (a tether pulled mid-packet,
+// a frozen laptop) would otherwise leave the robot on its last state until
+// TCP gives up, which takes minutes. The client resends its state at least
+// twice a second, so DRIVER_TIMEOUT without one means the driver is gone:
+// the robot gets the failsafe frame, as if the driver had left, and
+// BUS_DRIVER_LOST goes out. The driver keeps the seat, and its next state
+// drives again.
+
+// heardDriver restarts the silence timer. Callers hold h.mu.
+func (h *clientHub) heardDriver() {
+	if h.driverSilent {
+		slog.Info("Driver heard from again", "client", h.driver.conn.RemoteAddr())
+	}
+	h.driverLast = time.Now()
+	h.driverSilent = false
+}
+
+// watchDriver stops the robot whenever the driver goes silent
+func (h *clientHub) watchDriver() {
+	ticker := time.NewTicker(protocol.DRIVER_TIMEOUT / 5)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.checkDriver()
+	}
+}
+
+// checkDriver sends the failsafe frame once the driver has been silent for
+// DRIVER_TIMEOUT, and again only after it has been heard from since
+func (h *clientHub) checkDriver() {
+	h.mu.Lock()
+	driver := h.driver
+	silent := driver != nil && !h.driverSilent && !h.estop && !h.closing &&
+		time.Since(h.driverLast) > protocol.DRIVER_TIMEOUT
+	var failsafe *serverEvent
+	if silent {
+		h.driverSilent = true
+		failsafe = h.stopDriving("driver silent")
+	}
+	h.mu.Unlock()
+	if !silent {
+		return
+	}
+
+	client := driver.conn.RemoteAddr().String()
+	slog.Warn("Driver went silent, stopping the robot", "client", client, "timeout", protocol.DRIVER_TIMEOUT)
+	h.publish(&serverEvent{Kind: BUS_DRIVER_LOST, Client: client, Detail: "silent"})
+	if failsafe != nil {
+		h.publish(failsafe)
+	}
+}
+
+// stopDriving drops whatever the driver had the robot doing and, unless
+// the autonomy source is the one steering, sends the failsafe frame to
+// every device. It returns the BUS_FAILSAFE event for the caller to
+// publish once it releases h.mu, which it holds, or nil.
+func (h *clientHub) stopDriving(reason string) *serverEvent {
+	h.resetDriving(reason)
+	if h.mode != protocol.MODE_TELEOP {
+		return nil
+	}
+	for _, d := range h.devices {
+		d.formatter.ResetSlew()
+		d.submit(d.formatter.Format(FailsafeState()))
+	}
+	return &serverEvent{Kind: BUS_FAILSAFE, Detail: reason}
+}
+
+// resetDriving drops what one driver built up, a running macro, the cruise
+// latch and the smoothing and slew filters, so none of it carries over to
+// whoever drives next. Callers hold h.mu.
+func (h *clientHub) resetDriving(reason string) {
+	h.stopMacro(reason)
+	h.releaseCruise(reason)
+	h.smoothed, h.slewed = nil, nil
+}
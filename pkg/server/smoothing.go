@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// Worn potentiometers make a resting stick jitter by a few counts, and the
+// motors chatter with it. -smooth runs the driver's axes through an
+// exponential moving average before anything else touches them: each state
+// moves the output alpha of the way toward the new reading, so alpha 1 is
+// no filtering and smaller values smooth harder at the cost of lag. The
+// filter advances once per state, so its time constant scales with the
+// client's send rate. It starts afresh for each driver, after an e-stop and
+// on every mode switch, so it never eases in from a stale reading.
+
+// SmoothingConfig is the server config's smoothing section: an alpha per
+// axis, with "all" for the axes not listed, as -smooth
+type SmoothingConfig map[string]float64
+
+// smoothAxes are the fields -smooth can filter
+var smoothAxes = []string{"LjoyX", "LjoyY", "RjoyX", "RjoyY", "LT", "RT"}
+
+// parseSmoothing reads -smooth: comma-separated FIELD=alpha entries, or a
+// bare alpha for every axis not listed, e.g. "0.5,LT=0.2"
+func parseSmoothing(s string) (SmoothingConfig, error) {
+	if s == "" {
+		return nil, nil
+	}
+	alphas := make(SmoothingConfig)
+	all := 0.0
+	for _, entry := range strings.Split(s, ",") {
+		field, value, named := strings.Cut(strings.TrimSpace(entry), "=")
+		if !named {
+			field, value = "", field
+		}
+		alpha, err := strconv.ParseFloat(value, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("alpha %q must be above 0 and at most 1", value)
+		}
+		switch {
+		case !named:
+			all = alpha
+		case !isSmoothAxis(field):
+			return nil, fmt.Errorf("%q is not an axis (valid: %s)", field, strings.Join(smoothAxes, ", "))
+		default:
+			alphas[field] = alpha
+		}
+	}
+	if all > 0 {
+		for _, field := range smoothAxes {
+			if _, ok := alphas[field]; !ok {
+				alphas[field] = all
+			}
+		}
+	}
+	return alphas, nil
+}
+
+// formatSmoothing writes alphas as -smooth takes them
+func formatSmoothing(alphas SmoothingConfig) string {
+	entries := make([]string, 0, len(alphas))
+	for field, alpha := range alphas {
+		if field == "all" {
+			entries = append(entries, strconv.FormatFloat(alpha, 'g', -1, 64))
+			continue
+		}
+		entries = append(entries, field+"="+strconv.FormatFloat(alpha, 'g', -1, 64))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func isSmoothAxis(field string) bool {
+	for _, axis := range smoothAxes {
+		if axis == field {
+			return true
+		}
+	}
+	return false
+}
+
+// applySmoothing returns the driver's state with each filtered axis
+// replaced by its moving average
+func (h *clientHub) applySmoothing(state *protocol.ControllerState) *protocol.ControllerState {
+	if len(h.smoothing) == 0 {
+		return state
+	}
+	var f formatter.ByteFormatter
+	smoothed := *state
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.smoothed == nil {
+		h.smoothed = make(map[string]float64, len(h.smoothing))
+	}
+	for field, alpha := range h.smoothing {
+		v := float64(f.Field16Value(state, field))
+		last, ok := h.smoothed[field]
+		if ok {
+			v = last + alpha*(v-last)
+		}
+		h.smoothed[field] = v
+		setAxis16(&smoothed, field, uint16(math.Round(v)))
+	}
+	return &smoothed
+}
+
+// setAxis16 sets an axis' 16-bit field and the 8-bit field it widens
+func setAxis16(state *protocol.ControllerState, field string, v uint16) {
+	switch field {
+	case "LjoyX":
+		state.LeftX, state.LeftX16 = uint8(v>>8), v
+	case "LjoyY":
+		state.LeftY, state.LeftY16 = uint8(v>>8), v
+	case "RjoyX":
+		state.RightX, state.RightX16 = uint8(v>>8), v
+	case "RjoyY":
+		state.RightY, state.RightY16 = uint8(v>>8), v
+	case "LT":
+		state.LeftTrigger, state.LeftTrigger16 = uint8(v>>8), v
+	case "RT":
+		state.RightTrigger, state.RightTrigger16 = uint8(v>>8), v
+	}
+}
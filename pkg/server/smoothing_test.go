@@ -0,0 +1,76 @@
+package server
+
+import (
+	"maps"
+	"testing"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+func TestParseSmoothing(t *testing.T) {
+	tests := []struct {
+		in   string
+		want SmoothingConfig // nil for "", which turns smoothing off
+		err  bool
+	}{
+		{"", nil, false},
+		{"LT=0.2", SmoothingConfig{"LT": 0.2}, false},
+		{"0.5, LT=0.2", SmoothingConfig{"LjoyX": 0.5, "LjoyY": 0.5, "RjoyX": 0.5, "RjoyY": 0.5, "LT": 0.2, "RT": 0.5}, false},
+		{"1", SmoothingConfig{"LjoyX": 1, "LjoyY": 1, "RjoyX": 1, "RjoyY": 1, "LT": 1, "RT": 1}, false},
+		{"0", nil, true},
+		{"LT=1.5", nil, true},
+		{"LT=soft", nil, true},
+		{"N=0.5", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSmoothing(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q gave %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, tt.want) {
+			t.Errorf("%q gave %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	h := newClientHub("")
+	h.smoothing = SmoothingConfig{"RT": 0.5}
+	pulled := protocol.ControllerState{RightTrigger: 255, RightTrigger16: 0xFFFF, LeftTrigger: 200}
+	// The first state passes as is, then each moves half way
+	for i, want := range []uint8{255, 255} {
+		if out := h.applySmoothing(&pulled); out.RightTrigger != want || out.LeftTrigger != 200 {
+			t.Fatalf("state %d: RT %d LT %d, want RT %d and LT untouched", i, out.RightTrigger, out.LeftTrigger, want)
+		}
+	}
+	released := protocol.ControllerState{}
+	for i, want := range []uint8{128, 64, 32} {
+		if out := h.applySmoothing(&released); out.RightTrigger != want {
+			t.Fatalf("release %d: RT %d, want %d", i, out.RightTrigger, want)
+		}
+	}
+}
+
+// The states dropped while e-stopped never reach the filter, so a reset
+// must start it afresh rather than ease in from the stick before the stop
+func TestSmoothingAfterEStop(t *testing.T) {
+	h := newClientHub("")
+	h.smoothing = SmoothingConfig{"LjoyY": 0.2}
+	forward := formatter.NeutralState()
+	forward.LeftY, forward.LeftY16 = 255, 0xFFFF
+	for range 20 {
+		h.applySmoothing(forward)
+	}
+
+	h.triggerEStop("test", "")
+	if why := h.resetEStop(nil, "test"); why != "" {
+		t.Fatalf("reset refused: %s", why)
+	}
+	if out := h.applySmoothing(formatter.NeutralState()); out.LeftY != protocol.AXIS_CENTER {
+		t.Fatalf("LjoyY %d for a centered stick after the reset, want %d", out.LeftY, protocol.AXIS_CENTER)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// SPEED_SCALES is the default -speed-scales, for turtle, normal and turbo
+const SPEED_SCALES = "0.3,0.7,1"
+
+// Speed levels let the driver trade top speed for finer control, e.g. to
+// creep into position over the hopper without feathering the stick. Each
+// press of -speed-button cycles turtle, normal, turbo and back, scaling the
+// stick axes by that level's entry in -speed-scales; triggers and buttons
+// are untouched. The level starts at normal and is reported in every
+// status frame. Without -speed-button the sticks pass through unscaled.
+
+// speedLevels are the SPEED_* names in cycle order
+var speedLevels = []string{protocol.SPEED_TURTLE, protocol.SPEED_NORMAL, protocol.SPEED_TURBO}
+
+// SpeedConfig is the server config's speed section, as -speed-button and
+// -speed-scales
+type SpeedConfig struct {
+	Button string    `json:"button,omitempty"`
+	Scales []float64 `json:"scales,omitempty"` // turtle, normal, turbo
+}
+
+// parseSpeedScales reads -speed-scales: one fraction (0-1] per level
+func parseSpeedScales(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != len(speedLevels) {
+		return nil, fmt.Errorf("want %d scales (%s), got %d", len(speedLevels), strings.Join(speedLevels, ", "), len(fields))
+	}
+	scales := make([]float64, len(fields))
+	for i, field := range fields {
+		scale, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || scale <= 0 || scale > 1 {
+			return nil, fmt.Errorf("%s scale %q must be above 0 and at most 1", speedLevels[i], field)
+		}
+		scales[i] = scale
+	}
+	return scales, nil
+}
+
+// joinFloats formats scales as -speed-scales takes them
+func joinFloats(scales []float64) string {
+	fields := make([]string, len(scales))
+	for i, scale := range scales {
+		fields[i] = strconv.FormatFloat(scale, 'g', -1, 64)
+	}
+	return strings.Join(fields, ",")
+}
+
+// checkSpeedButton moves to the next speed level when the driver presses
+// the speed button
+func (h *clientHub) checkSpeedButton(state *protocol.ControllerState) {
+	if h.speedButton == "" {
+		return
+	}
+	var f formatter.ByteFormatter
+	held := f.FieldValue(state, h.speedButton) != 0
+
+	h.mu.Lock()
+	pressed := held && !h.speedHeld
+	h.speedHeld = held
+	if pressed {
+		h.speed = (h.speed + 1) % len(speedLevels)
+	}
+	level := h.speed
+	h.mu.Unlock()
+
+	if pressed {
+		slog.Info("Speed level changed", "speed", speedLevels[level], "scale", h.speedScales[level])
+	}
+}
+
+// speedState returns the current SPEED_* level, or "" without a speed
+// button
+func (h *clientHub) speedState() string {
+	if h.speedButton == "" {
+		return ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.speedLevel()
+}
+
+// speedLevel is speedState for callers holding h.mu
+func (h *clientHub) speedLevel() string {
+	if h.speedButton == "" {
+		return ""
+	}
+	return speedLevels[h.speed]
+}
+
+// applySpeed scales the driver's sticks for the current speed level
+func (h *clientHub) applySpeed(state *protocol.ControllerState) *protocol.ControllerState {
+	if h.speedButton == "" {
+		return state
+	}
+	h.mu.Lock()
+	scale := h.speedScales[h.speed]
+	h.mu.Unlock()
+	if scale == 1 {
+		return state
+	}
+	return scaleSticks(state, scale)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"lunabotics/pkg/protocol"
+)
+
+func TestParseSpeedScales(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []float64 // nil for an error
+	}{
+		{SPEED_SCALES, []float64{0.3, 0.7, 1}},
+		{" 0.25 , 0.5 ,1", []float64{0.25, 0.5, 1}},
+		{"0.3,0.7", nil},
+		{"0.3,0.7,1,1", nil},
+		{"0,0.7,1", nil},
+		{"0.3,0.7,1.5", nil},
+		{"0.3,fast,1", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseSpeedScales(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q gave %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%q gave %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckSpeedButton(t *testing.T) {
+	h := newClientHub("")
+	h.speedButton = "RB"
+	h.speedScales = []float64{0.3, 0.7, 1}
+	h.speed = slices.Index(speedLevels, protocol.SPEED_NORMAL)
+	up := protocol.ControllerState{}
+	down := protocol.ControllerState{RightBumper: 1}
+
+	// Each press moves one level, however long the button is held
+	for _, want := range []string{protocol.SPEED_TURBO, protocol.SPEED_TURTLE, protocol.SPEED_NORMAL} {
+		h.checkSpeedButton(&down)
+		h.checkSpeedButton(&down)
+		h.checkSpeedButton(&up)
+		if got := h.speedState(); got != want {
+			t.Fatalf("speed %s, want %s", got, want)
+		}
+	}
+
+	full := protocol.ControllerState{LeftY: 255, RightTrigger: 255}
+	out := h.applySpeed(&full)
+	if out.LeftY >= 255 || out.LeftY <= protocol.AXIS_CENTER || out.RightTrigger != 255 {
+		t.Fatalf("normal speed gave LjoyY %d RT %d, want the stick scaled and the trigger untouched", out.LeftY, out.RightTrigger)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+// The deadzone, curve, mix, slew and failsafe stages do for the driver's
+// state what the byte mapping's deadzone, curve, mix and
+// max_delta_per_frame do for one byte, so a behavior can be placed in the
+// pipeline and apply to every device at once. They are set in the server config's stages section and pass
+// the state through while unset:
+//
+//	stages:
+//	  deadzone: {all: 8}              # stick counts from center that snap to it
+//	  curve: {LjoyY: {expo: 0.4}}     # as a byte mapping's curve
+//	  mix: {throttle: LjoyY, steer: RjoyX, left: LjoyY, right: RjoyY}
+//	  slew: {LjoyY: 400, RjoyY: 400}  # most change per second, in 8-bit counts
+//	  failsafe: "battery_a > 60"      # failsafe input while non-zero
+//
+// deadzone and curve take "all" for every stick axis not listed. mix is
+// arcade mixing: the left and right motor values are written to the left
+// and right fields as stick positions (up = forward), where the byte
+// mapping picks them up. slew ramps toward the new value over time. It runs
+// last by default, so the deadman, speed level and battery scaling are
+// ramped too, but it starts from the failsafe state after every stop and
+// never ramps into one: the deadman, failsafe and battery stages cut it as
+// they stop the robot. failsafe is a script expression and may read
+// telemetry.
+
+// StagesConfig is the server config's stages section
+type StagesConfig struct {
+	Deadzone map[string]uint8                  `json:"deadzone,omitempty"`
+	Curve    map[string]*formatter.CurveConfig `json:"curve,omitempty"`
+	Mix      *MixConfig                        `json:"mix,omitempty"`
+	Slew     map[string]float64                `json:"slew,omitempty"`
+	Failsafe string                            `json:"failsafe,omitempty"`
+}
+
+// MixConfig is the mix stage's fields, LjoyY, RjoyX, LjoyY and RjoyY by
+// default, and the arcade mix's max_speed and turn_gain (0 for 1)
+type MixConfig struct {
+	Throttle string  `json:"throttle,omitempty"`
+	Steer    string  `json:"steer,omitempty"`
+	Left     string  `json:"left,omitempty"`
+	Right    string  `json:"right,omitempty"`
+	MaxSpeed float64 `json:"max_speed,omitempty"`
+	TurnGain float64 `json:"turn_gain,omitempty"`
+}
+
+// stickAxes are the axes deadzone, curve and mix work on
+var stickAxes = []string{"LjoyX", "LjoyY", "RjoyX", "RjoyY"}
+
+// problems lists the mistakes in the section
+func (c *StagesConfig) problems() []string {
+	var problems []string
+	axis := func(stage, field string, axes []string) {
+		if field != "" && !slices.Contains(axes, field) {
+			problems = append(problems, fmt.Sprintf("stages.%s: %q is not an axis (valid: %s)", stage, field, strings.Join(axes, ", ")))
+		}
+	}
+	all := append([]string{"all"}, stickAxes...)
+	for field := range c.Deadzone {
+		axis("deadzone", field, all)
+	}
+	for field, curve := range c.Curve {
+		axis("curve", field, all)
+		if curve == nil {
+			continue
+		}
+		for _, problem := range curve.Problems() {
+			problems = append(problems, fmt.Sprintf("stages.curve.%s: %s", field, problem))
+		}
+	}
+	if m := c.Mix; m != nil {
+		for _, field := range []string{m.Throttle, m.Steer, m.Left, m.Right} {
+			axis("mix", field, stickAxes)
+		}
+		if m.MaxSpeed < 0 || m.MaxSpeed > 1 || m.TurnGain < 0 {
+			problems = append(problems, "stages.mix: max_speed must be between 0 and 1 and turn_gain can't be negative")
+		}
+	}
+	for field, rate := range c.Slew {
+		axis("slew", field, smoothAxes)
+		if rate <= 0 {
+			problems = append(problems, fmt.Sprintf("stages.slew.%s: %g must be above 0", field, rate))
+		}
+	}
+	if c.Failsafe != "" {
+		if _, err := formatter.CompileExprNames(c.Failsafe, isScriptName); err != nil {
+			problems = append(problems, fmt.Sprintf("stages.failsafe: %v", err))
+		}
+	}
+	return problems
+}
+
+// configured lists the stages the section sets
+func (c *StagesConfig) configured() []string {
+	var stages []string
+	if len(c.Deadzone) > 0 {
+		stages = append(stages, "deadzone")
+	}
+	if len(c.Curve) > 0 {
+		stages = append(stages, "curve")
+	}
+	if c.Mix != nil {
+		stages = append(stages, "mix")
+	}
+	if len(c.Slew) > 0 {
+		stages = append(stages, "slew")
+	}
+	if c.Failsafe != "" {
+		stages = append(stages, "failsafe")
+	}
+	return stages
+}
+
+// perStick spreads a per-axis setting with an "all" entry over the stick
+// axes
+func perStick[T any](settings map[string]T) map[string]T {
+	all, ok := settings["all"]
+	if !ok {
+		return settings
+	}
+	spread := make(map[string]T, len(stickAxes))
+	for _, field := range stickAxes {
+		if v, ok := settings[field]; ok {
+			spread[field] = v
+		} else {
+			spread[field] = all
+		}
+	}
+	return spread
+}
+
+// setStages installs the stages section, which the server config has
+// already checked
+func (h *clientHub) setStages(c StagesConfig) error {
+	var failsafe formatter.Expr
+	if c.Failsafe != "" {
+		var err error
+		if failsafe, err = formatter.CompileExprNames(c.Failsafe, isScriptName); err != nil {
+			return fmt.Errorf("stages.failsafe: %w", err)
+		}
+	}
+	c.Deadzone, c.Curve = perStick(c.Deadzone), perStick(c.Curve)
+	if m := c.Mix; m != nil {
+		mix := *m
+		mix.Throttle = cmp.Or(mix.Throttle, "LjoyY")
+		mix.Steer = cmp.Or(mix.Steer, "RjoyX")
+		mix.Left = cmp.Or(mix.Left, "LjoyY")
+		mix.Right = cmp.Or(mix.Right, "RjoyY")
+		c.Mix = &mix
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stages = c
+	h.failsafeWhen = failsafe
+	h.slewed = nil
+	return nil
+}
+
+// applyDeadzone snaps stick axes near center to center
+func (h *clientHub) applyDeadzone(state *protocol.ControllerState) *protocol.ControllerState {
+	if len(h.stages.Deadzone) == 0 {
+		return state
+	}
+	var f formatter.ByteFormatter
+	out := *state
+	for field, deadzone := range h.stages.Deadzone {
+		if v := f.FieldValue(state, field); formatter.Deadzone(v, deadzone) != v {
+			setStateField(&out, field, protocol.AXIS_CENTER)
+		}
+	}
+	return &out
+}
+
+// applyCurve reshapes stick axes with their response curves
+func (h *clientHub) applyCurve(state *protocol.ControllerState) *protocol.ControllerState {
+	if len(h.stages.Curve) == 0 {
+		return state
+	}
+	var f formatter.ByteFormatter
+	out := *state
+	for field, curve := range h.stages.Curve {
+		setStateField(&out, field, float64(curve.Apply(f.FieldValue(state, field))))
+	}
+	return &out
+}
+
+// applyMix replaces the left and right fields with the arcade mix of the
+// throttle and steer axes
+func (h *clientHub) applyMix(state *protocol.ControllerState) *protocol.ControllerState {
+	m := h.stages.Mix
+	if m == nil {
+		return state
+	}
+	var f formatter.ByteFormatter
+	left, right := formatter.ArcadeMix(f.FieldValue(state, m.Throttle), f.FieldValue(state, m.Steer), m.TurnGain, m.MaxSpeed)
+	// Motor values are forward-up; sticks are forward-down
+	out := *state
+	setStateField(&out, m.Left, float64(2*protocol.AXIS_CENTER-int(left)))
+	setStateField(&out, m.Right, float64(2*protocol.AXIS_CENTER-int(right)))
+	return &out
+}
+
+// applySlew limits how fast each configured axis may change, in 8-bit
+// counts per second
+func (h *clientHub) applySlew(state *protocol.ControllerState) *protocol.ControllerState {
+	if len(h.stages.Slew) == 0 {
+		return state
+	}
+	var f formatter.ByteFormatter
+	out := *state
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	elapsed := now.Sub(h.slewAt).Seconds()
+	if h.slewed == nil {
+		// Restarting after a stop: ramp up from the failsafe state
+		failsafe := FailsafeState()
+		h.slewed = make(map[string]float64, len(h.stages.Slew))
+		for field := range h.stages.Slew {
+			h.slewed[field] = float64(f.Field16Value(failsafe, field))
+		}
+		elapsed = 0
+	}
+	h.slewAt = now
+	for field, rate := range h.stages.Slew {
+		v := float64(f.Field16Value(state, field))
+		if last, ok := h.slewed[field]; ok {
+			step := rate * 257 * elapsed // 16-bit units
+			v = math.Max(last-step, math.Min(last+step, v))
+		}
+		h.slewed[field] = v
+		setAxis16(&out, field, uint16(math.Round(v)))
+	}
+	return &out
+}
+
+// applyFailsafeOverride replaces the state with the failsafe input while
+// the stages.failsafe expression is non-zero
+func (h *clientHub) applyFailsafeOverride(state *protocol.ControllerState) *protocol.ControllerState {
+	h.mu.Lock()
+	when := h.failsafeWhen
+	h.mu.Unlock()
+	if when == nil || when.Eval(h.scriptLookup(state)) == 0 {
+		return state
+	}
+	h.cutSlew()
+	return FailsafeState()
+}
+
+// cutSlew lets a stop through the slew stage at once, which then ramps up
+// from the failsafe state
+func (h *clientHub) cutSlew() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.slewed = nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/protocol"
+)
+
+func TestStages(t *testing.T) {
+	center := protocol.ControllerState{LeftX: protocol.AXIS_CENTER, LeftY: protocol.AXIS_CENTER,
+		RightX: protocol.AXIS_CENTER, RightY: protocol.AXIS_CENTER}
+	with := func(edit func(*protocol.ControllerState)) protocol.ControllerState {
+		s := center
+		edit(&s)
+		return s
+	}
+	tests := []struct {
+		name   string
+		config StagesConfig
+		stage  string
+		in     protocol.ControllerState
+		want   func(*protocol.ControllerState) bool
+	}{
+		{"inside the deadzone", StagesConfig{Deadzone: map[string]uint8{"all": 8}}, "deadzone",
+			with(func(s *protocol.ControllerState) { s.LeftY, s.RightX = 132, 120 }),
+			func(s *protocol.ControllerState) bool { return s.LeftY == 127 && s.RightX == 127 }},
+		{"outside the deadzone", StagesConfig{Deadzone: map[string]uint8{"all": 8, "LjoyY": 2}}, "deadzone",
+			with(func(s *protocol.ControllerState) { s.LeftY, s.RightX = 132, 140 }),
+			func(s *protocol.ControllerState) bool { return s.LeftY == 132 && s.RightX == 140 }},
+		{"curve", StagesConfig{Curve: map[string]*formatter.CurveConfig{"LjoyY": {Expo: 1}}}, "curve",
+			with(func(s *protocol.ControllerState) { s.LeftY, s.RightY = 64, 64 }),
+			func(s *protocol.ControllerState) bool { return s.LeftY > 64 && s.LeftY < 127 && s.RightY == 64 }},
+		{"curve end stops", StagesConfig{Curve: map[string]*formatter.CurveConfig{"all": {Expo: 1}}}, "curve",
+			with(func(s *protocol.ControllerState) { s.LeftX, s.RightX = 0, 255 }),
+			func(s *protocol.ControllerState) bool { return s.LeftX == 0 && s.RightX == 255 }},
+		{"mix at rest", StagesConfig{Mix: &MixConfig{}}, "mix", center,
+			func(s *protocol.ControllerState) bool { return s.LeftY == 127 && s.RightY == 127 }},
+		{"mix forward", StagesConfig{Mix: &MixConfig{}}, "mix",
+			with(func(s *protocol.ControllerState) { s.LeftY = 0 }),
+			func(s *protocol.ControllerState) bool { return s.LeftY == 0 && s.RightY == 0 }},
+		{"mix spin right", StagesConfig{Mix: &MixConfig{}}, "mix",
+			with(func(s *protocol.ControllerState) { s.RightX = 254 }),
+			func(s *protocol.ControllerState) bool { return s.LeftY == 0 && s.RightY == 254 }},
+		{"failsafe off", StagesConfig{Failsafe: "SELECT"}, "failsafe", center,
+			func(s *protocol.ControllerState) bool { return *s == center }},
+		{"failsafe on", StagesConfig{Failsafe: "SELECT"}, "failsafe",
+			with(func(s *protocol.ControllerState) { s.Select, s.RightTrigger = 1, 255 }),
+			func(s *protocol.ControllerState) bool { return *s == *FailsafeState() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problems := tt.config.problems(); len(problems) > 0 {
+				t.Fatalf("config problems: %v", problems)
+			}
+			h := newClientHub("")
+			if err := h.setStages(tt.config); err != nil {
+				t.Fatal(err)
+			}
+			in := tt.in
+			if out := stateStages[tt.stage](h, &in); !tt.want(out) {
+				t.Fatalf("%s gave %+v", tt.stage, *out)
+			}
+		})
+	}
+
+	t.Run("slew", func(t *testing.T) {
+		h := newClientHub("")
+		h.setStages(StagesConfig{Slew: map[string]float64{"LjoyY": 400}})
+		h.applySlew(&center)
+		h.slewAt = time.Now().Add(-100 * time.Millisecond)
+		full := with(func(s *protocol.ControllerState) { s.LeftY = 255 })
+		// 40 counts in 100ms, and a little for the time the test takes
+		if out := h.applySlew(&full); out.LeftY < 167 || out.LeftY > 175 {
+			t.Fatalf("LjoyY %d after 100ms at 400/s from 127", out.LeftY)
+		}
+	})
+
+	// Grabbing the deadman with the stick already pushed ramps up from the
+	// failsafe state, and letting go stops at once
+	t.Run("slew after the deadman", func(t *testing.T) {
+		h := newClientHub("")
+		h.deadman = "LB"
+		h.setStages(StagesConfig{Slew: map[string]float64{"LjoyY": 400}})
+		pushed := with(func(s *protocol.ControllerState) { s.LeftY = 255 })
+		stopped := FailsafeState().LeftY
+		if out := h.runPipeline(&pushed); out.LeftY != stopped {
+			t.Fatalf("LjoyY %d without the deadman, want the failsafe %d", out.LeftY, stopped)
+		}
+		h.slewAt = time.Now().Add(-100 * time.Millisecond)
+		held := with(func(s *protocol.ControllerState) { s.LeftY, s.LeftBumper = 255, 1 })
+		if out := h.runPipeline(&held); out.LeftY < 167 || out.LeftY > 176 {
+			t.Fatalf("LjoyY %d 100ms after grabbing the deadman, want a ramp at 400/s", out.LeftY)
+		}
+		if out := h.runPipeline(&pushed); out.LeftY != stopped {
+			t.Fatalf("LjoyY %d after letting go, want the failsafe %d at once", out.LeftY, stopped)
+		}
+	})
+
+	t.Run("problems", func(t *testing.T) {
+		c := StagesConfig{
+			Deadzone: map[string]uint8{"LT": 8},
+			Mix:      &MixConfig{Left: "RT"},
+			Slew:     map[string]float64{"LjoyY": 0},
+			Failsafe: "nope >",
+		}
+		if problems := c.problems(); len(problems) != 4 {
+			t.Fatalf("problems = %q, want 4", problems)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+
+	"lunabotics/pkg/protocol"
+)
+
+// Motor stall detection. A motor drawing -stall-current amps or more is
+// stalled or jammed (the bucket dug in, a wheel against a rock), and the
+// driver should back off before the controller or the motor overheats.
+// Each motor's crossing is published once as BUS_MOTOR_STALL, and again
+// only after its current has dropped STALL_HYSTERESIS below the threshold,
+// so the ripple of a stalled motor doesn't repeat it.
+const STALL_HYSTERESIS = 1.0 // amps
+
+// MotorsConfig is the server config's motors section
+type MotorsConfig struct {
+	StallAmps float64 `json:"stall_amps,omitempty"` // as -stall-current
+}
+
+// checkStall compares an Arduino's motor currents with -stall-current
+func (h *clientHub) checkStall(t *protocol.TelemetryState) {
+	if h.stallAmps <= 0 {
+		return
+	}
+	var stalls []string
+	h.mu.Lock()
+	if h.stalled == nil {
+		h.stalled = make(map[string][]bool)
+	}
+	prev := h.stalled[t.Device]
+	stalled := make([]bool, len(t.MotorCurrents))
+	for i, amps := range t.MotorCurrents {
+		amps = math.Abs(amps) // negative while braking
+		was := i < len(prev) && prev[i]
+		stalled[i] = amps >= h.stallAmps || was && amps > h.stallAmps-STALL_HYSTERESIS
+		if stalled[i] && !was {
+			stalls = append(stalls, fmt.Sprintf("%s motor %d at %.1f A", t.Device, i+1, amps))
+		}
+	}
+	h.stalled[t.Device] = stalled
+	h.mu.Unlock()
+
+	for _, detail := range stalls {
+		slog.Warn("Motor stall", "device", t.Device, "detail", detail, "threshold", h.stallAmps)
+		h.publish(&serverEvent{Kind: BUS_MOTOR_STALL, Device: t.Device, Detail: detail})
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"lunabotics/pkg/serialout"
+)
+
+// sdNotify sends a state line such as "READY=1" to systemd. It does
+// nothing when the server isn't running under a Type=notify unit.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the WatchdogSec= the unit asked for, or 0 when
+// the watchdog is off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings systemd at half the watchdog interval for as long as
+// the hub stays healthy. Once it doesn't, the pings stop and systemd
+// restarts the server; the unit's ExecStopPost sends the failsafe frame.
+func runWatchdog(hub *clientHub, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := hub.healthy(interval / 2); err != nil {
+			slog.Error("Health check failed, withholding watchdog ping", "err", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("Watchdog ping failed", "err", err)
+		}
+	}
+}
+
+// healthy checks that the hub isn't deadlocked and no serial write has been
+// stuck for longer than limit
+func (h *clientHub) healthy(limit time.Duration) error {
+	locked := make(chan struct{})
+	go func() {
+		h.mu.Lock()
+		h.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(limit):
+		return fmt.Errorf("hub lock held for over %v", limit)
+	}
+
+	for _, d := range h.devices {
+		if started := d.writing.Load(); started != 0 {
+			if stuck := time.Since(time.Unix(0, started)); stuck > limit {
+				return fmt.Errorf("Arduino %s write stuck for %v", d.name, stuck.Round(time.Millisecond))
+			}
+		}
+	}
+	return nil
+}
+
+// sendFailsafe opens every device, writes the failsafe frame and exits,
+// for use as a systemd ExecStopPost after a crash or watchdog kill
+func sendFailsafe(hub *clientHub) error {
+	var failed error
+	for _, d := range hub.devices {
+		outputs, _ := d.openOutputs(d.config.Outputs)
+		if len(outputs) > 0 {
+			frame := d.formatter.Format(FailsafeState())
+			_, failsafe := d.wireFrame(frame)
+			d.writeOutputs(outputs, frame, failsafe)
+			closeOutputs(outputs)
+		}
+		if d.config.Port == serialout.SERIAL_NONE {
+			continue
+		}
+		port, err := d.openPort()
+		if err != nil {
+			failed = fmt.Errorf("%s: %w", d.name, err)
+			continue
+		}
+		_, failsafe := d.wireFrame(d.formatter.Format(FailsafeState()))
+		if _, err := port.Write(failsafe); err != nil {
+			failed = fmt.Errorf("%s: %w", d.name, err)
+		} else {
+			port.Drain()
+			slog.Info("Failsafe frame sent", "device", d.name)
+		}
+		port.Close()
+	}
+	return failed
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"strings"
+
+	"go.bug.st/serial"
+
+	"lunabotics/pkg/formatter"
+	"lunabotics/pkg/serialout"
+)
+
+// openPort opens the device's serial port, or a virtual Arduino for a
+// mock: port, recording its traffic with -serial-dump
+func (d *serialDevice) openPort() (serial.Port, error) {
+	var port serial.Port
+	var err error
+	if script, ok := strings.CutPrefix(d.config.Port, serialout.VIRTUAL_PREFIX); ok {
+		port, err = serialout.NewVirtualArduino(d.name, d.formatter.Current().Framing, d.config.Ack, formatter.LayoutHash(d.formatter.Current(), d.config.Ack), script)
+	} else {
+		port, err = serialout.Open(d.config)
+	}
+	if err != nil || d.dump == nil {
+		return port, err
+	}
+	return &serialout.DumpPort{Port: port, Dump: d.dump, Device: d.name}, nil
+}
@@ -0,0 +1,255 @@
+"""ROS2 bridge between the Lunabotics server and an autonomy stack.
+
+The node subscribes to a `sensor_msgs/Joy` topic and drives the server like
+any other client: each Joy message becomes a ControllerState sent over the
+usual framed TCP link, so autonomy commands go through the same arbitration,
+deadman, e-stop and byte formatter as teleop. Telemetry the server relays
+from the Arduino is published back as ROS topics:
+
+    ~/battery         sensor_msgs/BatteryState   (voltage)
+    ~/motor_currents  std_msgs/Float64MultiArray (amps, one per motor)
+    ~/limit_switches  std_msgs/UInt8             (bitmask)
+    ~/estop           std_msgs/Bool              (server e-stop latched)
+
+Joy axes follow the ROS convention (joy_node): sticks are +1 left and up,
+triggers +1 released and -1 pressed, the d-pad +1 left and up. The default
+button and axis indices are an Xbox pad under joy_node; override them with
+the `buttons` and `axes` parameters, index lists in the order of
+BUTTON_FIELDS and AXIS_FIELDS below (-1 for one the pad lacks).
+
+If no Joy message arrives for `joy_timeout` seconds the bridge sends neutral
+states, so a crashed planner stops the robot instead of leaving its last
+command applied.
+
+Usage, with a ROS2 install sourced:
+
+    python3 ros2_bridge.py --ros-args -p server:=127.0.0.1:8080 -p joy_topic:=/joy
+"""
+
+import json
+import socket
+import struct
+import threading
+import time
+import zlib
+from typing import Any, Dict, List, Optional
+
+import rclpy
+from rclpy.node import Node
+from sensor_msgs.msg import BatteryState, Joy
+from std_msgs.msg import Bool, Float64MultiArray, UInt8
+
+MAX_PACKET_SIZE = 8192  # pkg/protocol's MaxPacketSize
+RECONNECT_DELAY = 1.0  # seconds between connection attempts
+
+BUTTON_FIELDS = ["S", "E", "W", "N", "LB", "RB", "SELECT", "START", "LS", "RS"]
+BUTTON_DEFAULTS = [0, 1, 2, 3, 4, 5, 6, 7, 9, 10]
+AXIS_FIELDS = ["LjoyX", "LjoyY", "LT", "RjoyX", "RjoyY", "RT", "dX", "dY"]
+AXIS_DEFAULTS = [0, 1, 2, 3, 4, 5, 6, 7]
+TRIGGERS = ("LT", "RT")
+
+
+def write_packet(sock: socket.socket, payload: bytes) -> None:
+    """Frame a payload as pkg/protocol does: length, payload, CRC-32."""
+    if len(payload) > MAX_PACKET_SIZE:
+        raise ValueError("packet too large")
+    crc = struct.pack(">I", zlib.crc32(payload) & 0xFFFFFFFF)
+    sock.sendall(struct.pack(">I", len(payload) + 4) + payload + crc)
+
+
+def read_packet(f) -> Optional[bytes]:
+    """Read one frame; None at end of stream, b"" for a frame to skip."""
+    hdr = f.read(4)
+    if len(hdr) < 4:
+        return None
+    length = struct.unpack(">I", hdr)[0]
+    if length < 4 or length > MAX_PACKET_SIZE + 4:
+        raise ValueError(f"bad frame length {length}")
+    body = f.read(length)
+    if len(body) < length:
+        return None
+    payload, crc = body[:-4], struct.unpack(">I", body[-4:])[0]
+    if zlib.crc32(payload) & 0xFFFFFFFF != crc:
+        return b""
+    return payload
+
+
+def axis16(value: float) -> int:
+    """A ROS axis (-1 to 1, +1 left/up/released) as the client's 0-65535,
+    where left, up and a released trigger read 0."""
+    value = max(-1.0, min(1.0, value))
+    return round((1.0 - value) / 2.0 * 0xFFFF)
+
+
+def neutral_state() -> Dict[str, int]:
+    """Sticks centered, triggers and buttons released, as the Go client
+    sends with the pad at rest."""
+    state = {field: 0 for field in BUTTON_FIELDS}
+    for field in AXIS_FIELDS:
+        if field in ("dX", "dY"):
+            state[field] = 0
+        elif field in TRIGGERS:
+            state[field + "16"] = 0
+            state[field] = 0
+        else:
+            state[field + "16"] = 0x8000
+            state[field] = 0x80
+    return state
+
+
+def joy_to_state(axes: List[float], buttons: List[int],
+                 axis_map: List[int], button_map: List[int]) -> Dict[str, int]:
+    """Translate a Joy message's arrays into a ControllerState payload.
+    Indices out of range (or -1) leave the field at rest."""
+    state = neutral_state()
+    for field, index in zip(BUTTON_FIELDS, button_map):
+        if 0 <= index < len(buttons):
+            state[field] = 1 if buttons[index] else 0
+    for field, index in zip(AXIS_FIELDS, axis_map):
+        if not 0 <= index < len(axes):
+            continue
+        if field in ("dX", "dY"):
+            # -1 is left/up on the wire, the opposite of ROS
+            state[field] = -round(max(-1.0, min(1.0, axes[index])))
+            continue
+        v = axis16(axes[index])
+        state[field + "16"] = v
+        state[field] = v >> 8
+    return state
+
+
+class ServerBridge(Node):
+    """One connection to the server, kept open while the node runs."""
+
+    def __init__(self) -> None:
+        super().__init__("lunabotics_bridge")
+        self.server = self.declare_parameter("server", "127.0.0.1:8080").value
+        self.token = self.declare_parameter("token", "").value
+        joy_topic = self.declare_parameter("joy_topic", "/joy").value
+        rate = self.declare_parameter("rate", 33.0).value
+        self.joy_timeout = self.declare_parameter("joy_timeout", 0.5).value
+        self.axis_map = list(self.declare_parameter("axes", AXIS_DEFAULTS).value)
+        self.button_map = list(self.declare_parameter("buttons", BUTTON_DEFAULTS).value)
+
+        self.battery_pub = self.create_publisher(BatteryState, "~/battery", 10)
+        self.motor_pub = self.create_publisher(Float64MultiArray, "~/motor_currents", 10)
+        self.limits_pub = self.create_publisher(UInt8, "~/limit_switches", 10)
+        self.estop_pub = self.create_publisher(Bool, "~/estop", 10)
+
+        self.lock = threading.Lock()
+        self.sock: Optional[socket.socket] = None
+        self.state: Dict[str, int] = neutral_state()
+        self.last_joy = 0.0
+        self.estop: Optional[bool] = None
+        self.role: Optional[str] = None
+
+        self.create_subscription(Joy, joy_topic, self.on_joy, 10)
+        # States are resent at a steady rate, as the Go client does, rather
+        # than only when Joy changes
+        self.create_timer(1.0 / rate, self.send_state)
+        threading.Thread(target=self.connect_loop, daemon=True).start()
+
+    def on_joy(self, msg: Joy) -> None:
+        state = joy_to_state(list(msg.axes), list(msg.buttons), self.axis_map, self.button_map)
+        with self.lock:
+            self.state = state
+            self.last_joy = time.monotonic()
+
+    def send_state(self) -> None:
+        with self.lock:
+            sock = self.sock
+            if time.monotonic() - self.last_joy > self.joy_timeout:
+                state = neutral_state()
+            else:
+                state = dict(self.state)
+        if sock is None:
+            return
+        state["ts"] = int(time.time() * 1000)
+        try:
+            write_packet(sock, json.dumps(state, separators=(",", ":")).encode())
+        except OSError as e:
+            self.get_logger().warning(f"write state error: {e}")
+            sock.close()
+
+    def connect_loop(self) -> None:
+        host, _, port = self.server.rpartition(":")
+        while rclpy.ok():
+            try:
+                sock = socket.create_connection((host.strip("[]"), int(port)), timeout=5)
+            except OSError as e:
+                self.get_logger().warning(f"connect {self.server}: {e}", throttle_duration_sec=10)
+                time.sleep(RECONNECT_DELAY)
+                continue
+            sock.settimeout(None)
+            sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_NODELAY, 1)
+            self.get_logger().info(f"Connected to {self.server}")
+            try:
+                if self.token:
+                    write_packet(sock, json.dumps({"type": "claim", "token": self.token}).encode())
+                with self.lock:
+                    self.sock = sock
+                self.read_loop(sock)
+            except (OSError, ValueError) as e:
+                self.get_logger().warning(f"connection lost: {e}")
+            with self.lock:
+                self.sock = None
+            sock.close()
+            self.get_logger().info("Disconnected, reconnecting")
+            time.sleep(RECONNECT_DELAY)
+
+    def read_loop(self, sock: socket.socket) -> None:
+        f = sock.makefile("rb")
+        while True:
+            payload = read_packet(f)
+            if payload is None:
+                return
+            if not payload.startswith(b"{"):
+                continue  # bad CRC, or protobuf we never asked for
+            msg = json.loads(payload)
+            kind = msg.get("type")
+            if kind == "telemetry":
+                self.publish_telemetry(msg)
+            elif kind == "status":
+                self.publish_estop(bool(msg.get("estop")), msg.get("role"))
+            elif kind == "shutdown":
+                self.get_logger().warning(f"server shutting down: {msg.get('reason')}")
+
+    def publish_telemetry(self, msg: Dict[str, Any]) -> None:
+        battery = BatteryState()
+        battery.header.stamp = self.get_clock().now().to_msg()
+        battery.header.frame_id = msg.get("device", "")
+        battery.voltage = float(msg.get("battery_v", 0.0))
+        battery.present = True
+        self.battery_pub.publish(battery)
+
+        motors = Float64MultiArray()
+        motors.data = [float(a) for a in msg.get("motor_a") or []]
+        self.motor_pub.publish(motors)
+
+        self.limits_pub.publish(UInt8(data=int(msg.get("limits", 0)) & 0xFF))
+
+    def publish_estop(self, estop: bool, role: Optional[str]) -> None:
+        # Status arrives several times a second; act only on changes
+        if estop != self.estop:
+            self.estop = estop
+            self.estop_pub.publish(Bool(data=estop))
+        if role != self.role:
+            self.role = role
+            if role != "driver":
+                self.get_logger().warning(f"bridge is {role}: its states are not driving")
+
+
+def main() -> None:
+    rclpy.init()
+    node = ServerBridge()
+    try:
+        rclpy.spin(node)
+    except KeyboardInterrupt:
+        pass
+    finally:
+        node.destroy_node()
+        rclpy.try_shutdown()
+
+
+if __name__ == "__main__":
+    main()
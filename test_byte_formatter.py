@@ -32,15 +32,9 @@ def format_state(state: Dict[str, int], config: Dict[str, Any]) -> bytes:
     output_size: int = config.get("output_size", 6)
     bytes_mapping: List[Dict[str, Any]] = config.get("bytes", [])
 
-    # Initialise output with zeros and optionally set default start/end bytes
+    # Initialise output with zeros.  Start/end markers are no longer implied
+    # by a 6-byte size; the config gives them as the "value" of a "bits" byte.
     output: List[int] = [0] * output_size
-    if output_size == 6:
-        # These constants (0b10101000 and 0b00010101) come from the Python
-        # RoverState.get_arduino_data() implementation.  They set reserved bits
-        # in the first and last packet bytes.  The Go version preserves them
-        # when applying bit masks.
-        output[0] = 0b10101000
-        output[-1] = 0b00010101
 
     for i, byte_map in enumerate(bytes_mapping):
         if i >= output_size:
@@ -53,9 +47,10 @@ def format_state(state: Dict[str, int], config: Dict[str, Any]) -> bytes:
             field_name = byte_map.get("field")
             output[i] = int(state.get(field_name, 0)) & 0xFF
         elif t == "bits":
-            # Build a bitmask from one or more fields.  Preserve the default
-            # bits in the first and last byte when using the 6‑byte format.
-            b = output[i] if (output_size == 6 and (i == 0 or i == output_size - 1)) else 0
+            # Build a bitmask from one or more fields on top of the fixed
+            # bits in "value" (e.g. 0b10101000 / 0b00010101 for the Python
+            # RoverState.get_arduino_data() start/end bytes).
+            b = int(byte_map.get("value", 0))
             for bit_mapping in byte_map.get("bits", []):
                 pos = int(bit_mapping.get("pos", 0))
                 field_name = bit_mapping.get("field")